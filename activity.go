@@ -0,0 +1,138 @@
+package ruledforward
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// recentQueries is how many queries the dashboard's query list keeps per server block.
+	recentQueries = 100
+	// maxBlockedDomains bounds the number of blocked names counted for the dashboard's top list.
+	maxBlockedDomains = 10000
+)
+
+// activity records the recent queries and the most blocked names of an instance for the admin dashboard. It is only
+// kept when `admin` is set.
+type activity struct {
+	mu      sync.Mutex
+	recent  [recentQueries]queryEntry // ring buffer
+	next    int
+	full    bool
+	blocked map[string]uint64 // qname -> count of queries answered by an empty group
+}
+
+// queryEntry is one query in the dashboard's query list.
+type queryEntry struct {
+	Time   time.Time `json:"time"`
+	Server string    `json:"server"`
+	Client string    `json:"client"`
+	Name   string    `json:"name"`
+	Type   string    `json:"type"`
+	Group  string    `json:"group,omitempty"` // empty if no group matched
+	Action string    `json:"action"`          // the group's action, "next" if the query went to the next plugin, or the rcode of on_no_match
+}
+
+// blockedName is a name in the dashboard's top blocked list.
+type blockedName struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+func newActivity() *activity {
+	return &activity{blocked: make(map[string]uint64)}
+}
+
+// record adds a query. Queries answered by an empty group are counted as blocked.
+func (a *activity) record(e queryEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.recent[a.next] = e
+	a.next = (a.next + 1) % recentQueries
+	a.full = a.full || a.next == 0
+	if e.Action == "empty" {
+		countName(a.blocked, e.Name, maxBlockedDomains)
+	}
+}
+
+// countName counts name in counts, which holds at most limit names.
+func countName(counts map[string]uint64, name string, limit int) {
+	if _, ok := counts[name]; !ok && len(counts) >= limit {
+		// Make room by forgetting the names counted only once, so a flood of random names cannot push out the top.
+		for n, c := range counts {
+			if c <= 1 {
+				delete(counts, n)
+			}
+		}
+		if len(counts) >= limit {
+			return
+		}
+	}
+	counts[name]++
+}
+
+// recordQuery records a query routed to g, or passed to the next plugin if g is nil, when the dashboard is enabled,
+// and logs it with `query_log`.
+func (r *Ruledforward) recordQuery(state request.Request, g *Group) {
+	if r.activity == nil && r.queryLog == nil {
+		return
+	}
+	e := queryEntry{Time: time.Now(), Server: r.server, Client: state.IP(), Name: state.Name(), Type: state.Type(), Action: "next"}
+	if g != nil {
+		e.Group, e.Action = g.Name, g.Action
+	} else if r.onNoMatch != dns.RcodeSuccess {
+		e.Action = strings.ToLower(dns.RcodeToString[r.onNoMatch])
+	}
+	if r.activity != nil {
+		r.activity.record(e)
+	}
+	if r.queryLog != nil {
+		r.queryLog.log(e)
+	}
+}
+
+// queries returns the recorded queries, newest first.
+func (a *activity) queries() []queryEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := a.next
+	if a.full {
+		n = recentQueries
+	}
+	out := make([]queryEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, a.recent[(a.next-i+recentQueries)%recentQueries])
+	}
+	return out
+}
+
+// topBlocked adds the blocked names and their counts to counts.
+func (a *activity) topBlocked(counts map[string]uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for name, n := range a.blocked {
+		counts[name] += n
+	}
+}
+
+// sortBlocked returns the n names with the highest counts, most blocked first.
+func sortBlocked(counts map[string]uint64, n int) []blockedName {
+	out := make([]blockedName, 0, len(counts))
+	for name, c := range counts {
+		out = append(out, blockedName{Name: name, Count: c})
+	}
+	slices.SortFunc(out, func(a, b blockedName) int {
+		if c := cmp.Compare(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return out[:min(n, len(out))]
+}
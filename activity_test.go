@@ -0,0 +1,42 @@
+package ruledforward
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestActivity(t *testing.T) {
+	a := newActivity()
+	for i := range recentQueries + 5 {
+		a.record(queryEntry{Name: strconv.Itoa(i) + ".example.", Action: "forward"})
+	}
+	q := a.queries()
+	if len(q) != recentQueries || q[0].Name != strconv.Itoa(recentQueries+4)+".example." {
+		t.Errorf("queries = %d, newest %q; want %d, newest last recorded", len(q), q[0].Name, recentQueries)
+	}
+
+	for range 3 {
+		a.record(queryEntry{Name: "ads.example.", Action: "empty"})
+	}
+	a.record(queryEntry{Name: "tracker.example.", Action: "empty"})
+	counts := make(map[string]uint64)
+	a.topBlocked(counts)
+	top := sortBlocked(counts, 1)
+	if len(counts) != 2 || len(top) != 1 || top[0] != (blockedName{Name: "ads.example.", Count: 3}) {
+		t.Errorf("blocked = %v, top = %v", counts, top)
+	}
+}
+
+func TestActivityBlockedLimit(t *testing.T) {
+	a := newActivity()
+	a.record(queryEntry{Name: "ads.example.", Action: "empty"})
+	a.record(queryEntry{Name: "ads.example.", Action: "empty"})
+	for i := range maxBlockedDomains {
+		a.record(queryEntry{Time: time.Now(), Name: strconv.Itoa(i) + ".example.", Action: "empty"})
+	}
+	if len(a.blocked) > maxBlockedDomains || a.blocked["ads.example."] != 2 {
+		t.Errorf("blocked has %d names, ads.example. = %d; want at most %d, keeping the repeated name",
+			len(a.blocked), a.blocked["ads.example."], maxBlockedDomains)
+	}
+}
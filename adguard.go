@@ -2,22 +2,39 @@ package ruledforward
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/miekg/dns"
+
+	"github.com/hr3lxphr6j/coredns-ruledforward/internal/zstd"
 )
 
 // ParseAdguardRules parses AdGuard-style filter content and returns rules.
-// Supports: domains-only, ||domain^ (suffix), /regex/, # and ! comments, @@ exceptions (skipped).
+// Supports: domains-only, ||domain^ (suffix), |domain^ and |http://domain anchors (exact), wildcards in anchored
+// domains (as regexes), /regex/, # and ! comments, @@ exceptions (skipped), hosts lines and the DOMAIN,
+// DOMAIN-SUFFIX and DOMAIN-KEYWORD lines of Surge-style rulesets (other lines with a comma are skipped). See
+// parseABPRule for modifiers.
 func ParseAdguardRules(body string) ([]Rule, error) {
-	var rules []Rule
+	rules, _, _, err := parseAdguardRules(body)
+	return rules, err
+}
+
+// parseAdguardRules is ParseAdguardRules that also returns the number of Adblock Plus lines skipped because they
+// have no DNS equivalent, such as those with a URL path, and the first of them. They are counted in
+// rules_skipped_total.
+func parseAdguardRules(body string) (rules []Rule, skipped int, example string, err error) {
 	scanner := bufio.NewScanner(strings.NewReader(body))
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
@@ -30,22 +47,28 @@ func ParseAdguardRules(body string) ([]Rule, error) {
 		if strings.HasPrefix(line, "@@") {
 			continue
 		}
-		// ||domain^ -> domain suffix
-		if after, ok := strings.CutPrefix(line, "||"); ok {
-			rest := after
-			rest = strings.TrimSuffix(rest, "^")
-			rest = strings.TrimSpace(rest)
-			if rest != "" {
-				rules = append(rules, Rule{Type: RuleDomain, Value: strings.ToLower(dns.Fqdn(rest))})
-			}
-			continue
-		}
 		// /regex/
 		if len(line) >= 2 && line[0] == '/' && line[len(line)-1] == '/' {
 			re := line[1 : len(line)-1]
 			rules = append(rules, Rule{Type: RuleRegex, Value: re})
 			continue
 		}
+		// ||domain^, |domain^, |http://domain/ and the like, with or without $modifiers
+		if strings.HasPrefix(line, "|") || strings.ContainsAny(line, "^$*") {
+			if r, ok := parseABPRule(line); ok {
+				rules = append(rules, r)
+			} else if skipped++; skipped == 1 {
+				example = line
+			}
+			continue
+		}
+		// Surge/Clash/Quantumult X: TYPE,VALUE[,POLICY]. No domain has a comma.
+		if strings.Contains(line, ",") {
+			if r, ok := parseSurgeRule(line); ok {
+				rules = append(rules, r)
+			}
+			continue
+		}
 		// hosts: IP domain -> use domain part
 		parts := strings.Fields(line)
 		if len(parts) >= 2 {
@@ -63,10 +86,94 @@ func ParseAdguardRules(body string) ([]Rule, error) {
 			}
 		}
 	}
+	if skipped > 0 {
+		rulesSkippedTotal.Add(float64(skipped))
+	}
 	if err := scanner.Err(); err != nil {
-		return nil, err
+		return nil, 0, "", err
 	}
-	return rules, nil
+	return rules, skipped, example, nil
+}
+
+// parseAdguardList parses the rule list from source, a file or URL, logging the lines it skips.
+func parseAdguardList(source string, data []byte) ([]Rule, error) {
+	rules, skipped, example, err := parseAdguardRules(string(data))
+	if skipped > 0 {
+		log.Infof("%s: skipped %d rules that do not apply to DNS names, e.g. %s", source, skipped, example)
+	}
+	return rules, err
+}
+
+// parseABPRule parses an Adblock Plus style line: `||domain^` matches domain and its subdomains, `|domain^` and
+// `|http://domain/` domain alone, and an unanchored `domain^` is taken as `||domain^`. `^|` and `|` at the end are
+// separators. Wildcards make a regex rule. Of the modifiers, `$important` is ignored, and `$denyallow` is only
+// accepted if none of its domains is within the rule's, as exceptions cannot be expressed. Lines that do not
+// translate to a rule, such as those with a URL path, `$badfilter` or modifiers that make the rule apply to some
+// clients or types only, have no rule and ok false rather than a wrong one.
+func parseABPRule(line string) (r Rule, ok bool) {
+	pattern, mods, _ := strings.Cut(line, "$")
+	var denyallow []string
+	if mods != "" {
+		for _, mod := range strings.Split(mods, ",") {
+			name, val, _ := strings.Cut(strings.TrimSpace(mod), "=")
+			switch name {
+			case "important":
+			case "denyallow":
+				denyallow = strings.Split(strings.ToLower(val), "|")
+			default:
+				return r, false
+			}
+		}
+	}
+
+	typ := RuleDomain
+	switch {
+	case strings.HasPrefix(pattern, "||"):
+		pattern = pattern[2:]
+	case strings.HasPrefix(pattern, "|"):
+		pattern, typ = pattern[1:], RuleFull
+		if _, rest, found := strings.Cut(pattern, "://"); found {
+			pattern = rest
+		}
+	}
+	// The host ends at a separator, a path or a port.
+	if i := strings.IndexAny(pattern, "^/:|"); i >= 0 {
+		rest := pattern[i:]
+		if port, ok := strings.CutPrefix(rest, ":"); ok {
+			rest = strings.TrimLeft(port, "0123456789")
+		}
+		if strings.TrimLeft(rest, "^/|") != "" {
+			return r, false
+		}
+		pattern = pattern[:i]
+	}
+	pattern = strings.ToLower(strings.TrimPrefix(pattern, "."))
+	if pattern == "" || pattern == "*" {
+		return r, false
+	}
+
+	if strings.Contains(pattern, "*") {
+		if len(denyallow) > 0 {
+			return r, false
+		}
+		re := strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*")
+		if typ == RuleDomain {
+			re = `(^|\.)` + re
+		} else {
+			re = "^" + re
+		}
+		return Rule{Type: RuleRegex, Value: re + `\.$`}, true
+	}
+	if _, ok := dns.IsDomainName(pattern); !ok {
+		return r, false
+	}
+	for _, d := range denyallow {
+		d = strings.TrimPrefix(d, ".")
+		if d == "" || d == pattern || strings.HasSuffix(d, "."+pattern) {
+			return r, false
+		}
+	}
+	return Rule{Type: typ, Value: dns.Fqdn(pattern)}, true
 }
 
 func isIP(s string) bool {
@@ -84,45 +191,133 @@ func LoadAdguardFromFile(path string) ([]Rule, error) {
 	if err != nil {
 		return nil, err
 	}
-	return ParseAdguardRules(string(data))
+	if data, err = decompress(data, path); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return parseAdguardList(path, data)
 }
 
-// transportWithBootstrapDNS returns an http.Transport that resolves hostnames via
-// the given bootstrap DNS server to avoid circular dependency when this plugin is the system DNS.
-func transportWithBootstrapDNS(bootstrapDNS string) *http.Transport {
+// maxRuleListSize bounds a rule list in bytes, as downloaded and after decompression, so that a hostile or broken
+// list host cannot exhaust memory, e.g. with a small gzip bomb. The largest public blocklists are a few tens of MB.
+const maxRuleListSize = 256 << 20
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// decompress returns data, read from the local file path, decompressed. A .gz or .zst extension of path selects
+// gzip or zstd; otherwise, and for data downloaded (path ""), compression is recognized by content, as list hosts do
+// not name files consistently.
+func decompress(data []byte, path string) ([]byte, error) {
+	var format string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gz":
+		format = "gzip"
+	case ".zst", ".zstd":
+		format = "zstd"
+	default:
+		switch {
+		case bytes.HasPrefix(data, gzipMagic):
+			format = "gzip"
+		case bytes.HasPrefix(data, zstdMagic):
+			format = "zstd"
+		}
+	}
+	return decode(data, format, maxRuleListSize)
+}
+
+// decode returns data decompressed with format, a Content-Encoding: gzip, zstd, or identity or "" for none. It
+// fails if the result would exceed limit bytes.
+func decode(data []byte, format string, limit int) ([]byte, error) {
+	var r io.Reader
+	switch strings.ToLower(format) {
+	case "", "identity":
+		return data, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	case "zstd":
+		r = zstd.NewReader(bytes.NewReader(data))
+	default:
+		return nil, fmt.Errorf("unsupported compression '%s'", format)
+	}
+	out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", format, err)
+	}
+	if len(out) > limit {
+		return nil, fmt.Errorf("decompressed list exceeds %d bytes", limit)
+	}
+	return out, nil
+}
+
+// bootstrapResolver returns a resolver that sends all lookups to bootstrapDNS (host or host:port)
+// to avoid circular dependency when this plugin is the system DNS.
+func bootstrapResolver(bootstrapDNS string) *net.Resolver {
 	bootstrapAddr := bootstrapDNS
 	if bootstrapAddr != "" && !strings.Contains(bootstrapAddr, ":") {
 		bootstrapAddr = net.JoinHostPort(bootstrapAddr, "53")
 	}
-	resolver := &net.Resolver{
+	return &net.Resolver{
 		PreferGo: true,
 		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
 			d := net.Dialer{Timeout: 10 * time.Second}
 			return d.DialContext(ctx, "udp", bootstrapAddr)
 		},
 	}
+}
+
+// transportWithBootstrapDNS returns an http.Transport that resolves hostnames via
+// the given bootstrap DNS server to avoid circular dependency when this plugin is the system DNS.
+func transportWithBootstrapDNS(bootstrapDNS string) *http.Transport {
 	dialer := &net.Dialer{
-		Resolver:  resolver,
+		Resolver:  bootstrapResolver(bootstrapDNS),
 		Timeout:   30 * time.Second,
 		KeepAlive: 30 * time.Second,
 	}
 	return &http.Transport{
+		Proxy:       http.ProxyFromEnvironment,
 		DialContext: dialer.DialContext,
 	}
 }
 
 // LoadAdguardFromURL fetches URL and parses body as AdGuard rules.
 // If bootstrapDNS is non-empty, the URL host is resolved via that DNS server to avoid
-// circular dependency when this plugin is the system DNS.
+// circular dependency when this plugin is the system DNS. HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY are honored.
 func LoadAdguardFromURL(rawURL string, timeout time.Duration, bootstrapDNS string) ([]Rule, error) {
+	data, err := fetchURL(rawURL, timeout, bootstrapDNS, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseAdguardData(rawURL, data)
+}
+
+// fetchURL downloads rawURL as LoadAdguardFromURL does and returns the body as received,
+// fetching through downloadProxy instead of the environment's proxy settings if it is non-nil.
+func fetchURL(rawURL string, timeout time.Duration, bootstrapDNS string, downloadProxy *url.URL) ([]byte, error) {
 	var transport *http.Transport
 	if bootstrapDNS != "" {
 		transport = transportWithBootstrapDNS(bootstrapDNS)
 	} else {
-		transport = &http.Transport{}
+		transport = &http.Transport{Proxy: http.ProxyFromEnvironment}
+	}
+	if downloadProxy != nil {
+		transport.Proxy = http.ProxyURL(downloadProxy)
 	}
 	client := &http.Client{Timeout: timeout, Transport: transport}
-	resp, err := client.Get(rawURL)
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Asking explicitly turns off the transport's transparent gzip, so both encodings are decoded below.
+	req.Header.Set("Accept-Encoding", "zstd, gzip")
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -130,11 +325,26 @@ func LoadAdguardFromURL(rawURL string, timeout time.Duration, bootstrapDNS strin
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("adguard_rules URL %s: status %d", rawURL, resp.StatusCode)
 	}
-	data, err := io.ReadAll(resp.Body)
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRuleListSize+1))
 	if err != nil {
 		return nil, err
 	}
-	return ParseAdguardRules(string(data))
+	if len(data) > maxRuleListSize {
+		return nil, fmt.Errorf("adguard_rules URL %s: body exceeds %d MiB", rawURL, maxRuleListSize>>20)
+	}
+	if data, err = decode(data, resp.Header.Get("Content-Encoding"), maxRuleListSize); err != nil {
+		return nil, fmt.Errorf("adguard_rules URL %s: %w", rawURL, err)
+	}
+	return data, nil
+}
+
+// parseAdguardData decompresses data downloaded from rawURL if needed and parses it as AdGuard rules.
+func parseAdguardData(rawURL string, data []byte) ([]Rule, error) {
+	data, err := decompress(data, "")
+	if err != nil {
+		return nil, fmt.Errorf("adguard_rules URL %s: %w", rawURL, err)
+	}
+	return parseAdguardList(rawURL, data)
 }
 
 // IsURL returns true if s looks like http(s) URL.
@@ -1,12 +1,18 @@
 package ruledforward
 
 import (
+	"bytes"
+	"compress/gzip"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func TestParseAdguardRules(t *testing.T) {
@@ -113,3 +119,238 @@ func TestLoadAdguardFromURL(t *testing.T) {
 		t.Error("expected error for 404")
 	}
 }
+
+func TestLoadAdguardFromURLDownloadProxy(t *testing.T) {
+	var requested string
+	proxySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.String()
+		_, _ = w.Write([]byte("||proxied.example^\n"))
+	}))
+	defer proxySrv.Close()
+	proxyURL, _ := url.Parse(proxySrv.URL)
+
+	g := &Group{Name: "ads", DownloadProxy: proxyURL}
+	rules, err := g.loadAdguardURL("http://lists.invalid/ads.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requested != "http://lists.invalid/ads.txt" {
+		t.Errorf("proxy saw %q, want the list URL", requested)
+	}
+	if len(rules) != 1 || rules[0].Value != "proxied.example." {
+		t.Errorf("rules = %+v", rules)
+	}
+}
+
+func TestLoadAdguardCompressed(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write([]byte("||gz.example^\nplain.example\n"))
+	_ = zw.Close()
+
+	fpath := filepath.Join(t.TempDir(), "rules.txt.gz")
+	if err := os.WriteFile(fpath, gz.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := LoadAdguardFromFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("file: expected 2 rules, got %d", len(rules))
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/gzip")
+		_, _ = w.Write(gz.Bytes())
+	}))
+	defer srv.Close()
+	rules, err = LoadAdguardFromURL(srv.URL+"/rules.txt.gz", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("URL: expected 2 rules, got %d", len(rules))
+	}
+
+	zst := filepath.Join(t.TempDir(), "rules.txt.zst")
+	if err := os.WriteFile(zst, []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadAdguardFromFile(zst); err == nil || !strings.Contains(err.Error(), "zstd") {
+		t.Errorf("truncated zstd: err = %v, want a zstd error", err)
+	}
+}
+
+// zstdRaw returns data, at most 255 bytes, as a zstd frame of one raw (stored) block.
+func zstdRaw(data string) []byte {
+	// Single segment with a 1-byte content size, then a last raw block.
+	frame := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x20, byte(len(data))}
+	hdr := 1 | len(data)<<3
+	frame = append(frame, byte(hdr), byte(hdr>>8), byte(hdr>>16))
+	return append(frame, data...)
+}
+
+func TestLoadAdguardZstd(t *testing.T) {
+	const list = "||zstd.example^\nplain.example\n"
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{
+		"rules.zst":      zstdRaw(list), // by extension
+		"rules.txt":      zstdRaw(list), // by content
+		"rules.list.ZST": zstdRaw(list),
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		rules, err := LoadAdguardFromFile(path)
+		if err != nil || len(rules) != 2 {
+			t.Errorf("%s: rules = %v, err = %v, want 2 rules", name, rules, err)
+		}
+	}
+	// The extension is honored: a plain file named .gz is an error rather than read as text.
+	path := filepath.Join(dir, "plain.gz")
+	if err := os.WriteFile(path, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadAdguardFromFile(path); err == nil {
+		t.Error("plain.gz: expected a gzip error")
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write([]byte(list))
+	_ = zw.Close()
+	var acceptEncoding string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+		switch r.URL.Path {
+		case "/zstd":
+			w.Header().Set("Content-Encoding", "zstd")
+			_, _ = w.Write(zstdRaw(list))
+		case "/gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			_, _ = w.Write(gz.Bytes())
+		case "/br":
+			w.Header().Set("Content-Encoding", "br")
+			_, _ = w.Write([]byte(list))
+		}
+	}))
+	defer srv.Close()
+	for _, path := range []string{"/zstd", "/gzip"} {
+		rules, err := LoadAdguardFromURL(srv.URL+path, 0, "")
+		if err != nil || len(rules) != 2 {
+			t.Errorf("%s: rules = %v, err = %v, want 2 rules", path, rules, err)
+		}
+	}
+	if !strings.Contains(acceptEncoding, "zstd") {
+		t.Errorf("Accept-Encoding = %q, want zstd offered", acceptEncoding)
+	}
+	if _, err := LoadAdguardFromURL(srv.URL+"/br", 0, ""); err == nil {
+		t.Error("br: expected an unsupported encoding error")
+	}
+}
+
+func TestDecodeLimit(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write(make([]byte, 1<<20))
+	_ = zw.Close()
+	if _, err := decode(gz.Bytes(), "gzip", 1<<20); err != nil {
+		t.Errorf("at the limit: %v", err)
+	}
+	if _, err := decode(gz.Bytes(), "gzip", 1<<20-1); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("over the limit: err = %v, want a size error", err)
+	}
+}
+
+func TestParseSurgeRules(t *testing.T) {
+	body := `
+# Surge
+DOMAIN,www.example.com
+DOMAIN-SUFFIX,.ads.example,REJECT
+DOMAIN-KEYWORD,Tracker
+IP-CIDR,192.0.2.0/24,DIRECT,no-resolve
+PROCESS-NAME,telnet
+# Quantumult X
+host-suffix, qx.example, reject
+`
+	rules, err := ParseAdguardRules(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Rule{
+		{Type: RuleFull, Value: "www.example.com."},
+		{Type: RuleDomain, Value: "ads.example."},
+		{Type: RuleKeyword, Value: "tracker"},
+		{Type: RuleDomain, Value: "qx.example."},
+	}
+	if !slices.Equal(rules, want) {
+		t.Errorf("rules = %v, want %v", rules, want)
+	}
+}
+
+func TestParseABPRules(t *testing.T) {
+	tests := []struct {
+		line string
+		want []Rule
+	}{
+		{"||example.com^", []Rule{{Type: RuleDomain, Value: "example.com."}}},
+		{"||example.com^|", []Rule{{Type: RuleDomain, Value: "example.com."}}},
+		{"||Example.com^$important", []Rule{{Type: RuleDomain, Value: "example.com."}}},
+		{"|example.com^", []Rule{{Type: RuleFull, Value: "example.com."}}},
+		{"|http://ads.example.com/", []Rule{{Type: RuleFull, Value: "ads.example.com."}}},
+		{"|https://ads.example.com:8443^", []Rule{{Type: RuleFull, Value: "ads.example.com."}}},
+		{"example.com^", []Rule{{Type: RuleDomain, Value: "example.com."}}},
+		{"||*.example.com^", []Rule{{Type: RuleRegex, Value: `(^|\.).*\.example\.com\.$`}}},
+		{"|ad*.example.com^", []Rule{{Type: RuleRegex, Value: `^ad.*\.example\.com\.$`}}},
+		{"||example.com^$denyallow=example.org|example.net", []Rule{{Type: RuleDomain, Value: "example.com."}}},
+		{"||example.com^$denyallow=ok.example.com", nil},
+		{"*$denyallow=com|net", nil},
+		{"||example.com/ads.js", nil},
+		{"|http://example.com/ads/", nil},
+		{"||example.com^$third-party", nil},
+		{"||example.com^$client=192.168.1.2", nil},
+		{"||example.com^$dnstype=AAAA", nil},
+		{"||example.com^$badfilter", nil},
+	}
+	for _, tc := range tests {
+		rules, err := ParseAdguardRules(tc.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(rules, tc.want) {
+			t.Errorf("ParseAdguardRules(%q) = %v, want %v", tc.line, rules, tc.want)
+		}
+	}
+
+	skippedTotal := func() float64 {
+		return gather(t, prometheus.DefaultGatherer, func(map[string]string) (string, bool) { return "", true })["coredns_ruledforward_rules_skipped_total"]
+	}
+	before := skippedTotal()
+	_, skipped, example, _ := parseAdguardRules("||example.com^\n|http://example.com/ads/\n||example.org/ads.js\n")
+	if skipped != 2 || example != "|http://example.com/ads/" {
+		t.Errorf("skipped %d lines, first %q; want 2, the path rule", skipped, example)
+	}
+	if n := skippedTotal() - before; n != 2 {
+		t.Errorf("rules_skipped_total grew by %v, want 2", n)
+	}
+
+	rules, _ := ParseAdguardRules("||*.example.com^\n|ad*.example.com^")
+	m := NewMatcher()
+	for _, r := range rules {
+		m.AddRule(r)
+	}
+	m.Build()
+	for name, want := range map[string]bool{
+		"x.example.com.":     true,
+		"example.com.":       false,
+		"ads.example.com.":   true,
+		"notexample.com.":    false,
+		"x.example.com.org.": false,
+	} {
+		if m.Match(name) != want {
+			t.Errorf("Match(%s) = %v, want %v", name, !want, want)
+		}
+	}
+}
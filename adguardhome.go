@@ -0,0 +1,163 @@
+package ruledforward
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// adguardHomeInterval is how often the filtering status of an adguard_home instance is polled by default.
+const adguardHomeInterval = 5 * time.Minute
+
+// adguardHomeSource is an `adguard_home` setting: an AdGuard Home instance whose enabled filter lists and custom
+// filtering rules the group mirrors. Its filtering status is polled, and the lists are downloaded again when it
+// changes, such as when AdGuard Home updated a list or a list was enabled.
+type adguardHomeSource struct {
+	base     string // URL of the instance, without credentials
+	username string
+	password string
+	interval time.Duration
+}
+
+// parseAdguardHomeSource parses `adguard_home http[s]://[USER:PASSWORD@]HOST[:PORT][/PATH] [INTERVAL]`.
+func parseAdguardHomeSource(args []string) (*adguardHomeSource, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, errors.New("adguard_home takes a URL and an optional interval")
+	}
+	u, err := url.Parse(args[0])
+	if err != nil {
+		return nil, errors.New("adguard_home needs an http:// or https:// URL")
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("adguard_home needs an http:// or https:// URL: %s", u.Redacted())
+	}
+	s := &adguardHomeSource{interval: adguardHomeInterval}
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+		u.User = nil
+	}
+	s.base = strings.TrimSuffix(u.String(), "/")
+	if len(args) == 2 {
+		d, err := time.ParseDuration(args[1])
+		if err != nil || d < 10*time.Second {
+			return nil, fmt.Errorf("adguard_home interval must be a duration of at least 10s: %s", args[1])
+		}
+		s.interval = d
+	}
+	return s, nil
+}
+
+func (s *adguardHomeSource) String() string {
+	return "adguard_home " + s.base
+}
+
+// adguardHomeStatus is the part of the answer of AdGuard Home's /control/filtering/status that the group uses.
+// Allowlists are left out, as `@@` exceptions are in adguard_rules.
+type adguardHomeStatus struct {
+	Enabled   bool                `json:"enabled"`
+	Filters   []adguardHomeFilter `json:"filters"`
+	UserRules []string            `json:"user_rules"`
+}
+
+type adguardHomeFilter struct {
+	URL         string `json:"url"`
+	Name        string `json:"name"`
+	Enabled     bool   `json:"enabled"`
+	LastUpdated string `json:"last_updated"`
+}
+
+// status fetches the instance's filtering status.
+func (s *adguardHomeSource) status(ctx context.Context) (*adguardHomeStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, adguardTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.base+"/control/filtering/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("filtering status: %s", resp.Status)
+	}
+	var st adguardHomeStatus
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return nil, fmt.Errorf("filtering status: %w", err)
+	}
+	return &st, nil
+}
+
+// load returns the rules of the instance's enabled filter lists, downloaded with fetch, and its custom rules; none
+// while its filtering is disabled. Lists AdGuard Home reads from its own disk cannot be downloaded and are skipped.
+func (s *adguardHomeSource) load(ctx context.Context, fetch func(string) ([]byte, error)) ([]Rule, error) {
+	st, err := s.status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !st.Enabled {
+		return nil, nil
+	}
+	var rules []Rule
+	for _, f := range st.Filters {
+		if !f.Enabled {
+			continue
+		}
+		if !IsURL(f.URL) {
+			log.Warningf("%s: skipping filter list '%s', a file on the AdGuard Home host", s, f.Name)
+			continue
+		}
+		data, err := fetch(f.URL)
+		if err != nil {
+			return nil, fmt.Errorf("filter list '%s': %w", f.Name, err)
+		}
+		listRules, err := parseAdguardData(f.URL, data)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, listRules...)
+	}
+	userRules, err := ParseAdguardRules(strings.Join(st.UserRules, "\n"))
+	if err != nil {
+		return nil, fmt.Errorf("custom filtering rules: %w", err)
+	}
+	return append(rules, userRules...), nil
+}
+
+// follow requests a reload, then one each time the filtering status changes, polling it every interval until
+// polling fails or ctx is done. It reports whether the first poll succeeded.
+func (s *adguardHomeSource) follow(ctx context.Context, notify func()) (bool, error) {
+	st, err := s.status(ctx)
+	if err != nil {
+		return false, err
+	}
+	last, _ := json.Marshal(st)
+	notify()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return true, ctx.Err()
+		case <-ticker.C:
+		}
+		st, err := s.status(ctx)
+		if err != nil {
+			return true, err
+		}
+		if cur, _ := json.Marshal(st); string(cur) != string(last) {
+			last = cur
+			notify()
+		}
+	}
+}
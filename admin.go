@@ -0,0 +1,539 @@
+package ruledforward
+
+import (
+	"bufio"
+	"cmp"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxAdminBody limits request bodies of the admin API.
+	maxAdminBody = 1 << 20
+	// topBlockedNames is how many names the dashboard's top blocked list shows.
+	topBlockedNames = 20
+)
+
+//go:embed web/dashboard.html
+var dashboardHTML []byte
+
+// admins holds the running admin HTTP servers by listen address. Server blocks configured with the same address
+// share one server, which serves every instance, and a Corefile reload hands the address over from the old instances
+// to the new ones.
+var admins = struct {
+	sync.Mutex
+	m map[string]*adminServer
+}{m: make(map[string]*adminServer)}
+
+type adminServer struct {
+	srv   *http.Server
+	token string
+	refs  int
+}
+
+// startAdmin starts serving the admin API on r's admin address, unless another instance already does.
+func (r *Ruledforward) startAdmin() error {
+	if r.admin == "" || r.adminUp {
+		return nil
+	}
+	admins.Lock()
+	defer admins.Unlock()
+	if s := admins.m[r.admin]; s != nil {
+		if s.token != r.adminToken {
+			return fmt.Errorf("admin %s: server blocks sharing the address must have the same admin_token", r.admin)
+		}
+		s.refs++
+		r.adminUp = true
+		return nil
+	}
+	ln, err := net.Listen("tcp", r.admin)
+	if err != nil {
+		return fmt.Errorf("admin: %w", err)
+	}
+	srv := &http.Server{Handler: adminGuard(adminHandler(), r.admin, r.adminToken), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("admin %s: %v", ln.Addr(), err)
+		}
+	}()
+	admins.m[r.admin] = &adminServer{srv: srv, token: r.adminToken, refs: 1}
+	r.adminUp = true
+	return nil
+}
+
+// stopAdmin releases r's admin address; the server stops when no instance uses it.
+func (r *Ruledforward) stopAdmin() error {
+	if !r.adminUp {
+		return nil
+	}
+	r.adminUp = false
+	admins.Lock()
+	defer admins.Unlock()
+	s := admins.m[r.admin]
+	if s == nil {
+		return nil
+	}
+	if s.refs--; s.refs == 0 {
+		delete(admins.m, r.admin)
+		return s.srv.Close()
+	}
+	return nil
+}
+
+// adminHandler returns the dashboard at / and the admin API:
+//
+//	GET    /api/groups                       groups and rulesets of all server blocks
+//	POST   /api/groups                       add a group, a `group NAME { ... }` block in the body (?before=GROUP)
+//	DELETE /api/groups/{group}               remove a group
+//	GET    /api/activity                     recent queries and the most blocked names
+//	GET    /api/conflicts                    rules shared by groups with different actions
+//	GET    /api/unmatched                    names no group matched, most queried first (?limit=N)
+//	DELETE /api/unmatched                    forget the names no group matched
+//	GET    /api/groups/{group}/rules         effective rules, in the ?format= of WriteRules (default: text)
+//	GET    /api/groups/{group}/runtime_rules rules added at runtime
+//	POST   /api/groups/{group}/runtime_rules add rules, one per line in the body
+//	DELETE /api/groups/{group}/runtime_rules remove rules, one per line in the body
+//
+// {group} may be qualified with ?server=KEY (e.g. `.:53`) when several server blocks have a group of that name, and
+// POST /api/groups needs it when there are several server blocks.
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", handleDashboard)
+	mux.HandleFunc("GET /api/groups", handleGroups)
+	mux.HandleFunc("POST /api/groups", handleAddGroup)
+	mux.HandleFunc("DELETE /api/groups/{group}", handleRemoveGroup)
+	mux.HandleFunc("GET /api/activity", handleActivity)
+	mux.HandleFunc("GET /api/conflicts", handleConflicts)
+	mux.HandleFunc("GET /api/unmatched", handleUnmatched)
+	mux.HandleFunc("DELETE /api/unmatched", handleUnmatched)
+	mux.HandleFunc("GET /api/groups/{group}/rules", handleRules)
+	mux.HandleFunc("GET /api/groups/{group}/runtime_rules", handleRuntimeRules)
+	mux.HandleFunc("POST /api/groups/{group}/runtime_rules", handleRuntimeRules)
+	mux.HandleFunc("DELETE /api/groups/{group}/runtime_rules", handleRuntimeRules)
+	return mux
+}
+
+// adminGuard keeps web pages from using the admin API through the operator's browser. A page of another origin can
+// send it simple requests (CSRF), or reach it under the page's own host name once that resolves to the admin address
+// (DNS rebinding). Requests are therefore refused unless their Host is an IP address, localhost or the host of addr,
+// and their Origin, if any, is that of the API itself. Changes also need the bearer token of `admin_token` or, without
+// one, a Content-Type that browsers do not send cross-origin without a CORS preflight, which the API never allows.
+func adminGuard(next http.Handler, addr, token string) http.Handler {
+	adminHost, _, _ := net.SplitHostPort(addr)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !adminHostAllowed(req.Host, adminHost) {
+			writeJSONError(w, http.StatusForbidden, fmt.Errorf("host %s is not allowed", req.Host))
+			return
+		}
+		if origin := req.Header.Get("Origin"); origin != "" {
+			if u, err := url.Parse(origin); err != nil || u.Host != req.Host {
+				writeJSONError(w, http.StatusForbidden, fmt.Errorf("origin %s is not allowed", origin))
+				return
+			}
+		}
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			if token != "" {
+				if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+					w.Header().Set("WWW-Authenticate", "Bearer")
+					writeJSONError(w, http.StatusUnauthorized, errors.New("missing or wrong bearer token"))
+					return
+				}
+			} else if ct := req.Header.Get("Content-Type"); corsSafelisted(ct) {
+				writeJSONError(w, http.StatusUnsupportedMediaType,
+					fmt.Errorf("content type '%s' is not accepted for changes, send e.g. application/octet-stream", ct))
+				return
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// adminHostAllowed reports whether hostport, the Host of a request, names the admin server rather than a name that
+// an attacker resolves to it.
+func adminHostAllowed(hostport, adminHost string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if _, err := netip.ParseAddr(host); err == nil {
+		return true
+	}
+	return strings.EqualFold(host, "localhost") || (adminHost != "" && strings.EqualFold(host, adminHost))
+}
+
+// adminLoopback reports whether the admin address addr, HOST:PORT, only listens on loopback. An empty host listens
+// on every interface, and names other than localhost may resolve to anything.
+func adminLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return ip.IsLoopback()
+	}
+	return strings.EqualFold(host, "localhost")
+}
+
+// corsSafelisted reports whether a request with Content-Type ct, or without one if ct is empty, may be sent
+// cross-origin without a preflight.
+func corsSafelisted(ct string) bool {
+	if ct == "" {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return true
+	}
+	return mt == "application/x-www-form-urlencoded" || mt == "multipart/form-data" || mt == "text/plain"
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// groupInfo describes a group in the admin API.
+type groupInfo struct {
+	Server       string         `json:"server"`
+	Name         string         `json:"name"`
+	Action       string         `json:"action,omitempty"`
+	Ruleset      bool           `json:"ruleset,omitempty"`
+	Rules        int64          `json:"rules"`
+	PrunedRules  int64          `json:"pruned_rules"`
+	RuntimeRules int            `json:"runtime_rules"`
+	Ready        bool           `json:"ready"`
+	Sources      []string       `json:"sources"`
+	Upstreams    []upstreamInfo `json:"upstreams,omitempty"`
+}
+
+// upstreamInfo describes the health of an upstream of a forward group.
+type upstreamInfo struct {
+	Addr    string `json:"addr"`
+	Fails   uint32 `json:"fails"`
+	Healthy bool   `json:"healthy"`
+}
+
+// sources describes the rule sources of g, e.g. `geosite:google` or `configmap dns/dns-rules`.
+func (g *Group) sources() []string {
+	out := []string{}
+	for _, name := range g.GeositeNames {
+		out = append(out, "geosite:"+name)
+	}
+	if len(g.InlineRules) > 0 {
+		out = append(out, fmt.Sprintf("inline:%d", len(g.InlineRules)))
+	}
+	for _, p := range g.AdguardPaths {
+		out = append(out, "adguard_rules:"+p)
+	}
+	for _, u := range g.AdguardURLs {
+		out = append(out, "adguard_rules:"+u)
+	}
+	for _, src := range g.Redis {
+		out = append(out, src.String())
+	}
+	for _, src := range g.Kube {
+		out = append(out, src.String())
+	}
+	for _, src := range g.AdguardHome {
+		out = append(out, src.String())
+	}
+	for _, src := range g.TXT {
+		out = append(out, src.String())
+	}
+	for _, f := range g.Feeds {
+		out = append(out, f.String())
+	}
+	for _, rs := range g.Rulesets {
+		out = append(out, "use:"+rs.Name)
+	}
+	return out
+}
+
+// sortedInstances returns the running instances ordered by server block key.
+func sortedInstances() []*Ruledforward {
+	all := Instances()
+	out := make([]*Ruledforward, 0, len(all))
+	for _, r := range all {
+		out = append(out, r)
+	}
+	slices.SortFunc(out, func(a, b *Ruledforward) int { return strings.Compare(a.server, b.server) })
+	return out
+}
+
+func handleGroups(w http.ResponseWriter, req *http.Request) {
+	out := []groupInfo{}
+	for _, r := range sortedInstances() {
+		for _, g := range r.allGroups() {
+			info := groupInfo{
+				Server:       r.server,
+				Name:         g.Name,
+				Rules:        g.ruleCount.Load(),
+				PrunedRules:  g.prunedCount.Load(),
+				RuntimeRules: len(g.RuntimeRules()),
+				Ready:        g.initialized.Load(),
+				Sources:      g.sources(),
+			}
+			for _, p := range g.Proxies() {
+				info.Upstreams = append(info.Upstreams, upstreamInfo{Addr: p.Addr(), Fails: p.Fails(), Healthy: !p.Down(g.Maxfails)})
+			}
+			if slices.Contains(r.rulesets, g) {
+				info.Ruleset = true
+			} else {
+				info.Action = g.Action
+			}
+			out = append(out, info)
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func handleDashboard(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(dashboardHTML)
+}
+
+func handleActivity(w http.ResponseWriter, req *http.Request) {
+	queries := []queryEntry{}
+	blocked := make(map[string]uint64)
+	for _, r := range sortedInstances() {
+		if r.activity == nil {
+			continue
+		}
+		queries = append(queries, r.activity.queries()...)
+		r.activity.topBlocked(blocked)
+	}
+	slices.SortStableFunc(queries, func(a, b queryEntry) int { return b.Time.Compare(a.Time) })
+	writeJSON(w, http.StatusOK, map[string]any{
+		"queries":     queries[:min(recentQueries, len(queries))],
+		"top_blocked": sortBlocked(blocked, topBlockedNames),
+	})
+}
+
+// conflictInfo is a ruleConflict of a server block in the admin API.
+type conflictInfo struct {
+	Server string `json:"server"`
+	ruleConflict
+}
+
+func handleConflicts(w http.ResponseWriter, req *http.Request) {
+	out := []conflictInfo{}
+	for _, r := range sortedInstances() {
+		for _, c := range r.lastConflicts() {
+			out = append(out, conflictInfo{Server: r.server, ruleConflict: c})
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func handleUnmatched(w http.ResponseWriter, req *http.Request) {
+	counts := make(map[string]uint64)
+	for _, r := range sortedInstances() {
+		if r.unmatched == nil {
+			continue
+		}
+		if req.Method == http.MethodDelete {
+			r.unmatched.reset()
+			continue
+		}
+		r.unmatched.add(counts)
+	}
+	if req.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	limit := len(counts)
+	if s := req.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("limit must be a positive integer: %s", s))
+			return
+		}
+		limit = n
+	}
+	writeJSON(w, http.StatusOK, sortBlocked(counts, limit))
+}
+
+// findGroup returns the group or ruleset named name, in the server block server if it is not empty.
+func findGroup(name, server string) (*Group, error) {
+	_, g, err := findGroupIn(name, server)
+	return g, err
+}
+
+// findGroupIn is findGroup, also returning the instance of the group.
+func findGroupIn(name, server string) (*Ruledforward, *Group, error) {
+	var found *Group
+	var in *Ruledforward
+	for _, r := range sortedInstances() {
+		if server != "" && r.server != server {
+			continue
+		}
+		for _, g := range r.allGroups() {
+			if g.Name != name {
+				continue
+			}
+			if found != nil {
+				return nil, nil, fmt.Errorf("group %s exists in several server blocks, add ?server=", name)
+			}
+			found, in = g, r
+		}
+	}
+	if found == nil {
+		return nil, nil, fmt.Errorf("no group %s", name)
+	}
+	return in, found, nil
+}
+
+// findInstance returns the instance of the server block server, or the only instance if server is empty.
+func findInstance(server string) (*Ruledforward, error) {
+	all := sortedInstances()
+	if server == "" {
+		if len(all) != 1 {
+			return nil, errors.New("several server blocks, add ?server=")
+		}
+		return all[0], nil
+	}
+	i := slices.IndexFunc(all, func(r *Ruledforward) bool { return r.server == server })
+	if i < 0 {
+		return nil, fmt.Errorf("no server block %s", server)
+	}
+	return all[i], nil
+}
+
+func handleAddGroup(w http.ResponseWriter, req *http.Request) {
+	r, err := findInstance(req.URL.Query().Get("server"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	block, err := io.ReadAll(io.LimitReader(req.Body, maxAdminBody))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	g, err := r.AddGroup(string(block), req.URL.Query().Get("before"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	log.Infof("admin: added group %s to %s", g.Name, r.server)
+	writeJSON(w, http.StatusOK, map[string]string{"added": g.Name})
+}
+
+func handleRemoveGroup(w http.ResponseWriter, req *http.Request) {
+	r, g, err := findGroupIn(req.PathValue("group"), req.URL.Query().Get("server"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	if slices.Contains(r.rulesets, g) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("%s is a ruleset", g.Name))
+		return
+	}
+	if err := r.RemoveGroup(g.Name); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	log.Infof("admin: removed group %s from %s", g.Name, r.server)
+	writeJSON(w, http.StatusOK, map[string]string{"removed": g.Name})
+}
+
+func handleRules(w http.ResponseWriter, req *http.Request) {
+	g, err := findGroup(req.PathValue("group"), req.URL.Query().Get("server"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	format := cmp.Or(req.URL.Query().Get("format"), "text")
+	if _, ok := ruleFormats[format]; !ok {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("unknown rule format '%s'", format))
+		return
+	}
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	_ = WriteRules(w, format, g.EffectiveRules())
+}
+
+// readRules parses the request body as rules, one per line. Empty lines and # comments are skipped.
+func readRules(body io.Reader) ([]Rule, error) {
+	var rules []Rule
+	sc := bufio.NewScanner(io.LimitReader(body, maxAdminBody))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseRuleLine(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, errors.New("no rules in request body")
+	}
+	return rules, nil
+}
+
+func handleRuntimeRules(w http.ResponseWriter, req *http.Request) {
+	g, err := findGroup(req.PathValue("group"), req.URL.Query().Get("server"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	if req.Method == http.MethodGet {
+		rules := []string{}
+		for _, r := range g.RuntimeRules() {
+			rules = append(rules, r.String())
+		}
+		writeJSON(w, http.StatusOK, map[string][]string{"rules": rules})
+		return
+	}
+	rules, err := readRules(req.Body)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Method == http.MethodPost {
+		n, err := g.AddRuntimeRules(rules)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		log.Infof("admin: added %d runtime rules to group %s", n, g.Name)
+		writeJSON(w, http.StatusOK, map[string]int{"added": n})
+		return
+	}
+	n, err := g.RemoveRuntimeRules(rules)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	log.Infof("admin: removed %d runtime rules from group %s", n, g.Name)
+	writeJSON(w, http.StatusOK, map[string]int{"removed": n})
+}
@@ -0,0 +1,248 @@
+package ruledforward
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminRuntimeRules(t *testing.T) {
+	newGroup := func(name string) *Group {
+		g := &Group{Name: name, Action: "empty"}
+		g.SetMatcher(NewMatcher())
+		return g
+	}
+	a := &Ruledforward{from: ".", server: "admin-a:53", groups: []*Group{newGroup("admin-block"), newGroup("admin-only-a")}}
+	b := &Ruledforward{from: ".", server: "admin-b:53", groups: []*Group{newGroup("admin-block")}}
+	a.registerInstance()
+	b.registerInstance()
+	t.Cleanup(a.unregisterInstance)
+	t.Cleanup(b.unregisterInstance)
+
+	srv := httptest.NewServer(adminHandler())
+	defer srv.Close()
+	do := func(method, path, body string) (int, map[string]any) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		var out map[string]any
+		_ = json.Unmarshal(b, &out)
+		return resp.StatusCode, out
+	}
+
+	if code, _ := do("POST", "/api/groups/admin-block/runtime_rules", "domain:ads.example"); code != http.StatusNotFound {
+		t.Errorf("ambiguous group: status %d, want 404", code)
+	}
+	if code, _ := do("POST", "/api/groups/nope/runtime_rules", "domain:ads.example"); code != http.StatusNotFound {
+		t.Errorf("unknown group: status %d, want 404", code)
+	}
+	if code, _ := do("POST", "/api/groups/admin-only-a/runtime_rules", "domain:"); code != http.StatusBadRequest {
+		t.Errorf("invalid rule: status %d, want 400", code)
+	}
+	code, out := do("POST", "/api/groups/admin-block/runtime_rules?server=admin-a:53", "# block now\n||ads.example^\nkeyword:tracker\n")
+	if code != http.StatusOK || out["added"] != float64(2) {
+		t.Fatalf("POST = %d, %v", code, out)
+	}
+	if !a.groups[0].Match("x.ads.example.") || b.groups[0].Match("x.ads.example.") {
+		t.Error("rule should apply to the group of admin-a:53 only")
+	}
+	code, out = do("GET", "/api/groups/admin-block/runtime_rules?server=admin-a:53", "")
+	if rules, _ := out["rules"].([]any); code != http.StatusOK || len(rules) != 2 || rules[0] != "domain:ads.example" {
+		t.Errorf("GET = %d, %v", code, out)
+	}
+	code, out = do("DELETE", "/api/groups/admin-block/runtime_rules?server=admin-a:53", "domain:ads.example\ndomain:other.example")
+	if code != http.StatusOK || out["removed"] != float64(1) {
+		t.Errorf("DELETE = %d, %v", code, out)
+	}
+	if a.groups[0].Match("x.ads.example.") {
+		t.Error("removed rule still matches")
+	}
+	code, _ = do("GET", "/api/groups/admin-only-a/rules?format=csv", "")
+	if code != http.StatusBadRequest {
+		t.Errorf("GET rules with unknown format: status %d, want 400", code)
+	}
+	req, _ := http.NewRequest("GET", srv.URL+"/api/groups/admin-block/rules?server=admin-a:53&format=adguard", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "/tracker/\n" {
+		t.Errorf("GET rules = %d, %q", resp.StatusCode, body)
+	}
+
+	resp, err = http.Get(srv.URL + "/api/groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var groups []groupInfo
+	if err := json.NewDecoder(resp.Body).Decode(&groups); err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, g := range groups {
+		if g.Server == "admin-a:53" && g.Name == "admin-block" {
+			found = g.RuntimeRules == 1 && g.Action == "empty"
+		}
+	}
+	if !found {
+		t.Errorf("groups = %+v, want admin-block of admin-a:53 with 1 runtime rule", groups)
+	}
+}
+
+func TestAdminSharedListener(t *testing.T) {
+	a := &Ruledforward{admin: "127.0.0.1:0"}
+	b := &Ruledforward{admin: "127.0.0.1:0"}
+	if err := a.startAdmin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.startAdmin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.stopAdmin(); err != nil {
+		t.Fatal(err)
+	}
+	admins.Lock()
+	s := admins.m["127.0.0.1:0"]
+	admins.Unlock()
+	if s == nil || s.refs != 1 {
+		t.Fatal("admin server should keep running while another instance uses it")
+	}
+	// Stopping twice, as OnRestart and OnFinalShutdown may, releases the address once.
+	_ = a.stopAdmin()
+	if err := b.stopAdmin(); err != nil {
+		t.Fatal(err)
+	}
+	admins.Lock()
+	defer admins.Unlock()
+	if admins.m["127.0.0.1:0"] != nil {
+		t.Error("admin server should stop with its last instance")
+	}
+}
+
+func TestAdminGuard(t *testing.T) {
+	g := &Group{Name: "admin-guard", Action: "empty"}
+	g.SetMatcher(NewMatcher())
+	r := &Ruledforward{from: ".", server: "admin-guard:53", groups: []*Group{g}}
+	r.registerInstance()
+	t.Cleanup(r.unregisterInstance)
+
+	do := func(h http.Handler, method string, header map[string]string) int {
+		t.Helper()
+		req := httptest.NewRequest(method, "http://127.0.0.1:8053/api/groups/admin-guard/runtime_rules?server=admin-guard:53", strings.NewReader("domain:ads.example"))
+		for k, v := range header {
+			if k == "Host" {
+				req.Host = v
+				continue
+			}
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	binary := "application/octet-stream"
+
+	h := adminGuard(adminHandler(), "127.0.0.1:8053", "")
+	for _, tt := range []struct {
+		name   string
+		method string
+		header map[string]string
+		want   int
+	}{
+		{"read", "GET", nil, http.StatusOK},
+		{"read from localhost", "GET", map[string]string{"Host": "localhost:8053"}, http.StatusOK},
+		{"rebound host", "GET", map[string]string{"Host": "attacker.example:8053"}, http.StatusForbidden},
+		{"cross-origin", "GET", map[string]string{"Origin": "http://attacker.example"}, http.StatusForbidden},
+		{"same origin", "GET", map[string]string{"Origin": "http://127.0.0.1:8053"}, http.StatusOK},
+		{"change without content type", "POST", nil, http.StatusUnsupportedMediaType},
+		{"change as text/plain", "POST", map[string]string{"Content-Type": "text/plain; charset=utf-8"}, http.StatusUnsupportedMediaType},
+		{"change as form", "DELETE", map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, http.StatusUnsupportedMediaType},
+		{"change", "POST", map[string]string{"Content-Type": binary}, http.StatusOK},
+		{"cross-origin change", "POST", map[string]string{"Content-Type": binary, "Origin": "http://attacker.example"}, http.StatusForbidden},
+	} {
+		if code := do(h, tt.method, tt.header); code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, code, tt.want)
+		}
+	}
+
+	h = adminGuard(adminHandler(), "127.0.0.1:8053", "secret")
+	for _, tt := range []struct {
+		name   string
+		method string
+		header map[string]string
+		want   int
+	}{
+		{"read", "GET", nil, http.StatusOK},
+		{"change without token", "POST", map[string]string{"Content-Type": binary}, http.StatusUnauthorized},
+		{"change with wrong token", "POST", map[string]string{"Authorization": "Bearer wrong"}, http.StatusUnauthorized},
+		{"change with token", "DELETE", map[string]string{"Authorization": "Bearer secret"}, http.StatusOK},
+	} {
+		if code := do(h, tt.method, tt.header); code != tt.want {
+			t.Errorf("token: %s: status %d, want %d", tt.name, code, tt.want)
+		}
+	}
+	if len(g.RuntimeRules()) != 0 {
+		t.Errorf("runtime rules = %v, want none after adding and removing", g.RuntimeRules())
+	}
+
+	a := &Ruledforward{admin: "127.0.0.1:0", adminToken: "a"}
+	b := &Ruledforward{admin: "127.0.0.1:0", adminToken: "b"}
+	if err := a.startAdmin(); err != nil {
+		t.Fatal(err)
+	}
+	defer a.stopAdmin()
+	if err := b.startAdmin(); err == nil {
+		t.Error("a shared admin address with another admin_token should fail")
+	}
+}
+
+func TestAdminDashboard(t *testing.T) {
+	g := &Group{Name: "admin-dash", Action: "empty"}
+	g.SetMatcher(NewMatcher())
+	r := &Ruledforward{from: ".", server: "admin-dash:53", groups: []*Group{g}, activity: newActivity()}
+	r.registerInstance()
+	t.Cleanup(r.unregisterInstance)
+	r.activity.record(queryEntry{Server: r.server, Name: "ads.example.", Type: "A", Group: g.Name, Action: "empty"})
+
+	srv := httptest.NewServer(adminHandler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "<title>ruledforward</title>") {
+		t.Errorf("GET / = %d, %.80q", resp.StatusCode, body)
+	}
+
+	resp, err = http.Get(srv.URL + "/api/activity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Queries    []queryEntry  `json:"queries"`
+		TopBlocked []blockedName `json:"top_blocked"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Queries) != 1 || out.Queries[0].Group != "admin-dash" {
+		t.Errorf("queries = %+v", out.Queries)
+	}
+	if len(out.TopBlocked) != 1 || out.TopBlocked[0].Name != "ads.example." {
+		t.Errorf("top_blocked = %+v", out.TopBlocked)
+	}
+}
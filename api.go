@@ -0,0 +1,76 @@
+package ruledforward
+
+import (
+	"sync"
+
+	"github.com/coredns/coredns/plugin"
+)
+
+// instances holds the running instances by server block key, so other plugins and embedding programs can look up
+// routing decisions without sending DNS queries.
+var instances = struct {
+	sync.RWMutex
+	m map[string]*Ruledforward
+}{m: make(map[string]*Ruledforward)}
+
+// Instance returns the running instance of the server block with the given key (e.g. ".:53"), or nil.
+func Instance(server string) *Ruledforward {
+	instances.RLock()
+	defer instances.RUnlock()
+	return instances.m[server]
+}
+
+// Instances returns all running instances keyed by server block.
+func Instances() map[string]*Ruledforward {
+	instances.RLock()
+	defer instances.RUnlock()
+	out := make(map[string]*Ruledforward, len(instances.m))
+	for k, r := range instances.m {
+		out[k] = r
+	}
+	return out
+}
+
+func (r *Ruledforward) registerInstance() {
+	instances.Lock()
+	defer instances.Unlock()
+	instances.m[r.server] = r
+}
+
+// unregisterInstance removes r unless a reloaded instance already took its place.
+func (r *Ruledforward) unregisterInstance() {
+	instances.Lock()
+	defer instances.Unlock()
+	if instances.m[r.server] == r {
+		delete(instances.m, r.server)
+	}
+}
+
+// GroupFor reports the group and action a query for qname would be routed to, as ServeDNS decides it.
+// ok is false if qname is outside the plugin's zone or matches no group and there is no default group,
+// in which case the query would be passed to the next plugin.
+func (r *Ruledforward) GroupFor(qname string) (group, action string, ok bool) {
+	qname = normalizeName(qname)
+	if r.from != "." && !plugin.Name(r.from).Matches(qname) {
+		return "", "", false
+	}
+	g := r.groupFor(qname, nil)
+	if g == nil {
+		return "", "", false
+	}
+	return g.Name, g.Action, true
+}
+
+// RuleFor reports the rule that routes qname to the group GroupFor returns and the source the rule was loaded from,
+// if known. ok is false if no rule matches, e.g. when qname goes to the default group.
+func (r *Ruledforward) RuleFor(qname string) (rule Rule, source string, ok bool) {
+	qname = normalizeName(qname)
+	if r.from != "." && !plugin.Name(r.from).Matches(qname) {
+		return Rule{}, "", false
+	}
+	g := r.groupFor(qname, nil)
+	if g == nil {
+		return Rule{}, "", false
+	}
+	return g.explainMatch(qname)
+}
@@ -0,0 +1,56 @@
+package ruledforward
+
+import (
+	"testing"
+)
+
+func TestGroupFor(t *testing.T) {
+	m := NewMatcher()
+	m.AddRule(Rule{Type: RuleDomain, Value: "ads.example."})
+	m.Build()
+	block := &Group{Name: "block", Action: "empty"}
+	block.SetMatcher(m)
+	def := &Group{Name: "default", Action: "forward"}
+	def.SetMatcher(NewMatcher())
+
+	r := &Ruledforward{from: "example.", groups: []*Group{block, def}}
+	tests := []struct {
+		qname          string
+		group, action  string
+		ok             bool
+		withoutDefault bool
+	}{
+		{qname: "x.ADS.example", group: "block", action: "empty", ok: true},
+		{qname: "www.example.", group: "default", action: "forward", ok: true},
+		{qname: "www.example.", withoutDefault: true},
+		{qname: "ads.example.org."},
+	}
+	for _, tc := range tests {
+		r.defaultGroup = def
+		if tc.withoutDefault {
+			r.defaultGroup = nil
+		}
+		group, action, ok := r.GroupFor(tc.qname)
+		if group != tc.group || action != tc.action || ok != tc.ok {
+			t.Errorf("GroupFor(%q) = %q, %q, %v; want %q, %q, %v", tc.qname, group, action, ok, tc.group, tc.action, tc.ok)
+		}
+	}
+}
+
+func TestInstanceRegistry(t *testing.T) {
+	old := &Ruledforward{from: ".", server: "api-test:53"}
+	old.registerInstance()
+	cur := &Ruledforward{from: ".", server: "api-test:53"}
+	cur.registerInstance()
+	old.unregisterInstance()
+	if Instance("api-test:53") != cur {
+		t.Fatal("shutting down the old instance should keep the reloaded one registered")
+	}
+	if Instances()["api-test:53"] != cur {
+		t.Error("Instances should include the registered instance")
+	}
+	cur.unregisterInstance()
+	if Instance("api-test:53") != nil {
+		t.Error("instance should be unregistered after shutdown")
+	}
+}
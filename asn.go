@@ -0,0 +1,84 @@
+package ruledforward
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// asnSet matches addresses that a MaxMind ASN database (e.g. GeoLite2-ASN) places in one of asns.
+type asnSet struct {
+	db   *mmdbReader
+	asns map[uint64]bool
+}
+
+func (s *asnSet) Contains(addr netip.Addr) bool {
+	v, err := s.db.lookup(addr)
+	if err != nil || v == nil {
+		return false
+	}
+	n, ok := mmdbPath(v, "autonomous_system_number").(uint64)
+	return ok && s.asns[n]
+}
+
+// parseASNs parses `block_asn` arguments, AS numbers with or without the "AS" prefix (e.g. AS13335, 16509).
+func parseASNs(args []string) ([]uint64, error) {
+	out := make([]uint64, 0, len(args))
+	for _, a := range args {
+		s := a
+		if len(s) > 2 && strings.EqualFold(s[:2], "AS") {
+			s = s[2:]
+		}
+		n, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AS number '%s'", a)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// resolveBlockASN builds each group's BlockASN from its block_asn numbers and the ASN database db.
+func resolveBlockASN(groups []*Group, db *mmdbReader) error {
+	for _, g := range groups {
+		if len(g.blockASNs) == 0 {
+			continue
+		}
+		if db == nil {
+			return errors.New("block_asn requires asnfile")
+		}
+		s := &asnSet{db: db, asns: make(map[uint64]bool, len(g.blockASNs))}
+		for _, n := range g.blockASNs {
+			s.asns[n] = true
+		}
+		g.BlockASN = s
+	}
+	return nil
+}
+
+// answerHasAddrIn reports whether any A/AAAA answer of ret is in set.
+func answerHasAddrIn(ret *dns.Msg, set addrMatcher) bool {
+	for _, rr := range ret.Answer {
+		if addr, ok := rrAddr(rr); ok && set.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// dropAddrs returns rrs without the A/AAAA records whose address is in set, and whether any were removed. It filters
+// in place.
+func dropAddrs(rrs []dns.RR, set addrMatcher) ([]dns.RR, bool) {
+	out := rrs[:0]
+	for _, rr := range rrs {
+		if addr, ok := rrAddr(rr); ok && set.Contains(addr) {
+			continue
+		}
+		out = append(out, rr)
+	}
+	return out, len(out) < len(rrs)
+}
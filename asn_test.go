@@ -0,0 +1,62 @@
+package ruledforward
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseASNs(t *testing.T) {
+	got, err := parseASNs([]string{"AS13335", "as16509", "24940"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{13335, 16509, 24940}; !slices.Equal(got, want) {
+		t.Errorf("parseASNs = %v, want %v", got, want)
+	}
+	for _, bad := range []string{"AS", "ASx", "-1", "4294967296"} {
+		if _, err := parseASNs([]string{bad}); err == nil {
+			t.Errorf("parseASNs(%q): expected error", bad)
+		}
+	}
+}
+
+func TestBlockASN(t *testing.T) {
+	db, err := newMMDBReader(buildTestMMDB(map[netip.Prefix]map[string]any{
+		netip.MustParsePrefix("104.16.0.0/13"): {"autonomous_system_number": uint32(13335)},
+		netip.MustParsePrefix("1.0.1.0/24"):    {"autonomous_system_number": uint32(4134)},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resolveBlockASN([]*Group{{Name: "cn", blockASNs: []uint64{13335}}}, nil); err == nil {
+		t.Error("expected error without asnfile")
+	}
+	g := &Group{Name: "cn", Action: "forward", blockASNs: []uint64{13335}}
+	if err := resolveBlockASN([]*Group{g}, db); err != nil {
+		t.Fatal(err)
+	}
+
+	answer := func(ips ...string) *dns.Msg {
+		m := new(dns.Msg)
+		for _, ip := range ips {
+			m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: "a.example.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.ParseIP(ip)})
+		}
+		return m
+	}
+	if reason := g.untrusted(answer("1.0.1.1", "104.16.1.1")); reason != "asn" {
+		t.Errorf("untrusted = %q, want asn", reason)
+	}
+	if reason := g.untrusted(answer("1.0.1.1")); reason != "" {
+		t.Errorf("untrusted = %q, want trusted", reason)
+	}
+
+	ret := answer("104.16.1.1", "1.0.1.1", "104.23.255.1")
+	g.processResponse(ret)
+	if len(ret.Answer) != 1 || ret.Answer[0].(*dns.A).A.String() != "1.0.1.1" {
+		t.Errorf("answer after block_asn = %v", ret.Answer)
+	}
+}
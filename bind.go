@@ -0,0 +1,220 @@
+package ruledforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// bindReadTimeout is the read timeout of bound connections, that of the proxies. Dials time out with the query.
+const bindReadTimeout = 2 * time.Second
+
+// sourceBinding is a group's `bind` setting: either a fixed local address or an interface name.
+// Interface addresses are looked up at dial time so a VPN interface that is re-addressed keeps working.
+type sourceBinding struct {
+	ip    net.IP
+	iface string
+}
+
+// parseSourceBinding parses a `bind` argument as an IP address or an existing interface name.
+func parseSourceBinding(s string) (*sourceBinding, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return &sourceBinding{ip: ip}, nil
+	}
+	if _, err := net.InterfaceByName(s); err != nil {
+		return nil, fmt.Errorf("bind %s: not an IP address or interface: %w", s, err)
+	}
+	return &sourceBinding{iface: s}, nil
+}
+
+// localIP returns the source address to use towards an upstream of the given address family.
+func (b *sourceBinding) localIP(v6 bool) (net.IP, error) {
+	if b.ip != nil {
+		if (b.ip.To4() == nil) != v6 {
+			return nil, fmt.Errorf("bind %s: address family does not match upstream", b.ip)
+		}
+		return b.ip, nil
+	}
+	ifi, err := net.InterfaceByName(b.iface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if (ipnet.IP.To4() == nil) == v6 {
+			return ipnet.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("bind %s: no usable address on interface", b.iface)
+}
+
+// localAddr returns ip as a net.Addr of the type net.Dialer expects for network.
+func localAddr(network string, ip net.IP) net.Addr {
+	if network == "udp" {
+		return &net.UDPAddr{IP: ip}
+	}
+	return &net.TCPAddr{IP: ip}
+}
+
+// connect sends the query to pr, with DNS 0x20 case randomization for plain-DNS upstreams when enabled.
+func (g *Group) connect(ctx context.Context, pr *proxy.Proxy, state request.Request, opts proxy.Options) (*dns.Msg, error) {
+	if g.DNS0x20 && pr.GetTransport().GetTLSConfig() == nil {
+		return g.connect0x20(ctx, pr, state, opts)
+	}
+	return g.dial(ctx, pr, state, opts)
+}
+
+// dial sends the query to pr. Groups with a `bind` use their own connections so the source address is honored;
+// all other groups go through the proxy and its connection cache.
+func (g *Group) dial(ctx context.Context, pr *proxy.Proxy, state request.Request, opts proxy.Options) (*dns.Msg, error) {
+	if g.bind == nil {
+		return pr.Connect(ctx, state, opts)
+	}
+	return g.exchangeBound(ctx, pr, state, opts)
+}
+
+// exchangeBound sends the query to pr over a connection from the group's bind address, reusing an idle one if there
+// is one. A reused connection that fails other than by timing out, as when the upstream closed it in the meantime,
+// is replaced by a new one.
+func (g *Group) exchangeBound(ctx context.Context, pr *proxy.Proxy, state request.Request, opts proxy.Options) (*dns.Msg, error) {
+	var proto string
+	switch {
+	case opts.ForceTCP:
+		proto = "tcp"
+	case opts.PreferUDP:
+		proto = "udp"
+	default:
+		proto = state.Proto()
+	}
+	tlsConfig := pr.GetTransport().GetTLSConfig()
+	if tlsConfig != nil {
+		proto = "tcp"
+	}
+
+	c := &dns.Client{
+		Net:         proto,
+		TLSConfig:   tlsConfig,
+		ReadTimeout: bindReadTimeout,
+		UDPSize:     max(uint16(state.Size()), 512), // #nosec G115 -- UDP size fits in uint16
+	}
+	if tlsConfig != nil {
+		c.Net = "tcp-tls"
+	}
+	key := c.Net + " " + pr.Addr()
+	for {
+		co, cached := g.boundConns.get(key)
+		if !cached {
+			var err error
+			if co, err = g.dialBound(ctx, c, pr.Addr()); err != nil {
+				return nil, err
+			}
+		}
+		ret, _, err := c.ExchangeWithConnContext(ctx, state.Req, co)
+		if err != nil {
+			co.Close()
+			var ne net.Error
+			if cached && ctx.Err() == nil && !(errors.As(err, &ne) && ne.Timeout()) {
+				continue
+			}
+			return nil, err
+		}
+		g.boundConns.put(key, co)
+		return ret, nil
+	}
+}
+
+// dialBound dials addr for c from the group's bind address.
+func (g *Group) dialBound(ctx context.Context, c *dns.Client, addr string) (*dns.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	upstream := net.ParseIP(host)
+	lip, err := g.bind.localIP(upstream != nil && upstream.To4() == nil)
+	if err != nil {
+		return nil, err
+	}
+	d := *c
+	d.Dialer = &net.Dialer{Timeout: defaultTimeout, LocalAddr: localAddr(c.Net, lip)}
+	return d.DialContext(ctx, addr)
+}
+
+// boundConns caches the idle connections of a group with `bind`, by protocol and upstream, as the transports of the
+// proxies do for other groups. Connections idle for longer than expire are closed rather than reused, and at most
+// maxIdle (0 for no limit) are kept per upstream and protocol.
+type boundConns struct {
+	expire  time.Duration
+	maxIdle int
+
+	mu     sync.Mutex
+	idle   map[string][]boundConn
+	closed bool
+}
+
+// boundConn is an idle connection and when it was last used.
+type boundConn struct {
+	co   *dns.Conn
+	used time.Time
+}
+
+func newBoundConns(expire time.Duration, maxIdle int) *boundConns {
+	return &boundConns{expire: expire, maxIdle: maxIdle, idle: make(map[string][]boundConn)}
+}
+
+// get returns the most recently used idle connection for key, closing those that have expired. It reports false if
+// there is none.
+func (b *boundConns) get(key string) (*dns.Conn, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	conns := b.idle[key]
+	for len(conns) > 0 {
+		bc := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if time.Since(bc.used) < b.expire {
+			b.idle[key] = conns
+			return bc.co, true
+		}
+		bc.co.Close()
+	}
+	delete(b.idle, key)
+	return nil, false
+}
+
+// put makes co available for reuse, or closes it if the cache is full or closed.
+func (b *boundConns) put(key string, co *dns.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || b.maxIdle > 0 && len(b.idle[key]) >= b.maxIdle {
+		co.Close()
+		return
+	}
+	b.idle[key] = append(b.idle[key], boundConn{co: co, used: time.Now()})
+}
+
+// close closes the idle connections; connections in use are closed when they are returned.
+func (b *boundConns) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for _, conns := range b.idle {
+		for _, bc := range conns {
+			bc.co.Close()
+		}
+	}
+	b.idle = nil
+}
@@ -0,0 +1,81 @@
+package ruledforward
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseSourceBinding(t *testing.T) {
+	b, err := parseSourceBinding("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.ip == nil || b.iface != "" {
+		t.Errorf("binding = %+v, want fixed IP", b)
+	}
+	if _, err := b.localIP(true); err == nil {
+		t.Error("expected error for IPv4 bind towards IPv6 upstream")
+	}
+
+	b, err = parseSourceBinding("lo")
+	if err != nil {
+		t.Skipf("no loopback interface named lo: %v", err)
+	}
+	ip, err := b.localIP(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.IsLoopback() {
+		t.Errorf("localIP(lo) = %v, want loopback", ip)
+	}
+
+	if _, err := parseSourceBinding("no-such-iface0"); err == nil {
+		t.Error("expected error for unknown interface")
+	}
+}
+
+func TestExchangeBound(t *testing.T) {
+	remotes := make(chan string, 2)
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		remotes <- w.RemoteAddr().String()
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		_ = w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	b, err := parseSourceBinding("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &Group{Name: "bound", bind: b, boundConns: newBoundConns(defaultExpire, 0)}
+	defer g.boundConns.close()
+	_, port, _ := net.SplitHostPort(s.Addr)
+	p := proxy.NewProxy("ruledforward", net.JoinHostPort("127.0.0.1", port), transport.DNS)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: req}
+	for range 2 {
+		ret, err := g.connect(context.Background(), p, state, proxy.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !state.Match(ret) || len(ret.Answer) != 1 {
+			t.Errorf("unexpected reply: %v", ret)
+		}
+	}
+	if first, second := <-remotes, <-remotes; first != second {
+		t.Errorf("queries came from %s and %s, want both over the same cached connection", first, second)
+	}
+}
@@ -1,8 +1,10 @@
 package ruledforward
 
 import (
+	"bytes"
 	"slices"
 	"strings"
+	"unsafe"
 
 	"github.com/bits-and-blooms/bloom/v3"
 	"github.com/miekg/dns"
@@ -46,26 +48,21 @@ func (b *BloomFilter) Add(s ...string) {
 
 // MaybeMatch returns true if qname or any of its parent suffixes might be in the set.
 // Used for pre-match: if false, definitely no match; if true, call full matcher.
-// Safe for concurrent read.
+// Safe for concurrent read, and does not allocate for a normalized qname.
 func (b *BloomFilter) MaybeMatch(qname string) bool {
-	q := strings.ToLower(dns.Fqdn(qname))
-	// Check qname itself (full match)
-	if b.bf.Test([]byte(q)) {
-		return true
-	}
-	// Check each parent suffix (domain match)
-	for {
-		idx := strings.Index(q, ".")
-		if idx == -1 {
-			break
+	q := normalizeName(qname)
+	// Test only hashes its argument, so qname and each parent suffix are tested through a view of the bytes of q
+	// instead of a copy per suffix.
+	key := unsafe.Slice(unsafe.StringData(q), len(q))
+	for len(key) > 0 {
+		if b.bf.Test(key) {
+			return true
 		}
-		q = q[idx+1:]
-		if q == "" {
+		i := bytes.IndexByte(key, '.')
+		if i < 0 {
 			break
 		}
-		if b.bf.Test([]byte(q)) {
-			return true
-		}
+		key = key[i+1:]
 	}
 	return false
 }
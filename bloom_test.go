@@ -21,3 +21,16 @@ func TestBloomMaybeMatch(t *testing.T) {
 		t.Error("expected MaybeMatch(other.org) false")
 	}
 }
+
+func TestBloomMaybeMatchAllocs(t *testing.T) {
+	bf := NewBloomFilter(1000, 0.01)
+	bf.Add("example.com.")
+	// Longer than the buffer the compiler keeps on the stack for a []byte conversion.
+	q := "a-fairly-long-label.another-long-label.yet-another-label.example.net."
+	if n := testing.AllocsPerRun(100, func() { bf.MaybeMatch(q) }); n != 0 {
+		t.Errorf("MaybeMatch allocates %v times", n)
+	}
+	if !bf.MaybeMatch("a-fairly-long-label.another-long-label.example.com.") || bf.MaybeMatch(q) {
+		t.Error("MaybeMatch should test every parent suffix")
+	}
+}
@@ -0,0 +1,49 @@
+package ruledforward
+
+import (
+	"github.com/miekg/dns"
+)
+
+// withBufsize returns a copy of req, as forwarded by a group with `bufsize`, with size as its EDNS0 UDP payload
+// size; an OPT record is added if req has none. req is returned as is if it already has that size.
+func withBufsize(req *dns.Msg, size uint16) *dns.Msg {
+	if opt := req.IsEdns0(); opt != nil && opt.UDPSize() == size {
+		return req
+	}
+	out := req.Copy()
+	if opt := out.IsEdns0(); opt != nil {
+		opt.SetUDPSize(size)
+	} else {
+		out.SetEdns0(size, false)
+	}
+	return out
+}
+
+// bufsizeWriter sets the EDNS0 UDP payload size of a group's responses to its `bufsize`. A client that did not
+// use EDNS0 gets responses without an OPT record, as forwarded responses have one if the query got one added.
+type bufsizeWriter struct {
+	dns.ResponseWriter
+	size uint16
+	edns bool // the query has an OPT record
+	do   bool
+}
+
+func newBufsizeWriter(w dns.ResponseWriter, req *dns.Msg, size uint16) *bufsizeWriter {
+	bw := &bufsizeWriter{ResponseWriter: w, size: size}
+	if opt := req.IsEdns0(); opt != nil {
+		bw.edns, bw.do = true, opt.Do()
+	}
+	return bw
+}
+
+func (w *bufsizeWriter) WriteMsg(m *dns.Msg) error {
+	switch opt := m.IsEdns0(); {
+	case !w.edns:
+		m.Extra = withoutOPT(m.Extra)
+	case opt != nil:
+		opt.SetUDPSize(w.size)
+	default:
+		m.SetEdns0(w.size, w.do)
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,70 @@
+package ruledforward
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestBufsize(t *testing.T) {
+	var upstreamSize atomic.Int32
+	p := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if opt := r.IsEdns0(); opt != nil {
+			upstreamSize.Store(int32(opt.UDPSize()))
+			ret.SetEdns0(4096, false)
+		}
+		ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" 300 IN A 192.0.2.1"))
+		_ = w.WriteMsg(ret)
+	})
+	fwd := &Group{Name: "default", Action: "forward", Policy: &sequential{}, BufSize: 1232}
+	fwd.SetProxies([]*proxy.Proxy{p})
+	fwd.SetMatcher(NewMatcher())
+	m := NewMatcher()
+	m.AddRule(Rule{Type: RuleDomain, Value: "ads.example."})
+	m.Build()
+	ads := &Group{Name: "ads", Action: "empty", BufSize: 1232}
+	ads.SetMatcher(m)
+	r := &Ruledforward{from: ".", groups: []*Group{ads, fwd}, defaultGroup: fwd}
+
+	tests := []struct {
+		name     string
+		edns     uint16 // 0 for none
+		upstream int32
+		opt      bool
+	}{
+		{"www.example.org.", 4096, 1232, true},
+		{"www.example.org.", 0, 1232, false},
+		{"x.ads.example.", 4096, 0, true},
+		{"x.ads.example.", 0, 0, false},
+	}
+	for _, tc := range tests {
+		upstreamSize.Store(0)
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, dns.TypeA)
+		if tc.edns > 0 {
+			req.SetEdns0(tc.edns, false)
+		}
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := r.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatal(err)
+		}
+		if got := upstreamSize.Load(); got != tc.upstream {
+			t.Errorf("%s, EDNS %d: upstream got payload size %d, want %d", tc.name, tc.edns, got, tc.upstream)
+		}
+		opt := rec.Msg.IsEdns0()
+		if tc.opt && (opt == nil || opt.UDPSize() != 1232) || !tc.opt && opt != nil {
+			t.Errorf("%s, EDNS %d: response OPT = %v", tc.name, tc.edns, opt)
+		}
+		if tc.edns > 0 && req.IsEdns0().UDPSize() != tc.edns {
+			t.Errorf("%s: the client's query should not be changed", tc.name)
+		}
+	}
+}
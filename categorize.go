@@ -0,0 +1,147 @@
+package ruledforward
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultCategoryTTL is how long `categorize` keeps the categories of a name by default.
+	defaultCategoryTTL = time.Hour
+	// categoryFailTTL is how long a failed lookup counts as no categories, so that a service that is down does not
+	// delay every query.
+	categoryFailTTL = time.Minute
+	// categoryCacheSize is the number of names whose categories are kept.
+	categoryCacheSize = 10000
+	categorizeTimeout = 2 * time.Second
+	// maxCategoryReply caps the size of a reply of the categorization service.
+	maxCategoryReply = 64 << 10
+)
+
+// categorizer looks up the categories of names in an HTTP categorization service, see `categorize`, for the groups
+// that match by `category`.
+type categorizer struct {
+	url    string // with {name} in place of the name looked up
+	host   string // of url, normalized; never looked up, so the service can be resolved through this server
+	ttl    time.Duration
+	client *http.Client
+	cache  *lru[string, categoryEntry]
+}
+
+type categoryEntry struct {
+	categories []string
+	expires    time.Time
+}
+
+// parseCategorizer parses the arguments of `categorize URL [TTL]`.
+func parseCategorizer(args []string) (*categorizer, error) {
+	if len(args) == 0 || len(args) > 2 {
+		return nil, errors.New("categorize takes a URL and an optional TTL")
+	}
+	u, err := url.Parse(args[0])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || !strings.Contains(args[0], "{name}") {
+		return nil, fmt.Errorf("categorize needs an http:// or https:// URL with {name} for the name: %s", args[0])
+	}
+	c := &categorizer{
+		url:    args[0],
+		host:   normalizeName(u.Hostname()),
+		ttl:    defaultCategoryTTL,
+		client: &http.Client{Timeout: categorizeTimeout},
+		cache:  newLRU[string, categoryEntry](categoryCacheSize),
+	}
+	if len(args) == 2 {
+		if c.ttl, err = time.ParseDuration(args[1]); err != nil || c.ttl <= 0 {
+			return nil, fmt.Errorf("categorize TTL must be a positive duration: %s", args[1])
+		}
+	}
+	return c, nil
+}
+
+// categories returns the categories of q (normalized), from the cache or else from the service. A failed lookup is
+// logged and has no categories.
+func (c *categorizer) categories(q string) []string {
+	if q == c.host {
+		return nil
+	}
+	now := time.Now()
+	if e, ok := c.cache.get(q); ok && now.Before(e.expires) {
+		categoryLookupsTotal.WithLabelValues("cached").Inc()
+		return e.categories
+	}
+	categories, err := c.fetch(q)
+	ttl := c.ttl
+	if err != nil {
+		categoryLookupsTotal.WithLabelValues("failed").Inc()
+		log.Warningf("Categorizing %s: %v", q, err)
+		ttl = min(ttl, categoryFailTTL)
+	} else {
+		categoryLookupsTotal.WithLabelValues("fetched").Inc()
+	}
+	c.cache.add(q, categoryEntry{categories: categories, expires: now.Add(ttl)})
+	return categories
+}
+
+// fetch asks the service for the categories of q. The reply is a JSON list of category names, or an object with such
+// a list as `categories`.
+func (c *categorizer) fetch(q string) ([]string, error) {
+	resp, err := c.client.Get(strings.ReplaceAll(c.url, "{name}", url.QueryEscape(strings.TrimSuffix(q, "."))))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxCategoryReply))
+	if err != nil {
+		return nil, err
+	}
+	var categories []string
+	if err := json.Unmarshal(body, &categories); err != nil {
+		var reply struct {
+			Categories []string `json:"categories"`
+		}
+		if err := json.Unmarshal(body, &reply); err != nil {
+			return nil, fmt.Errorf("reply is neither a list of categories nor an object with one: %w", err)
+		}
+		categories = reply.Categories
+	}
+	for i, name := range categories {
+		categories[i] = strings.ToLower(strings.TrimSpace(name))
+	}
+	return categories, nil
+}
+
+// matchCategory returns the first category of q (normalized) that is one of the group's, if any.
+func (g *Group) matchCategory(q string) (string, bool) {
+	if g.categorizer == nil {
+		return "", false
+	}
+	for _, name := range g.categorizer.categories(q) {
+		if slices.Contains(g.Categories, name) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// resolveCategories gives the groups with `category` the instance's categorizer.
+func resolveCategories(groups []*Group, c *categorizer) error {
+	for _, g := range groups {
+		if len(g.Categories) == 0 {
+			continue
+		}
+		if c == nil {
+			return fmt.Errorf("group %s: category requires categorize", g.Name)
+		}
+		g.categorizer = c
+	}
+	return nil
+}
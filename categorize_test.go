@@ -0,0 +1,99 @@
+package ruledforward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCategorizer(t *testing.T) {
+	var lookups atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		switch r.URL.Query().Get("domain") {
+		case "casino.example":
+			_, _ = w.Write([]byte(`{"domain":"casino.example","categories":["Gambling","Games"]}`))
+		case "news.example":
+			_, _ = w.Write([]byte(`["news"]`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := parseCategorizer([]string{srv.URL + "/lookup?domain={name}", "10m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.categories("casino.example."); !slices.Equal(got, []string{"gambling", "games"}) {
+		t.Errorf("categories = %v, want gambling and games", got)
+	}
+	if got := c.categories("news.example."); !slices.Equal(got, []string{"news"}) {
+		t.Errorf("categories = %v, want news", got)
+	}
+	if got := c.categories("down.example."); got != nil {
+		t.Errorf("categories of a failed lookup = %v, want none", got)
+	}
+	c.categories("casino.example.")
+	c.categories("down.example.")
+	if n := lookups.Load(); n != 3 {
+		t.Errorf("%d lookups, want 3: answers and failures should be cached", n)
+	}
+	if got := c.categories("127.0.0.1."); got != nil || lookups.Load() != 3 {
+		t.Error("the service's own host should not be looked up")
+	}
+
+	for _, args := range [][]string{
+		{},
+		{"ftp://cat.example/{name}"},
+		{"https://cat.example/lookup"},
+		{"https://cat.example/{name}", "soon"},
+		{"https://cat.example/{name}", "1h", "extra"},
+	} {
+		if _, err := parseCategorizer(args); err == nil {
+			t.Errorf("parseCategorizer(%q) should fail", args)
+		}
+	}
+}
+
+func TestRouteByCategory(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`["gambling"]`))
+	}))
+	defer srv.Close()
+	c, err := parseCategorizer([]string{srv.URL + "/{name}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gambling := &Group{Name: "gambling", Action: "empty", Categories: []string{"adult", "gambling"}}
+	allowed := &Group{Name: "allowed", Action: "empty"}
+	m := NewMatcher()
+	m.AddRule(Rule{Type: RuleDomain, Value: "casino.example."})
+	m.Build()
+	allowed.SetMatcher(m)
+	r := &Ruledforward{groups: []*Group{gambling, allowed}, categorizer: c, decisions: newLRU[string, decision](10)}
+	if err := resolveCategories(r.groups, c); err != nil {
+		t.Fatal(err)
+	}
+
+	if g := r.routeFor("www.casino.example.", queryClient{}, nil); g != allowed {
+		t.Errorf("routeFor = %v, want allowed: rules come before categories", g)
+	}
+	if g := r.routeFor("poker.example.", queryClient{}, nil); g != gambling {
+		t.Errorf("routeFor = %v, want gambling", g)
+	}
+	if r.decisions.len() != 1 {
+		t.Errorf("%d cached decisions, want only the one by rule", r.decisions.len())
+	}
+	rule, source, ok := gambling.explainMatch("poker.example.")
+	if !ok || rule.String() != "category:gambling" || source != "categorize" {
+		t.Errorf("explainMatch = %v, %q, %v", rule, source, ok)
+	}
+
+	if err := resolveCategories([]*Group{{Name: "x", Categories: []string{"adult"}}}, nil); err == nil {
+		t.Error("category without categorize should fail")
+	}
+}
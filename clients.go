@@ -0,0 +1,365 @@
+package ruledforward
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// EDNS0 options routers add to identify the device behind them: dnsmasq's --add-mac sends the MAC address in binary
+// in ednsMACOption, or as text or base64 in ednsDeviceIDOption, and --add-cpe-id sends an identifier of its own.
+const (
+	ednsMACOption      = 65001
+	ednsDeviceIDOption = 65073
+	ednsCPEIDOption    = 65074
+)
+
+// clientRule is a `clients`, `client_tag`, `client_mac`, `client_id` or `client_geoip` setting of a group: the
+// clients the group applies to and, optionally, the times of day it does, e.g. for devices that get other rules at
+// night.
+type clientRule struct {
+	nets    []netip.Prefix
+	tags    []string     // tags of clients in the clients_file
+	macs    []string     // MAC addresses, as net.HardwareAddr.String
+	ids     []string     // client identifiers
+	geo     []string     // country codes of client_geoip, resolved into geoIPs after parsing
+	geoIPs  addrMatcher  // addresses of the countries in geo
+	windows []timeWindow // empty for all day
+}
+
+// queryClient is where a query came from: its source address and the device identity a router added to it, if any,
+// along with its DNSSEC OK and checking disabled bits.
+type queryClient struct {
+	addr   netip.Addr
+	mac    string
+	id     string
+	do, cd bool
+}
+
+// DNSSEC bits of a query, in a dnssecFlags.
+const (
+	flagDO = 1 << iota
+	flagCD
+)
+
+// dnssecFlags is the `dnssec_flags` setting of a group: the DNSSEC bits of the queries it takes. Bits in mask must
+// be as in want.
+type dnssecFlags struct {
+	mask, want uint8
+}
+
+// parseDNSSECFlags parses the arguments of `dnssec_flags [!]do|[!]cd...`.
+func parseDNSSECFlags(args []string) (dnssecFlags, error) {
+	var f dnssecFlags
+	if len(args) == 0 {
+		return f, errors.New("dnssec_flags needs at least one of do, !do, cd and !cd")
+	}
+	for _, arg := range args {
+		name, not := strings.CutPrefix(strings.ToLower(arg), "!")
+		var bit uint8
+		switch name {
+		case "do":
+			bit = flagDO
+		case "cd":
+			bit = flagCD
+		default:
+			return f, fmt.Errorf("invalid dnssec_flags flag '%s', want do, !do, cd or !cd", arg)
+		}
+		if f.mask&bit != 0 {
+			return f, fmt.Errorf("dnssec_flags flag '%s' given twice", name)
+		}
+		f.mask |= bit
+		if !not {
+			f.want |= bit
+		}
+	}
+	return f, nil
+}
+
+// holds reports whether the query of client has the bits of f.
+func (f dnssecFlags) holds(client queryClient) bool {
+	var bits uint8
+	if client.do {
+		bits |= flagDO
+	}
+	if client.cd {
+		bits |= flagCD
+	}
+	return bits&f.mask == f.want
+}
+
+// timeWindow is a time of day range in minutes since midnight, local time. A window whose end is before its start
+// spans midnight.
+type timeWindow struct {
+	from, to int
+}
+
+// parseClientRule parses the arguments of `clients ADDRESS|CIDR... [schedule HH:MM-HH:MM...]`.
+func parseClientRule(args []string) (clientRule, error) {
+	var cr clientRule
+	args, windows, err := parseSchedule(args)
+	if err != nil {
+		return cr, err
+	}
+	cr.windows = windows
+	for _, arg := range args {
+		p, err := parseClientPrefix(arg)
+		if err != nil {
+			return cr, err
+		}
+		cr.nets = append(cr.nets, p)
+	}
+	if len(cr.nets) == 0 {
+		return cr, errors.New("clients needs at least one address or CIDR")
+	}
+	return cr, nil
+}
+
+// parseClientTagRule parses the arguments of `client_tag TAG... [schedule HH:MM-HH:MM...]`.
+func parseClientTagRule(args []string) (clientRule, error) {
+	var cr clientRule
+	args, windows, err := parseSchedule(args)
+	if err != nil {
+		return cr, err
+	}
+	cr.windows = windows
+	for _, arg := range args {
+		cr.tags = append(cr.tags, strings.ToLower(arg))
+	}
+	if len(cr.tags) == 0 {
+		return cr, errors.New("client_tag needs at least one tag")
+	}
+	return cr, nil
+}
+
+// parseClientMACRule parses the arguments of `client_mac MAC... [schedule HH:MM-HH:MM...]`.
+func parseClientMACRule(args []string) (clientRule, error) {
+	var cr clientRule
+	args, windows, err := parseSchedule(args)
+	if err != nil {
+		return cr, err
+	}
+	cr.windows = windows
+	for _, arg := range args {
+		mac, err := net.ParseMAC(arg)
+		if err != nil {
+			return cr, fmt.Errorf("invalid client MAC address '%s'", arg)
+		}
+		cr.macs = append(cr.macs, mac.String())
+	}
+	if len(cr.macs) == 0 {
+		return cr, errors.New("client_mac needs at least one MAC address")
+	}
+	return cr, nil
+}
+
+// parseClientIDRule parses the arguments of `client_id ID... [schedule HH:MM-HH:MM...]`.
+func parseClientIDRule(args []string) (clientRule, error) {
+	var cr clientRule
+	args, windows, err := parseSchedule(args)
+	if err != nil {
+		return cr, err
+	}
+	cr.windows = windows
+	cr.ids = args
+	if len(cr.ids) == 0 {
+		return cr, errors.New("client_id needs at least one identifier")
+	}
+	return cr, nil
+}
+
+// parseClientGeoIPRule parses the arguments of `client_geoip CC... [schedule HH:MM-HH:MM...]`, with country codes as
+// in geoip.dat or the mmdbfile, e.g. `CN` or `private`.
+func parseClientGeoIPRule(args []string) (clientRule, error) {
+	var cr clientRule
+	args, windows, err := parseSchedule(args)
+	if err != nil {
+		return cr, err
+	}
+	cr.windows = windows
+	for _, arg := range args {
+		cr.geo = append(cr.geo, strings.ToUpper(strings.TrimPrefix(arg, "geoip:")))
+	}
+	if len(cr.geo) == 0 || slices.Contains(cr.geo, "") {
+		return cr, errors.New("client_geoip needs at least one country code")
+	}
+	return cr, nil
+}
+
+// parseSchedule splits args at `schedule`, returning the arguments before it and the windows after it.
+func parseSchedule(args []string) ([]string, []timeWindow, error) {
+	i := slices.Index(args, "schedule")
+	if i < 0 {
+		return args, nil, nil
+	}
+	if i+1 == len(args) {
+		return nil, nil, errors.New("schedule needs at least one HH:MM-HH:MM window")
+	}
+	var windows []timeWindow
+	for _, w := range args[i+1:] {
+		tw, err := parseTimeWindow(w)
+		if err != nil {
+			return nil, nil, err
+		}
+		windows = append(windows, tw)
+	}
+	return args[:i], windows, nil
+}
+
+// parseClientPrefix parses an address, as a prefix of its full length, or a CIDR.
+func parseClientPrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid client CIDR '%s'", s)
+		}
+		return p.Masked(), nil
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid client address '%s'", s)
+	}
+	return netip.PrefixFrom(a, a.BitLen()), nil
+}
+
+// parseTimeWindow parses HH:MM-HH:MM.
+func parseTimeWindow(s string) (timeWindow, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return timeWindow{}, fmt.Errorf("invalid schedule window '%s', want HH:MM-HH:MM", s)
+	}
+	var tw timeWindow
+	for _, p := range []struct {
+		s string
+		m *int
+	}{{from, &tw.from}, {to, &tw.to}} {
+		t, err := time.Parse("15:04", p.s)
+		if err != nil {
+			return timeWindow{}, fmt.Errorf("invalid schedule window '%s', want HH:MM-HH:MM", s)
+		}
+		*p.m = t.Hour()*60 + t.Minute()
+	}
+	if tw.from == tw.to {
+		return timeWindow{}, fmt.Errorf("schedule window '%s' is empty", s)
+	}
+	return tw, nil
+}
+
+// contains reports whether the time of day of t is in w, start included and end excluded.
+func (w timeWindow) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.from < w.to {
+		return m >= w.from && m < w.to
+	}
+	return m >= w.from || m < w.to
+}
+
+// matches reports whether client is one of the rule's, by address, country, MAC address or identifier, or has one of
+// its tags in tags, and, if the rule has a schedule, t is in one of its windows.
+func (cr clientRule) matches(client queryClient, t time.Time, tags *clientTags) bool {
+	addr := client.addr.Unmap()
+	if !slices.ContainsFunc(cr.nets, func(p netip.Prefix) bool { return p.Contains(addr) }) &&
+		(cr.geoIPs == nil || !addr.IsValid() || !cr.geoIPs.Contains(addr)) &&
+		(len(cr.tags) == 0 || tags == nil || !tags.has(addr, cr.tags)) &&
+		(client.mac == "" || !slices.Contains(cr.macs, client.mac)) &&
+		(client.id == "" || !slices.Contains(cr.ids, client.id)) {
+		return false
+	}
+	if len(cr.windows) == 0 {
+		return true
+	}
+	for _, w := range cr.windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// appliesTo reports whether the group takes queries from client at time t: the query has its `dnssec_flags`, and it
+// has no `clients` or one of them matches. The zero client, as for lookups outside of a query, only gets groups
+// without `clients`, as a query without DNSSEC bits.
+func (g *Group) appliesTo(client queryClient, t time.Time) bool {
+	if !g.DNSSECFlags.holds(client) {
+		return false
+	}
+	if len(g.Clients) == 0 {
+		return true
+	}
+	for _, cr := range g.Clients {
+		if cr.matches(client, t, g.clientTags) {
+			return true
+		}
+	}
+	return false
+}
+
+// perQuery reports whether the group takes a query depends on more than its name: on `clients` or
+// `dnssec_flags`.
+func (g *Group) perQuery() bool {
+	return len(g.Clients) > 0 || g.DNSSECFlags.mask != 0
+}
+
+// clientAddr returns the source address of a query, unmapped from IPv4-mapped IPv6, taken from the UDP or TCP
+// address of its writer without formatting and parsing it again, as request.Request.IP would.
+func clientAddr(state request.Request) netip.Addr {
+	var addr netip.Addr
+	switch ra := state.W.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		addr, _ = netip.AddrFromSlice(ra.IP)
+	case *net.TCPAddr:
+		addr, _ = netip.AddrFromSlice(ra.IP)
+	default:
+		addr, _ = netip.ParseAddr(state.IP())
+	}
+	return addr.Unmap()
+}
+
+// clientOf returns where a query came from: its source address, or the zero address if it is not known, and the MAC
+// address and identifier in its EDNS0 options, if any. Options a router did not send may have come from the device
+// itself, so `client_mac` and `client_id` are only as trustworthy as the network between it and the router.
+func clientOf(state request.Request) queryClient {
+	client := queryClient{addr: clientAddr(state), cd: state.Req.CheckingDisabled}
+	opt := state.Req.IsEdns0()
+	if opt == nil {
+		return client
+	}
+	client.do = opt.Do()
+	for _, o := range opt.Option {
+		local, ok := o.(*dns.EDNS0_LOCAL)
+		if !ok {
+			continue
+		}
+		switch local.Code {
+		case ednsMACOption:
+			if len(local.Data) == 6 {
+				client.mac = net.HardwareAddr(local.Data).String()
+			}
+		case ednsDeviceIDOption:
+			client.mac = parseDeviceID(string(local.Data))
+		case ednsCPEIDOption:
+			client.id = string(local.Data)
+		}
+	}
+	return client
+}
+
+// parseDeviceID returns the MAC address of a device ID option, sent by dnsmasq as text with --add-mac=text or in
+// base64 with --add-mac=base64, or "" if it is neither.
+func parseDeviceID(s string) string {
+	if mac, err := net.ParseMAC(s); err == nil {
+		return mac.String()
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil && len(b) == 6 {
+		return net.HardwareAddr(b).String()
+	}
+	return ""
+}
@@ -0,0 +1,229 @@
+package ruledforward
+
+import (
+	"encoding/base64"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestParseClientRule(t *testing.T) {
+	cr, err := parseClientRule([]string{"192.168.1.50", "10.0.0.0/8", "fd00::/8", "schedule", "21:00-07:00", "12:00-13:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cr.nets) != 3 || len(cr.windows) != 2 || cr.windows[0] != (timeWindow{from: 21 * 60, to: 7 * 60}) {
+		t.Errorf("clientRule = %+v", cr)
+	}
+	for _, args := range [][]string{
+		{},
+		{"schedule", "21:00-07:00"},
+		{"192.168.1.50", "schedule"},
+		{"192.168.1.500"},
+		{"192.168.1.0/33"},
+		{"192.168.1.50", "schedule", "21:00"},
+		{"192.168.1.50", "schedule", "25:00-07:00"},
+		{"192.168.1.50", "schedule", "07:00-07:00"},
+	} {
+		if _, err := parseClientRule(args); err == nil {
+			t.Errorf("parseClientRule(%q) should fail", args)
+		}
+	}
+}
+
+func TestClientRuleMatches(t *testing.T) {
+	cr, err := parseClientRule([]string{"192.168.1.50", "10.1.0.0/16", "schedule", "21:00-07:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(hhmm string) time.Time {
+		tm, _ := time.Parse("15:04", hhmm)
+		return tm
+	}
+	tests := []struct {
+		client string
+		at     string
+		want   bool
+	}{
+		{"192.168.1.50", "22:30", true},
+		{"192.168.1.50", "03:00", true},
+		{"::ffff:192.168.1.50", "21:00", true},
+		{"10.1.2.3", "06:59", true},
+		{"192.168.1.50", "07:00", false},
+		{"192.168.1.50", "12:00", false},
+		{"192.168.1.51", "22:30", false},
+	}
+	for _, tc := range tests {
+		if got := cr.matches(queryClient{addr: netip.MustParseAddr(tc.client)}, at(tc.at), nil); got != tc.want {
+			t.Errorf("matches(%s at %s) = %v, want %v", tc.client, tc.at, got, tc.want)
+		}
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		w    dns.ResponseWriter
+		want string
+	}{
+		{"udp", &test.ResponseWriter{}, "10.240.0.1"},
+		{"tcp", &test.ResponseWriter{TCP: true}, "10.240.0.1"},
+		{"ipv6", &test.ResponseWriter6{}, "fe80::42:ff:feca:4c65"},
+		{"mapped", &addrWriter{ResponseWriter: &test.ResponseWriter{}, addr: &net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.7"), Port: 40212}}, "192.0.2.7"},
+		{"other", &addrWriter{ResponseWriter: &test.ResponseWriter{}, addr: &net.IPAddr{IP: net.ParseIP("192.0.2.8")}}, "192.0.2.8"},
+	}
+	for _, tc := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("games.example.", dns.TypeA)
+		if got := clientAddr(request.Request{W: tc.w, Req: req}); got != netip.MustParseAddr(tc.want) {
+			t.Errorf("%s: clientAddr = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+// addrWriter is a test.ResponseWriter with another remote address.
+type addrWriter struct {
+	dns.ResponseWriter
+	addr net.Addr
+}
+
+func (w *addrWriter) RemoteAddr() net.Addr { return w.addr }
+
+func TestClientOf(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	tests := []struct {
+		name    string
+		options []dns.EDNS0
+		want    queryClient
+	}{
+		{"none", nil, queryClient{}},
+		{"binary MAC", []dns.EDNS0{&dns.EDNS0_LOCAL{Code: ednsMACOption, Data: mac}}, queryClient{mac: "00:11:22:33:44:55"}},
+		{"text MAC", []dns.EDNS0{&dns.EDNS0_LOCAL{Code: ednsDeviceIDOption, Data: []byte("00:11:22:33:44:55")}}, queryClient{mac: "00:11:22:33:44:55"}},
+		{"base64 MAC", []dns.EDNS0{&dns.EDNS0_LOCAL{Code: ednsDeviceIDOption, Data: []byte(base64.StdEncoding.EncodeToString(mac))}}, queryClient{mac: "00:11:22:33:44:55"}},
+		{"short MAC", []dns.EDNS0{&dns.EDNS0_LOCAL{Code: ednsMACOption, Data: mac[:4]}}, queryClient{}},
+		{"CPE ID", []dns.EDNS0{&dns.EDNS0_LOCAL{Code: ednsCPEIDOption, Data: []byte("kids-tablet")}}, queryClient{id: "kids-tablet"}},
+	}
+	for _, tc := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("games.example.", dns.TypeA)
+		if tc.options != nil {
+			req.SetEdns0(1232, false)
+			opt := req.IsEdns0()
+			opt.Option = tc.options
+		}
+		got := clientOf(request.Request{W: &test.ResponseWriter{}, Req: req})
+		tc.want.addr = netip.MustParseAddr("10.240.0.1")
+		if got != tc.want {
+			t.Errorf("%s: clientOf = %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+
+	cr, err := parseClientMACRule([]string{"00-11-22-33-44-55", "schedule", "00:00-23:59"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	noon := time.Date(2026, 1, 1, 12, 0, 0, 0, time.Local)
+	if !cr.matches(queryClient{mac: "00:11:22:33:44:55"}, noon, nil) || cr.matches(queryClient{mac: "00:11:22:33:44:66"}, noon, nil) {
+		t.Error("client_mac should match the MAC address only")
+	}
+	cr, err = parseClientIDRule([]string{"kids-tablet"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cr.matches(queryClient{id: "kids-tablet"}, noon, nil) || cr.matches(queryClient{}, noon, nil) {
+		t.Error("client_id should match the identifier only")
+	}
+}
+
+func TestRouteByClient(t *testing.T) {
+	newGroup := func(name string, clients ...clientRule) *Group {
+		g := &Group{Name: name, Action: "empty", Clients: clients}
+		m := NewMatcher()
+		m.AddRule(Rule{Type: RuleDomain, Value: "games.example."})
+		m.Build()
+		g.SetMatcher(m)
+		return g
+	}
+	// Windows around and away from the current time of day.
+	m := time.Now().Hour()*60 + time.Now().Minute()
+	now := timeWindow{from: (m + 1380) % 1440, to: (m + 60) % 1440}
+	later := timeWindow{from: (m + 120) % 1440, to: (m + 180) % 1440}
+	kids := netip.MustParsePrefix("192.168.1.50/32")
+
+	bedtime := newGroup("bedtime", clientRule{nets: []netip.Prefix{kids}, windows: []timeWindow{now}})
+	homework := newGroup("homework", clientRule{nets: []netip.Prefix{kids}, windows: []timeWindow{later}})
+	def := &Group{Name: "default", Action: "forward"}
+	r := &Ruledforward{groups: []*Group{homework, bedtime, def}, defaultGroup: def, decisions: newLRU[string, decision](10)}
+
+	if g := r.routeFor("games.example.", queryClient{addr: netip.MustParseAddr("192.168.1.50")}, nil); g != bedtime {
+		t.Errorf("routeFor = %v, want bedtime", g)
+	}
+	if g := r.routeFor("games.example.", queryClient{addr: netip.MustParseAddr("192.168.1.60")}, nil); g != def {
+		t.Errorf("routeFor for another client = %v, want default", g)
+	}
+	if g := r.groupFor("games.example.", nil); g != def {
+		t.Errorf("groupFor without a client = %v, want default", g)
+	}
+	if g := r.routeFor("news.example.", queryClient{addr: netip.MustParseAddr("192.168.1.50")}, nil); g != def {
+		t.Errorf("routeFor = %v, want default", g)
+	}
+	if r.decisions.len() != 1 {
+		t.Errorf("%d cached decisions, want only the one that did not depend on the client", r.decisions.len())
+	}
+}
+
+func TestDNSSECFlags(t *testing.T) {
+	for _, args := range [][]string{{}, {"ad"}, {"do", "!do"}} {
+		if _, err := parseDNSSECFlags(args); err == nil {
+			t.Errorf("parseDNSSECFlags(%q) should fail", args)
+		}
+	}
+	newGroup := func(name string, args ...string) *Group {
+		f, err := parseDNSSECFlags(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := &Group{Name: name, Action: "forward", DNSSECFlags: f}
+		m := NewMatcher()
+		m.AddRule(Rule{Type: RuleDomain, Value: "example.org."})
+		m.Build()
+		g.SetMatcher(m)
+		return g
+	}
+	validating := newGroup("validating", "DO", "!cd")
+	fast := newGroup("fast", "!do")
+	r := &Ruledforward{groups: []*Group{validating, fast}, decisions: newLRU[string, decision](10)}
+
+	tests := []struct {
+		do, cd bool
+		want   *Group
+	}{
+		{true, false, validating},
+		{false, false, fast},
+		{false, true, fast},
+		{true, true, nil},
+	}
+	for _, tc := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.org.", dns.TypeA)
+		req.CheckingDisabled = tc.cd
+		if tc.do {
+			req.SetEdns0(1232, true)
+		}
+		client := clientOf(request.Request{W: &test.ResponseWriter{}, Req: req})
+		if client.do != tc.do || client.cd != tc.cd {
+			t.Errorf("clientOf = %+v, want do %v and cd %v", client, tc.do, tc.cd)
+		}
+		if g := r.routeFor("www.example.org.", client, nil); g != tc.want {
+			t.Errorf("routeFor with do %v and cd %v = %v, want %v", tc.do, tc.cd, g, tc.want)
+		}
+	}
+	if r.decisions.len() != 0 {
+		t.Errorf("%d cached decisions, want none as they depend on the DNSSEC bits", r.decisions.len())
+	}
+}
@@ -0,0 +1,195 @@
+package ruledforward
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// clientTags maps clients to tags, from a `clients_file`, for groups with `client_tag`. The file is re-read when it
+// changes, and its host names are resolved again every upstreamResolveInterval, or at each check while one fails.
+type clientTags struct {
+	path  string
+	table atomic.Pointer[tagTable]
+	stop  chan struct{}
+
+	// only used by watch
+	stamp      fileStamp
+	resolvedAt time.Time
+	failed     bool // a host name failed to resolve at the last load
+}
+
+// tagTable is a loaded clients_file.
+type tagTable struct {
+	addrs map[netip.Addr][]string
+	nets  []clientEntry // CIDRs
+	hosts bool          // the file names at least one host
+}
+
+// clientEntry is a line of a clients_file: a client and its tags.
+type clientEntry struct {
+	prefix netip.Prefix // invalid for a host name
+	host   string
+	tags   []string
+}
+
+// newClientTags loads the clients_file at path, without resolving its host names yet: that is left to watch, as
+// the system resolver may well be the server being set up.
+func newClientTags(path string) (*clientTags, error) {
+	t := &clientTags{path: path}
+	if err := t.load(false); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// parseClientsFile parses lines of `CLIENT TAG...`, CLIENT being an address, a CIDR or a host name; # starts a
+// comment.
+func parseClientsFile(data []byte) ([]clientEntry, error) {
+	var entries []clientEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("line %d: client '%s' has no tags", n, fields[0])
+		}
+		e := clientEntry{tags: make([]string, 0, len(fields)-1)}
+		for _, tag := range fields[1:] {
+			e.tags = append(e.tags, strings.ToLower(tag))
+		}
+		p, err := parseClientPrefix(fields[0])
+		switch {
+		case err == nil:
+			e.prefix = p
+		case strings.ContainsAny(fields[0], "/:") || strings.Trim(fields[0], "0123456789.") == "":
+			return nil, fmt.Errorf("line %d: %v", n, err) // a malformed address rather than a host name
+		default:
+			e.host = strings.TrimSuffix(fields[0], ".")
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// load reads the file and, if resolve is set, resolves its host names, then installs the result. Host names that do
+// not resolve are logged and left out until the next load.
+func (t *clientTags) load(resolve bool) error {
+	t.stamp = statUpstreamFiles([]string{t.path})[t.path]
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		return err
+	}
+	entries, err := parseClientsFile(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", t.path, err)
+	}
+
+	tt := &tagTable{addrs: make(map[netip.Addr][]string)}
+	t.failed = false
+	for _, e := range entries {
+		switch {
+		case e.host != "":
+			tt.hosts = true
+			if !resolve {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), upstreamResolveTimeout)
+			addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", e.host)
+			cancel()
+			if err != nil {
+				log.Warningf("clients_file %s: resolving %s: %v", t.path, e.host, err)
+				t.failed = true
+				continue
+			}
+			for _, a := range addrs {
+				a = a.Unmap()
+				tt.addrs[a] = append(tt.addrs[a], e.tags...)
+			}
+		case e.prefix.IsSingleIP():
+			a := e.prefix.Addr()
+			tt.addrs[a] = append(tt.addrs[a], e.tags...)
+		default:
+			tt.nets = append(tt.nets, e)
+		}
+	}
+	t.table.Store(tt)
+	return nil
+}
+
+// watch resolves the file's host names, then checks the file every interval and loads it again when it changed or
+// its host names are due to be resolved again, until stop is closed. A file that fails to load keeps the tags of the
+// last load.
+func (t *clientTags) watch(interval time.Duration, stop <-chan struct{}) {
+	reload := func(now time.Time) {
+		if err := t.load(true); err != nil {
+			log.Errorf("reloading clients_file %s: %v", t.path, err)
+			return
+		}
+		t.resolvedAt = now
+	}
+	if t.table.Load().hosts {
+		reload(time.Now())
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			stamp := statUpstreamFiles([]string{t.path})[t.path]
+			changed := !stamp.modTime.Equal(t.stamp.modTime) || stamp.size != t.stamp.size
+			due := t.table.Load().hosts && (t.failed || now.Sub(t.resolvedAt) >= upstreamResolveInterval)
+			if changed || due {
+				reload(now)
+			}
+		}
+	}
+}
+
+// has reports whether client has any of tags.
+func (t *clientTags) has(client netip.Addr, tags []string) bool {
+	tt := t.table.Load()
+	for _, tag := range tt.addrs[client] {
+		if slices.Contains(tags, tag) {
+			return true
+		}
+	}
+	for _, e := range tt.nets {
+		if !e.prefix.Contains(client) {
+			continue
+		}
+		for _, tag := range e.tags {
+			if slices.Contains(tags, tag) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolveClientTags gives the groups with `client_tag` the instance's client tags.
+func resolveClientTags(groups []*Group, t *clientTags) error {
+	for _, g := range groups {
+		if !slices.ContainsFunc(g.Clients, func(cr clientRule) bool { return len(cr.tags) > 0 }) {
+			continue
+		}
+		if t == nil {
+			return fmt.Errorf("group %s: client_tag requires clients_file", g.Name)
+		}
+		g.clientTags = t
+	}
+	return nil
+}
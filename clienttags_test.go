@@ -0,0 +1,106 @@
+package ruledforward
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+func TestParseClientsFile(t *testing.T) {
+	entries, err := parseClientsFile([]byte("# devices\n192.168.1.50 Kids\n192.168.1.0/24 home iot # the LAN\n\nkids-ipad.lan. kids\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].tags[0] != "kids" || len(entries[1].tags) != 2 || entries[2].host != "kids-ipad.lan" {
+		t.Errorf("entries = %+v", entries)
+	}
+	for _, body := range []string{"192.168.1.50\n", "192.168.1.500 kids\n", "192.168.1.0/33 kids\n", "fe80::zz kids\n"} {
+		if _, err := parseClientsFile([]byte(body)); err == nil {
+			t.Errorf("parseClientsFile(%q) should fail", body)
+		}
+	}
+}
+
+func TestClientTags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clients")
+	if err := os.WriteFile(path, []byte("192.168.1.50 kids\n10.0.0.0/8 iot\nlocalhost admin\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tags, err := newClientTags(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		client string
+		tags   []string
+		want   bool
+	}{
+		{"192.168.1.50", []string{"kids"}, true},
+		{"192.168.1.50", []string{"iot", "kids"}, true},
+		{"10.1.2.3", []string{"iot"}, true},
+		{"192.168.1.51", []string{"kids", "iot"}, false},
+		{"127.0.0.1", []string{"admin"}, false}, // host names are resolved by watch
+	}
+	for _, tc := range tests {
+		if got := tags.has(netip.MustParseAddr(tc.client), tc.tags); got != tc.want {
+			t.Errorf("has(%s, %v) = %v, want %v", tc.client, tc.tags, got, tc.want)
+		}
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go tags.watch(10*time.Millisecond, stop)
+	if err := os.WriteFile(path, []byte("192.168.1.51 kids\nlocalhost admin\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !tags.has(netip.MustParseAddr("192.168.1.51"), []string{"kids"}) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !tags.has(netip.MustParseAddr("192.168.1.51"), []string{"kids"}) || tags.has(netip.MustParseAddr("192.168.1.50"), []string{"kids"}) {
+		t.Error("a changed clients_file should be loaded again")
+	}
+	if !tags.has(netip.MustParseAddr("127.0.0.1"), []string{"admin"}) {
+		t.Error("host names should be resolved")
+	}
+}
+
+func TestSetupClientTag(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "clients"), []byte("192.168.1.50 kids\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	input := `ruledforward . {
+    clients_file ` + filepath.Join(dir, "clients") + `
+    group bedtime {
+        action empty
+        client_tag kids schedule 00:00-23:59
+        games.example
+    }
+}`
+	r, err := parseRuledforward(caddy.NewTestController("dns", input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := r.groups[0]
+	if g.clientTags != r.clientTags || !g.appliesTo(queryClient{addr: netip.MustParseAddr("192.168.1.50")}, time.Date(2026, 1, 1, 12, 0, 0, 0, time.Local)) {
+		t.Error("the group should apply to clients tagged kids")
+	}
+	if g.appliesTo(queryClient{addr: netip.MustParseAddr("192.168.1.51")}, time.Date(2026, 1, 1, 12, 0, 0, 0, time.Local)) {
+		t.Error("the group should not apply to other clients")
+	}
+
+	for _, input := range []string{
+		"ruledforward . {\n    group bedtime {\n        action empty\n        client_tag kids\n    }\n}",
+		"ruledforward . {\n    clients_file " + filepath.Join(dir, "missing") + "\n}",
+		"ruledforward . {\n    clients_file " + filepath.Join(dir, "clients") + "\n    group bedtime {\n        client_tag schedule 21:00-07:00\n    }\n}",
+	} {
+		if _, err := parseRuledforward(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("parsing %q should fail", input)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+// Command ruledforwardctl works with ruledforward rules outside of CoreDNS: it compiles rule sources into a single
+// list a group loads quickly, tests names against the rules of a Corefile and diffs rule snapshots.
+//
+//	ruledforwardctl compile [-o FILE] [-format FORMAT] [-dlc FILE -geosite NAME...] [SOURCE...]
+//	ruledforwardctl test [-conf Corefile] [-server KEY] [-local] NAME...
+//	ruledforwardctl diff OLD NEW
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	ruledforward "github.com/hr3lxphr6j/coredns-ruledforward"
+)
+
+const usage = `usage:
+  ruledforwardctl compile [-o FILE] [-format FORMAT] [-dlc FILE -geosite NAME...] [SOURCE...]
+  ruledforwardctl test [-conf Corefile] [-server KEY] [-local] NAME...
+  ruledforwardctl diff OLD NEW
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	status := 0
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "compile":
+		err = compile(args)
+	case "test":
+		err = test(args, os.Stdout)
+	case "diff":
+		var differ bool
+		if differ, err = diff(args, os.Stdout); differ {
+			status = 1
+		}
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ruledforwardctl:", err)
+		os.Exit(2)
+	}
+	os.Exit(status)
+}
+
+// stringList is a flag that can be given more than once.
+type stringList []string
+
+func (s *stringList) String() string     { return strings.Join(*s, ",") }
+func (s *stringList) Set(v string) error { *s = append(*s, v); return nil }
+
+// compile loads adguard_rules lists and hosts files (local or http(s) URLs) and geosite lists, and writes their rules
+// as one list without duplicates or rules covered by broader domain rules. Written as adguard (the default), it can
+// replace the sources in a group with a single `adguard_rules FILE`. A FILE ending in .gz is gzip-compressed.
+func compile(args []string) error {
+	fs := flag.NewFlagSet("compile", flag.ExitOnError)
+	out := fs.String("o", "", "output `file` (default: standard output)")
+	format := fs.String("format", "adguard", "output format: adguard, text, hosts or json")
+	dlcfile := fs.String("dlc", "", "dlc.dat `file` for -geosite")
+	timeout := fs.Duration("timeout", 30*time.Second, "timeout for downloading a SOURCE URL")
+	bootstrap := fs.String("bootstrap_dns", "", "DNS server `address` to resolve SOURCE URLs with")
+	var geosites stringList
+	fs.Var(&geosites, "geosite", "geosite list `name`, e.g. google@ads; may be repeated")
+	fs.Parse(args)
+
+	var rules []ruledforward.Rule
+	if len(geosites) > 0 {
+		if *dlcfile == "" {
+			return fmt.Errorf("-geosite needs -dlc")
+		}
+		dlc, err := ruledforward.LoadDLC(*dlcfile)
+		if err != nil {
+			return fmt.Errorf("loading %s: %w", *dlcfile, err)
+		}
+		for _, name := range geosites {
+			list, ok := dlc[strings.ToUpper(name)]
+			if !ok {
+				return fmt.Errorf("geosite %s not found in %s", name, *dlcfile)
+			}
+			rules = append(rules, list...)
+		}
+	}
+	for _, src := range fs.Args() {
+		var list []ruledforward.Rule
+		var err error
+		if ruledforward.IsURL(src) {
+			list, err = ruledforward.LoadAdguardFromURL(src, *timeout, *bootstrap)
+		} else {
+			list, err = ruledforward.LoadAdguardFromFile(src)
+		}
+		if err != nil {
+			return fmt.Errorf("loading %s: %w", src, err)
+		}
+		rules = append(rules, list...)
+	}
+	compiled := ruledforward.CompileRules(rules)
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+		if strings.HasSuffix(*out, ".gz") {
+			zw := gzip.NewWriter(f)
+			defer zw.Close()
+			w = zw
+		}
+	}
+	if err := ruledforward.WriteRules(w, *format, compiled); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "compiled %d rules into %d\n", len(rules), len(compiled))
+	return nil
+}
+
+// test reports, for each server block of a Corefile with ruledforward, the group each NAME is routed to and the rule
+// and source that decided it.
+func test(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	conf := fs.String("conf", "Corefile", "Corefile `path`")
+	server := fs.String("server", "", "only test the server block with this `key`, e.g. .:53")
+	local := fs.Bool("local", false, "skip remote adguard_rules, redis_rules and kubernetes_rules sources")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("test: no names given")
+	}
+
+	items := ruledforward.UpdateMatcherAll
+	if *local {
+		items = ruledforward.UpdateMatcherLocal
+	}
+	instances, err := ruledforward.LoadCorefile(*conf, items)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(instances))
+	for k := range instances {
+		if *server == "" || k == *server {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no server block %s with ruledforward in %s", *server, *conf)
+	}
+	slices.Sort(keys)
+
+	tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSERVER\tGROUP\tRULE\tSOURCE")
+	for _, name := range fs.Args() {
+		for _, k := range keys {
+			r := instances[k]
+			group, action, ok := r.GroupFor(name)
+			if !ok {
+				fmt.Fprintf(tw, "%s\t%s\t-\t-\t-\n", name, k)
+				continue
+			}
+			ruleText, sourceText := "-", "-"
+			if rule, source, ok := r.RuleFor(name); ok {
+				ruleText = rule.String()
+				if source != "" {
+					sourceText = source
+				}
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s (%s)\t%s\t%s\n", name, k, group, action, ruleText, sourceText)
+		}
+	}
+	return tw.Flush()
+}
+
+// diff prints the rules only in OLD prefixed with - and those only in NEW prefixed with +, sorted, and reports
+// whether there were any. Snapshots can be in any format ruledforward exports.
+func diff(args []string, stdout io.Writer) (bool, error) {
+	if len(args) != 2 {
+		return false, fmt.Errorf("diff: need OLD and NEW")
+	}
+	old, err := ruledforward.ReadRules(args[0])
+	if err != nil {
+		return false, err
+	}
+	cur, err := ruledforward.ReadRules(args[1])
+	if err != nil {
+		return false, err
+	}
+	inOld := make(map[ruledforward.Rule]bool, len(old))
+	for _, r := range old {
+		inOld[r] = true
+	}
+	inCur := make(map[ruledforward.Rule]bool, len(cur))
+	for _, r := range cur {
+		inCur[r] = true
+	}
+	var lines []string
+	for r := range inOld {
+		if !inCur[r] {
+			lines = append(lines, "-"+r.String())
+		}
+	}
+	for r := range inCur {
+		if !inOld[r] {
+			lines = append(lines, "+"+r.String())
+		}
+	}
+	slices.SortFunc(lines, func(a, b string) int { return strings.Compare(a[1:], b[1:]) })
+	for _, l := range lines {
+		if _, err := fmt.Fprintln(stdout, l); err != nil {
+			return false, err
+		}
+	}
+	return len(lines) > 0, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "old.txt")
+	cur := filepath.Join(dir, "new.json")
+	os.WriteFile(old, []byte("domain:ads.example\nfull:tracker.example\n"), 0o644)
+	os.WriteFile(cur, []byte(`[{"type":"domain","value":"ads.example."},{"type":"keyword","value":"banner"}]`), 0o644)
+
+	var b bytes.Buffer
+	differ, err := diff([]string{old, cur}, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "-full:tracker.example\n+keyword:banner\n"; !differ || b.String() != want {
+		t.Errorf("diff = %v, %q; want true, %q", differ, b.String(), want)
+	}
+
+	b.Reset()
+	if differ, err := diff([]string{old, old}, &b); err != nil || differ || b.Len() != 0 {
+		t.Errorf("diff of a file with itself = %v, %v, %q", differ, err, b.String())
+	}
+}
@@ -0,0 +1,48 @@
+package ruledforward
+
+import (
+	"context"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// exchangeConcurrent sends fwd to pr and to up to g.Concurrent-1 other healthy upstreams at once. It returns the first
+// reply that matches the query and that the group trusts (see untrusted), cancelling the others. If no reply passes,
+// it returns the first one that arrived, so the usual checks reject it or hand it to the fallback group, or the last
+// error if all exchanges failed.
+func (g *Group) exchangeConcurrent(ctx context.Context, pr *proxy.Proxy, others []*proxy.Proxy, fwd request.Request) (*proxy.Proxy, *dns.Msg, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	targets := append([]*proxy.Proxy{pr}, others...)
+	results := make(chan exchangeResult, len(targets))
+	for _, p := range targets {
+		// Each exchange gets its own copy of the query, see exchangeHedged.
+		go func() {
+			ret, err := g.exchange(ctx, p, request.Request{W: fwd.W, Req: fwd.Req.Copy()})
+			results <- exchangeResult{pr: p, ret: ret, err: err}
+		}()
+	}
+
+	var first, last exchangeResult
+	for range targets {
+		res := <-results
+		if res.err != nil {
+			last = res
+			continue
+		}
+		if fwd.Match(res.ret) && g.untrusted(res.ret) == "" {
+			return res.pr, res.ret, nil
+		}
+		concurrentRejectedTotal.WithLabelValues(g.Name).Inc()
+		if first.ret == nil {
+			first = res
+		}
+	}
+	if first.ret != nil {
+		return first.pr, first.ret, nil
+	}
+	return last.pr, last.ret, last.err
+}
@@ -0,0 +1,72 @@
+package ruledforward
+
+import (
+	"context"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestForwardGroupConcurrent(t *testing.T) {
+	var slowN, fastN, trustedN atomic.Int32
+	slow := newDelayedUpstream(t, "192.0.2.1", 200*time.Millisecond, &slowN)
+	fast := newDelayedUpstream(t, "198.51.100.1", 0, &fastN)
+	trustedUp := newDelayedUpstream(t, "192.0.2.9", 0, &trustedN)
+
+	trusted := &Group{Name: "trusted", Action: "forward", Policy: &sequential{}}
+	trusted.SetProxies([]*proxy.Proxy{trustedUp})
+	trusted.SetMatcher(NewMatcher())
+	g := &Group{Name: "default", Action: "forward", Policy: &sequential{}, Concurrent: 2}
+	g.SetProxies([]*proxy.Proxy{slow, fast})
+	g.SetMatcher(NewMatcher())
+	r := &Ruledforward{from: ".", groups: []*Group{g, trusted}, defaultGroup: g}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.org.", dns.TypeA)
+	query := func() *dns.Msg {
+		t.Helper()
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := r.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Msg
+	}
+
+	// The fastest reply wins.
+	start := time.Now()
+	ret := query()
+	if d := time.Since(start); d > 150*time.Millisecond {
+		t.Errorf("concurrent query took %v", d)
+	}
+	if len(ret.Answer) != 1 || ret.Answer[0].(*dns.A).A.String() != "198.51.100.1" {
+		t.Errorf("answer = %v, want the fast upstream's", ret.Answer)
+	}
+	if slowN.Load() != 1 || fastN.Load() != 1 {
+		t.Errorf("upstream queries = %d, %d; want one each", slowN.Load(), fastN.Load())
+	}
+
+	// A faster reply that fails validation is passed over for a slower valid one, without using the fallback.
+	g.ExpectedIPs = newIPSet([]netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")})
+	g.Fallback = trusted
+	ret = query()
+	if len(ret.Answer) != 1 || ret.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("answer = %v, want the slow upstream's expected 192.0.2.1", ret.Answer)
+	}
+	if trustedN.Load() != 0 {
+		t.Errorf("fallback group queried %d times, want 0", trustedN.Load())
+	}
+
+	// If no reply is valid, the fallback group answers.
+	g.ExpectedIPs = newIPSet([]netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")})
+	ret = query()
+	if len(ret.Answer) != 1 || ret.Answer[0].(*dns.A).A.String() != "192.0.2.9" {
+		t.Errorf("answer = %v, want the fallback group's 192.0.2.9", ret.Answer)
+	}
+}
@@ -0,0 +1,99 @@
+package ruledforward
+
+import (
+	"slices"
+	"strings"
+)
+
+// ruleConflict is a rule that groups with different actions share. Groups are matched in order, so the first one
+// decides and the rule never applies in the others.
+type ruleConflict struct {
+	Rule    string   `json:"rule"`
+	Groups  []string `json:"groups"`  // in evaluation order; the first one wins
+	Actions []string `json:"actions"` // of Groups
+}
+
+// findConflicts returns the rules that groups with different actions share, sorted by rule. Shadow groups and the
+// default group are left out, as they never compete for a rule.
+func (r *Ruledforward) findConflicts() []ruleConflict {
+	var groups []*Group
+	all, _ := r.routes()
+	for _, g := range all {
+		if !g.Shadow && g.Name != "default" && len(g.Split) == 0 {
+			groups = append(groups, g)
+		}
+	}
+	if len(groups) < 2 {
+		return nil
+	}
+	first := make(map[Rule]*Group)
+	shared := make(map[Rule][]*Group)
+	for _, g := range groups {
+		for _, rule := range g.EffectiveRules() {
+			f, ok := first[rule]
+			if !ok {
+				first[rule] = g
+				continue
+			}
+			if len(shared[rule]) == 0 {
+				shared[rule] = []*Group{f}
+			}
+			shared[rule] = append(shared[rule], g)
+		}
+	}
+	var out []ruleConflict
+	for rule, gs := range shared {
+		if !slices.ContainsFunc(gs, func(g *Group) bool { return g.Action != gs[0].Action }) {
+			continue
+		}
+		c := ruleConflict{Rule: rule.String()}
+		for _, g := range gs {
+			c.Groups = append(c.Groups, g.Name)
+			c.Actions = append(c.Actions, g.Action)
+		}
+		out = append(out, c)
+	}
+	slices.SortFunc(out, func(a, b ruleConflict) int { return strings.Compare(a.Rule, b.Rule) })
+	return out
+}
+
+// checkConflicts looks for conflicting rules after the rules of a group changed. It keeps the result for the admin
+// API, updates rule_conflicts and logs a warning for each group whose number of overridden rules changed.
+func (r *Ruledforward) checkConflicts() {
+	r.conflictsMu.Lock()
+	defer r.conflictsMu.Unlock()
+	conflicts := r.findConflicts()
+	r.conflicts = conflicts
+
+	overridden := make(map[string][]ruleConflict) // group -> conflicts it loses
+	for _, c := range conflicts {
+		for i, name := range c.Groups[1:] {
+			if c.Actions[i+1] != c.Actions[0] {
+				overridden[name] = append(overridden[name], c)
+			}
+		}
+	}
+	groups, _ := r.routes()
+	for _, g := range groups {
+		cs := overridden[g.Name]
+		ruleConflicts.WithLabelValues(g.Name).Set(float64(len(cs)))
+		if len(cs) == r.overridden[g.Name] {
+			continue
+		}
+		if len(cs) > 0 {
+			log.Warningf("group %s: %d rules never apply because earlier groups with another action have them too, e.g. %s in group %s",
+				g.Name, len(cs), cs[0].Rule, cs[0].Groups[0])
+		}
+	}
+	r.overridden = make(map[string]int, len(overridden))
+	for name, cs := range overridden {
+		r.overridden[name] = len(cs)
+	}
+}
+
+// lastConflicts returns the rules last found shared by groups with different actions.
+func (r *Ruledforward) lastConflicts() []ruleConflict {
+	r.conflictsMu.Lock()
+	defer r.conflictsMu.Unlock()
+	return r.conflicts
+}
@@ -0,0 +1,63 @@
+package ruledforward
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestConflicts(t *testing.T) {
+	newGroup := func(name, action string, shadow bool, rules ...Rule) *Group {
+		g := &Group{Name: name, Action: action, Shadow: shadow, InlineRules: rules}
+		if err := g.Update(nil, UpdateMatcherLocal); err != nil {
+			t.Fatal(err)
+		}
+		return g
+	}
+	a := Rule{Type: RuleDomain, Value: "a.example."}
+	b := Rule{Type: RuleDomain, Value: "b.example."}
+	r := &Ruledforward{from: ".", server: "conflicts:53", groups: []*Group{
+		newGroup("candidate", "forward", true, a),
+		newGroup("block", "empty", false, a),
+		newGroup("proxy", "forward", false, a, b),
+		newGroup("direct", "forward", false, b),
+	}}
+	for _, g := range r.groups {
+		g.onUpdate = r.checkConflicts
+	}
+	r.checkConflicts()
+	want := []ruleConflict{{Rule: "domain:a.example", Groups: []string{"block", "proxy"}, Actions: []string{"empty", "forward"}}}
+	if got := r.lastConflicts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("conflicts = %+v, want %+v", got, want)
+	}
+
+	// Runtime rules count, and the report follows them.
+	if _, err := r.groups[3].AddRuntimeRules([]Rule{{Type: RuleFull, Value: "ads.example."}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.groups[1].AddRuntimeRules([]Rule{{Type: RuleFull, Value: "ads.example."}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.lastConflicts(); len(got) != 2 || got[1].Rule != "full:ads.example" || got[1].Groups[0] != "block" {
+		t.Errorf("conflicts after adding runtime rules = %+v", got)
+	}
+
+	r.registerInstance()
+	t.Cleanup(r.unregisterInstance)
+	srv := httptest.NewServer(adminHandler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/api/conflicts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out []conflictInfo
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 || out[0].Server != "conflicts:53" || out[0].Rule != "domain:a.example" {
+		t.Errorf("GET /api/conflicts = %+v", out)
+	}
+}
@@ -0,0 +1,124 @@
+package ruledforward
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// Reasons a consensus query was not agreed on, the reason label of consensus_disagreements_total.
+const (
+	consensusDisagreement = "disagreement" // the replies differ
+	consensusInsufficient = "insufficient" // fewer than two replies arrived, so there was nothing to compare
+)
+
+// consensusUpstreams returns the upstreams queried together with pr: the next healthy ones, with the trusted upstream
+// of ConsensusTrust among them if it is healthy.
+func (g *Group) consensusUpstreams(list []*proxy.Proxy, i int, pr *proxy.Proxy) []*proxy.Proxy {
+	others := g.otherUpstreams(list, i, pr, g.Consensus-1)
+	if g.ConsensusTrust == "" || pr.Addr() == g.ConsensusTrust ||
+		slices.ContainsFunc(others, func(p *proxy.Proxy) bool { return p.Addr() == g.ConsensusTrust }) {
+		return others
+	}
+	for _, p := range list {
+		if p.Addr() != g.ConsensusTrust || p.Down(g.Maxfails) {
+			continue
+		}
+		if len(others) == g.Consensus-1 {
+			others[len(others)-1] = p
+		} else {
+			others = append(others, p)
+		}
+		break
+	}
+	return others
+}
+
+// exchangeConsensus sends fwd to pr and the others at once and waits for all of them. It returns pr's reply, or the
+// first one that arrived if pr failed, and why the replies were not agreed on, "" if they were: at least two replies
+// to the query arrived and each agrees with the returned one (see repliesAgree). accepted reports whether the reply
+// may be used: the replies agreed, or the trusted upstream of ConsensusTrust replied, and then its reply is returned.
+// It returns the last error if all exchanges failed.
+func (g *Group) exchangeConsensus(ctx context.Context, pr *proxy.Proxy, others []*proxy.Proxy, fwd request.Request) (_ *proxy.Proxy, _ *dns.Msg, reason string, accepted bool, _ error) {
+	targets := append([]*proxy.Proxy{pr}, others...)
+	results := make(chan exchangeResult, len(targets))
+	for _, p := range targets {
+		// Each exchange gets its own copy of the query, see exchangeHedged.
+		go func() {
+			ret, err := g.exchange(ctx, p, request.Request{W: fwd.W, Req: fwd.Req.Copy()})
+			results <- exchangeResult{pr: p, ret: ret, err: err}
+		}()
+	}
+
+	var replies []exchangeResult
+	var last exchangeResult
+	for range targets {
+		res := <-results
+		switch {
+		case res.err != nil:
+			last = res
+		case !fwd.Match(res.ret):
+			last = exchangeResult{pr: res.pr, err: errWrongReply}
+		case res.pr == pr:
+			replies = append([]exchangeResult{res}, replies...)
+		default:
+			replies = append(replies, res)
+		}
+	}
+	if len(replies) == 0 {
+		return last.pr, last.ret, "", false, last.err
+	}
+	reason = consensusInsufficient
+	if len(replies) >= 2 {
+		reason = ""
+		for _, res := range replies[1:] {
+			if !repliesAgree(replies[0].ret, res.ret, fwd.QType()) {
+				reason = consensusDisagreement
+			}
+		}
+	}
+	if reason == "" {
+		return replies[0].pr, replies[0].ret, "", true, nil
+	}
+	for _, res := range replies {
+		if g.ConsensusTrust != "" && res.pr.Addr() == g.ConsensusTrust {
+			return res.pr, res.ret, reason, true, nil
+		}
+	}
+	return replies[0].pr, replies[0].ret, reason, false, nil
+}
+
+// repliesAgree reports whether two replies to a query of type qtype agree: they have the same rcode and either
+// neither has a record of qtype in its answer or they share at least one. Sharing one record, rather than all, keeps
+// rotating CDN answers from counting as disagreement while forged answers still stand out.
+func repliesAgree(a, b *dns.Msg, qtype uint16) bool {
+	if a.Rcode != b.Rcode {
+		return false
+	}
+	ra, rb := answerData(a, qtype), answerData(b, qtype)
+	if len(ra) == 0 && len(rb) == 0 {
+		return true
+	}
+	for d := range ra {
+		if _, ok := rb[d]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// answerData returns the record data of the records of type qtype in ret's answer, without owner name and TTL.
+func answerData(ret *dns.Msg, qtype uint16) map[string]struct{} {
+	out := make(map[string]struct{})
+	for _, rr := range ret.Answer {
+		if rr.Header().Rrtype == qtype {
+			out[strings.TrimPrefix(rr.String(), rr.Header().String())] = struct{}{}
+		}
+	}
+	return out
+}
@@ -0,0 +1,145 @@
+package ruledforward
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestRepliesAgree(t *testing.T) {
+	reply := func(rcode int, rrs ...dns.RR) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("a.example.", dns.TypeA)
+		m.Rcode = rcode
+		m.Answer = rrs
+		return m
+	}
+	a1 := test.A("a.example. 300 IN A 192.0.2.1")
+	a1ttl := test.A("A.example. 60 IN A 192.0.2.1")
+	a2 := test.A("a.example. 300 IN A 192.0.2.2")
+	forged := test.A("a.example. 300 IN A 203.0.113.1")
+	cname := test.CNAME("a.example. 300 IN CNAME b.example.")
+	tests := []struct {
+		name string
+		a, b *dns.Msg
+		want bool
+	}{
+		{name: "same address, other TTL and case", a: reply(dns.RcodeSuccess, a1), b: reply(dns.RcodeSuccess, a1ttl), want: true},
+		{name: "overlapping rotation", a: reply(dns.RcodeSuccess, a1, a2), b: reply(dns.RcodeSuccess, a2), want: true},
+		{name: "forged address", a: reply(dns.RcodeSuccess, a1), b: reply(dns.RcodeSuccess, forged)},
+		{name: "NODATA both", a: reply(dns.RcodeSuccess, cname), b: reply(dns.RcodeSuccess), want: true},
+		{name: "NODATA and address", a: reply(dns.RcodeSuccess), b: reply(dns.RcodeSuccess, a1)},
+		{name: "rcode", a: reply(dns.RcodeNameError), b: reply(dns.RcodeSuccess)},
+	}
+	for _, tc := range tests {
+		if got := repliesAgree(tc.a, tc.b, dns.TypeA); got != tc.want {
+			t.Errorf("%s: repliesAgree = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestForwardGroupConsensus(t *testing.T) {
+	var n1, n2, trustedN atomic.Int32
+	up1 := newDelayedUpstream(t, "192.0.2.1", 0, &n1)
+	up2 := newDelayedUpstream(t, "192.0.2.1", 0, &n2)
+	tampered := newDelayedUpstream(t, "203.0.113.1", 0, &n2)
+	trustedUp := newDelayedUpstream(t, "192.0.2.9", 0, &trustedN)
+
+	trusted := &Group{Name: "trusted", Action: "forward", Policy: &sequential{}}
+	trusted.SetProxies([]*proxy.Proxy{trustedUp})
+	trusted.SetMatcher(NewMatcher())
+	g := &Group{Name: "default", Action: "forward", Policy: &sequential{}, Consensus: 2}
+	g.SetProxies([]*proxy.Proxy{up1, up2})
+	g.SetMatcher(NewMatcher())
+	r := &Ruledforward{from: ".", groups: []*Group{g, trusted}, defaultGroup: g}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.org.", dns.TypeA)
+	query := func() (*dns.Msg, int) {
+		t.Helper()
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, _ := r.ServeDNS(context.Background(), rec, req)
+		return rec.Msg, rcode
+	}
+
+	ret, _ := query()
+	if ret == nil || len(ret.Answer) != 1 || ret.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("agreeing upstreams: answer = %v", ret)
+	}
+	if n1.Load() != 1 || n2.Load() != 1 {
+		t.Errorf("upstream queries = %d, %d; want one each", n1.Load(), n2.Load())
+	}
+
+	g.SetProxies([]*proxy.Proxy{up1, tampered})
+	if ret, rcode := query(); ret != nil || rcode != dns.RcodeServerFailure {
+		t.Errorf("disagreeing upstreams without fallback: reply %v, rcode %d; want SERVFAIL", ret, rcode)
+	}
+
+	g.Fallback = trusted
+	ret, _ = query()
+	if ret == nil || len(ret.Answer) != 1 || ret.Answer[0].(*dns.A).A.String() != "192.0.2.9" {
+		t.Errorf("disagreeing upstreams with fallback: answer = %v, want the trusted group's", ret)
+	}
+
+	// A single reply is not confirmed.
+	g.SetProxies([]*proxy.Proxy{up1})
+	trustedN.Store(0)
+	query()
+	if trustedN.Load() != 1 {
+		t.Error("a single upstream reply should go to the fallback group")
+	}
+}
+
+func TestForwardGroupConsensusTrusted(t *testing.T) {
+	var n1, n2, n3 atomic.Int32
+	up1 := newDelayedUpstream(t, "192.0.2.1", 0, &n1)
+	up2 := newDelayedUpstream(t, "192.0.2.2", 0, &n2)
+	trustedUp := newDelayedUpstream(t, "192.0.2.9", 0, &n3)
+
+	g := &Group{Name: "default", Action: "forward", Policy: &sequential{}, Consensus: 2, ConsensusTrust: trustedUp.Addr()}
+	g.SetProxies([]*proxy.Proxy{up1, up2, trustedUp})
+	g.SetMatcher(NewMatcher())
+	r := &Ruledforward{from: ".", groups: []*Group{g}, defaultGroup: g}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	r.ServeDNS(context.Background(), rec, req)
+	if rec.Msg == nil || len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].(*dns.A).A.String() != "192.0.2.9" {
+		t.Errorf("disagreement with a trusted upstream: answer = %v, want the trusted upstream's", rec.Msg)
+	}
+	if n1.Load() != 1 || n2.Load() != 0 || n3.Load() != 1 {
+		t.Errorf("upstream queries = %d, %d, %d; want the first and the trusted one", n1.Load(), n2.Load(), n3.Load())
+	}
+
+	// A single reply is enough if it is the trusted upstream's.
+	g.SetProxies([]*proxy.Proxy{trustedUp})
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	if rcode, _ := r.ServeDNS(context.Background(), rec, req); rec.Msg == nil || rcode != dns.RcodeSuccess {
+		t.Errorf("trusted upstream alone: reply %v, rcode %d", rec.Msg, rcode)
+	}
+}
+
+func TestConsensusUpstreams(t *testing.T) {
+	var n atomic.Int32
+	a, b, c := newDelayedUpstream(t, "192.0.2.1", 0, &n), newDelayedUpstream(t, "192.0.2.1", 0, &n), newDelayedUpstream(t, "192.0.2.1", 0, &n)
+	list := []*proxy.Proxy{a, b, c}
+	g := &Group{Consensus: 2}
+	if got := g.consensusUpstreams(list, 0, a); len(got) != 1 || got[0] != b {
+		t.Errorf("without trusted upstream: %v", got)
+	}
+	g.ConsensusTrust = c.Addr()
+	if got := g.consensusUpstreams(list, 0, a); len(got) != 1 || got[0] != c {
+		t.Errorf("with trusted upstream: %v, want it", got)
+	}
+	g.Consensus = 3
+	if got := g.consensusUpstreams(list, 0, a); len(got) != 2 || got[0] != b || got[1] != c {
+		t.Errorf("trusted upstream already chosen: %v", got)
+	}
+}
@@ -0,0 +1,163 @@
+package ruledforward
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/pkg/parse"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+
+	"github.com/miekg/dns"
+)
+
+// ddrName is the special-use name a resolver publishes its designated encrypted endpoints under (RFC 9462).
+const ddrName = "_dns.resolver.arpa."
+
+// ddrEndpoint is a DoT endpoint advertised by a resolver.
+type ddrEndpoint struct {
+	addr       string // host:port
+	serverName string
+	resolver   string // IP address of the unencrypted resolver that advertised it
+}
+
+// tlsConfig returns base for connections to ep: with ep's server name, and accepting only certificates that also
+// cover the IP address of the resolver that advertised ep, as RFC 9462 verified discovery requires.
+func (ep ddrEndpoint) tlsConfig(base *tls.Config) *tls.Config {
+	cfg := base.Clone()
+	cfg.ServerName = ep.serverName
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("%s sent no certificate", ep.addr)
+		}
+		if err := cs.PeerCertificates[0].VerifyHostname(ep.resolver); err != nil {
+			return fmt.Errorf("certificate of %s does not cover the designating resolver: %w", ep.addr, err)
+		}
+		return nil
+	}
+	return cfg
+}
+
+// verify connects to ep over TLS with ep.tlsConfig(base), verifying the certificate chain, its server name and the
+// resolver's IP address.
+func (ep ddrEndpoint) verify(base *tls.Config) error {
+	d := &net.Dialer{Timeout: upstreamResolveTimeout}
+	conn, err := tls.DialWithDialer(d, "tcp", ep.addr, ep.tlsConfig(base))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// discoverDesignated replaces each plain dns:// upstream in toHosts that advertises DoT endpoints through DDR with
+// those endpoints. Since the advertisement itself is unauthenticated, only endpoints that pass verified discovery
+// (RFC 9462, section 4.2) are used: their certificates, checked against the roots of tlsConfig (the system's if nil),
+// must cover both their server name and the IP address of the plain upstream. designated maps each resulting tls://
+// address to its endpoint. Upstreams with no verified endpoints stay as they are; failed reports that a query
+// failed, so discovery is retried soon.
+func discoverDesignated(toHosts []string, tlsConfig *tls.Config) (hosts []string, designated map[string]ddrEndpoint, failed bool) {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	for _, h := range toHosts {
+		trans, addr := parse.Transport(h)
+		if trans != transport.DNS {
+			hosts = append(hosts, h)
+			continue
+		}
+		eps, err := queryDesignated(addr)
+		if err != nil {
+			log.Warningf("DDR discovery via %s: %v", addr, err)
+			failed = true
+		}
+		verified := 0
+		for _, ep := range eps {
+			if err := ep.verify(tlsConfig); err != nil {
+				log.Warningf("DDR discovery via %s: not using %s (%s): %v", addr, ep.addr, ep.serverName, err)
+				continue
+			}
+			if designated == nil {
+				designated = make(map[string]ddrEndpoint)
+			}
+			key := transport.TLS + "://" + ep.addr
+			hosts = append(hosts, key)
+			designated[key] = ep
+			verified++
+		}
+		if verified == 0 {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts, designated, failed
+}
+
+// queryDesignated asks the resolver at addr for its DDR SVCB records and returns the DoT endpoints, in priority order.
+// Targets without address hints are resolved through the same resolver.
+func queryDesignated(addr string) ([]ddrEndpoint, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(ddrName, dns.TypeSVCB)
+	m.RecursionDesired = true
+	c := &dns.Client{Timeout: upstreamResolveTimeout}
+	ret, _, err := c.Exchange(m, addr)
+	if err == nil && ret.Truncated {
+		c.Net = "tcp"
+		ret, _, err = c.Exchange(m, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resolver, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*dns.SVCB
+	for _, rr := range ret.Answer {
+		if s, ok := rr.(*dns.SVCB); ok && s.Priority > 0 && s.Target != "." && svcbHasALPN(s, "dot") {
+			records = append(records, s)
+		}
+	}
+	slices.SortStableFunc(records, func(a, b *dns.SVCB) int { return int(a.Priority) - int(b.Priority) })
+
+	var eps []ddrEndpoint
+	for _, s := range records {
+		port := transport.TLSPort
+		var ips []net.IP
+		for _, kv := range s.Value {
+			switch v := kv.(type) {
+			case *dns.SVCBPort:
+				port = strconv.Itoa(int(v.Port))
+			case *dns.SVCBIPv4Hint:
+				ips = append(ips, v.Hint...)
+			case *dns.SVCBIPv6Hint:
+				ips = append(ips, v.Hint...)
+			}
+		}
+		name := strings.TrimSuffix(s.Target, ".")
+		if len(ips) == 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), upstreamResolveTimeout)
+			ips, err = bootstrapResolver(addr).LookupIP(ctx, "ip", name)
+			cancel()
+			if err != nil {
+				return eps, err
+			}
+		}
+		for _, ip := range ips {
+			eps = append(eps, ddrEndpoint{addr: net.JoinHostPort(ip.String(), port), serverName: name, resolver: resolver})
+		}
+	}
+	return eps, nil
+}
+
+func svcbHasALPN(s *dns.SVCB, proto string) bool {
+	for _, kv := range s.Value {
+		if a, ok := kv.(*dns.SVCBAlpn); ok && slices.Contains(a.Alpn, proto) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,195 @@
+package ruledforward
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+
+	"github.com/miekg/dns"
+)
+
+// newTestResolver starts a DNS server answering with rrs (in presentation format) by question name and type.
+func newTestResolver(t *testing.T, rrs ...string) string {
+	t.Helper()
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		q := r.Question[0]
+		for _, z := range rrs {
+			rr, err := dns.NewRR(z)
+			if err != nil {
+				t.Errorf("bad RR %q: %v", z, err)
+				continue
+			}
+			if rr.Header().Name == q.Name && rr.Header().Rrtype == q.Qtype {
+				ret.Answer = append(ret.Answer, rr)
+			}
+		}
+		_ = w.WriteMsg(ret)
+	})
+	t.Cleanup(s.Close)
+	_, port, _ := net.SplitHostPort(s.Addr)
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+func TestQueryDesignated(t *testing.T) {
+	addr := newTestResolver(t,
+		`_dns.resolver.arpa. 300 IN SVCB 2 dot.example. alpn="dot" ipv4hint="192.0.2.2"`,
+		`_dns.resolver.arpa. 300 IN SVCB 1 dns.example. alpn="h2,dot" port="8853" ipv4hint="192.0.2.1"`,
+		`_dns.resolver.arpa. 300 IN SVCB 3 doh.example. alpn="h2" ipv4hint="192.0.2.9"`,
+		`_dns.resolver.arpa. 300 IN SVCB 4 nohint.example. alpn="dot"`,
+		`nohint.example. 300 IN A 192.0.2.4`,
+	)
+	eps, err := queryDesignated(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ddrEndpoint{
+		{addr: "192.0.2.1:8853", serverName: "dns.example", resolver: "127.0.0.1"},
+		{addr: "192.0.2.2:853", serverName: "dot.example", resolver: "127.0.0.1"},
+		{addr: "192.0.2.4:853", serverName: "nohint.example", resolver: "127.0.0.1"},
+	}
+	if !slices.Equal(eps, want) {
+		t.Errorf("endpoints = %+v, want %+v", eps, want)
+	}
+}
+
+// newTestDoT starts a TLS server on 127.0.0.1 that completes handshakes with a certificate for names and ips,
+// issued by ca, and returns its port.
+func newTestDoT(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, names []string, ips []net.IP) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		IPAddresses:  ips,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
+
+func TestDiscoverDesignated(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	tlsConfig := &tls.Config{RootCAs: roots}
+
+	loopback := []net.IP{net.IPv4(127, 0, 0, 1)}
+	good := newTestDoT(t, ca, caKey, []string{"dns.example"}, loopback)
+	noIP := newTestDoT(t, ca, caKey, []string{"noip.example"}, nil)
+	wrongName := newTestDoT(t, ca, caKey, []string{"other.example"}, loopback)
+	addr := newTestResolver(t,
+		`_dns.resolver.arpa. 300 IN SVCB 1 noip.example. alpn="dot" port="`+noIP+`" ipv4hint="127.0.0.1"`,
+		`_dns.resolver.arpa. 300 IN SVCB 2 dns.example. alpn="dot" port="`+good+`" ipv4hint="127.0.0.1"`,
+		`_dns.resolver.arpa. 300 IN SVCB 3 wrong.example. alpn="dot" port="`+wrongName+`" ipv4hint="127.0.0.1"`,
+	)
+	hosts, designated, failed := discoverDesignated([]string{addr, "tls://192.0.2.53:853"}, tlsConfig)
+	if failed {
+		t.Error("failed = true")
+	}
+	key := "tls://127.0.0.1:" + good
+	if want := []string{key, "tls://192.0.2.53:853"}; !slices.Equal(hosts, want) {
+		t.Errorf("hosts = %v, want %v: only the endpoint whose certificate covers its name and the resolver's IP", hosts, want)
+	}
+	if ep := designated[key]; ep.serverName != "dns.example" || ep.resolver != "127.0.0.1" {
+		t.Errorf("designated[%s] = %+v", key, ep)
+	}
+	if _, ok := designated["tls://192.0.2.53:853"]; ok {
+		t.Error("configured TLS upstream was taken as designated")
+	}
+
+	// Without a trusted chain, nothing is verified and the plain upstream stays.
+	hosts, designated, _ = discoverDesignated([]string{addr}, nil)
+	if len(designated) != 0 || !slices.Equal(hosts, []string{addr}) {
+		t.Errorf("untrusted: hosts = %v, designated = %v, want the plain upstream", hosts, designated)
+	}
+}
+
+func TestDiscoverDesignatedNone(t *testing.T) {
+	addr := newTestResolver(t)
+	hosts, names, failed := discoverDesignated([]string{addr}, nil)
+	if failed || len(names) != 0 {
+		t.Errorf("failed = %v, serverNames = %v, want false, none", failed, names)
+	}
+	if len(hosts) != 1 || hosts[0] != addr {
+		t.Errorf("hosts = %v, want [%s]", hosts, addr)
+	}
+}
+
+func TestDDRUnresolvedReset(t *testing.T) {
+	// A port nothing listens on, so that the DDR query fails.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := pc.LocalAddr().String()
+	pc.Close()
+
+	cfg := &upstreamConfig{toHosts: []string{dead}, expire: defaultExpire, ddr: true}
+	if _, _, err := newProxies("g", cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.unresolved {
+		t.Fatal("unresolved = false after a failed DDR query")
+	}
+	cfg.toHosts = []string{newTestResolver(t)}
+	if _, _, err := newProxies("g", cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.unresolved {
+		t.Error("unresolved = true after DDR discovery succeeded")
+	}
+}
@@ -0,0 +1,39 @@
+package ruledforward
+
+// defaultDecisionCacheSize is the number of names `decision_cache` remembers by default.
+const defaultDecisionCacheSize = 10000
+
+// decision is a cached result of groupFor.
+type decision struct {
+	group    *Group   // nil if the query goes to the next plugin
+	shadowed []*Group // shadow groups that matched before group
+	gen      uint64   // matcherGeneration when decided
+}
+
+// routeFor is groupFor for a query from client, remembering the decision for qname in the decision cache if there is
+// one. Cached decisions are dropped whenever the rules of any group change. Decisions that depended on more than
+// qname, the categories of qname or the client and the time, are not cached; the categorizer caches categories.
+func (r *Ruledforward) routeFor(qname string, client queryClient, shadowed func(*Group)) *Group {
+	if r.decisions == nil {
+		g, _ := r.matchGroup(qname, client, shadowed, r.pprofLabels)
+		return g
+	}
+	gen := matcherGeneration.Load()
+	if d, ok := r.decisions.get(qname); ok && d.gen == gen {
+		decisionCacheHitsTotal.Inc()
+		for _, sg := range d.shadowed {
+			shadowed(sg)
+		}
+		return d.group
+	}
+	d := decision{gen: gen}
+	var varies bool
+	d.group, varies = r.matchGroup(qname, client, func(sg *Group) {
+		d.shadowed = append(d.shadowed, sg)
+		shadowed(sg)
+	}, r.pprofLabels)
+	if !varies {
+		r.decisions.add(qname, d)
+	}
+	return d.group
+}
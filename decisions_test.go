@@ -0,0 +1,43 @@
+package ruledforward
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestDecisionCache(t *testing.T) {
+	var matches atomic.Int32
+	newGroup := func(name, action string, shadow bool) *Group {
+		m := NewMatcher()
+		m.AddRule(Rule{Type: RuleDomain, Value: "ads.example."})
+		m.Build()
+		g := &Group{Name: name, Action: action, Shadow: shadow}
+		g.SetMatcher(countingMatcher{Matcher: m, n: &matches})
+		return g
+	}
+	candidate := newGroup("candidate", "empty", true)
+	block := newGroup("block", "empty", false)
+	r := &Ruledforward{from: ".", groups: []*Group{candidate, block}, decisions: newLRU[string, decision](10)}
+
+	for i := 1; i <= 2; i++ {
+		var shadowed []string
+		g := r.routeFor("x.ads.example.", queryClient{}, func(sg *Group) { shadowed = append(shadowed, sg.Name) })
+		if g != block || len(shadowed) != 1 || shadowed[0] != "candidate" {
+			t.Errorf("query %d: routed to %v with shadow matches %v, want block after candidate", i, g, shadowed)
+		}
+	}
+	if n := matches.Load(); n != 2 {
+		t.Errorf("matchers consulted %d times, want 2 for the first query only", n)
+	}
+	if g := r.routeFor("other.example.", queryClient{}, func(*Group) {}); g != nil {
+		t.Errorf("routed other.example. to %v, want no group", g)
+	}
+
+	// A rule change invalidates cached decisions.
+	m := NewMatcher()
+	m.Build()
+	block.SetMatcher(m)
+	if g := r.routeFor("x.ads.example.", queryClient{}, func(*Group) {}); g != nil {
+		t.Errorf("after removing the rule: routed to %v, want no group", g)
+	}
+}
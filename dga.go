@@ -0,0 +1,92 @@
+package ruledforward
+
+import (
+	"math"
+	"strings"
+)
+
+const (
+	// defaultDGAThreshold is the score above which `dga` takes a name by default.
+	defaultDGAThreshold = 0.6
+	// minDGALabel is the shortest label scored; shorter ones carry too little information to tell.
+	minDGALabel = 8
+)
+
+// commonBigrams are the letter pairs frequent in English words and in the names built from them. Generated labels
+// are mostly made of the other pairs.
+var commonBigrams = func() map[[2]byte]bool {
+	const pairs = "th he in er an re on at en nd ti es or te of ed is it al ar st to nt ng se ha as ou io le ve co " +
+		"me de hi ri ro ic ne ea ra ce li ch ll be ma si om ur ca el ta la ns di fo ho pe ec pr no ct us ac ot il " +
+		"tr ly nc et ut ss so rs un lo wa ge ie wh ee wi em ad ol rt po we na ul ni ts mo ow pa im mi ai sh ir su " +
+		"id os iv ia am fi ci vi pl ig tu ev ld ry mp fe bl ab gh ty op wo sa ay ex ke fr oo av ag if ap gr od bo " +
+		"sp rd do uc bu ei ov by rm ep tt oc fa ef cu rn sc gi da yo cr cl du ga qu ue ff ba ey ls va um pp ua up " +
+		"lu go ht ru ug ds lt pi rc rr eg au ck ew mu br bi pt ak pu ui rg ib tl ny ki rk ys ob mm fu ph og ms ye " +
+		"ud mb ip ub oi rl gu dr hr cc tw ft wn nu af hu nn eo vo rv nf xp gn sm fl iz ok nl my gl aw ju oa eq sy " +
+		"sl ps jo lf nv je nk kn gs dy hy ze ks xt bs ik dd cy rp sk xi oe oy ws lv dl rf eu dg wr xa yi nm eb rb " +
+		"tm xc eh tc gy ja hn yp za gg ym sw cs ii ix xe oh lk lp ax ox uf dm iu sf bt ka yt ek pm ya gt wl rh " +
+		"yl hs ah yc yn ae zi az lc py nh uo kl lb tn sn nr fs zo oz"
+	m := make(map[[2]byte]bool)
+	for _, p := range strings.Fields(pairs) {
+		m[[2]byte{p[0], p[1]}] = true
+	}
+	return m
+}()
+
+// dgaScorer takes names that look generated by an algorithm, as those of botnets and of tunnels through DNS, see
+// `dga`.
+type dgaScorer struct {
+	threshold float64
+}
+
+// match reports whether the score of q (normalized) is above the threshold.
+func (d *dgaScorer) match(q string) bool {
+	return dgaScore(q) > d.threshold
+}
+
+// dgaScore returns how much q looks algorithmically generated, from 0 to 1. It scores the longest word of q below the
+// top-level domain, words being separated by dots and hyphens: the share of its character pairs that are rare in
+// words, which weighs most, its character entropy and its share of digits. Punycode labels are not scored.
+func dgaScore(q string) float64 {
+	q = strings.TrimSuffix(q, ".")
+	i := strings.LastIndexByte(q, '.')
+	if i < 0 {
+		return 0 // a top-level domain only
+	}
+	label := ""
+	for _, l := range strings.Split(q[:i], ".") {
+		if strings.HasPrefix(l, "xn--") {
+			continue
+		}
+		for _, w := range strings.Split(l, "-") {
+			if len(w) > len(label) {
+				label = w
+			}
+		}
+	}
+	if len(label) < minDGALabel {
+		return 0
+	}
+
+	var counts [256]int
+	rare, digits := 0, 0
+	for i := 0; i < len(label); i++ {
+		counts[label[i]]++
+		if label[i] >= '0' && label[i] <= '9' {
+			digits++
+		}
+		if i > 0 && !commonBigrams[[2]byte{label[i-1], label[i]}] {
+			rare++
+		}
+	}
+	entropy := 0.0
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(len(label))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	// The most a label can have: every character different, from an alphabet of 36 letters and digits.
+	maxEntropy := math.Log2(float64(min(len(label), 36)))
+
+	return 0.6*float64(rare)/float64(len(label)-1) + 0.25*entropy/maxEntropy + 0.15*float64(digits)/float64(len(label))
+}
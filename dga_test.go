@@ -0,0 +1,38 @@
+package ruledforward
+
+import "testing"
+
+func TestDGAScore(t *testing.T) {
+	for _, q := range []string{
+		"www.google.com.", "en.wikipedia.org.", "login.microsoftonline.com.", "photos.googleusercontent.com.",
+		"www.stackoverflow.com.", "cloudflare-dns.com.", "xn--80ak6aa92e.com.", "com.", "",
+	} {
+		if s := dgaScore(q); s > defaultDGAThreshold {
+			t.Errorf("dgaScore(%q) = %.2f, want at most %v", q, s, defaultDGAThreshold)
+		}
+	}
+	for _, q := range []string{
+		"xjwqpzkvbnrt.com.", "a8f3k2m9q1z7.net.", "www.kjsdhfkwqertyu.info.", "1a2b3c4d5e6f7a8b.example.com.",
+	} {
+		if s := dgaScore(q); s <= defaultDGAThreshold {
+			t.Errorf("dgaScore(%q) = %.2f, want above %v", q, s, defaultDGAThreshold)
+		}
+	}
+}
+
+func TestGroupDGA(t *testing.T) {
+	g := &Group{Name: "dga", Action: "empty", DGA: &dgaScorer{threshold: defaultDGAThreshold}}
+	g.SetMatcher(NewMatcher())
+	if !g.Match("XJWQPZKVBNRT.com") || g.Match("www.example.com.") {
+		t.Error("the group should match generated names only")
+	}
+	rule, source, ok := g.explainMatch("xjwqpzkvbnrt.com.")
+	if !ok || rule.Type != RuleDGA || source != "dga" {
+		t.Errorf("explainMatch = %v, %q, %v; want a dga rule", rule, source, ok)
+	}
+
+	g.DGA.threshold = 0.99
+	if g.Match("xjwqpzkvbnrt.com.") {
+		t.Error("a higher threshold should let the name pass")
+	}
+}
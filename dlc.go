@@ -6,7 +6,10 @@ package ruledforward
 
 import (
 	"errors"
+	"fmt"
+	"maps"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"google.golang.org/protobuf/proto"
@@ -22,7 +25,11 @@ var errInvalidDLC = errors.New("invalid dlc.dat: not a valid GeoSiteList protobu
 // (e.g. "GOOGLE@ADS"). Use geosite google@ads in config to get only domains with @ads.
 // Uses a minimal GeoSiteList proto (see proto/geosite.proto) to avoid importing
 // v2fly/v2ray-core and its proto extension 50000 conflict with grpc.
+// If path is a directory, it is read as the source lists of a dlc.dat with LoadDLCDir.
 func LoadDLC(path string) (map[string][]Rule, error) {
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		return LoadDLCDir(path)
+	}
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -93,3 +100,82 @@ func domainToRule(d *dlcpb.Domain) (Rule, bool) {
 	}
 	return r, true
 }
+
+// parseGeositeName parses a list name of the geosite directive. As in v2ray and xray routing rules, it may be written
+// `geosite:LIST`, and `ext:FILE:LIST` names a list of another .dat file than the dlcfile.
+func parseGeositeName(arg string) (string, error) {
+	name := arg
+	if len(name) > len("geosite:") && strings.EqualFold(name[:len("geosite:")], "geosite:") {
+		name = name[len("geosite:"):]
+	}
+	if rest, ok := strings.CutPrefix(name, "ext:"); ok {
+		i := strings.LastIndexByte(rest, ':')
+		if i <= 0 || i == len(rest)-1 {
+			return "", fmt.Errorf("geosite: expected ext:FILE:LIST, got '%s'", arg)
+		}
+		return name, nil
+	}
+	if name == "" || strings.Contains(name, ":") {
+		return "", fmt.Errorf("invalid geosite list '%s'", arg)
+	}
+	return name, nil
+}
+
+// extGeosite splits an `ext:FILE:LIST` geosite name.
+func extGeosite(name string) (file, list string, ok bool) {
+	rest, ok := strings.CutPrefix(name, "ext:")
+	if !ok {
+		return "", "", false
+	}
+	i := strings.LastIndexByte(rest, ':')
+	return rest[:i], rest[i+1:], true
+}
+
+// geositeKey returns the key of the rules of a geosite name in the lists of LoadDLC, as extended by loadExtGeosites:
+// the list name in upper case, after the file for `ext:FILE:LIST`.
+func geositeKey(name string) string {
+	if file, list, ok := extGeosite(name); ok {
+		return "ext:" + file + ":" + strings.ToUpper(list)
+	}
+	return strings.ToUpper(name)
+}
+
+// loadExtGeosites resolves the files of the `ext:FILE:LIST` geosite names of groups against root and returns dlc with
+// the lists of those files added, or dlc itself if there are none. dlc is not modified, as reloads share it.
+func loadExtGeosites(dlc map[string][]Rule, groups []*Group, root string) (map[string][]Rule, error) {
+	var out map[string][]Rule
+	loaded := make(map[string]bool)
+	for _, g := range groups {
+		for i, name := range g.GeositeNames {
+			file, list, ok := extGeosite(name)
+			if !ok {
+				continue
+			}
+			if !filepath.IsAbs(file) && root != "" {
+				file = filepath.Join(root, file)
+			}
+			g.GeositeNames[i] = "ext:" + file + ":" + list
+			if loaded[file] {
+				continue
+			}
+			lists, err := LoadDLC(file)
+			if err != nil {
+				return nil, fmt.Errorf("group %s geosite ext:%s: %w", g.Name, file, err)
+			}
+			if out == nil {
+				out = maps.Clone(dlc)
+				if out == nil {
+					out = make(map[string][]Rule)
+				}
+			}
+			for l, rules := range lists {
+				out["ext:"+file+":"+l] = rules
+			}
+			loaded[file] = true
+		}
+	}
+	if out == nil {
+		return dlc, nil
+	}
+	return out, nil
+}
@@ -3,6 +3,7 @@ package ruledforward
 import (
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
 
 	"google.golang.org/protobuf/proto"
@@ -237,3 +238,133 @@ func TestLoadDLCWire_Attribute(t *testing.T) {
 		t.Errorf("TEST@ADS[0].Value = %q", m["TEST@ADS"][0].Value)
 	}
 }
+
+func TestParseGeositeName(t *testing.T) {
+	for arg, want := range map[string]string{
+		"cn":                    "cn",
+		"geosite:cn":            "cn",
+		"GeoSite:google@ads":    "google@ads",
+		"ext:mydata.dat:mylist": "ext:mydata.dat:mylist",
+		"ext:C:\\x.dat:mylist":  "ext:C:\\x.dat:mylist",
+	} {
+		if got, err := parseGeositeName(arg); err != nil || got != want {
+			t.Errorf("parseGeositeName(%q) = %q, %v, want %q", arg, got, err, want)
+		}
+	}
+	for _, arg := range []string{"geosite:", "ext:mydata.dat", "ext::mylist", "ext:mydata.dat:", "domain:cn"} {
+		if _, err := parseGeositeName(arg); err == nil {
+			t.Errorf("parseGeositeName(%q) should fail", arg)
+		}
+	}
+}
+
+func TestLoadExtGeosites(t *testing.T) {
+	dir := t.TempDir()
+	list := &dlcpb.GeoSiteList{Entry: []*dlcpb.GeoSite{{
+		CountryCode: "mylist",
+		Domain:      []*dlcpb.Domain{{Type: dlcpb.Domain_RootDomain, Value: "ext.example"}},
+	}}}
+	if err := os.WriteFile(filepath.Join(dir, "mydata.dat"), mustMarshal(t, list), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dlc := map[string][]Rule{"CN": {{Type: RuleDomain, Value: "cn.example"}}}
+	g := &Group{Name: "g", Action: "empty", GeositeNames: []string{"cn", "ext:mydata.dat:mylist"}}
+	merged, err := loadExtGeosites(dlc, []*Group{g}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dlc) != 1 {
+		t.Errorf("dlc was modified: %v", mapKeys(dlc))
+	}
+	if want := "ext:" + filepath.Join(dir, "mydata.dat") + ":mylist"; g.GeositeNames[1] != want {
+		t.Errorf("GeositeNames[1] = %q, want %q", g.GeositeNames[1], want)
+	}
+	if err := g.Update(merged, UpdateMatcherAll); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"www.cn.example.": true, "www.ext.example.": true, "other.example.": false} {
+		if g.Match(name) != want {
+			t.Errorf("Match(%s) = %v, want %v", name, !want, want)
+		}
+	}
+
+	g = &Group{Name: "g", Action: "empty", GeositeNames: []string{"ext:missing.dat:mylist"}}
+	if _, err := loadExtGeosites(dlc, []*Group{g}, dir); err == nil {
+		t.Error("a missing ext file should fail")
+	}
+}
+
+func TestLoadDLCDir(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"example": `# comment
+example.com
+full:www.example.net @cn
+keyword:tracker @ads @cn # trailing comment
+regexp:^ad[0-9]+\.example\.org$ @ads
+include:other @cn
+include:other @-cn
+`,
+		"other": "other.cn @cn\nother.com &example\n",
+		".git":  "not a list",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lists, err := LoadDLC(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := mapKeys(lists)
+	slices.Sort(keys)
+	if want := []string{"EXAMPLE", "EXAMPLE@ADS", "EXAMPLE@CN", "OTHER", "OTHER@CN"}; !slices.Equal(keys, want) {
+		t.Fatalf("lists = %v, want %v", keys, want)
+	}
+	for key, want := range map[string][]Rule{
+		"EXAMPLE@CN": {
+			{Type: RuleFull, Value: "www.example.net"},
+			{Type: RuleKeyword, Value: "tracker"},
+			{Type: RuleDomain, Value: "other.cn"},
+		},
+		"EXAMPLE@ADS": {
+			{Type: RuleKeyword, Value: "tracker"},
+			{Type: RuleRegex, Value: `^ad[0-9]+\.example\.org$`},
+		},
+	} {
+		if !slices.Equal(lists[key], want) {
+			t.Errorf("%s = %v, want %v", key, lists[key], want)
+		}
+	}
+	if n := len(lists["EXAMPLE"]); n != 6 {
+		t.Errorf("EXAMPLE has %d rules, want 6", n)
+	}
+
+	g := &Group{Name: "g", Action: "empty", GeositeNames: []string{"example@cn"}}
+	if err := g.Update(lists, UpdateMatcherAll); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"www.example.net.": true, "a.other.cn.": true, "example.com.": false, "other.com.": false} {
+		if g.Match(name) != want {
+			t.Errorf("Match(%s) = %v, want %v", name, !want, want)
+		}
+	}
+
+	for name, data := range map[string]string{
+		"cycle":    "include:cycle2\n",
+		"unknown":  "include:missing\n",
+		"badtype":  "path:example.com\n",
+		"badattr":  "example.com cn\n",
+		"notattr":  "example.com @-cn\n",
+		"badregex": "regexp:(\n",
+	} {
+		bad := t.TempDir()
+		os.WriteFile(filepath.Join(bad, name), []byte(data), 0o644)
+		if name == "cycle" {
+			os.WriteFile(filepath.Join(bad, "cycle2"), []byte("include:cycle\n"), 0o644)
+		}
+		if _, err := LoadDLCDir(bad); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package ruledforward
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// dlcTextEntry is a rule of a domain-list-community source list, with its attributes in upper case.
+type dlcTextEntry struct {
+	rule  Rule
+	attrs []string
+}
+
+// dlcTextInclude is an `include:LIST [@ATTR] [@-ATTR]` line: the entries of LIST that have every attribute of must
+// and none of mustNot.
+type dlcTextInclude struct {
+	list          string
+	must, mustNot []string
+	line          int
+}
+
+// dlcTextList is a parsed source list.
+type dlcTextList struct {
+	entries  []dlcTextEntry
+	includes []dlcTextInclude
+}
+
+// LoadDLCDir reads a domain-list-community `data` directory, whose files are the source lists dlc.dat is built
+// from, and returns its lists as LoadDLC does: keyed by upper-case file name, and by "LIST@ATTR" for the entries
+// with an attribute. Lines are `[domain:|full:|keyword:|regexp:]VALUE [@ATTR...]` or
+// `include:LIST [@ATTR] [@-ATTR]`; # starts a comment. Files whose name starts with a dot are skipped.
+func LoadDLCDir(dir string) (map[string][]Rule, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	lists := make(map[string]*dlcTextList)
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		l, err := parseDLCText(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Join(dir, f.Name()), err)
+		}
+		lists[strings.ToUpper(f.Name())] = l
+	}
+	if len(lists) == 0 {
+		return nil, fmt.Errorf("no lists in %s", dir)
+	}
+
+	resolved := make(map[string][]dlcTextEntry, len(lists))
+	var resolve func(name string, visiting []string) ([]dlcTextEntry, error)
+	resolve = func(name string, visiting []string) ([]dlcTextEntry, error) {
+		if entries, ok := resolved[name]; ok {
+			return entries, nil
+		}
+		if slices.Contains(visiting, name) {
+			return nil, fmt.Errorf("include cycle: %s", strings.Join(append(visiting, name), " -> "))
+		}
+		l := lists[name]
+		entries := slices.Clip(l.entries)
+		for _, inc := range l.includes {
+			if lists[inc.list] == nil {
+				return nil, fmt.Errorf("%s:%d: include of unknown list '%s'", strings.ToLower(name), inc.line, strings.ToLower(inc.list))
+			}
+			included, err := resolve(inc.list, append(visiting, name))
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range included {
+				if inc.selects(e) {
+					entries = append(entries, e)
+				}
+			}
+		}
+		resolved[name] = entries
+		return entries, nil
+	}
+
+	out := make(map[string][]Rule, len(lists))
+	for name := range lists {
+		entries, err := resolve(name, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			out[name] = append(out[name], e.rule)
+			for _, a := range e.attrs {
+				out[name+"@"+a] = append(out[name+"@"+a], e.rule)
+			}
+		}
+	}
+	return out, nil
+}
+
+// selects reports whether inc takes e.
+func (inc dlcTextInclude) selects(e dlcTextEntry) bool {
+	for _, a := range inc.must {
+		if !slices.Contains(e.attrs, a) {
+			return false
+		}
+	}
+	for _, a := range inc.mustNot {
+		if slices.Contains(e.attrs, a) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseDLCText parses a domain-list-community source list.
+func parseDLCText(data []byte) (*dlcTextList, error) {
+	l := new(dlcTextList)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		var attrs, notAttrs []string
+		for _, f := range fields[1:] {
+			switch {
+			case strings.HasPrefix(f, "@-"):
+				notAttrs = append(notAttrs, strings.ToUpper(f[2:]))
+			case strings.HasPrefix(f, "@"):
+				attrs = append(attrs, strings.ToUpper(f[1:]))
+			case strings.HasPrefix(f, "&"):
+				// Affiliations add the entry to other lists when dlc.dat is built; not supported.
+			default:
+				return nil, fmt.Errorf("line %d: unexpected '%s'", n, f)
+			}
+		}
+		typ, val, found := strings.Cut(fields[0], ":")
+		if !found {
+			typ, val = "domain", fields[0]
+		}
+		val = strings.ToLower(val)
+		if val == "" {
+			return nil, fmt.Errorf("line %d: empty value", n)
+		}
+		if typ == "include" {
+			l.includes = append(l.includes, dlcTextInclude{list: strings.ToUpper(val), must: attrs, mustNot: notAttrs, line: n})
+			continue
+		}
+		if len(notAttrs) > 0 {
+			return nil, fmt.Errorf("line %d: @- is only allowed in include", n)
+		}
+		var r Rule
+		switch typ {
+		case "domain":
+			r = Rule{Type: RuleDomain, Value: val}
+		case "full":
+			r = Rule{Type: RuleFull, Value: val}
+		case "keyword":
+			r = Rule{Type: RuleKeyword, Value: val}
+		case "regexp":
+			if _, err := parseRegexRule(val, line); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			r = Rule{Type: RuleRegex, Value: val}
+		default:
+			return nil, fmt.Errorf("line %d: unknown rule type '%s'", n, typ)
+		}
+		l.entries = append(l.entries, dlcTextEntry{rule: r, attrs: attrs})
+	}
+	return l, sc.Err()
+}
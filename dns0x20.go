@@ -0,0 +1,61 @@
+package ruledforward
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+var errDNS0x20Mismatch = errors.New("dns0x20: reply question case does not match query")
+
+// randomizeCase returns name with the case of each ASCII letter flipped at random (draft-vixie-dnsext-dns0x20).
+func randomizeCase(name string) string {
+	b := []byte(name)
+	var bits uint64
+	for i, c := range b {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+			continue
+		}
+		if i%64 == 0 || bits == 0 {
+			bits = rand.Uint64()
+		}
+		if bits&1 == 1 {
+			b[i] ^= 0x20
+		}
+		bits >>= 1
+	}
+	return string(b)
+}
+
+// connect0x20 sends a copy of the query with a case-randomized qname and only accepts a reply that echoes the exact
+// same case, which an off-path spoofer has to guess. The reply is rewritten back to the client's original case.
+func (g *Group) connect0x20(ctx context.Context, pr *proxy.Proxy, state request.Request, opts proxy.Options) (*dns.Msg, error) {
+	req := state.Req.Copy()
+	orig := req.Question[0].Name
+	mixed := randomizeCase(orig)
+	req.Question[0].Name = mixed
+
+	ret, err := g.dial(ctx, pr, request.Request{W: state.W, Req: req}, opts)
+	if err != nil || ret == nil {
+		return ret, err
+	}
+	if len(ret.Question) != 1 || ret.Question[0].Name != mixed {
+		dns0x20MismatchTotal.WithLabelValues(g.Name).Inc()
+		return nil, errDNS0x20Mismatch
+	}
+	ret.Question[0].Name = orig
+	for _, section := range [][]dns.RR{ret.Answer, ret.Ns, ret.Extra} {
+		for _, rr := range section {
+			if hdr := rr.Header(); strings.EqualFold(hdr.Name, orig) {
+				hdr.Name = orig
+			}
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,73 @@
+package ruledforward
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestRandomizeCase(t *testing.T) {
+	name := "a-very-long-label-with-many-letters.example-domain.com."
+	changed := false
+	for range 10 {
+		got := randomizeCase(name)
+		if !strings.EqualFold(got, name) {
+			t.Fatalf("randomizeCase(%q) = %q, not equal ignoring case", name, got)
+		}
+		if got != name {
+			changed = true
+		}
+	}
+	if !changed {
+		t.Error("randomizeCase never changed the case")
+	}
+	if got := randomizeCase("123.-."); got != "123.-." {
+		t.Errorf("randomizeCase changed non-letters: %q", got)
+	}
+}
+
+func TestConnect0x20(t *testing.T) {
+	var lowercase atomic.Bool // simulate an upstream that does not preserve query case
+	p := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if lowercase.Load() {
+			ret.Question[0].Name = strings.ToLower(ret.Question[0].Name)
+		}
+		ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" 300 IN A 127.0.0.1"))
+		_ = w.WriteMsg(ret)
+	})
+
+	g := &Group{Name: "plain", DNS0x20: true}
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: req}
+
+	ret, err := g.connect(context.Background(), p, state, proxy.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Question[0].Name != "www.example.com." || ret.Answer[0].Header().Name != "www.example.com." {
+		t.Errorf("reply not restored to original case: %v", ret)
+	}
+	if req.Question[0].Name != "www.example.com." {
+		t.Errorf("client request was modified: %q", req.Question[0].Name)
+	}
+
+	// Use a long name so that the randomized case being all-lowercase by chance is negligible.
+	lowercase.Store(true)
+	req.SetQuestion("abcdefghijklmnopqrstuvwxyz.example.com.", dns.TypeA)
+	state = request.Request{W: &test.ResponseWriter{}, Req: req}
+	_, err = g.connect(context.Background(), p, state, proxy.Options{})
+	if !errors.Is(err, errDNS0x20Mismatch) {
+		t.Errorf("connect err = %v, want errDNS0x20Mismatch", err)
+	}
+}
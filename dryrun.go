@@ -0,0 +1,45 @@
+package ruledforward
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// envDryRun enables dry-run validation: every rule source is loaded at setup, a report is logged, and CoreDNS exits
+// before serving, with a non-zero status if anything failed. Meant for CI checks of a Corefile and its rule lists.
+const envDryRun = "RULEDFORWARD_DRY_RUN"
+
+func dryRunEnabled() bool {
+	b, _ := strconv.ParseBool(os.Getenv(envDryRun))
+	return b
+}
+
+// dryRun loads all rule sources of every group and ruleset synchronously, including remote adguard_rules, and logs
+// the resulting rule and upstream counts. It returns all load errors joined.
+func (r *Ruledforward) dryRun() error {
+	var errs []error
+	for _, g := range r.allGroups() {
+		if err := g.Update(r.dlc, UpdateMatcherAll); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if slices.Contains(r.rulesets, g) {
+			log.Infof("dry run: ruleset %s: %d rules", g.Name, g.ruleCount.Load())
+			continue
+		}
+		log.Infof("dry run: group %s (%s): %d rules, %d rulesets, %d upstreams",
+			g.Name, g.Action, g.ruleCount.Load(), len(g.Rulesets), len(g.Proxies()))
+	}
+	for _, c := range r.findConflicts() {
+		groups := make([]string, len(c.Groups))
+		for i := range c.Groups {
+			groups[i] = fmt.Sprintf("%s (%s)", c.Groups[i], c.Actions[i])
+		}
+		log.Warningf("dry run: rule %s is in groups %s; only the first applies", c.Rule, strings.Join(groups, ", "))
+	}
+	return errors.Join(errs...)
+}
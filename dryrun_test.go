@@ -0,0 +1,70 @@
+package ruledforward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+)
+
+func TestDryRun(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ads.txt" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("||ads.example.com^\n||tracker.example.org^\n"))
+	}))
+	defer srv.Close()
+
+	parse := func(t *testing.T, url string) *Ruledforward {
+		t.Helper()
+		c := caddy.NewTestController("dns", `ruledforward . {
+    group block {
+        action empty
+        adguard_rules `+url+`
+        domain: local.example
+    }
+}`)
+		dnsserver.NewServer("", []*dnsserver.Config{{Root: t.TempDir()}})
+		r, err := parseRuledforward(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	r := parse(t, srv.URL+"/ads.txt")
+	if err := r.dryRun(); err != nil {
+		t.Fatal(err)
+	}
+	g := r.groups[0]
+	if n := g.ruleCount.Load(); n != 3 {
+		t.Errorf("ruleCount = %d, want 3", n)
+	}
+	if !g.Match("x.ads.example.com.") {
+		t.Error("dry run should load remote rules synchronously")
+	}
+
+	r = parse(t, srv.URL+"/missing.txt")
+	if err := r.dryRun(); err == nil || !strings.Contains(err.Error(), "missing.txt") {
+		t.Errorf("dryRun error = %v, want failure for the missing list", err)
+	}
+}
+
+func TestSetupDryRunFailure(t *testing.T) {
+	t.Setenv(envDryRun, "1")
+	c := caddy.NewTestController("dns", `ruledforward . {
+    group block {
+        action empty
+        adguard_rules http://127.0.0.1:1/list.txt
+    }
+}`)
+	dnsserver.NewServer("", []*dnsserver.Config{{Root: t.TempDir()}})
+	if err := setup(c); err == nil || !strings.Contains(err.Error(), "dry run") {
+		t.Errorf("setup error = %v, want dry run failure", err)
+	}
+}
@@ -0,0 +1,217 @@
+package ruledforward
+
+import (
+	"cmp"
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+
+	"github.com/miekg/dns"
+)
+
+// ruleExplainer is implemented by matchers that can tell which rule matches a name.
+type ruleExplainer interface {
+	matchRule(qname string) (Rule, bool)
+}
+
+// matchRule returns the rule that matches qname, in the order Match checks them.
+func (m *matcher) matchRule(qname string) (Rule, bool) {
+	q := normalizeName(qname)
+	if r, ok := m.matchNameRule(q); ok {
+		return r, true
+	}
+	return m.matchPatternRule(q)
+}
+
+// matchNameRule returns the full or domain rule that matches q (normalized), like matchNames.
+func (m *matcher) matchNameRule(q string) (Rule, bool) {
+	if _, ok := m.full[q]; ok {
+		return Rule{Type: RuleFull, Value: q}, true
+	}
+	if d, ok := m.matchDomainSuffix(q); ok {
+		return Rule{Type: RuleDomain, Value: d}, true
+	}
+	return Rule{}, false
+}
+
+// matchPatternRule returns the keyword or regex rule that matches q (normalized), like matchPatterns.
+func (m *matcher) matchPatternRule(q string) (Rule, bool) {
+	for _, k := range m.keyword {
+		if strings.Contains(q, k) {
+			return Rule{Type: RuleKeyword, Value: k}, true
+		}
+	}
+	for _, re := range m.regex {
+		if re.MatchString(q) {
+			return Rule{Type: RuleRegex, Value: re.String()}, true
+		}
+	}
+	return Rule{}, false
+}
+
+func (m *bloomedMatcher) matchRule(qname string) (Rule, bool) {
+	q := normalizeName(qname)
+	if m.bf.MaybeMatch(q) {
+		if r, ok := m.m.matchNameRule(q); ok {
+			return r, true
+		}
+	}
+	return m.m.matchPatternRule(q)
+}
+
+// ruleOrigins records the source each rule of a group was loaded from, e.g. `adguard_rules:https://…/list.txt`. It
+// is only kept when the server block has `debug`, as it takes about as much memory as the rules themselves.
+type ruleOrigins struct {
+	sources []string
+	index   map[string]int // source -> index into sources
+	rules   map[Rule]int   // normalized rule -> index into sources
+}
+
+func newRuleOrigins() *ruleOrigins {
+	return &ruleOrigins{index: make(map[string]int), rules: make(map[Rule]int)}
+}
+
+// add records that r came from source. The first source of a rule wins, as its later copies add nothing.
+func (o *ruleOrigins) add(r Rule, source string) {
+	r = normalizeRule(r)
+	if _, ok := o.rules[r]; ok {
+		return
+	}
+	i, ok := o.index[source]
+	if !ok {
+		i = len(o.sources)
+		o.sources = append(o.sources, source)
+		o.index[source] = i
+	}
+	o.rules[r] = i
+}
+
+// addAll records that rules came from source. o may be nil.
+func (o *ruleOrigins) addAll(rules []Rule, source string) {
+	if o == nil {
+		return
+	}
+	for _, r := range rules {
+		o.add(r, source)
+	}
+}
+
+// source returns the source of r, or "" if it is not known.
+func (o *ruleOrigins) source(r Rule) string {
+	if o == nil {
+		return ""
+	}
+	i, ok := o.rules[r]
+	if !ok {
+		return ""
+	}
+	return o.sources[i]
+}
+
+// normalizeRule returns r with its value normalized the way the matcher stores it.
+func normalizeRule(r Rule) Rule {
+	switch r.Type {
+	case RuleFull, RuleDomain:
+		r.Value = strings.ToLower(dns.Fqdn(r.Value))
+	case RuleKeyword:
+		r.Value = strings.ToLower(r.Value)
+	}
+	return r
+}
+
+// explainMatch returns the rule of g that qname matches, in the order Match checks them, and where the rule came
+// from: its source if the group keeps ruleOrigins, "runtime" for rules added at runtime, "dga" for names taken by the
+// dga heuristic, "categorize" for names in a category of the group, prefixed by `use:NAME ` for the rules of a
+// ruleset.
+func (g *Group) explainMatch(qname string) (rule Rule, source string, ok bool) {
+	if rule, source, ok = g.explainOwn(qname); ok {
+		return rule, source, true
+	}
+	for _, rs := range g.Rulesets {
+		if rule, source, ok = rs.explainOwn(qname); ok {
+			return rule, strings.TrimSpace("use:" + rs.Name + " " + source), true
+		}
+	}
+	if name, ok := g.matchCategory(normalizeName(qname)); ok {
+		return Rule{Type: RuleCategory, Value: name}, "categorize", true
+	}
+	return Rule{}, "", false
+}
+
+func (g *Group) explainOwn(qname string) (Rule, string, bool) {
+	if e, ok := g.Matcher().(ruleExplainer); ok {
+		if rule, ok := e.matchRule(qname); ok {
+			return rule, g.origins.Load().source(rule), true
+		}
+	}
+	if m := g.runtimeMatcher.Load(); m != nil {
+		if e, ok := (*m).(ruleExplainer); ok {
+			if rule, ok := e.matchRule(qname); ok {
+				return rule, "runtime", true
+			}
+		}
+	}
+	for _, f := range g.Feeds {
+		if rule, ok := f.matchRule(normalizeName(qname)); ok {
+			return rule, f.String(), true
+		}
+	}
+	if g.DGA != nil {
+		if score := dgaScore(normalizeName(qname)); score > g.DGA.threshold {
+			return Rule{Type: RuleDGA, Value: strconv.FormatFloat(score, 'f', 2, 64)}, "dga", true
+		}
+	}
+	return Rule{}, "", false
+}
+
+// matchReport explains a routing decision once, when it is first asked for.
+type matchReport struct {
+	once    sync.Once
+	qname   string
+	g       *Group
+	rule    Rule
+	source  string
+	matched bool // false if the query went to the default group without a matching rule
+}
+
+func (m *matchReport) explain() {
+	m.once.Do(func() { m.rule, m.source, m.matched = m.g.explainMatch(m.qname) })
+}
+
+func (m *matchReport) ruleValue() string {
+	if m.explain(); !m.matched {
+		return ""
+	}
+	return m.rule.String()
+}
+
+func (m *matchReport) sourceValue() string {
+	m.explain()
+	return m.source
+}
+
+// reportMatch logs the rule that routed qname to g when debug logging is on, and sets the metadata
+// ruledforward/group, ruledforward/rule and ruledforward/source when the metadata plugin is enabled.
+func reportMatch(ctx context.Context, qname string, g *Group) {
+	md := metadata.ValueFuncs(ctx) != nil
+	if !md && !clog.D.Value() {
+		return
+	}
+	m := &matchReport{qname: qname, g: g}
+	if md {
+		metadata.SetValueFunc(ctx, "ruledforward/group", func() string { return g.Name })
+		metadata.SetValueFunc(ctx, "ruledforward/rule", m.ruleValue)
+		metadata.SetValueFunc(ctx, "ruledforward/source", m.sourceValue)
+	}
+	if clog.D.Value() {
+		if m.explain(); m.matched {
+			log.Debugf("%s matched %s from %s in group '%s'", qname, m.rule, cmp.Or(m.source, "an unknown source"), g.Name)
+		} else {
+			log.Debugf("%s matched no rule and went to group '%s'", qname, g.Name)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package ruledforward
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/metadata"
+)
+
+func TestMatchRule(t *testing.T) {
+	for _, m := range []Matcher{NewMatcher(), NewBloomedMatcher(100, bloomFP)} {
+		m.AddRule(Rule{Type: RuleFull, Value: "exact.example.org"})
+		m.AddRule(Rule{Type: RuleDomain, Value: "Ads.Example.com"})
+		m.AddRule(Rule{Type: RuleKeyword, Value: "tracker"})
+		m.AddRule(Rule{Type: RuleRegex, Value: `^ad[0-9]+\.`})
+		m.Build()
+		tests := []struct {
+			qname string
+			want  Rule
+			ok    bool
+		}{
+			{qname: "exact.example.org.", want: Rule{Type: RuleFull, Value: "exact.example.org."}, ok: true},
+			{qname: "x.y.ads.example.com.", want: Rule{Type: RuleDomain, Value: "ads.example.com."}, ok: true},
+			{qname: "ads.example.com.", want: Rule{Type: RuleDomain, Value: "ads.example.com."}, ok: true},
+			{qname: "mytracker.example.net.", want: Rule{Type: RuleKeyword, Value: "tracker"}, ok: true},
+			{qname: "ad12.example.net.", want: Rule{Type: RuleRegex, Value: `^ad[0-9]+\.`}, ok: true},
+			{qname: "example.com."},
+		}
+		for _, tc := range tests {
+			got, ok := m.(ruleExplainer).matchRule(tc.qname)
+			if ok != tc.ok || got != tc.want {
+				t.Errorf("matchRule(%s) = %v, %v, want %v, %v", tc.qname, got, ok, tc.want, tc.ok)
+			}
+			if ok != m.Match(tc.qname) {
+				t.Errorf("matchRule(%s) disagrees with Match", tc.qname)
+			}
+		}
+	}
+}
+
+func TestExplainMatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(path, []byte("||ads.example^\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rs := &Group{Name: "shared", trackOrigins: true, InlineRules: []Rule{{Type: RuleFull, Value: "shared.example."}}}
+	g := &Group{Name: "block", Action: "empty", trackOrigins: true, AdguardPaths: []string{path},
+		InlineRules: []Rule{{Type: RuleDomain, Value: "inline.example."}}, Rulesets: []*Group{rs}}
+	for _, h := range []*Group{rs, g} {
+		if err := h.Update(nil, UpdateMatcherLocal); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g.setRuntimeMatcher([]Rule{{Type: RuleKeyword, Value: "tracker"}})
+
+	tests := []struct{ qname, rule, source string }{
+		{qname: "x.ads.example.", rule: "domain:ads.example", source: "adguard_rules:" + path},
+		{qname: "inline.example.", rule: "domain:inline.example", source: "inline"},
+		{qname: "tracker.example.", rule: "keyword:tracker", source: "runtime"},
+		{qname: "shared.example.", rule: "full:shared.example", source: "use:shared inline"},
+	}
+	for _, tc := range tests {
+		rule, source, ok := g.explainMatch(tc.qname)
+		if !ok || rule.String() != tc.rule || source != tc.source {
+			t.Errorf("explainMatch(%s) = %s, %q, %v, want %s from %q", tc.qname, rule, source, ok, tc.rule, tc.source)
+		}
+	}
+
+	// Without origins, the rule is still known.
+	g.origins.Store(nil)
+	if rule, source, ok := g.explainMatch("x.ads.example."); !ok || rule.String() != "domain:ads.example" || source != "" {
+		t.Errorf("explainMatch without origins = %s, %q, %v", rule, source, ok)
+	}
+}
+
+func TestReportMatchMetadata(t *testing.T) {
+	g := &Group{Name: "block", Action: "empty", InlineRules: []Rule{{Type: RuleDomain, Value: "ads.example."}}}
+	if err := g.Update(nil, UpdateMatcherLocal); err != nil {
+		t.Fatal(err)
+	}
+	ctx := metadata.ContextWithMetadata(context.Background())
+	reportMatch(ctx, "x.ads.example.", g)
+	for label, want := range map[string]string{"ruledforward/group": "block", "ruledforward/rule": "domain:ads.example", "ruledforward/source": ""} {
+		f := metadata.ValueFunc(ctx, label)
+		if f == nil {
+			t.Errorf("metadata %s not set", label)
+			continue
+		}
+		if got := f(); got != want {
+			t.Errorf("metadata %s = %q, want %q", label, got, want)
+		}
+	}
+}
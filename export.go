@@ -0,0 +1,137 @@
+package ruledforward
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ruleLister is implemented by matchers that can list the rules they were built from.
+type ruleLister interface {
+	rules() []Rule
+}
+
+// rules returns the matcher's rules without duplicates.
+func (m *matcher) rules() []Rule {
+	var out []Rule
+	for v := range m.full {
+		out = append(out, Rule{Type: RuleFull, Value: v})
+	}
+	for _, v := range m.domain {
+		out = append(out, Rule{Type: RuleDomain, Value: v})
+	}
+	for _, v := range m.keyword {
+		out = append(out, Rule{Type: RuleKeyword, Value: v})
+	}
+	for _, re := range m.regex {
+		out = append(out, Rule{Type: RuleRegex, Value: re.String()})
+	}
+	return sortRules(out)
+}
+
+func (m *bloomedMatcher) rules() []Rule { return m.m.rules() }
+
+// sortRules sorts rules by type and value and removes duplicates.
+func sortRules(rules []Rule) []Rule {
+	slices.SortFunc(rules, func(a, b Rule) int {
+		if c := cmp.Compare(a.Type, b.Type); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Value, b.Value)
+	})
+	return slices.Compact(rules)
+}
+
+// EffectiveRules returns the rules the group matches: those of all its sources, its rulesets and the rules added at
+// runtime, without duplicates, sorted by type and value.
+func (g *Group) EffectiveRules() []Rule {
+	var out []Rule
+	for _, h := range append([]*Group{g}, g.Rulesets...) {
+		if l, ok := h.Matcher().(ruleLister); ok {
+			out = append(out, l.rules()...)
+		}
+		out = append(out, h.RuntimeRules()...)
+	}
+	return sortRules(out)
+}
+
+// ruleFormats are the formats WriteRules supports, by name.
+var ruleFormats = map[string]func(w io.Writer, rules []Rule) error{
+	"text":    writeRulesText,
+	"adguard": writeRulesAdguard,
+	"hosts":   writeRulesHosts,
+	"json":    writeRulesJSON,
+}
+
+// WriteRules writes rules in the named format: text (one `domain:`/`full:`/`keyword:`/`regex:` rule per line),
+// adguard, hosts or json.
+func WriteRules(w io.Writer, format string, rules []Rule) error {
+	f, ok := ruleFormats[format]
+	if !ok {
+		return fmt.Errorf("unknown rule format '%s'", format)
+	}
+	return f(w, rules)
+}
+
+func writeRulesText(w io.Writer, rules []Rule) error {
+	for _, r := range rules {
+		if _, err := fmt.Fprintln(w, r.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRulesAdguard writes rules as an adguard_rules list. Keywords become regular expressions.
+func writeRulesAdguard(w io.Writer, rules []Rule) error {
+	for _, r := range rules {
+		var line string
+		switch r.Type {
+		case RuleDomain:
+			line = "||" + strings.TrimSuffix(r.Value, ".") + "^"
+		case RuleFull:
+			line = strings.TrimSuffix(r.Value, ".")
+		case RuleKeyword:
+			line = "/" + regexp.QuoteMeta(r.Value) + "/"
+		case RuleRegex:
+			line = "/" + r.Value + "/"
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRulesHosts writes rules as a hosts file mapping names to 0.0.0.0. Hosts files only match exact names, so
+// domain rules only cover the domain itself and keyword and regex rules are left out.
+func writeRulesHosts(w io.Writer, rules []Rule) error {
+	for _, r := range rules {
+		if r.Type != RuleDomain && r.Type != RuleFull {
+			continue
+		}
+		if _, err := fmt.Fprintln(w, "0.0.0.0 "+strings.TrimSuffix(r.Value, ".")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ruleTypeNames are the rule type names of the json format.
+var ruleTypeNames = map[RuleType]string{RuleDomain: "domain", RuleFull: "full", RuleKeyword: "keyword", RuleRegex: "regex"}
+
+func writeRulesJSON(w io.Writer, rules []Rule) error {
+	type jsonRule struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	out := make([]jsonRule, 0, len(rules))
+	for _, r := range rules {
+		out = append(out, jsonRule{Type: ruleTypeNames[r.Type], Value: r.Value})
+	}
+	return json.NewEncoder(w).Encode(out)
+}
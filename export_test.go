@@ -0,0 +1,77 @@
+package ruledforward
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+func TestEffectiveRules(t *testing.T) {
+	m := NewBloomedMatcher(1024, bloomFP)
+	for _, r := range []Rule{
+		{Type: RuleDomain, Value: "ads.example."},
+		{Type: RuleDomain, Value: "ads.example."},
+		{Type: RuleFull, Value: "tracker.example."},
+		{Type: RuleKeyword, Value: "banner"},
+	} {
+		m.AddRule(r)
+	}
+	m.Build()
+	rs := &Group{Name: "trackers"}
+	rs.SetMatcher(NewMatcher())
+	rs.setRuntimeRules([]Rule{{Type: RuleFull, Value: "tracker.example."}, {Type: RuleRegex, Value: `^ad\d+\.`}})
+	g := &Group{Name: "block", Action: "empty", Rulesets: []*Group{rs}}
+	g.SetMatcher(m)
+
+	want := []Rule{
+		{Type: RuleDomain, Value: "ads.example."},
+		{Type: RuleFull, Value: "tracker.example."},
+		{Type: RuleKeyword, Value: "banner"},
+		{Type: RuleRegex, Value: `^ad\d+\.`},
+	}
+	if got := g.EffectiveRules(); !slices.Equal(got, want) {
+		t.Errorf("EffectiveRules = %v, want %v", got, want)
+	}
+	if !g.Match("ad1.example.") {
+		t.Error("runtime rule of a ruleset should match")
+	}
+}
+
+func TestWriteRules(t *testing.T) {
+	rules := []Rule{
+		{Type: RuleDomain, Value: "ads.example."},
+		{Type: RuleFull, Value: "tracker.example."},
+		{Type: RuleKeyword, Value: "ad.banner"},
+		{Type: RuleRegex, Value: `^ad\d+\.`},
+	}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{format: "text", want: "domain:ads.example\nfull:tracker.example\nkeyword:ad.banner\nregex:^ad\\d+\\.\n"},
+		{format: "adguard", want: "||ads.example^\ntracker.example\n/ad\\.banner/\n/^ad\\d+\\./\n"},
+		{format: "hosts", want: "0.0.0.0 ads.example\n0.0.0.0 tracker.example\n"},
+		{format: "json", want: `[{"type":"domain","value":"ads.example."},{"type":"full","value":"tracker.example."},` +
+			`{"type":"keyword","value":"ad.banner"},{"type":"regex","value":"^ad\\d+\\."}]` + "\n"},
+	}
+	for _, tc := range tests {
+		var b bytes.Buffer
+		if err := WriteRules(&b, tc.format, rules); err != nil {
+			t.Fatalf("%s: %v", tc.format, err)
+		}
+		if b.String() != tc.want {
+			t.Errorf("%s:\n%s\nwant:\n%s", tc.format, b.String(), tc.want)
+		}
+	}
+	if err := WriteRules(&bytes.Buffer{}, "csv", rules); err == nil {
+		t.Error("expected error for unknown format")
+	}
+
+	// Text and adguard output read back as the same rules (keywords as equivalent regexes in adguard).
+	var b bytes.Buffer
+	_ = WriteRules(&b, "adguard", rules)
+	back, err := ParseAdguardRules(b.String())
+	if err != nil || len(back) != len(rules) || back[0] != rules[0] || back[1] != rules[1] || back[3] != rules[3] {
+		t.Errorf("adguard round trip = %v, %v", back, err)
+	}
+}
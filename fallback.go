@@ -0,0 +1,87 @@
+package ruledforward
+
+import (
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+// untrusted returns why the group's forwarded response ret should be answered by its fallback group instead, or ""
+// if ret can be used.
+func (g *Group) untrusted(ret *dns.Msg) string {
+	if _, ok := g.FallbackOn[ret.Rcode]; ok {
+		return "rcode"
+	}
+	if g.FallbackEmpty && emptyAddrAnswer(ret) {
+		return "empty"
+	}
+	if g.ExpectedIPs != nil && !answerHasExpectedIP(ret, g.ExpectedIPs) {
+		return "expected_ips"
+	}
+	if g.BlockASN != nil && answerHasAddrIn(ret, g.BlockASN) {
+		return "asn"
+	}
+	return ""
+}
+
+// answerHasExpectedIP reports whether ret has no A/AAAA answers, or at least one of them is in set.
+// Poisoned answers typically carry a single forged address, so one expected address is enough to trust the rest.
+func answerHasExpectedIP(ret *dns.Msg, set addrMatcher) bool {
+	seen := false
+	for _, rr := range ret.Answer {
+		addr, ok := rrAddr(rr)
+		if !ok {
+			continue
+		}
+		seen = true
+		if set.Contains(addr) {
+			return true
+		}
+	}
+	return !seen
+}
+
+// emptyAddrAnswer reports whether ret is a NOERROR response to an A or AAAA query without a record of that type,
+// e.g. NODATA or a CNAME chain that ends nowhere, which filtering resolvers send for names they block.
+func emptyAddrAnswer(ret *dns.Msg) bool {
+	if ret.Rcode != dns.RcodeSuccess || len(ret.Question) == 0 {
+		return false
+	}
+	qtype := ret.Question[0].Qtype
+	if qtype != dns.TypeA && qtype != dns.TypeAAAA {
+		return false
+	}
+	for _, rr := range ret.Answer {
+		if rr.Header().Rrtype == qtype {
+			return false
+		}
+	}
+	return true
+}
+
+// rrAddr returns the address of an A or AAAA record.
+func rrAddr(rr dns.RR) (netip.Addr, bool) {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return netip.AddrFromSlice(rr.A.To4())
+	case *dns.AAAA:
+		return netip.AddrFromSlice(rr.AAAA)
+	}
+	return netip.Addr{}, false
+}
+
+// countAnswerCountry counts ret by the country of its first A/AAAA address, per group.
+func (r *Ruledforward) countAnswerCountry(g *Group, ret *dns.Msg) {
+	for _, rr := range ret.Answer {
+		addr, ok := rrAddr(rr)
+		if !ok {
+			continue
+		}
+		cc := r.countries.country(addr)
+		if cc == "" {
+			cc = "unknown"
+		}
+		answerCountryTotal.WithLabelValues(g.Name, cc).Inc()
+		return
+	}
+}
@@ -0,0 +1,182 @@
+package ruledforward
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestForwardGroupFallbackExpectedIPs(t *testing.T) {
+	// The first query gets a forged foreign address, the retry via the fallback group the real one.
+	var n atomic.Int32
+	p := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if n.Add(1) == 1 {
+			ret.Answer = append(ret.Answer, test.A("www.example.cn. 300 IN A 203.0.113.1"))
+		} else {
+			ret.Answer = append(ret.Answer, test.A("www.example.cn. 300 IN A 1.0.1.1"))
+		}
+		_ = w.WriteMsg(ret)
+	})
+
+	trusted := &Group{Name: "trusted", Action: "forward", Policy: &sequential{}}
+	trusted.SetProxies([]*proxy.Proxy{p})
+	trusted.SetMatcher(NewMatcher())
+	m := NewMatcher()
+	m.AddRule(Rule{Type: RuleDomain, Value: "example.cn."})
+	m.Build()
+	local := &Group{Name: "local", Action: "forward", Policy: &sequential{}, Fallback: trusted,
+		ExpectedIPs: newIPSet([]netip.Prefix{netip.MustParsePrefix("1.0.1.0/24")})}
+	local.SetProxies([]*proxy.Proxy{p})
+	local.SetMatcher(m)
+	r := &Ruledforward{from: ".", groups: []*Group{local, trusted}}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.cn.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := r.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].(*dns.A).A.String() != "1.0.1.1" {
+		t.Errorf("answer = %v, want the fallback group's 1.0.1.1", rec.Msg.Answer)
+	}
+	if n.Load() != 2 {
+		t.Errorf("upstream queries = %d, want 2", n.Load())
+	}
+}
+
+func TestForwardGroupFallbackOnRcode(t *testing.T) {
+	// The censoring resolver claims the name does not exist (odd queries); the fallback group's resolver answers.
+	var n atomic.Int32
+	p := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		if n.Add(1)%2 == 1 {
+			ret.SetRcode(r, dns.RcodeNameError)
+		} else {
+			ret.SetReply(r)
+			ret.Answer = append(ret.Answer, test.A("www.example.org. 300 IN A 192.0.2.1"))
+		}
+		_ = w.WriteMsg(ret)
+	})
+
+	trusted := &Group{Name: "trusted", Action: "forward", Policy: &sequential{}}
+	trusted.SetProxies([]*proxy.Proxy{p})
+	trusted.SetMatcher(NewMatcher())
+	local := &Group{Name: "default", Action: "forward", Policy: &sequential{}, Fallback: trusted,
+		FallbackOn: map[int]struct{}{dns.RcodeNameError: {}, dns.RcodeServerFailure: {}}}
+	local.SetProxies([]*proxy.Proxy{p})
+	local.SetMatcher(NewMatcher())
+	r := &Ruledforward{from: ".", groups: []*Group{local, trusted}, defaultGroup: local}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := r.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Msg.Rcode != dns.RcodeSuccess || len(rec.Msg.Answer) != 1 {
+		t.Errorf("answer = %s %v, want the fallback group's NOERROR answer", dns.RcodeToString[rec.Msg.Rcode], rec.Msg.Answer)
+	}
+
+	// Rcodes not listed are relayed.
+	local.FallbackOn = map[int]struct{}{dns.RcodeServerFailure: {}}
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := r.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Msg.Rcode != dns.RcodeNameError {
+		t.Errorf("rcode = %s, want NXDOMAIN relayed", dns.RcodeToString[rec.Msg.Rcode])
+	}
+}
+
+func TestFallbackNotAdmittedAgain(t *testing.T) {
+	p := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" 300 IN A 203.0.113.1"))
+		_ = w.WriteMsg(ret)
+	})
+	// The fallback's limit has room for one query only; answers of local all go to it.
+	trusted := &Group{Name: "fallback-admission-trusted", Action: "forward", Policy: &sequential{}, RateLimit: NewRateLimiter(0, 1, "refuse")}
+	trusted.SetProxies([]*proxy.Proxy{p})
+	trusted.SetMatcher(NewMatcher())
+	local := &Group{Name: "fallback-admission-local", Action: "forward", Policy: &sequential{}, Fallback: trusted,
+		ExpectedIPs: newIPSet([]netip.Prefix{netip.MustParsePrefix("1.0.1.0/24")})}
+	local.SetProxies([]*proxy.Proxy{p})
+	local.SetMatcher(NewMatcher())
+	r := &Ruledforward{from: ".", groups: []*Group{local, trusted}, defaultGroup: local}
+
+	for range 3 {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.cn.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := r.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Msg == nil || rec.Msg.Rcode != dns.RcodeSuccess {
+			t.Fatalf("reply = %v, want the fallback group's answer, not rate limited", rec.Msg)
+		}
+	}
+	got := gather(t, prometheus.DefaultGatherer, func(labels map[string]string) (string, bool) {
+		return labels["group"], labels["action"] == "forward" && strings.HasPrefix(labels["group"], "fallback-admission-")
+	})
+	if got["coredns_ruledforward_requests_total fallback-admission-local"] != 3 || got["coredns_ruledforward_requests_total fallback-admission-trusted"] != 0 {
+		t.Errorf("requests_total = %v, want 3 queries of the local group only", got)
+	}
+}
+
+func TestEmptyAddrAnswer(t *testing.T) {
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		rrs   []dns.RR
+		want  bool
+	}{
+		{name: "A with address", qtype: dns.TypeA, rrs: []dns.RR{test.A("a.example. 300 IN A 192.0.2.1")}},
+		{name: "A NODATA", qtype: dns.TypeA, want: true},
+		{name: "AAAA with only A", qtype: dns.TypeAAAA, rrs: []dns.RR{test.A("a.example. 300 IN A 192.0.2.1")}, want: true},
+		{name: "dangling CNAME", qtype: dns.TypeA, rrs: []dns.RR{test.CNAME("a.example. 300 IN CNAME b.example.")}, want: true},
+		{name: "NXDOMAIN", qtype: dns.TypeA, rcode: dns.RcodeNameError},
+		{name: "MX NODATA", qtype: dns.TypeMX},
+	}
+	for _, tc := range tests {
+		ret := new(dns.Msg)
+		ret.SetQuestion("a.example.", tc.qtype)
+		ret.Rcode = tc.rcode
+		ret.Answer = tc.rrs
+		if got := emptyAddrAnswer(ret); got != tc.want {
+			t.Errorf("%s: emptyAddrAnswer = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAnswerHasExpectedIP(t *testing.T) {
+	set := newIPSet([]netip.Prefix{netip.MustParsePrefix("1.0.1.0/24")})
+	tests := []struct {
+		name   string
+		answer []dns.RR
+		want   bool
+	}{
+		{"no addresses", []dns.RR{test.CNAME("a.example. 60 IN CNAME b.example.")}, true},
+		{"expected", []dns.RR{test.A("a.example. 60 IN A 1.0.1.1")}, true},
+		{"one of several expected", []dns.RR{test.A("a.example. 60 IN A 203.0.113.1"), test.A("a.example. 60 IN A 1.0.1.2")}, true},
+		{"unexpected", []dns.RR{test.A("a.example. 60 IN A 203.0.113.1")}, false},
+		{"unexpected AAAA", []dns.RR{test.AAAA("a.example. 60 IN AAAA 2001:db8::1")}, false},
+	}
+	for _, tc := range tests {
+		if got := answerHasExpectedIP(&dns.Msg{Answer: tc.answer}, set); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package ruledforward
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// feedParsers parse the body of a threat feed, by `threat_feed` format, into rules.
+var feedParsers = map[string]func([]byte) ([]Rule, error){
+	"hosts":        parseHostsFeed,
+	"urlhaus":      parseURLhausFeed,
+	"threatfox":    parseThreatFoxFeed,
+	"abusech_json": parseAbuseChJSONFeed,
+	"rpz":          parseRPZFeed,
+}
+
+// threatFeed is a `threat_feed` setting: a list of malicious hosts in one of the formats threat-intelligence
+// providers publish, from a URL, a file or, for RPZ, a zone transfer. The rules of a transferred zone are matched
+// from zone rather than the group's matcher, so that IXFR changes apply without a rebuild; rules then holds those of
+// its last full transfer, for snapshots.
+type threatFeed struct {
+	format   string
+	source   string                   // URL or file path
+	interval time.Duration            // optional; also reloaded on its own at this interval
+	rules    atomic.Pointer[[]Rule]   // last successful load; nil until the first load
+	rpz      *rpzSource               // for an axfr:// source
+	zone     atomic.Pointer[rpzState] // of rpz; nil until the first load
+}
+
+// parseThreatFeed parses `threat_feed FORMAT URL|FILE [INTERVAL]`.
+func parseThreatFeed(args []string) (*threatFeed, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return nil, errors.New("threat_feed takes a format, a URL or file and an optional interval")
+	}
+	format := strings.ToLower(args[0])
+	if feedParsers[format] == nil {
+		return nil, fmt.Errorf("unknown threat_feed format '%s', want hosts, urlhaus, threatfox, abusech_json or rpz", args[0])
+	}
+	f := &threatFeed{format: format, source: args[1]}
+	if strings.HasPrefix(f.source, "axfr://") {
+		if format != "rpz" {
+			return nil, errors.New("threat_feed axfr:// sources need the rpz format")
+		}
+		s, err := parseRPZSource(f.source)
+		if err != nil {
+			return nil, err
+		}
+		f.rpz = s
+	}
+	if len(args) == 3 {
+		d, err := time.ParseDuration(args[2])
+		if err != nil || d < time.Minute {
+			return nil, fmt.Errorf("threat_feed interval must be a duration of at least 1m: %s", args[2])
+		}
+		f.interval = d
+	}
+	return f, nil
+}
+
+func (f *threatFeed) String() string {
+	return fmt.Sprintf("threat_feed %s %s", f.format, redactFeedSource(f.source))
+}
+
+// loadFeed downloads or reads f, verifying a download if the group has a check for its URL, and parses it. An RPZ
+// zone is transferred instead, or brought up to date by IXFR, in which case errFeedUnchanged is returned.
+func (g *Group) loadFeed(f *threatFeed) ([]Rule, error) {
+	if f.rpz != nil {
+		return loadRPZ(f, f.rpz)
+	}
+	var data []byte
+	var err error
+	path := ""
+	if IsURL(f.source) {
+		data, err = g.fetchVerified(f.source)
+	} else {
+		data, err = os.ReadFile(f.source)
+		path = f.source
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data, err = decompress(data, path); err != nil {
+		return nil, err
+	}
+	return feedParsers[f.format](data)
+}
+
+// refreshFeed reloads f every interval, then rebuilds the group's matcher with its local rules, with geosite lists
+// from dlc, until stop is closed. A failed load keeps the rules of the last one. The rules of an RPZ zone transferred
+// from its master are not in the matcher, so it is left as it is.
+func (g *Group) refreshFeed(f *threatFeed, dlc map[string][]Rule, stop <-chan struct{}) {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		start := time.Now()
+		err := g.reloadFeed(f, dlc)
+		if err != nil {
+			log.Errorf("refresh failed for group '%s' %s: %v", g.Name, f, err)
+		}
+		g.observeRefresh(f.String(), start, err)
+	}
+}
+
+// reloadFeed loads f and, unless it is an RPZ zone transferred from its master, rebuilds the group's matcher with it.
+func (g *Group) reloadFeed(f *threatFeed, dlc map[string][]Rule) error {
+	rules, err := g.loadFeed(f)
+	if errors.Is(err, errFeedUnchanged) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f.rules.Store(&rules)
+	if f.rpz != nil {
+		return nil
+	}
+	return g.Update(dlc, UpdateMatcherLocal)
+}
+
+// feedHost returns the rule for host, a name or address from a feed; addresses and empty names are skipped.
+func feedHost(host string) (Rule, bool) {
+	host = strings.TrimSpace(strings.Trim(host, "[]"))
+	if host == "" {
+		return Rule{}, false
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return Rule{}, false
+	}
+	name := strings.ToLower(dns.Fqdn(host))
+	if _, ok := dns.IsDomainName(name); !ok || name == "." {
+		return Rule{}, false
+	}
+	return Rule{Type: RuleFull, Value: name}, true
+}
+
+// feedURLHost returns the rule for the host of rawURL, a URL from a feed.
+func feedURLHost(rawURL string) (Rule, bool) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return Rule{}, false
+	}
+	return feedHost(u.Hostname())
+}
+
+// hostsLocal are the names hosts files map to loopback for the system itself rather than to block.
+var hostsLocal = map[string]bool{
+	"localhost.": true, "localhost.localdomain.": true, "local.": true, "broadcasthost.": true,
+	"ip6-localhost.": true, "ip6-loopback.": true,
+}
+
+// parseHostsFeed parses a hosts file, `ADDRESS NAME...` lines, or a list of names, one per line; # starts a comment.
+func parseHostsFeed(data []byte) ([]Rule, error) {
+	var rules []Rule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) > 1 {
+			fields = fields[1:]
+		}
+		for _, name := range fields {
+			if r, ok := feedHost(name); ok && !hostsLocal[r.Value] {
+				rules = append(rules, r)
+			}
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// readFeedCSV returns the records of an abuse.ch CSV export, whose header and notes are # comments.
+func readFeedCSV(data []byte) ([][]string, error) {
+	cr := csv.NewReader(bytes.NewReader(data))
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	cr.TrimLeadingSpace = true
+	var records [][]string
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+}
+
+// parseURLhausFeed parses the CSV export of URLhaus: id, dateadded, url, url_status, ... The hosts of the URLs are
+// taken, except addresses.
+func parseURLhausFeed(data []byte) ([]Rule, error) {
+	records, err := readFeedCSV(data)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	for _, rec := range records {
+		if len(rec) < 3 {
+			continue
+		}
+		if r, ok := feedURLHost(rec[2]); ok {
+			rules = append(rules, r)
+		}
+	}
+	return rules, nil
+}
+
+// threatFoxIOC returns the rule for an indicator of compromise of ThreatFox: domains and the hosts of URLs, not
+// addresses.
+func threatFoxIOC(value, typ string) (Rule, bool) {
+	switch strings.TrimSpace(typ) {
+	case "domain":
+		return feedHost(value)
+	case "url":
+		return feedURLHost(value)
+	}
+	return Rule{}, false
+}
+
+// parseThreatFoxFeed parses the CSV export of ThreatFox: first_seen_utc, ioc_id, ioc_value, ioc_type, ...
+func parseThreatFoxFeed(data []byte) ([]Rule, error) {
+	records, err := readFeedCSV(data)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	for _, rec := range records {
+		if len(rec) < 4 {
+			continue
+		}
+		if r, ok := threatFoxIOC(rec[2], rec[3]); ok {
+			rules = append(rules, r)
+		}
+	}
+	return rules, nil
+}
+
+// parseAbuseChJSONFeed parses the JSON exports of URLhaus and ThreatFox: objects mapping ids to lists of entries with
+// either a `url` or an `ioc_value` and `ioc_type`.
+func parseAbuseChJSONFeed(data []byte) ([]Rule, error) {
+	var entries map[string][]struct {
+		URL      string `json:"url"`
+		IOCValue string `json:"ioc_value"`
+		IOCType  string `json:"ioc_type"`
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	for _, list := range entries {
+		for _, e := range list {
+			var r Rule
+			var ok bool
+			if e.URL != "" {
+				r, ok = feedURLHost(e.URL)
+			} else {
+				r, ok = threatFoxIOC(e.IOCValue, e.IOCType)
+			}
+			if ok {
+				rules = append(rules, r)
+			}
+		}
+	}
+	return rules, nil
+}
@@ -0,0 +1,114 @@
+package ruledforward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseFeeds(t *testing.T) {
+	tests := []struct {
+		format string
+		body   string
+		want   []string
+	}{
+		{"hosts", "# malware\n0.0.0.0 evil.example bad.example # two names\n127.0.0.1 localhost\n::1 ip6-localhost\nplain.example\n0.0.0.0\n",
+			[]string{"evil.example.", "bad.example.", "plain.example."}},
+		{"urlhaus", `################################################################
+# abuse.ch URLhaus Database Dump (CSV - recent URLs only)      #
+################################################################
+#
+# id,dateadded,url,url_status,last_online,threat,tags,urlhaus_link,reporter
+"3051234","2026-10-01 10:00:00","http://Evil.example/bins/x86","online","2026-10-01 10:00:00","malware_download","elf,mirai","https://urlhaus.abuse.ch/url/3051234/","anonymous"
+"3051235","2026-10-01 10:01:00","http://192.0.2.1:8080/i","online","2026-10-01 10:01:00","malware_download","elf","https://urlhaus.abuse.ch/url/3051235/","anonymous"
+"3051236","2026-10-01 10:02:00","https://drop.example:8443/a.exe","offline","","malware_download","exe","https://urlhaus.abuse.ch/url/3051236/","anonymous"
+`, []string{"evil.example.", "drop.example."}},
+		{"threatfox", `# ThreatFox IOCs: CSV export
+# "first_seen_utc","ioc_id","ioc_value","ioc_type","threat_type","fk_malware","malware_alias","malware_printable","last_seen_utc","confidence_level","reference","tags","anonymous","reporter"
+"2026-10-01 10:00:00", "1500001", "c2.example", "domain", "botnet_cc", "win.cobalt_strike", "", "Cobalt Strike", "", "100", "", "", "0", "abuse_ch"
+"2026-10-01 10:00:00", "1500002", "192.0.2.1:443", "ip:port", "botnet_cc", "win.cobalt_strike", "", "Cobalt Strike", "", "100", "", "", "0", "abuse_ch"
+"2026-10-01 10:00:00", "1500003", "https://panel.example/gate.php", "url", "botnet_cc", "win.lumma", "", "Lumma Stealer", "", "75", "", "", "0", "abuse_ch"
+`, []string{"c2.example.", "panel.example."}},
+		{"abusech_json", `{"1500001":[{"ioc_value":"c2.example","ioc_type":"domain"}],"1500002":[{"ioc_value":"192.0.2.1:443","ioc_type":"ip:port"}],` +
+			`"3051234":[{"url":"http://evil.example/bins/x86","url_status":"online"}]}`,
+			[]string{"c2.example.", "evil.example."}},
+	}
+	for _, tc := range tests {
+		rules, err := feedParsers[tc.format]([]byte(tc.body))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.format, err)
+		}
+		var got []string
+		for _, r := range rules {
+			if r.Type != RuleFull {
+				t.Errorf("%s: rule %v, want full rules", tc.format, r)
+			}
+			got = append(got, r.Value)
+		}
+		slices.Sort(got)
+		slices.Sort(tc.want)
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%s: rules = %v, want %v", tc.format, got, tc.want)
+		}
+	}
+	if _, err := parseAbuseChJSONFeed([]byte("no entries")); err == nil {
+		t.Error("parsing a JSON feed that is not JSON should fail")
+	}
+}
+
+func TestGroupThreatFeeds(t *testing.T) {
+	var down atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("0.0.0.0 evil.example\n"))
+	}))
+	defer srv.Close()
+	file := filepath.Join(t.TempDir(), "threatfox.csv")
+	if err := os.WriteFile(file, []byte(`"2026-10-01 10:00:00","1","c2.example","domain"`+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	hosts, err := parseThreatFeed([]string{"hosts", srv.URL, "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	threatfox, err := parseThreatFeed([]string{"ThreatFox", file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &Group{Name: "malware", NoBloom: true, Feeds: []*threatFeed{hosts, threatfox}}
+	if err := g.Update(nil, UpdateMatcherAll); err != nil {
+		t.Fatal(err)
+	}
+	if !g.Match("evil.example.") || !g.Match("c2.example.") || g.Match("www.evil.example.") {
+		t.Error("the group should match exactly the hosts of its feeds")
+	}
+
+	// A failed load keeps the rules of the last one, and a local update keeps the feeds' rules.
+	down.Store(true)
+	if err := g.Update(nil, UpdateMatcherAll); err == nil {
+		t.Error("updating from a broken feed should fail")
+	}
+	if err := g.Update(nil, UpdateMatcherLocal); err != nil {
+		t.Fatal(err)
+	}
+	if !g.Match("evil.example.") || !g.Match("c2.example.") {
+		t.Error("the rules of the feeds should be kept")
+	}
+
+	next := &Group{Name: "malware", Feeds: []*threatFeed{{format: "hosts", source: srv.URL}}}
+	next.inheritFeeds(g)
+	if rules := next.Feeds[0].rules.Load(); rules == nil || len(*rules) != 1 {
+		t.Errorf("inherited rules = %v, want those of the previous group", rules)
+	}
+	if _, err := parseThreatFeed([]string{"hosts"}); err == nil {
+		t.Error("threat_feed without a source should fail")
+	}
+}
@@ -0,0 +1,232 @@
+// GeoIP (geoip.dat) parsing using protobuf-generated GeoIPList.
+// Minimal proto copied from v2fly/v2ray-core routercommon, like dlc.go.
+
+package ruledforward
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/hr3lxphr6j/coredns-ruledforward/internal/dlcpb"
+)
+
+// LoadGeoIP reads a v2fly geoip.dat file and returns the prefixes of the requested country codes (e.g. "cn",
+// "private"), keyed by upper-case code. Other lists are skipped so a full geoip.dat does not stay in memory.
+// It is an error if a requested code is missing or is an inverse-match list.
+func LoadGeoIP(path string, codes []string) (map[string][]netip.Prefix, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list dlcpb.GeoIPList
+	if err := proto.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	want := make(map[string]bool, len(codes))
+	for _, c := range codes {
+		want[strings.ToUpper(c)] = true
+	}
+	out := make(map[string][]netip.Prefix, len(want))
+	for _, entry := range list.GetEntry() {
+		code := strings.ToUpper(entry.GetCountryCode())
+		if code == "" {
+			code = strings.ToUpper(entry.GetCode())
+		}
+		if !want[code] {
+			continue
+		}
+		if entry.GetInverseMatch() {
+			return nil, fmt.Errorf("geoip %s: inverse-match lists are not supported", code)
+		}
+		for _, c := range entry.GetCidr() {
+			addr, ok := netip.AddrFromSlice(c.GetIp())
+			if !ok {
+				continue
+			}
+			p, err := addr.Unmap().Prefix(int(c.GetPrefix()) - (addr.BitLen() - addr.Unmap().BitLen()))
+			if err != nil {
+				continue
+			}
+			out[code] = append(out[code], p)
+		}
+	}
+	for code := range want {
+		if _, ok := out[code]; !ok {
+			return nil, fmt.Errorf("geoip %s not found in %s", code, path)
+		}
+	}
+	return out, nil
+}
+
+// ipRange is an inclusive range of addresses of one family.
+type ipRange struct {
+	from, to netip.Addr
+}
+
+// ipSet is a set of addresses built from prefixes, merged into sorted ranges for binary search.
+type ipSet struct {
+	ranges []ipRange
+}
+
+// newIPSet returns the set of addresses covered by prefixes.
+func newIPSet(prefixes []netip.Prefix) *ipSet {
+	ranges := make([]ipRange, 0, len(prefixes))
+	for _, p := range prefixes {
+		p = p.Masked()
+		ranges = append(ranges, ipRange{from: p.Addr(), to: lastAddr(p)})
+	}
+	slices.SortFunc(ranges, func(a, b ipRange) int { return a.from.Compare(b.from) })
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if last.to.Is4() == r.from.Is4() && (r.from.Compare(last.to) <= 0 || last.to.Next() == r.from) {
+				if r.to.Compare(last.to) > 0 {
+					last.to = r.to
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return &ipSet{ranges: merged}
+}
+
+// lastAddr returns the highest address in the masked prefix p.
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// Contains reports whether addr is in the set.
+func (s *ipSet) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	i, found := slices.BinarySearchFunc(s.ranges, addr, func(r ipRange, a netip.Addr) int { return r.from.Compare(a) })
+	if found {
+		return true
+	}
+	return i > 0 && s.ranges[i-1].to.Is4() == addr.Is4() && addr.Compare(s.ranges[i-1].to) <= 0
+}
+
+// parseExpectedIPs splits `expected_ips` arguments into geoip codes (geoip:CC) and literal prefixes (CIDR or address).
+func parseExpectedIPs(args []string) (codes []string, prefixes []netip.Prefix, err error) {
+	for _, a := range args {
+		if code, ok := strings.CutPrefix(a, "geoip:"); ok {
+			if code == "" {
+				return nil, nil, fmt.Errorf("empty geoip code in '%s'", a)
+			}
+			codes = append(codes, strings.ToUpper(code))
+			continue
+		}
+		var p netip.Prefix
+		if strings.Contains(a, "/") {
+			p, err = netip.ParsePrefix(a)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(a)
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid expected_ips entry '%s'", a)
+		}
+		prefixes = append(prefixes, p)
+	}
+	return codes, prefixes, nil
+}
+
+// addrMatcher is a set of addresses that answers are checked against.
+type addrMatcher interface {
+	Contains(addr netip.Addr) bool
+}
+
+// countrySet matches addresses that a MaxMind country database places in one of codes.
+type countrySet struct {
+	db    *mmdbReader
+	codes map[string]bool
+}
+
+func (s *countrySet) Contains(addr netip.Addr) bool {
+	return s.codes[s.db.country(addr)]
+}
+
+// anyOf matches addresses matched by any of its members.
+type anyOf []addrMatcher
+
+func (a anyOf) Contains(addr netip.Addr) bool {
+	for _, m := range a {
+		if m.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveExpectedIPs builds each group's ExpectedIPs from its expected_ips literal prefixes and geoip codes, and the
+// addresses of its client_geoip countries. Codes are looked up in geoipfile if it is set, and otherwise in the country
+// database db.
+func resolveExpectedIPs(groups []*Group, geoipfile string, db *mmdbReader) error {
+	var codes []string
+	for _, g := range groups {
+		codes = append(codes, g.expectedGeo...)
+		for _, cr := range g.Clients {
+			codes = append(codes, cr.geo...)
+		}
+	}
+	var geo map[string][]netip.Prefix
+	if len(codes) > 0 {
+		switch {
+		case geoipfile != "":
+			var err error
+			if geo, err = LoadGeoIP(geoipfile, codes); err != nil {
+				return fmt.Errorf("loading geoipfile %s: %w", geoipfile, err)
+			}
+		case db == nil:
+			return errors.New("expected_ips with geoip: and client_geoip require geoipfile or mmdbfile")
+		}
+	}
+	for _, g := range groups {
+		for i := range g.Clients {
+			if cr := &g.Clients[i]; len(cr.geo) > 0 {
+				cr.geoIPs = geoMatcher(nil, cr.geo, geo, db)
+			}
+		}
+		if len(g.expectedGeo) == 0 && len(g.expectedNets) == 0 {
+			continue
+		}
+		g.ExpectedIPs = geoMatcher(g.expectedNets, g.expectedGeo, geo, db)
+	}
+	return nil
+}
+
+// geoMatcher matches prefixes and the addresses of codes: their prefixes in geo if geoipfile was loaded, and
+// otherwise those db places in them.
+func geoMatcher(prefixes []netip.Prefix, codes []string, geo map[string][]netip.Prefix, db *mmdbReader) addrMatcher {
+	prefixes = slices.Clone(prefixes)
+	if geo != nil {
+		for _, code := range codes {
+			prefixes = append(prefixes, geo[code]...)
+		}
+	}
+	var m addrMatcher = newIPSet(prefixes)
+	if geo == nil && len(codes) > 0 {
+		cs := &countrySet{db: db, codes: make(map[string]bool)}
+		for _, code := range codes {
+			cs.codes[code] = true
+		}
+		if len(prefixes) == 0 {
+			return cs
+		}
+		m = anyOf{m, cs}
+	}
+	return m
+}
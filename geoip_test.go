@@ -0,0 +1,126 @@
+package ruledforward
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/hr3lxphr6j/coredns-ruledforward/internal/dlcpb"
+)
+
+func writeTestGeoIP(t *testing.T) string {
+	t.Helper()
+	list := &dlcpb.GeoIPList{Entry: []*dlcpb.GeoIP{
+		{CountryCode: "CN", Cidr: []*dlcpb.CIDR{
+			{Ip: []byte{1, 0, 1, 0}, Prefix: 24},
+			{Ip: []byte{1, 0, 2, 0}, Prefix: 23},
+			{Ip: netip.MustParseAddr("2001:db8::").AsSlice(), Prefix: 32},
+		}},
+		{CountryCode: "US", Cidr: []*dlcpb.CIDR{{Ip: []byte{8, 8, 8, 0}, Prefix: 24}}},
+		{CountryCode: "NOTCN", InverseMatch: true, Cidr: []*dlcpb.CIDR{{Ip: []byte{1, 0, 1, 0}, Prefix: 24}}},
+	}}
+	data, err := proto.Marshal(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "geoip.dat")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadGeoIP(t *testing.T) {
+	path := writeTestGeoIP(t)
+	geo, err := LoadGeoIP(path, []string{"cn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(geo) != 1 || len(geo["CN"]) != 3 {
+		t.Fatalf("LoadGeoIP = %v, want only CN with 3 prefixes", geo)
+	}
+	if _, err := LoadGeoIP(path, []string{"jp"}); err == nil {
+		t.Error("expected error for missing code")
+	}
+	if _, err := LoadGeoIP(path, []string{"notcn"}); err == nil {
+		t.Error("expected error for inverse-match list")
+	}
+}
+
+func TestIPSet(t *testing.T) {
+	s := newIPSet([]netip.Prefix{
+		netip.MustParsePrefix("1.0.2.0/23"),
+		netip.MustParsePrefix("1.0.1.0/24"),
+		netip.MustParsePrefix("1.0.1.128/25"),
+		netip.MustParsePrefix("10.0.0.1/32"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	})
+	if len(s.ranges) != 3 {
+		t.Errorf("ranges = %v, want adjacent and overlapping prefixes merged into 3", s.ranges)
+	}
+	tests := map[string]bool{
+		"1.0.1.0":          true,
+		"1.0.3.255":        true,
+		"1.0.4.0":          false,
+		"1.0.0.255":        false,
+		"10.0.0.1":         true,
+		"10.0.0.2":         false,
+		"::ffff:1.0.2.1":   true,
+		"2001:db8:1::1":    true,
+		"2001:db9::":       false,
+		"::1":              false,
+		"255.255.255.255":  false,
+		"0.0.0.0":          false,
+		"ffff::":           false,
+		"2001:db8:ffff::1": true,
+	}
+	for addr, want := range tests {
+		if got := s.Contains(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("Contains(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestParseExpectedIPs(t *testing.T) {
+	codes, prefixes, err := parseExpectedIPs([]string{"geoip:cn", "10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 1 || codes[0] != "CN" || len(prefixes) != 2 || prefixes[1].Bits() != 32 {
+		t.Errorf("codes = %v, prefixes = %v", codes, prefixes)
+	}
+	for _, bad := range []string{"geoip:", "not-an-ip", "10.0.0.0/33"} {
+		if _, _, err := parseExpectedIPs([]string{bad}); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
+
+func TestClientGeoIP(t *testing.T) {
+	if _, err := parseClientGeoIPRule(nil); err == nil {
+		t.Error("client_geoip without a country code should fail")
+	}
+	cr, err := parseClientGeoIPRule([]string{"cn", "geoip:us"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &Group{Name: "roaming", Clients: []clientRule{cr}}
+	if err := resolveExpectedIPs([]*Group{g}, "", nil); err == nil {
+		t.Error("client_geoip without geoipfile or mmdbfile should fail")
+	}
+	if err := resolveExpectedIPs([]*Group{g}, writeTestGeoIP(t), nil); err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{"1.0.1.1": true, "8.8.8.8": true, "2001:db8::1": true, "9.9.9.9": false} {
+		if got := g.appliesTo(queryClient{addr: netip.MustParseAddr(addr)}, time.Now()); got != want {
+			t.Errorf("appliesTo(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	if g.appliesTo(queryClient{}, time.Now()) {
+		t.Error("a group with client_geoip should not apply to the zero client")
+	}
+}
@@ -0,0 +1,188 @@
+package ruledforward
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/coredns/caddy"
+)
+
+// groupTable is the list of groups queries are matched against, replaced as a whole when groups are added or
+// removed at runtime so that ServeDNS reads it without a lock.
+type groupTable struct {
+	groups       []*Group
+	defaultGroup *Group
+}
+
+// routes returns the groups in matching order and the default group, or nil if there is none.
+func (r *Ruledforward) routes() ([]*Group, *Group) {
+	if t := r.table.Load(); t != nil {
+		return t.groups, t.defaultGroup
+	}
+	return r.groups, r.defaultGroup
+}
+
+// AddGroup adds a group to the running instance. block is a `group NAME { ... }` block as in the Corefile; `use`,
+// `split` and `fallback` may refer to the rulesets and groups of the instance. The group is matched before the group
+// named before, or after all others if before is empty. Its rules, including those of remote sources, are loaded
+// before it takes queries. Groups added at runtime are not kept across a Corefile reload.
+func (r *Ruledforward) AddGroup(block, before string) (*Group, error) {
+	g, err := r.parseGroupBlock(block)
+	if err != nil {
+		return nil, err
+	}
+	// Checked again when the group is inserted; this only saves loading the rules of a group that cannot be added.
+	if groups, _ := r.routes(); slices.ContainsFunc(groups, func(o *Group) bool { return o.Name == g.Name }) {
+		return nil, fmt.Errorf("group %s already exists", g.Name)
+	}
+	if err := resolveExpectedIPs([]*Group{g}, r.geoipfile, r.countries); err != nil {
+		return nil, err
+	}
+	if err := resolveBlockASN([]*Group{g}, r.asn); err != nil {
+		return nil, err
+	}
+	if err := resolveCategories([]*Group{g}, r.categorizer); err != nil {
+		return nil, err
+	}
+	if err := resolveClientTags([]*Group{g}, r.clientTags); err != nil {
+		return nil, err
+	}
+
+	// Rules are loaded before taking tableMu, so that a slow remote source does not hold up other changes.
+	g.trackOrigins = r.debug
+	if err := g.Update(r.dlc, UpdateMatcherLocal); err != nil {
+		return nil, fmt.Errorf("updating group %s: %w", g.Name, err)
+	}
+	if g.hasRemoteSources() {
+		// As at startup, a failed remote load is logged and left to the refresh schedule and watchers.
+		if err := g.Update(r.dlc, UpdateMatcherAll); err != nil {
+			log.Errorf("updating group %s: %v", g.Name, err)
+		}
+	}
+	g.initialized.Store(true)
+
+	r.tableMu.Lock()
+	defer r.tableMu.Unlock()
+	groups, defaultGroup := r.routes()
+	if slices.ContainsFunc(groups, func(o *Group) bool { return o.Name == g.Name }) {
+		return nil, fmt.Errorf("group %s already exists", g.Name)
+	}
+	i := len(groups)
+	if before != "" {
+		if i = slices.IndexFunc(groups, func(o *Group) bool { return o.Name == before }); i < 0 {
+			return nil, fmt.Errorf("no group %s", before)
+		}
+	}
+	if err := g.resolveRefs(groups, r.rulesets); err != nil {
+		return nil, err
+	}
+	g.onUpdate = r.checkConflicts
+	r.startGroup(g)
+
+	if g.Name == "default" {
+		defaultGroup = g
+	}
+	r.table.Store(&groupTable{groups: slices.Insert(slices.Clone(groups), i, g), defaultGroup: defaultGroup})
+	matcherGeneration.Add(1)
+	r.checkConflicts()
+	return g, nil
+}
+
+// RemoveGroup removes the group named name from the running instance and stops its upstreams and rule sources.
+// A group that is the split target or fallback of another, or that the pipeline uses, cannot be removed.
+func (r *Ruledforward) RemoveGroup(name string) error {
+	r.tableMu.Lock()
+	defer r.tableMu.Unlock()
+	groups, defaultGroup := r.routes()
+	i := slices.IndexFunc(groups, func(g *Group) bool { return g.Name == name })
+	if i < 0 {
+		return fmt.Errorf("no group %s", name)
+	}
+	g := groups[i]
+	if r.pipeline != nil && r.pipeline.uses(g) {
+		return fmt.Errorf("group %s is used by the pipeline", name)
+	}
+	for _, o := range groups {
+		if o.Fallback == g || slices.ContainsFunc(o.Split, func(t splitTarget) bool { return t.group == g }) {
+			return fmt.Errorf("group %s is used by group %s", name, o.Name)
+		}
+	}
+
+	if defaultGroup == g {
+		defaultGroup = nil
+	}
+	r.table.Store(&groupTable{groups: slices.Delete(slices.Clone(groups), i, i+1), defaultGroup: defaultGroup})
+	matcherGeneration.Add(1)
+	// Queries already routed to g may still be answered by it; stopping a proxy only ends its health checks and
+	// idle connections.
+	unregisterLiveGroup(g)
+	g.stop()
+	ruleConflicts.DeleteLabelValues(g.Name)
+	r.checkConflicts()
+	return nil
+}
+
+// runtimeGroupDirectives are the directives a group added at runtime may use, besides rules. Those that read or
+// write local files (runtime_rules, local adguard_rules, tls, tls_ca, action zonefile and script), change the host's
+// kernel state (ipset, nftset, bind) or connect to other services for rules (redis_rules, kubernetes_rules,
+// adguard_home, txt_rules, threat_feed) are left out, so that the admin API cannot reach beyond DNS routing.
+var runtimeGroupDirectives = map[string]bool{
+	"action": true, "mode": true, "geosite": true, "adguard_rules": true, "bootstrap_dns": true, "download_proxy": true,
+	"verify": true, "refresh": true, "split": true, "use": true, "to": true, "policy": true, "max_fails": true,
+	"failfast_all_unhealthy_upstreams": true, "tls_servername": true, "tls_min_version": true, "tls_ciphers": true,
+	"tls_session_tickets": true, "expire": true, "keepalive": true, "bufsize": true, "hedge": true, "bloom": true,
+	"dga": true, "category": true, "clients": true, "client_tag": true, "client_mac": true, "client_id": true,
+	"client_geoip": true, "dnssec_flags": true, "no_bloom": true, "negative_cache": true, "prefetch": true,
+	"concurrent": true, "consensus": true, "max_concurrent": true, "ratelimit": true, "dns0x20": true, "ddr": true,
+	"expected_ips": true, "block_asn": true, "fallback": true, "fallback_on": true, "cname_check": true,
+	"strip_ech": true, "filter_response_types": true, "block_qtypes": true, "rewrite": true, "map_answer": true,
+	"sort_answers": true, "min_ttl": true, "max_ttl": true, "max_idle_conns": true, "force_tcp": true,
+	"prefer_udp": true,
+}
+
+// parseGroupBlock builds the group of a `group NAME { ... }` block added at runtime.
+func (r *Ruledforward) parseGroupBlock(block string) (*Group, error) {
+	c := caddy.NewTestController("dns", block)
+	if !c.Next() || c.Val() != "group" {
+		return nil, errors.New("expected a group block")
+	}
+	if !c.NextArg() {
+		return nil, c.ArgErr()
+	}
+	gb := newGroupBuild()
+	gb.Name = c.Val()
+	if len(c.RemainingArgs()) > 0 {
+		return nil, c.Errf("group %s: extends is not supported for groups added at runtime", gb.Name)
+	}
+	for c.Next() && c.Val() != "}" {
+		// Rules are domain names, `TYPE:VALUE` or AdGuard `||` lines; anything else is a directive.
+		if d := c.Val(); d != "{" && !runtimeGroupDirectives[d] && !strings.ContainsAny(d, ".:|") {
+			return nil, c.Errf("group %s: %s is not supported for groups added at runtime", gb.Name, d)
+		}
+		if err := parseGroupDirective(c, gb); err != nil {
+			return nil, err
+		}
+	}
+	if c.Next() {
+		return nil, c.Errf("unexpected '%s' after the group block", c.Val())
+	}
+	if len(gb.adguardPaths) > 0 {
+		return nil, c.Errf("group %s: local adguard_rules are not supported for groups added at runtime, use URLs", gb.Name)
+	}
+	if gb.Action == "zonefile" || gb.Action == "script" {
+		return nil, c.Errf("group %s: action %s is not supported for groups added at runtime", gb.Name, gb.Action)
+	}
+	for _, name := range gb.geositeNames {
+		if _, _, ok := extGeosite(name); ok {
+			return nil, c.Errf("group %s: geosite %s is not supported for groups added at runtime", gb.Name, name)
+		}
+	}
+	g, err := buildGroup(gb, nil)
+	if err != nil {
+		return nil, err
+	}
+	g.key = groupKey(r.server, g.Name)
+	return g, nil
+}
@@ -0,0 +1,172 @@
+package ruledforward
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddRemoveGroup(t *testing.T) {
+	def := &Group{Name: "default", Action: "empty"}
+	def.SetMatcher(NewMatcher())
+	def.initialized.Store(true)
+	r := &Ruledforward{from: ".", server: "groups:53", groups: []*Group{def}, defaultGroup: def, decisions: newLRU[string, decision](10)}
+
+	if g := r.routeFor("x.ads.example.", queryClient{}, nil); g != def {
+		t.Fatalf("routeFor = %v, want default", g)
+	}
+	ads, err := r.AddGroup("group ads {\n    action empty\n    ads.example\n}", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := r.routeFor("x.ads.example.", queryClient{}, nil); g != ads {
+		t.Errorf("routeFor after AddGroup = %v, want ads", g)
+	}
+	if !ads.initialized.Load() || !r.Ready() {
+		t.Error("an added group should be ready")
+	}
+
+	trusted, err := r.AddGroup("group trusted {\n    to 127.0.0.1:1\n    full:x.ads.example\n}", "ads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := r.routeFor("x.ads.example.", queryClient{}, nil); g != trusted {
+		t.Errorf("routeFor = %v, want the group added before ads", g)
+	}
+	if _, err := r.AddGroup("group local {\n    to 127.0.0.1:2\n    fallback trusted\n    local.example\n}", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, block := range []string{
+		"group ads {\n    action empty\n}",             // exists
+		"group x {\n    fallback nope\n}",              // unknown fallback
+		"group x extends ads {\n}",                     // extends
+		"group x {\n    action empty\n}\ngroup y {\n}", // two blocks
+		"ruleset x {\n}",                               // not a group
+		"group x {\n    hedge soon\n}",                 // bad directive
+		"group x {\n    geosite ext:x.dat:ads\n}",      // ext geosite
+		"group x {\n    action empty\n    runtime_rules /tmp/x\n}",
+		"group x {\n    action empty\n    adguard_rules /etc/passwd\n}",
+		"group x {\n    to 1.1.1.1\n    ipset x\n}",
+		"group x {\n    to 1.1.1.1\n    tls /tmp/cert /tmp/key\n}",
+		"group x {\n    action empty\n    threat_feed urlhaus /tmp/feed\n}",
+		"group x {\n    action zonefile /etc/hosts\n}",
+		"group x {\n    action script /etc/coredns/policy.lua\n}",
+	} {
+		if _, err := r.AddGroup(block, ""); err == nil {
+			t.Errorf("AddGroup(%q) should fail", block)
+		}
+	}
+	if _, err := r.AddGroup("group x {\n    action empty\n}", "nope"); err == nil {
+		t.Error("AddGroup before an unknown group should fail")
+	}
+
+	if err := r.RemoveGroup("trusted"); err == nil {
+		t.Error("removing the fallback of another group should fail")
+	}
+	if err := r.RemoveGroup("local"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RemoveGroup("trusted"); err != nil {
+		t.Fatal(err)
+	}
+	if g := r.routeFor("x.ads.example.", queryClient{}, nil); g != ads {
+		t.Errorf("routeFor after RemoveGroup = %v, want ads", g)
+	}
+	if err := r.RemoveGroup("default"); err != nil {
+		t.Fatal(err)
+	}
+	if g := r.routeFor("www.example.", queryClient{}, nil); g != nil {
+		t.Errorf("routeFor without a default group = %v, want nil", g)
+	}
+	if err := r.RemoveGroup("default"); err == nil {
+		t.Error("removing a missing group should fail")
+	}
+	if groups, _ := r.routes(); len(groups) != 1 || groups[0] != ads || len(r.groups) != 1 {
+		t.Errorf("groups = %v, want only ads; the configured groups should stay as they were", groups)
+	}
+}
+
+func TestAddGroupSlowSource(t *testing.T) {
+	requested, release := make(chan struct{}), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		close(requested)
+		<-release
+		_, _ = w.Write([]byte("||slow.example^\n"))
+	}))
+	defer srv.Close()
+	r := &Ruledforward{from: ".", server: "groups-slow:53"}
+
+	added := make(chan error, 1)
+	go func() {
+		_, err := r.AddGroup("group slow {\n    action empty\n    adguard_rules "+srv.URL+"\n}", "")
+		added <- err
+	}()
+	<-requested
+	// Other groups can be added and removed while the rules of slow are downloaded.
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.AddGroup("group fast {\n    action empty\n    fast.example\n}", "")
+		if err == nil {
+			err = r.RemoveGroup("fast")
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("adding a group waited for the rules of another group being added")
+	}
+	close(release)
+	if err := <-added; err != nil {
+		t.Fatal(err)
+	}
+	if g := r.routeFor("slow.example.", queryClient{}, nil); g == nil || g.Name != "slow" {
+		t.Errorf("routeFor(slow.example.) = %v, want slow", g)
+	}
+}
+
+func TestAdminGroups(t *testing.T) {
+	r := &Ruledforward{from: ".", server: "admin-groups:53"}
+	r.registerInstance()
+	t.Cleanup(r.unregisterInstance)
+	srv := httptest.NewServer(adminHandler())
+	defer srv.Close()
+	do := func(method, path, body string) (int, map[string]string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out map[string]string
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+
+	if code, out := do("POST", "/api/groups?server=admin-groups:53", "group ads {\n    action empty\n    ads.example\n}"); code != http.StatusOK || out["added"] != "ads" {
+		t.Fatalf("POST = %d, %v", code, out)
+	}
+	if g := r.groupFor("x.ads.example.", nil); g == nil || g.Name != "ads" {
+		t.Errorf("groupFor = %v, want ads", g)
+	}
+	if code, _ := do("POST", "/api/groups?server=admin-groups:53", "group ads {\n}"); code != http.StatusBadRequest {
+		t.Errorf("POST of an existing group: status %d, want 400", code)
+	}
+	if code, _ := do("POST", "/api/groups?server=nope:53", "group x {\n}"); code != http.StatusNotFound {
+		t.Errorf("POST to an unknown server block: status %d, want 404", code)
+	}
+	if code, out := do("DELETE", "/api/groups/ads?server=admin-groups:53", ""); code != http.StatusOK || out["removed"] != "ads" {
+		t.Errorf("DELETE = %d, %v", code, out)
+	}
+	if g := r.groupFor("x.ads.example.", nil); g != nil {
+		t.Errorf("groupFor after DELETE = %v, want nil", g)
+	}
+}
@@ -0,0 +1,90 @@
+package ruledforward
+
+import (
+	"context"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// hedgeTarget returns the upstream a hedged query for pr goes to, or nil if the group does not hedge or has no
+// other healthy upstream.
+func (g *Group) hedgeTarget(list []*proxy.Proxy, i int, pr *proxy.Proxy) *proxy.Proxy {
+	if g.Hedge <= 0 {
+		return nil
+	}
+	if others := g.otherUpstreams(list, i, pr, 1); len(others) > 0 {
+		return others[0]
+	}
+	return nil
+}
+
+// otherUpstreams returns up to n healthy upstreams other than pr, in list order from position i, wrapping around.
+// It returns none if n < 1.
+func (g *Group) otherUpstreams(list []*proxy.Proxy, i int, pr *proxy.Proxy, n int) []*proxy.Proxy {
+	var out []*proxy.Proxy
+	for j := 0; j < len(list) && len(out) < n; j++ {
+		next := list[(i+j)%len(list)]
+		if next != pr && !next.Down(g.Maxfails) {
+			out = append(out, next)
+		}
+	}
+	return out
+}
+
+type exchangeResult struct {
+	pr  *proxy.Proxy
+	ret *dns.Msg
+	err error
+}
+
+// exchangeHedged sends fwd to pr and, if pr has not answered within g.Hedge, to next as well. It returns the first
+// reply and the upstream it came from. If pr fails before the hedge is sent, or both fail, it returns the last error
+// and the upstream that caused it.
+func (g *Group) exchangeHedged(ctx context.Context, pr, next *proxy.Proxy, fwd request.Request) (*proxy.Proxy, *dns.Msg, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Each exchange gets its own copy of the query: the proxy sets its ID while sending, and the losing exchange may
+	// still be running when the winner's reply is relayed.
+	results := make(chan exchangeResult, 2)
+	send := func(p *proxy.Proxy) {
+		ret, err := g.exchange(ctx, p, request.Request{W: fwd.W, Req: fwd.Req.Copy()})
+		results <- exchangeResult{pr: p, ret: ret, err: err}
+	}
+	go send(pr)
+
+	timer := time.NewTimer(g.Hedge)
+	defer timer.Stop()
+	pending, hedged := 1, false
+	for {
+		var res exchangeResult
+		select {
+		case <-timer.C:
+			hedged = true
+			pending++
+			go send(next)
+			continue
+		case res = <-results:
+		}
+		pending--
+		if res.err == nil {
+			if hedged {
+				winner := "primary"
+				if res.pr == next {
+					winner = "hedge"
+				}
+				hedgeTotal.WithLabelValues(g.Name, winner).Inc()
+			}
+			return res.pr, res.ret, nil
+		}
+		if pending == 0 {
+			if hedged {
+				hedgeTotal.WithLabelValues(g.Name, "none").Inc()
+			}
+			return res.pr, res.ret, res.err
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package ruledforward
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+// newDelayedUpstream returns an upstream answering with addr after delay, counting the queries it receives.
+// Unlike newTestUpstream, several of them can run at once with their own handlers.
+func newDelayedUpstream(t *testing.T, addr string, delay time.Duration, n *atomic.Int32) *proxy.Proxy {
+	t.Helper()
+	s := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		n.Add(1)
+		time.Sleep(delay)
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" 300 IN A "+addr))
+		_ = w.WriteMsg(ret)
+	})
+	t.Cleanup(s.Close)
+	_, port, _ := net.SplitHostPort(s.Addr)
+	return proxy.NewProxy("ruledforward", net.JoinHostPort("127.0.0.1", port), transport.DNS)
+}
+
+func TestForwardGroupHedge(t *testing.T) {
+	var slowN, fastN atomic.Int32
+	slow := newDelayedUpstream(t, "192.0.2.1", time.Second, &slowN)
+	fast := newDelayedUpstream(t, "192.0.2.2", 0, &fastN)
+
+	g := &Group{Name: "default", Action: "forward", Policy: &sequential{}, Hedge: 50 * time.Millisecond}
+	g.SetProxies([]*proxy.Proxy{slow, fast})
+	g.SetMatcher(NewMatcher())
+	r := &Ruledforward{from: ".", groups: []*Group{g}, defaultGroup: g}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	start := time.Now()
+	if _, err := r.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("hedged query took %v", d)
+	}
+	if len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].(*dns.A).A.String() != "192.0.2.2" {
+		t.Errorf("answer = %v, want the hedged upstream's 192.0.2.2", rec.Msg.Answer)
+	}
+	if rec.Msg.Id != req.Id {
+		t.Errorf("reply id = %d, want %d", rec.Msg.Id, req.Id)
+	}
+
+	// A fast primary answers alone.
+	g.SetProxies([]*proxy.Proxy{fast, slow})
+	slowN.Store(0)
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := r.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].(*dns.A).A.String() != "192.0.2.2" {
+		t.Errorf("answer = %v, want the primary's 192.0.2.2", rec.Msg.Answer)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if slowN.Load() != 0 {
+		t.Errorf("slow upstream got %d queries, want none without hedging", slowN.Load())
+	}
+}
+
+func TestHedgeTarget(t *testing.T) {
+	a := proxy.NewProxy("ruledforward", "127.0.0.1:1", transport.DNS)
+	b := proxy.NewProxy("ruledforward", "127.0.0.1:2", transport.DNS)
+	g := &Group{}
+	if g.hedgeTarget([]*proxy.Proxy{a, b}, 1, a) != nil {
+		t.Error("no hedge target without hedge")
+	}
+	g.Hedge = time.Millisecond
+	if g.hedgeTarget([]*proxy.Proxy{a, b}, 1, a) != b {
+		t.Error("hedge target should be the next upstream")
+	}
+	if g.hedgeTarget([]*proxy.Proxy{a, b}, 2, b) != a {
+		t.Error("hedge target should wrap around")
+	}
+	if g.hedgeTarget([]*proxy.Proxy{a}, 1, a) != nil {
+		t.Error("no hedge target with a single upstream")
+	}
+}
@@ -0,0 +1,95 @@
+package ruledforward
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/parse"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+)
+
+const (
+	upstreamResolveInterval = 5 * time.Minute
+	upstreamResolveTimeout  = 5 * time.Second
+)
+
+// upstreamHostname reports whether a `to` entry names a host (e.g. tls://dns.google or dns.example:5353) rather than
+// an address or a resolv.conf-style file. It returns the host name and the entry as trans://name:port, with the
+// transport's default port filled in.
+func upstreamHostname(entry string) (name, normalized string, ok bool) {
+	trans, host := parse.Transport(entry)
+	if _, err := os.Stat(host); err == nil {
+		return "", "", false
+	}
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		name, port = host, transport.Port
+		if trans == transport.TLS {
+			port = transport.TLSPort
+		}
+	}
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || strings.ContainsAny(name, "/%") || net.ParseIP(name) != nil {
+		return "", "", false
+	}
+	return name, trans + "://" + net.JoinHostPort(name, port), true
+}
+
+// hasHostnames reports whether any of the `to` entries names a host.
+func hasHostnames(toHosts []string) bool {
+	for _, h := range toHosts {
+		if _, _, ok := upstreamHostname(h); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// expandHostnames returns cfg.toHosts with each host name replaced by the addresses it resolves to via the bootstrap
+// server. origins maps each such transport-qualified address to the trans://name:port entry it came from. Names that
+// fail to resolve are logged and left out; failed reports that this happened so the caller can retry soon.
+func (cfg *upstreamConfig) expandHostnames() (hosts []string, origins map[string]string, failed bool) {
+	for _, entry := range cfg.toHosts {
+		name, normalized, ok := upstreamHostname(entry)
+		if !ok {
+			hosts = append(hosts, entry)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), upstreamResolveTimeout)
+		ips, err := bootstrapResolver(cfg.bootstrapDNS).LookupIP(ctx, "ip", name)
+		cancel()
+		if err != nil {
+			log.Warningf("Resolving upstream %s via %s: %v", name, cfg.bootstrapDNS, err)
+			failed = true
+			continue
+		}
+		trans, host := parse.Transport(normalized)
+		_, port, _ := net.SplitHostPort(host)
+		if origins == nil {
+			origins = make(map[string]string)
+		}
+		for _, ip := range ips {
+			addr := trans + "://" + net.JoinHostPort(ip.String(), port)
+			hosts = append(hosts, addr)
+			origins[addr] = normalized
+		}
+	}
+	return hosts, origins, failed
+}
+
+// upstreamResolveDue reports whether the group's upstream host names and DDR endpoints should be resolved again:
+// periodically, and on every watch tick while the last attempt failed. Only called from the watch goroutine.
+func (g *Group) upstreamResolveDue(now time.Time) bool {
+	if !g.upstream.resolves() {
+		return false
+	}
+	return g.upstream.unresolved || now.Sub(g.resolvedAt) >= upstreamResolveInterval
+}
+
+// resolves reports whether the proxy set depends on lookups that must be repeated to stay current.
+func (cfg *upstreamConfig) resolves() bool {
+	return cfg != nil && (cfg.hostnames || cfg.ddr)
+}
@@ -0,0 +1,129 @@
+package ruledforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamHostname(t *testing.T) {
+	tests := []struct {
+		entry      string
+		name       string
+		normalized string
+		ok         bool
+	}{
+		{"tls://dns.google", "dns.google", "tls://dns.google:853", true},
+		{"dns.example.", "dns.example", "dns://dns.example:53", true},
+		{"dns://resolver.example:5353", "resolver.example", "dns://resolver.example:5353", true},
+		{"8.8.8.8", "", "", false},
+		{"tls://[2001:4860:4860::8888]:853", "", "", false},
+		{"fe80::1%eth0", "", "", false},
+	}
+	for _, tc := range tests {
+		name, normalized, ok := upstreamHostname(tc.entry)
+		if name != tc.name || normalized != tc.normalized || ok != tc.ok {
+			t.Errorf("upstreamHostname(%q) = %q, %q, %v, want %q, %q, %v",
+				tc.entry, name, normalized, ok, tc.name, tc.normalized, tc.ok)
+		}
+	}
+}
+
+// newTestBootstrap starts a DNS server answering A queries from addrs and returns its address.
+func newTestBootstrap(t *testing.T, addrs map[string][]string) string {
+	t.Helper()
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		q := r.Question[0]
+		if _, ok := addrs[q.Name]; !ok {
+			ret.Rcode = dns.RcodeNameError
+		}
+		if q.Qtype == dns.TypeA {
+			for _, a := range addrs[q.Name] {
+				ret.Answer = append(ret.Answer, test.A(q.Name+" 60 IN A "+a))
+			}
+		}
+		_ = w.WriteMsg(ret)
+	})
+	t.Cleanup(s.Close)
+	_, port, _ := net.SplitHostPort(s.Addr)
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+func TestNewProxiesHostnames(t *testing.T) {
+	bootstrap := newTestBootstrap(t, map[string][]string{
+		"dns.google.":  {"192.0.2.1", "192.0.2.2"},
+		"one.example.": {"192.0.2.3"},
+	})
+	cfg := &upstreamConfig{
+		toHosts:      []string{"tls://dns.google", "tls://one.example", "missing.example", "8.8.8.8"},
+		perUpstream:  map[string]upstreamOptions{"tls://one.example:853": {tlsServerName: "override.example"}},
+		bootstrapDNS: bootstrap,
+		expire:       defaultExpire,
+		hostnames:    true,
+	}
+	list, byKey, err := newProxies("g", cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.unresolved {
+		t.Error("unresolved = false, want true for missing.example")
+	}
+	want := map[string]string{
+		"tls://192.0.2.1:853": "dns.google",
+		"tls://192.0.2.2:853": "dns.google",
+		"tls://192.0.2.3:853": "override.example",
+		"dns://8.8.8.8:53":    "",
+	}
+	if len(list) != len(want) || len(byKey) != len(want) {
+		t.Fatalf("len(list) = %d, len(byKey) = %d, want %d", len(list), len(byKey), len(want))
+	}
+	for key, sni := range want {
+		p := byKey[key]
+		if p == nil {
+			t.Fatalf("no proxy for %s", key)
+		}
+		if sni == "" {
+			continue
+		}
+		if got := p.GetTransport().GetTLSConfig().ServerName; got != sni {
+			t.Errorf("%s: ServerName = %q, want %q", key, got, sni)
+		}
+	}
+
+	// Re-resolving to the same addresses keeps the proxies.
+	list2, _, err := newProxies("g", cfg, byKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range list {
+		if list[i] != list2[i] {
+			t.Errorf("proxy %d not reused", i)
+		}
+	}
+}
+
+func TestUpstreamResolveDue(t *testing.T) {
+	now := time.Now()
+	g := &Group{upstream: &upstreamConfig{hostnames: true}, resolvedAt: now}
+	if g.upstreamResolveDue(now.Add(time.Minute)) {
+		t.Error("due one minute after resolving")
+	}
+	if !g.upstreamResolveDue(now.Add(upstreamResolveInterval)) {
+		t.Error("not due after upstreamResolveInterval")
+	}
+	g.upstream.unresolved = true
+	if !g.upstreamResolveDue(now.Add(time.Second)) {
+		t.Error("not due while a name is unresolved")
+	}
+	g.upstream = &upstreamConfig{}
+	if g.upstreamResolveDue(now.Add(time.Hour)) {
+		t.Error("due without host names")
+	}
+}
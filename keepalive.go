@@ -0,0 +1,54 @@
+package ruledforward
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// keepaliveTimeout bounds a keepalive query.
+const keepaliveTimeout = 5 * time.Second
+
+// keepalive sends a query over a cached connection to each of the group's DoT upstreams, or each upstream with
+// force_tcp, every interval until stop is closed. This keeps the connection from reaching `expire` and from being
+// dropped by middleboxes that close idle connections, and if it was dropped, it is dialed again here rather than by
+// the next query.
+func (g *Group) keepalive(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, pr := range g.Proxies() {
+				if pr.GetTransport().GetTLSConfig() == nil && !g.Opts.ForceTCP {
+					continue
+				}
+				if err := keepaliveQuery(pr); err != nil {
+					log.Debugf("Keepalive to %s of group %s failed: %v", pr.Addr(), g.Name, err)
+				}
+			}
+		}
+	}
+}
+
+// keepaliveQuery sends a query for the root NS records to pr over TCP, dialing again once if the cached connection
+// turns out to be closed.
+func keepaliveQuery(pr *proxy.Proxy) error {
+	req := new(dns.Msg)
+	req.SetQuestion(".", dns.TypeNS)
+	ctx, cancel := context.WithTimeout(context.Background(), keepaliveTimeout)
+	defer cancel()
+	state := request.Request{W: discardWriter{}, Req: req}
+	_, err := pr.Connect(ctx, state, proxy.Options{ForceTCP: true})
+	if errors.Is(err, proxy.ErrCachedClosed) {
+		_, err = pr.Connect(ctx, state, proxy.Options{ForceTCP: true})
+	}
+	return err
+}
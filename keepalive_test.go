@@ -0,0 +1,57 @@
+package ruledforward
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+
+	"github.com/miekg/dns"
+)
+
+func TestKeepalive(t *testing.T) {
+	var mu sync.Mutex
+	conns := make(map[string]int) // TCP queries by client address
+	p := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if w.RemoteAddr().Network() == "tcp" {
+			mu.Lock()
+			conns[w.RemoteAddr().String()]++
+			mu.Unlock()
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		_ = w.WriteMsg(ret)
+	})
+	p.SetExpire(time.Minute)
+	g := &Group{Name: "dot", Action: "forward", Opts: proxy.Options{ForceTCP: true}}
+	g.SetProxies([]*proxy.Proxy{p})
+
+	stop := make(chan struct{})
+	go g.keepalive(10*time.Millisecond, stop)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := 0
+		for _, c := range conns {
+			n += c
+		}
+		mu.Unlock()
+		if n >= 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(conns) != 1 {
+		t.Fatalf("keepalive queries came over %d connections, want 1: %v", len(conns), conns)
+	}
+	for _, n := range conns {
+		if n < 3 {
+			t.Errorf("%d keepalive queries, want at least 3", n)
+		}
+	}
+}
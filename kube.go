@@ -0,0 +1,259 @@
+package ruledforward
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// serviceAccountDir holds the token, CA certificate and namespace that Kubernetes mounts into pods.
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	kubeTimeout       = 10 * time.Second
+)
+
+// kubeSource is a `kubernetes_rules` setting: a ConfigMap whose data values are rule files in the adguard_rules
+// format. It is read and watched through the Kubernetes API with the pod's service account, which needs get, list
+// and watch on configmaps in the namespace.
+type kubeSource struct {
+	namespace string   // "" for the pod's namespace
+	name      string   // ConfigMap name
+	keys      []string // data keys to use; all if empty
+	dir       string   // service account directory
+
+	mu     sync.Mutex
+	client *kubeClient // created on first use, so the Corefile can be parsed outside a cluster
+}
+
+// parseKubeSource parses `kubernetes_rules [NAMESPACE/]NAME [KEY...]`.
+func parseKubeSource(ref string, keys []string) (*kubeSource, error) {
+	ns, name, ok := strings.Cut(ref, "/")
+	if !ok {
+		ns, name = "", ref
+	}
+	for _, s := range append([]string{name}, keys...) {
+		if s == "" || strings.ContainsAny(s, "/?&#% ") {
+			return nil, fmt.Errorf("invalid ConfigMap name or key '%s'", s)
+		}
+	}
+	if ok && (ns == "" || strings.ContainsAny(ns, "/?&#% ")) {
+		return nil, fmt.Errorf("invalid namespace in '%s'", ref)
+	}
+	return &kubeSource{namespace: ns, name: name, keys: keys, dir: serviceAccountDir}, nil
+}
+
+func (s *kubeSource) String() string {
+	ns := s.namespace
+	if ns == "" {
+		ns = "(pod namespace)"
+	}
+	return "configmap " + ns + "/" + s.name
+}
+
+// kubeClient calls the Kubernetes API server of the cluster the pod runs in.
+type kubeClient struct {
+	base      string
+	namespace string
+	tokenPath string
+	http      *http.Client
+}
+
+// newKubeClient returns a client for the API server in KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT,
+// authenticating with the service account in dir.
+func newKubeClient(dir string) (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster: KUBERNETES_SERVICE_HOST/PORT are not set")
+	}
+	ca, err := os.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s", filepath.Join(dir, "ca.crt"))
+	}
+	ns, err := os.ReadFile(filepath.Join(dir, "namespace"))
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	return &kubeClient{
+		base:      "https://" + net.JoinHostPort(host, port),
+		namespace: strings.TrimSpace(string(ns)),
+		tokenPath: filepath.Join(dir, "token"),
+		http:      &http.Client{Transport: transport},
+	}, nil
+}
+
+// get requests path. The token is re-read for each request since projected service account tokens are rotated.
+func (c *kubeClient) get(ctx context.Context, path string) (*http.Response, error) {
+	token, err := os.ReadFile(c.tokenPath)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+string(bytes.TrimSpace(token)))
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("GET %s: status %d: %s", path, resp.StatusCode, bytes.TrimSpace(body))
+	}
+	return resp, nil
+}
+
+// configMapList is the part of a ConfigMapList (and of watch event objects) that rule loading reads.
+type configMapList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []configMap `json:"items"`
+}
+
+type configMap struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Data map[string]string `json:"data"`
+}
+
+func (s *kubeSource) kubeClient() (*kubeClient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		c, err := newKubeClient(s.dir)
+		if err != nil {
+			return nil, err
+		}
+		s.client = c
+	}
+	return s.client, nil
+}
+
+// path returns the API path listing the source's ConfigMap, with extra query parameters.
+func (s *kubeSource) path(c *kubeClient, query string) string {
+	ns := s.namespace
+	if ns == "" {
+		ns = c.namespace
+	}
+	q := "fieldSelector=" + url.QueryEscape("metadata.name="+s.name)
+	if query != "" {
+		q += "&" + query
+	}
+	return "/api/v1/namespaces/" + ns + "/configmaps?" + q
+}
+
+// list returns the ConfigMap (nil if it does not exist) and the resource version to watch from.
+func (s *kubeSource) list(ctx context.Context, c *kubeClient) (*configMap, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, kubeTimeout)
+	defer cancel()
+	resp, err := c.get(ctx, s.path(c, ""))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	var list configMapList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, "", err
+	}
+	if len(list.Items) == 0 {
+		return nil, list.Metadata.ResourceVersion, nil
+	}
+	return &list.Items[0], list.Metadata.ResourceVersion, nil
+}
+
+// load reads the rules of the ConfigMap. A missing ConfigMap or key has no rules.
+func (s *kubeSource) load(ctx context.Context) ([]Rule, error) {
+	c, err := s.kubeClient()
+	if err != nil {
+		return nil, err
+	}
+	cm, _, err := s.list(ctx, c)
+	if err != nil || cm == nil {
+		return nil, err
+	}
+	keys := s.keys
+	if len(keys) == 0 {
+		for k := range cm.Data {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+	}
+	var rules []Rule
+	for _, k := range keys {
+		r, err := ParseAdguardRules(cm.Data[k])
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", k, err)
+		}
+		rules = append(rules, r...)
+	}
+	return rules, nil
+}
+
+// follow watches the ConfigMap, requesting a reload once the watch is set up and then on each change, until the
+// API server reports an error (e.g. an expired resource version) or ctx is done. Watches the server ends normally
+// are resumed without a reload.
+func (s *kubeSource) follow(ctx context.Context, notify func()) (bool, error) {
+	c, err := s.kubeClient()
+	if err != nil {
+		return false, err
+	}
+	_, rv, err := s.list(ctx, c)
+	if err != nil {
+		return false, err
+	}
+	notify()
+	for {
+		resp, err := c.get(ctx, s.path(c, "watch=true&allowWatchBookmarks=true&resourceVersion="+url.QueryEscape(rv)))
+		if err != nil {
+			return true, err
+		}
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var ev struct {
+				Type   string          `json:"type"`
+				Object json.RawMessage `json:"object"`
+			}
+			if err := dec.Decode(&ev); err != nil {
+				resp.Body.Close()
+				if errors.Is(err, io.EOF) && ctx.Err() == nil {
+					break
+				}
+				return true, err
+			}
+			if ev.Type == "ERROR" {
+				resp.Body.Close()
+				return true, fmt.Errorf("watch: %s", ev.Object)
+			}
+			var obj configMap
+			if err := json.Unmarshal(ev.Object, &obj); err == nil && obj.Metadata.ResourceVersion != "" {
+				rv = obj.Metadata.ResourceVersion
+			}
+			if ev.Type != "BOOKMARK" {
+				notify()
+			}
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package ruledforward
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseKubeSource(t *testing.T) {
+	tests := []struct {
+		ref       string
+		keys      []string
+		namespace string
+		name      string
+		wantErr   bool
+	}{
+		{ref: "dns-rules", name: "dns-rules"},
+		{ref: "infra/dns-rules", keys: []string{"ads.txt"}, namespace: "infra", name: "dns-rules"},
+		{ref: "/dns-rules", wantErr: true},
+		{ref: "infra/", wantErr: true},
+		{ref: "a/b/c", wantErr: true},
+		{ref: "dns-rules", keys: []string{"a&b"}, wantErr: true},
+	}
+	for _, tc := range tests {
+		s, err := parseKubeSource(tc.ref, tc.keys)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseKubeSource(%s) err = %v, wantErr %v", tc.ref, err, tc.wantErr)
+			continue
+		}
+		if err == nil && (s.namespace != tc.namespace || s.name != tc.name) {
+			t.Errorf("parseKubeSource(%s) = %s/%s, want %s/%s", tc.ref, s.namespace, s.name, tc.namespace, tc.name)
+		}
+	}
+}
+
+// fakeKube is an API server with one namespace of ConfigMaps that supports list and watch by name.
+type fakeKube struct {
+	srv *httptest.Server
+	dir string // service account directory
+
+	mu       sync.Mutex
+	rv       int
+	data     map[string]map[string]string // ConfigMap name -> data
+	watchers []chan string                // event JSON
+}
+
+func newFakeKube(t *testing.T) *fakeKube {
+	t.Helper()
+	f := &fakeKube{data: make(map[string]map[string]string), dir: t.TempDir()}
+	f.srv = httptest.NewTLSServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.srv.Close)
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.srv.Certificate().Raw})
+	for name, content := range map[string][]byte{"ca.crt": ca, "token": []byte("tok\n"), "namespace": []byte("dns")} {
+		if err := os.WriteFile(filepath.Join(f.dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	host, port, _ := net.SplitHostPort(f.srv.Listener.Addr().String())
+	t.Setenv("KUBERNETES_SERVICE_HOST", host)
+	t.Setenv("KUBERNETES_SERVICE_PORT", port)
+	return f
+}
+
+func (f *fakeKube) object(name string) string {
+	b, _ := json.Marshal(map[string]any{
+		"metadata": map[string]any{"name": name, "resourceVersion": strconv.Itoa(f.rv)},
+		"data":     f.data[name],
+	})
+	return string(b)
+}
+
+func (f *fakeKube) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer tok" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path != "/api/v1/namespaces/dns/configmaps" {
+		http.NotFound(w, r)
+		return
+	}
+	var name string
+	if _, err := fmt.Sscanf(r.URL.Query().Get("fieldSelector"), "metadata.name=%s", &name); err != nil {
+		http.Error(w, "bad selector", http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	if r.URL.Query().Get("watch") != "true" {
+		items := "[]"
+		if _, ok := f.data[name]; ok {
+			items = "[" + f.object(name) + "]"
+		}
+		fmt.Fprintf(w, `{"metadata":{"resourceVersion":"%d"},"items":%s}`, f.rv, items)
+		f.mu.Unlock()
+		return
+	}
+	events := make(chan string, 8)
+	f.watchers = append(f.watchers, events)
+	f.mu.Unlock()
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-events:
+			fmt.Fprintln(w, ev)
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+// set stores a ConfigMap and sends a watch event for it.
+func (f *fakeKube) set(name string, data map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	typ := "MODIFIED"
+	if _, ok := f.data[name]; !ok {
+		typ = "ADDED"
+	}
+	f.rv++
+	f.data[name] = data
+	for _, w := range f.watchers {
+		w <- `{"type":"` + typ + `","object":` + f.object(name) + `}`
+	}
+}
+
+func TestKubeSourceLoad(t *testing.T) {
+	f := newFakeKube(t)
+	f.set("dns-rules", map[string]string{"ads.txt": "||ads.example^\n", "trackers.txt": "tracker.example\n"})
+
+	src, _ := parseKubeSource("dns-rules", nil)
+	src.dir = f.dir
+	rules, err := src.load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Errorf("rules = %v, want both keys", rules)
+	}
+
+	src, _ = parseKubeSource("dns-rules", []string{"trackers.txt"})
+	src.dir = f.dir
+	if rules, err := src.load(context.Background()); err != nil || len(rules) != 1 || rules[0].Value != "tracker.example." {
+		t.Errorf("rules = %v, %v, want trackers.txt only", rules, err)
+	}
+
+	src, _ = parseKubeSource("missing", nil)
+	src.dir = f.dir
+	if rules, err := src.load(context.Background()); err != nil || len(rules) != 0 {
+		t.Errorf("missing ConfigMap: rules = %v, err = %v", rules, err)
+	}
+
+	src, _ = parseKubeSource("other/dns-rules", nil)
+	src.dir = f.dir
+	if _, err := src.load(context.Background()); err == nil {
+		t.Error("expected error for another namespace")
+	}
+}
+
+func TestWatchKubeRules(t *testing.T) {
+	f := newFakeKube(t)
+	f.set("dns-rules", map[string]string{"ads.txt": "||ads.example^\n"})
+	src, _ := parseKubeSource("dns/dns-rules", nil)
+	src.dir = f.dir
+	g := &Group{Name: "ads", Action: "empty", Kube: []*kubeSource{src}}
+	if err := g.Update(nil, UpdateMatcherLocal); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go g.watchRuleSource(src, nil, UpdateMatcherKube, 10*time.Millisecond, stop)
+
+	waitMatch := func(qname string, want bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for g.Match(qname) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("Match(%s) != %v", qname, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitMatch("x.ads.example.", true)
+	f.set("dns-rules", map[string]string{"ads.txt": "||tracker.example^\n"})
+	waitMatch("tracker.example.", true)
+	waitMatch("x.ads.example.", false)
+}
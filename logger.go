@@ -0,0 +1,126 @@
+package ruledforward
+
+import (
+	"context"
+	"fmt"
+	golog "log"
+	"log/slog"
+	"sync/atomic"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+)
+
+var log = &pluginLogger{P: clog.NewWithPlugin("ruledforward")}
+
+// pluginLogger logs the plugin's lines as clog does, or with `log_format json` as JSON objects with the fields time,
+// level, plugin and msg, one per line, for log collectors that parse them.
+type pluginLogger struct {
+	clog.P
+	json atomic.Pointer[slog.Logger] // nil for clog's text lines
+}
+
+// setJSON switches between JSON and text lines. JSON lines go where the standard logger writes, as clog's do.
+func (l *pluginLogger) setJSON(on bool) {
+	if !on {
+		l.json.Store(nil)
+		return
+	}
+	h := slog.NewJSONHandler(golog.Writer(), &slog.HandlerOptions{Level: slog.LevelDebug, ReplaceAttr: jsonLevel})
+	l.json.Store(slog.New(h).With("plugin", "ruledforward"))
+}
+
+// jsonLevel writes levels as clog names them, in lower case.
+func jsonLevel(_ []string, a slog.Attr) slog.Attr {
+	if a.Key != slog.LevelKey {
+		return a
+	}
+	switch a.Value.Any().(slog.Level) {
+	case slog.LevelDebug:
+		return slog.String(a.Key, "debug")
+	case slog.LevelInfo:
+		return slog.String(a.Key, "info")
+	case slog.LevelWarn:
+		return slog.String(a.Key, "warning")
+	default:
+		return slog.String(a.Key, "error")
+	}
+}
+
+func (l *pluginLogger) Debug(v ...any) {
+	if j := l.json.Load(); j != nil {
+		if clog.D.Value() {
+			j.Log(context.Background(), slog.LevelDebug, fmt.Sprint(v...))
+		}
+		return
+	}
+	l.P.Debug(v...)
+}
+
+func (l *pluginLogger) Debugf(format string, v ...any) {
+	if j := l.json.Load(); j != nil {
+		if clog.D.Value() {
+			j.Log(context.Background(), slog.LevelDebug, fmt.Sprintf(format, v...))
+		}
+		return
+	}
+	l.P.Debugf(format, v...)
+}
+
+func (l *pluginLogger) Info(v ...any) {
+	if j := l.json.Load(); j != nil {
+		j.Log(context.Background(), slog.LevelInfo, fmt.Sprint(v...))
+		return
+	}
+	l.P.Info(v...)
+}
+
+func (l *pluginLogger) Infof(format string, v ...any) {
+	if j := l.json.Load(); j != nil {
+		j.Log(context.Background(), slog.LevelInfo, fmt.Sprintf(format, v...))
+		return
+	}
+	l.P.Infof(format, v...)
+}
+
+func (l *pluginLogger) Warning(v ...any) {
+	if j := l.json.Load(); j != nil {
+		j.Log(context.Background(), slog.LevelWarn, fmt.Sprint(v...))
+		return
+	}
+	l.P.Warning(v...)
+}
+
+func (l *pluginLogger) Warningf(format string, v ...any) {
+	if j := l.json.Load(); j != nil {
+		j.Log(context.Background(), slog.LevelWarn, fmt.Sprintf(format, v...))
+		return
+	}
+	l.P.Warningf(format, v...)
+}
+
+func (l *pluginLogger) Error(v ...any) {
+	if j := l.json.Load(); j != nil {
+		j.Log(context.Background(), slog.LevelError, fmt.Sprint(v...))
+		return
+	}
+	l.P.Error(v...)
+}
+
+func (l *pluginLogger) Errorf(format string, v ...any) {
+	if j := l.json.Load(); j != nil {
+		j.Log(context.Background(), slog.LevelError, fmt.Sprintf(format, v...))
+		return
+	}
+	l.P.Errorf(format, v...)
+}
+
+// applyLogFormat logs JSON lines if any running instance has `log_format json`, as the log is shared by all of them.
+func applyLogFormat() {
+	instances.RLock()
+	defer instances.RUnlock()
+	json := false
+	for _, r := range instances.m {
+		json = json || r.logJSON
+	}
+	log.setJSON(json)
+}
@@ -0,0 +1,54 @@
+package ruledforward
+
+import (
+	"bytes"
+	"encoding/json"
+	golog "log"
+	"strings"
+	"testing"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+)
+
+func TestPluginLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	out, flags := golog.Writer(), golog.Flags()
+	golog.SetOutput(&buf)
+	golog.SetFlags(0)
+	defer func() {
+		golog.SetOutput(out)
+		golog.SetFlags(flags)
+	}()
+
+	log.setJSON(true)
+	defer log.setJSON(false)
+	log.Warningf("refresh failed for group '%s': %v", "ads", "timeout")
+	log.Debugf("not logged without the debug plugin")
+	clog.D.Set()
+	log.Debugf("%s matched %s", "x.ads.example.", "domain:ads.example")
+	clog.D.Clear()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %q, want 2 lines", lines)
+	}
+	var entry struct {
+		Time, Level, Plugin, Msg string
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Time == "" || entry.Level != "warning" || entry.Plugin != "ruledforward" || entry.Msg != "refresh failed for group 'ads': timeout" {
+		t.Errorf("entry = %+v", entry)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil || entry.Level != "debug" {
+		t.Errorf("debug entry = %+v, %v", entry, err)
+	}
+
+	buf.Reset()
+	log.setJSON(false)
+	log.Infof("loaded")
+	if got := buf.String(); got != "[INFO] plugin/ruledforward: loaded\n" {
+		t.Errorf("text line = %q", got)
+	}
+}
@@ -0,0 +1,70 @@
+package ruledforward
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lru is a concurrency-safe least-recently-used cache holding up to size entries.
+type lru[K comparable, V any] struct {
+	mu   sync.Mutex
+	size int
+	ll   *list.List // front is most recently used
+	m    map[K]*list.Element
+}
+
+type lruEntry[K comparable, V any] struct {
+	key K
+	val V
+}
+
+func newLRU[K comparable, V any](size int) *lru[K, V] {
+	return &lru[K, V]{size: size, ll: list.New(), m: make(map[K]*list.Element)}
+}
+
+// get returns the value for k and marks it as recently used.
+func (c *lru[K, V]) get(k K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[k]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*lruEntry[K, V]).val, true
+}
+
+// add sets the value for k, evicting the least recently used entry if the cache is full.
+func (c *lru[K, V]) add(k K, v V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.m[k]; ok {
+		e.Value.(*lruEntry[K, V]).val = v
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.m[k] = c.ll.PushFront(&lruEntry[K, V]{key: k, val: v})
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.m, oldest.Value.(*lruEntry[K, V]).key)
+	}
+}
+
+// remove deletes k.
+func (c *lru[K, V]) remove(k K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.m[k]; ok {
+		c.ll.Remove(e)
+		delete(c.m, k)
+	}
+}
+
+// len returns the number of entries.
+func (c *lru[K, V]) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
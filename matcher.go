@@ -2,10 +2,12 @@
 package ruledforward
 
 import (
+	"cmp"
 	"maps"
 	"regexp"
 	"slices"
 	"strings"
+	"sync/atomic"
 
 	"github.com/miekg/dns"
 )
@@ -29,6 +31,12 @@ const (
 	RuleKeyword
 	// RuleRegex matches qname against value as regex.
 	RuleRegex
+	// RuleDGA is what a name matched by the `dga` heuristic of a group matched; its value is the name's score. It is
+	// only reported, never added to a matcher.
+	RuleDGA
+	// RuleCategory is what a name routed to a group by `category` matched; its value is the category. It is only
+	// reported, never added to a matcher.
+	RuleCategory
 )
 
 // Rule is a single matching rule.
@@ -44,6 +52,31 @@ type Matcher interface {
 	Match(qname string) bool
 }
 
+// normalizedMatcher is implemented by matchers that can match a name already normalized by normalizeName, sparing
+// the per-group normalization of Match on the query path.
+type normalizedMatcher interface {
+	matchNormalized(q string) bool
+}
+
+// matchNormalized reports whether m matches q, which must be normalized.
+func matchNormalized(m Matcher, q string) bool {
+	if nm, ok := m.(normalizedMatcher); ok {
+		return nm.matchNormalized(q)
+	}
+	return m.Match(q)
+}
+
+// normalizeName returns qname lower-case and fully qualified. It does not allocate if qname already is, as names
+// from request.Request are.
+func normalizeName(qname string) string {
+	return strings.ToLower(dns.Fqdn(qname))
+}
+
+// rulePruner is implemented by matchers that drop redundant rules in Build.
+type rulePruner interface {
+	prunedRules() int
+}
+
 // matcher holds rules and provides Match(qname).
 // matcher has no internal lock; the holder (Group) uses atomic.Pointer + Store/Load for concurrent safety.
 // domainTrie is built in Build() from domain slice for O(qname labels) domain matching instead of O(rules).
@@ -53,6 +86,7 @@ type matcher struct {
 	domainTrie *domainTrieNode     // label trie for domain match (right-to-left)
 	keyword    []string            // substring
 	regex      []*regexp.Regexp    // compiled
+	pruned     int                 // rules dropped by Build
 }
 
 // NewMatcher returns an empty matcher.
@@ -126,54 +160,96 @@ func (m *matcher) insertDomainTrie(fqdn string) {
 
 // matchDomainTrie returns true if qname (already normalized FQDN, lower) matches any domain rule in the trie.
 func (m *matcher) matchDomainTrie(qname string) bool {
-	labels := domainLabels(qname)
-	if len(labels) == 0 || m.domainTrie == nil {
-		return false
-	}
+	_, ok := m.matchDomainSuffix(qname)
+	return ok
+}
+
+// matchDomainSuffix returns the domain rule of the trie that qname (normalized) is equal to or a subdomain of. It
+// walks the labels of qname right to left in place, without splitting it.
+func (m *matcher) matchDomainSuffix(qname string) (string, bool) {
 	node := m.domainTrie
-	for _, label := range labels {
-		if node == nil {
-			return false
-		}
+	if node == nil || qname == "" {
+		return "", false
+	}
+	// qname[:end] holds the labels not yet walked; qname[end+1:] is the suffix matched by node.
+	end := len(qname) - 1
+	for end >= 0 {
 		if node.match {
-			return true
+			return qname[end+1:], true
 		}
-		if node.children == nil {
-			return false
+		start := strings.LastIndexByte(qname[:end], '.') + 1
+		if node = node.children[qname[start:end]]; node == nil {
+			return "", false
 		}
-		node = node.children[label]
+		end = start - 1
 	}
-	return node != nil && node.match
+	return qname, node.match
 }
 
-// Build finalizes the matcher: builds domain trie from domain rules and sorts domain slice for keysForBloom.
-// Call after adding all rules.
+// Build finalizes the matcher: drops duplicate rules and rules covered by a broader domain rule, builds the domain
+// trie and sorts the domain slice for keysForBloom. Call after adding all rules.
 func (m *matcher) Build() {
-	// Build label trie for O(qname labels) domain matching (reference: v2ray DomainMatcherGroup)
-	seen := make(map[string]struct{})
-	for _, d := range m.domain {
-		if _, ok := seen[d]; ok {
+	// Insert broader domains first so that the rules they cover can be dropped: domain:a.example.com is redundant
+	// next to domain:example.com, and so is full:a.example.com.
+	domains := slices.Clone(m.domain)
+	slices.SortFunc(domains, func(a, b string) int {
+		return cmp.Or(cmp.Compare(dns.CountLabel(a), dns.CountLabel(b)), strings.Compare(a, b))
+	})
+	domains = slices.Compact(domains)
+	m.pruned = len(m.domain) - len(domains)
+	m.domainTrie = nil
+	m.domain = m.domain[:0]
+	for _, d := range domains {
+		if m.matchDomainTrie(d) {
+			m.pruned++
 			continue
 		}
-		seen[d] = struct{}{}
 		m.insertDomainTrie(d)
+		m.domain = append(m.domain, d)
+	}
+	for q := range m.full {
+		if m.matchDomainTrie(q) {
+			delete(m.full, q)
+			m.pruned++
+		}
 	}
+	n := len(m.keyword)
+	slices.Sort(m.keyword)
+	m.keyword = slices.Compact(m.keyword)
+	m.pruned += n - len(m.keyword)
+	n = len(m.regex)
+	slices.SortStableFunc(m.regex, func(a, b *regexp.Regexp) int { return strings.Compare(a.String(), b.String()) })
+	m.regex = slices.CompactFunc(m.regex, func(a, b *regexp.Regexp) bool { return a.String() == b.String() })
+	m.pruned += n - len(m.regex)
+
 	// Keep domain slice sorted for keysForBloom (longest first)
 	slices.SortFunc(m.domain, func(a, b string) int {
 		return len(b) - len(a)
 	})
 }
 
+// prunedRules returns the number of rules Build dropped as duplicates or covered by a broader domain rule.
+func (m *matcher) prunedRules() int { return m.pruned }
+
 // Match returns true if qname matches any rule. Order: full -> domain (trie) -> keyword -> regex.
 func (m *matcher) Match(qname string) bool {
-	q := strings.ToLower(dns.Fqdn(qname))
+	return m.matchNormalized(normalizeName(qname))
+}
+
+func (m *matcher) matchNormalized(q string) bool {
+	return m.matchNames(q) || m.matchPatterns(q)
+}
 
+// matchNames reports whether q (normalized) matches a full or domain rule, the rules a bloom filter covers.
+func (m *matcher) matchNames(q string) bool {
 	if _, ok := m.full[q]; ok {
 		return true
 	}
-	if m.matchDomainTrie(q) {
-		return true
-	}
+	return m.matchDomainTrie(q)
+}
+
+// matchPatterns reports whether q (normalized) matches a keyword or regex rule.
+func (m *matcher) matchPatterns(q string) bool {
 	for _, k := range m.keyword {
 		if strings.Contains(q, k) {
 			return true
@@ -193,32 +269,61 @@ func (m *matcher) keysForBloom() (full []string, domain []string) {
 	return slices.Collect(maps.Keys(m.full)), slices.Clone(m.domain)
 }
 
+// NewBloomedMatcher returns a matcher that screens names with a bloom filter for n keys at false positive rate fp.
+// With n 0, Build sizes the filter for the domain and full rules left after pruning.
 func NewBloomedMatcher(n uint, fp float64) Matcher {
+	return newBloomedMatcher(n, fp)
+}
+
+func newBloomedMatcher(n uint, fp float64) *bloomedMatcher {
 	return &bloomedMatcher{
 		m:  matcher{full: make(map[string]struct{})},
-		bf: NewBloomFilter(n, fp),
+		bf: NewBloomFilter(max(n, 1), fp),
+		n:  n,
+		fp: fp,
 	}
 }
 
 type bloomedMatcher struct {
 	m  matcher
 	bf *BloomFilter
+	n  uint    // keys bf is sized for; 0 to size it in Build
+	fp float64 // target false positive rate of bf
+	// falsePositives counts the names bf let through that no full or domain rule matched; nil not to count them.
+	falsePositives *atomic.Uint64
 }
 
 func (m *bloomedMatcher) AddRule(r Rule) {
 	m.m.AddRule(r)
-	switch r.Type {
-	case RuleDomain, RuleFull:
-		m.bf.Add(r.Value)
-	default:
-		// do nothing
-	}
 }
 
+// Build builds the matcher and fills the bloom filter with the rules left after pruning.
 func (m *bloomedMatcher) Build() {
 	m.m.Build()
+	full, domain := m.m.keysForBloom()
+	if m.n == 0 {
+		m.bf = NewBloomFilter(uint(max(len(full)+len(domain), 1)), m.fp)
+	}
+	m.bf.Add(full...)
+	m.bf.Add(domain...)
 }
 
+func (m *bloomedMatcher) prunedRules() int { return m.m.prunedRules() }
+
+// Match checks full and domain rules only if the bloom filter may hold qname or a parent. The filter has no keys for
+// keyword and regex rules, so those are always checked.
 func (m *bloomedMatcher) Match(qname string) bool {
-	return m.bf.MaybeMatch(qname) && m.m.Match(qname)
+	return m.matchNormalized(normalizeName(qname))
+}
+
+func (m *bloomedMatcher) matchNormalized(q string) bool {
+	if m.bf.MaybeMatch(q) {
+		if m.m.matchNames(q) {
+			return true
+		}
+		if m.falsePositives != nil {
+			m.falsePositives.Add(1)
+		}
+	}
+	return m.m.matchPatterns(q)
 }
@@ -60,3 +60,20 @@ func BenchmarkMatcherMatch_Full(b *testing.B) {
 		_ = m.Match(qname)
 	}
 }
+
+// BenchmarkGroupMatchNormalized benchmarks the query path: a bloomed group matching a normalized name it misses.
+func BenchmarkGroupMatchNormalized(b *testing.B) {
+	m := NewBloomedMatcher(0, 0.01)
+	for i := range 10_000 {
+		m.AddRule(Rule{Type: RuleDomain, Value: fmt.Sprintf("sub%d.example.com.", i)})
+	}
+	m.AddRule(Rule{Type: RuleKeyword, Value: "banner"})
+	m.Build()
+	g := &Group{Name: "block"}
+	g.SetMatcher(m)
+	qname := "a.sub5000.example.net."
+	b.ReportAllocs()
+	for b.Loop() {
+		_ = g.matchNormalized(qname)
+	}
+}
@@ -1,6 +1,8 @@
 package ruledforward
 
 import (
+	"fmt"
+	"slices"
 	"testing"
 )
 
@@ -82,6 +84,45 @@ func TestMatcherBuild(t *testing.T) {
 	}
 }
 
+// TestMatcherBuildPrunes verifies Build drops duplicates and rules covered by broader domain rules.
+func TestMatcherBuildPrunes(t *testing.T) {
+	m := NewBloomedMatcher(100, 0.01)
+	for _, r := range []Rule{
+		{Type: RuleDomain, Value: "a.example.com."},
+		{Type: RuleDomain, Value: "example.com."},
+		{Type: RuleDomain, Value: "example.com."},
+		{Type: RuleDomain, Value: "other.org."},
+		{Type: RuleFull, Value: "www.example.com."},
+		{Type: RuleFull, Value: "example.com."},
+		{Type: RuleFull, Value: "www.example.net."},
+		{Type: RuleKeyword, Value: "ads"},
+		{Type: RuleKeyword, Value: "ads"},
+		{Type: RuleRegex, Value: "^x"},
+		{Type: RuleRegex, Value: "^x"},
+	} {
+		m.AddRule(r)
+	}
+	m.Build()
+	if n := m.(rulePruner).prunedRules(); n != 6 {
+		t.Errorf("prunedRules() = %d, want 6", n)
+	}
+	want := []Rule{
+		{Type: RuleDomain, Value: "example.com."},
+		{Type: RuleDomain, Value: "other.org."},
+		{Type: RuleFull, Value: "www.example.net."},
+		{Type: RuleKeyword, Value: "ads"},
+		{Type: RuleRegex, Value: "^x"},
+	}
+	if got := m.(ruleLister).rules(); !slices.Equal(got, want) {
+		t.Errorf("rules after Build = %v, want %v", got, want)
+	}
+	for _, q := range []string{"a.example.com.", "www.example.com.", "example.com.", "www.example.net.", "x.other.org."} {
+		if !m.Match(q) {
+			t.Errorf("Match(%s) = false after pruning", q)
+		}
+	}
+}
+
 // TestMatcherMatchRegex tests regex rule matching.
 func TestMatcherMatchRegex(t *testing.T) {
 	m := NewMatcher()
@@ -112,6 +153,74 @@ func TestBloomedMatcher(t *testing.T) {
 	}
 }
 
+// TestBloomedMatcherAutoSize verifies a bloom filter without a size is sized for the rules left after pruning.
+func TestBloomedMatcherAutoSize(t *testing.T) {
+	m := NewBloomedMatcher(0, 0.01).(*bloomedMatcher)
+	for i := range 50000 {
+		m.AddRule(Rule{Type: RuleDomain, Value: fmt.Sprintf("d%d.example.", i)})
+		m.AddRule(Rule{Type: RuleFull, Value: fmt.Sprintf("www.d%d.example.", i)}) // pruned
+		m.AddRule(Rule{Type: RuleFull, Value: fmt.Sprintf("f%d.example.org.", i)})
+	}
+	m.Build()
+	if want := NewBloomFilter(100000, 0.01).bf.Cap(); m.bf.bf.Cap() != want {
+		t.Errorf("bloom filter has %d bits, want %d for 100000 keys", m.bf.bf.Cap(), want)
+	}
+	passed := 0
+	for i := range 10000 {
+		if m.bf.MaybeMatch(fmt.Sprintf("n%d.example.net.", i)) {
+			passed++
+		}
+	}
+	// Each name tests 3 keys (itself and 2 parents), so about 3% of them may pass.
+	if passed > 500 {
+		t.Errorf("%d of 10000 unknown names passed the bloom filter", passed)
+	}
+	if !m.Match("x.d49999.example.") || !m.Match("f0.example.org.") {
+		t.Error("expected rules to match")
+	}
+}
+
+func TestBloomedMatcherFalsePositives(t *testing.T) {
+	g := &Group{Name: "block", BloomSize: 10, BloomFP: 0.5}
+	m := g.newMatcher().(*bloomedMatcher)
+	for i := range 100 {
+		m.AddRule(Rule{Type: RuleDomain, Value: fmt.Sprintf("d%d.example.", i)})
+	}
+	m.Build()
+	g.SetMatcher(m)
+	var want uint64
+	for i := range 1000 {
+		q := fmt.Sprintf("n%d.example.net.", i)
+		if m.bf.MaybeMatch(q) {
+			want++
+		}
+		if g.Match(q) {
+			t.Fatalf("expected no match for %s", q)
+		}
+	}
+	g.Match("x.d1.example.")
+	if want == 0 || g.bloomFalsePositives.Load() != want {
+		t.Errorf("false positives = %d, want the %d names that passed the overfull filter", g.bloomFalsePositives.Load(), want)
+	}
+}
+
+// TestBloomedMatcherPatterns verifies keyword and regex rules match although the bloom filter has no keys for them.
+func TestBloomedMatcherPatterns(t *testing.T) {
+	m := NewBloomedMatcher(1000, 0.01)
+	m.AddRule(Rule{Type: RuleDomain, Value: "example.com."})
+	m.AddRule(Rule{Type: RuleKeyword, Value: "tracker"})
+	m.AddRule(Rule{Type: RuleRegex, Value: `^ad[0-9]+\.`})
+	m.Build()
+	for _, q := range []string{"mytracker.example.net.", "ad12.example.org."} {
+		if !m.Match(q) {
+			t.Errorf("expected %s to match", q)
+		}
+	}
+	if m.Match("other.org.") {
+		t.Error("expected no match")
+	}
+}
+
 // TestMatcherDomainTrieEdgeCases covers domain trie: empty, single label, and multi-level.
 func TestMatcherDomainTrieEdgeCases(t *testing.T) {
 	// Empty trie (no domain rules)
@@ -149,3 +258,23 @@ func TestMatcherDomainTrieEdgeCases(t *testing.T) {
 		t.Error("example.com. should not match (rule is sub.example.com.)")
 	}
 }
+
+// TestMatchNormalizedAllocs checks that matching a normalized name, as on the query path, does not allocate.
+func TestMatchNormalizedAllocs(t *testing.T) {
+	for _, m := range []Matcher{NewMatcher(), NewBloomedMatcher(0, 0.01)} {
+		m.AddRule(Rule{Type: RuleDomain, Value: "ads.example.com."})
+		m.AddRule(Rule{Type: RuleFull, Value: "tracker.example.org."})
+		m.AddRule(Rule{Type: RuleKeyword, Value: "banner"})
+		m.Build()
+		g := &Group{Name: "block"}
+		g.SetMatcher(m)
+		for _, q := range []string{"a.b.ads.example.com.", "tracker.example.org.", "www.example.net.", "."} {
+			if n := testing.AllocsPerRun(100, func() { g.matchNormalized(q) }); n != 0 {
+				t.Errorf("%T: matching %q allocates %v times", m, q, n)
+			}
+		}
+		if !g.Match("A.B.Ads.Example.COM") || g.Match("example.com.") {
+			t.Errorf("%T: Match should normalize the name", m)
+		}
+	}
+}
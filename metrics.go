@@ -1,10 +1,14 @@
 package ruledforward
 
 import (
+	"errors"
+
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/transport"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
 )
 
 var (
@@ -15,11 +19,20 @@ var (
 		Help:      "Counter of requests handled by ruledforward, per group and action.",
 	}, []string{"group", "action"})
 
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:                   plugin.Namespace,
+		Subsystem:                   "ruledforward",
+		Name:                        "request_duration_seconds",
+		Buckets:                     plugin.TimeBuckets,
+		NativeHistogramBucketFactor: plugin.NativeHistogramBucketFactor,
+		Help:                        "Histogram of the time ruledforward took to match, resolve and answer a request, per group and action.",
+	}, []string{"group", "action"})
+
 	noMatchTotal = promauto.NewCounter(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: "ruledforward",
 		Name:      "no_match_total",
-		Help:      "Counter of requests that did not match any group and were passed to the next plugin.",
+		Help:      "Counter of requests that did not match any group and were passed to the next plugin or answered as on_no_match says.",
 	})
 
 	forwardUpstreamFailTotal = promauto.NewCounterVec(prometheus.CounterOpts{
@@ -28,4 +41,284 @@ var (
 		Name:      "forward_upstream_fail_total",
 		Help:      "Counter of forward groups where all upstreams failed for a request.",
 	}, []string{"group"})
+
+	upstreamRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "upstream_requests_total",
+		Help:      "Counter of queries sent to each upstream of a group, by the rcode of the reply (error if there was none).",
+	}, []string{"group", "to", "rcode"})
+
+	maxConcurrentRejectTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "max_concurrent_rejects_total",
+		Help:      "Counter of queries rejected because the group's concurrent queries were at maximum.",
+	}, []string{"group"})
+
+	rateLimitedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "rate_limited_total",
+		Help:      "Counter of queries rejected by a per-client rate limit, per group (empty for the plugin-wide limit) and action.",
+	}, []string{"group", "action"})
+
+	cnameBlockedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "cname_blocked_total",
+		Help:      "Counter of forwarded answers suppressed because a CNAME target matched a blocking group.",
+	}, []string{"group", "blocked_by"})
+
+	dns0x20MismatchTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "dns0x20_mismatch_total",
+		Help:      "Counter of upstream replies discarded because the qname case did not match the randomized query.",
+	}, []string{"group"})
+
+	qtypeBlockedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "qtype_blocked_total",
+		Help:      "Counter of queries answered locally because their type is listed in the group's block_qtypes.",
+	}, []string{"group", "qtype"})
+
+	shadowMatchTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "shadow_matches_total",
+		Help:      "Counter of queries a group in shadow mode would have handled, per group and action.",
+	}, []string{"group", "action"})
+
+	splitTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "split_total",
+		Help:      "Counter of queries matched by a group with split, per group and the target group chosen.",
+	}, []string{"group", "target"})
+
+	fallbackTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "fallback_total",
+		Help:      "Counter of responses not trusted by a group and answered by its fallback group, by reason.",
+	}, []string{"group", "fallback", "reason"})
+
+	scriptErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "script_errors_total",
+		Help:      "Counter of queries answered with SERVFAIL because the script of an action script group failed, per group.",
+	}, []string{"group"})
+
+	answerCountryTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "answer_countries_total",
+		Help:      "Counter of forwarded answers by the country of their first address, per group. Needs mmdbfile.",
+	}, []string{"group", "country"})
+
+	asnBlockedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "asn_blocked_total",
+		Help:      "Counter of forwarded answers from which A/AAAA records in a block_asn ASN were removed, per group.",
+	}, []string{"group"})
+
+	rulesSkippedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "rules_skipped_total",
+		Help:      "Counter of Adblock Plus style rule lines skipped because they have no DNS equivalent, such as those with a URL path.",
+	})
+
+	netSetErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "netset_errors_total",
+		Help:      "Counter of failures adding answer addresses to a group's ipset or nftset, per group.",
+	}, []string{"group"})
+
+	netSetDroppedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "netset_dropped_total",
+		Help:      "Counter of answers whose addresses were not added to a group's ipset or nftset because its queue was full, per group.",
+	}, []string{"group"})
+
+	hedgeTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "hedged_total",
+		Help:      "Counter of queries also sent to a second upstream by hedge, by which upstream answered first.",
+	}, []string{"group", "winner"})
+
+	concurrentRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "concurrent_rejected_total",
+		Help:      "Counter of upstream replies to concurrent queries passed over because they failed validation, per group.",
+	}, []string{"group"})
+
+	consensusDisagreementsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "consensus_disagreements_total",
+		Help:      "Counter of queries whose upstream replies were not agreed on in a group with consensus, per group and reason: disagreement or insufficient replies.",
+	}, []string{"group", "reason"})
+
+	negativeCacheHitsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "negative_cache_hits_total",
+		Help:      "Counter of queries answered from the negative cache, per group.",
+	}, []string{"group"})
+
+	prefetchTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "prefetch_total",
+		Help:      "Counter of negative cache entries refreshed by prefetch before they expired, per group.",
+	}, []string{"group"})
+
+	decisionCacheHitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "decision_cache_hits_total",
+		Help:      "Counter of queries routed by a cached decision instead of matching the groups' rules.",
+	})
+
+	categoryLookupsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "category_lookups_total",
+		Help:      "Counter of category lookups of names no rule matched, by result (cached, fetched or failed).",
+	}, []string{"result"})
+
+	pipelineTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "pipeline_total",
+		Help:      "Counter of queries answered by the pipeline, by how it ended (accept, reject, next or end).",
+	}, []string{"result"})
+
+	cachedClosedRetriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "cached_closed_retries_total",
+		Help:      "Counter of queries sent again over a new connection because the cached one to the upstream was closed.",
+	}, []string{"group", "to"})
+
+	refreshTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "refresh_total",
+		Help:      "Counter of rule reloads after startup, per group, what triggered them and result (success or failure).",
+	}, []string{"group", "source", "result"})
+
+	refreshDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:                   plugin.Namespace,
+		Subsystem:                   "ruledforward",
+		Name:                        "refresh_duration_seconds",
+		Buckets:                     prometheus.ExponentialBuckets(0.01, 4, 9),
+		NativeHistogramBucketFactor: plugin.NativeHistogramBucketFactor,
+		Help:                        "Histogram of the time rule reloads after startup took, including downloads, per group and what triggered them.",
+	}, []string{"group", "source"})
+
+	ruleConflicts = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ruledforward",
+		Name:      "rule_conflicts",
+		Help:      "Gauge of rules of a group that never apply because an earlier group with another action has them too.",
+	}, []string{"group"})
 )
+
+func init() {
+	prometheus.MustRegister(groupCollector{})
+}
+
+// proxyHealthcheckFailures is the coredns_proxy_healthcheck_failures_total counter of CoreDNS's proxy package, which
+// its health checks increment and which is not exported otherwise. Registering an identical counter returns the one
+// registered by the package.
+var proxyHealthcheckFailures = func() *prometheus.CounterVec {
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "healthcheck_failures_total",
+		Help:      "Counter of the number of failed healthchecks.",
+	}, []string{"proxy_name", "to"})
+	var are prometheus.AlreadyRegisteredError
+	if err := prometheus.Register(c); errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(*prometheus.CounterVec); ok {
+			return existing
+		}
+	}
+	return c
+}()
+
+var (
+	upstreamUpDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(plugin.Namespace, "ruledforward", "upstream_up"),
+		"Gauge of whether an upstream of a group is up (1) or marked down by its health checks (0).",
+		[]string{"server", "group", "to", "transport"}, nil)
+	upstreamFailsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(plugin.Namespace, "ruledforward", "upstream_healthcheck_failures"),
+		"Gauge of the consecutive failed health checks of an upstream of a group, reset when one succeeds.",
+		[]string{"server", "group", "to", "transport"}, nil)
+	upstreamFailuresDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(plugin.Namespace, "ruledforward", "upstream_healthcheck_failures_total"),
+		"Counter of the failed health checks of the upstreams of a group, of all its server blocks.",
+		[]string{"group", "to"}, nil)
+	bloomFalsePositivesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(plugin.Namespace, "ruledforward", "bloom_false_positives_total"),
+		"Counter of names the bloom filter of a group let through that no full or domain rule of the group matched.",
+		[]string{"server", "group"}, nil)
+)
+
+// groupCollector reports state kept by the running groups, such as the health of their upstreams, when scraped, so
+// that it follows groups and upstreams as they are added, replaced and removed.
+type groupCollector struct{}
+
+func (groupCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- upstreamUpDesc
+	ch <- upstreamFailsDesc
+	ch <- upstreamFailuresDesc
+	ch <- bloomFalsePositivesDesc
+}
+
+func (groupCollector) Collect(ch chan<- prometheus.Metric) {
+	// The health check failures are counted by CoreDNS per proxy name, which is that of the group, and address; groups
+	// of the same name in several server blocks share them.
+	failures := make(map[[2]string]bool)
+	for _, r := range sortedInstances() {
+		for _, g := range r.allGroups() {
+			if !g.NoBloom {
+				ch <- prometheus.MustNewConstMetric(bloomFalsePositivesDesc, prometheus.CounterValue, float64(g.bloomFalsePositives.Load()), r.server, g.Name)
+			}
+			for _, p := range g.Proxies() {
+				// A plain and a DoT upstream may share an address, e.g. with `dns://` on port 853.
+				trans := transport.DNS
+				if p.GetTransport().GetTLSConfig() != nil {
+					trans = transport.TLS
+				}
+				up := 1.0
+				if p.Down(g.Maxfails) {
+					up = 0
+				}
+				ch <- prometheus.MustNewConstMetric(upstreamUpDesc, prometheus.GaugeValue, up, r.server, g.Name, p.Addr(), trans)
+				ch <- prometheus.MustNewConstMetric(upstreamFailsDesc, prometheus.GaugeValue, float64(p.Fails()), r.server, g.Name, p.Addr(), trans)
+
+				key := [2]string{g.Name, p.Addr()}
+				if failures[key] {
+					continue
+				}
+				failures[key] = true
+				var m dto.Metric
+				if c, err := proxyHealthcheckFailures.GetMetricWithLabelValues(proxyName(g.Name), p.Addr()); err == nil && c.Write(&m) == nil {
+					ch <- prometheus.MustNewConstMetric(upstreamFailuresDesc, prometheus.CounterValue, m.GetCounter().GetValue(), g.Name, p.Addr())
+				}
+			}
+		}
+	}
+}
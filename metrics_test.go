@@ -0,0 +1,178 @@
+package ruledforward
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestUpstreamHealthMetrics(t *testing.T) {
+	// Nothing listens on the discard port, so the health checks of dead fail at once.
+	dead := proxy.NewProxy(proxyName("metrics-dot"), "127.0.0.1:9", transport.DNS)
+	live := mustProxy("127.0.0.2:53")
+	g := &Group{Name: "metrics-dot", Action: "forward", Maxfails: 1}
+	g.SetProxies([]*proxy.Proxy{dead, live})
+	r := &Ruledforward{from: ".", server: "metrics:53", groups: []*Group{g}}
+	r.registerInstance()
+	t.Cleanup(r.unregisterInstance)
+	// The same group in another server block, with a DoT upstream on the address of a plain one.
+	dot := mustProxy("127.0.0.2:53")
+	dot.SetTLSConfig(&tls.Config{})
+	g2 := &Group{Name: "metrics-dot", Action: "forward", Maxfails: 1}
+	g2.SetProxies([]*proxy.Proxy{live, dot})
+	r2 := &Ruledforward{from: ".", server: "metrics:5353", groups: []*Group{g2}}
+	r2.registerInstance()
+	t.Cleanup(r2.unregisterInstance)
+	dead.Start(10 * time.Millisecond)
+	defer dead.Stop()
+	for deadline := time.Now().Add(5 * time.Second); !dead.Down(g.Maxfails); {
+		if time.Now().After(deadline) {
+			t.Fatal("upstream not marked down")
+		}
+		dead.Healthcheck()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(groupCollector{})
+	got := gather(t, reg, func(labels map[string]string) (string, bool) {
+		return strings.Join([]string{labels["server"], labels["to"], labels["transport"]}, " "), labels["group"] == g.Name
+	})
+	if got["coredns_ruledforward_upstream_up metrics:53 127.0.0.1:9 dns"] != 0 || got["coredns_ruledforward_upstream_up metrics:53 127.0.0.2:53 dns"] != 1 ||
+		got["coredns_ruledforward_upstream_up metrics:5353 127.0.0.2:53 tls"] != 1 {
+		t.Errorf("upstream_up = %v", got)
+	}
+	if got["coredns_ruledforward_upstream_healthcheck_failures metrics:53 127.0.0.1:9 dns"] < 2 || got["coredns_ruledforward_upstream_healthcheck_failures metrics:53 127.0.0.2:53 dns"] != 0 {
+		t.Errorf("upstream_healthcheck_failures = %v", got)
+	}
+	if n := got["coredns_ruledforward_upstream_healthcheck_failures_total  127.0.0.1:9 "]; n < 2 {
+		t.Errorf("upstream_healthcheck_failures_total = %v, want at least 2", n)
+	}
+}
+
+func TestUpstreamRequestMetrics(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		_ = w.WriteMsg(ret)
+	})
+	defer s.Close()
+	_, port, _ := net.SplitHostPort(s.Addr)
+	to := net.JoinHostPort("127.0.0.1", port)
+	list, _, err := newProxies("metrics-cache", &upstreamConfig{toHosts: []string{to}, expire: defaultExpire}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &Group{Name: "metrics-cache", Action: "forward"}
+	for range 2 {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if _, err := g.exchange(context.Background(), list[0], request.Request{W: &test.ResponseWriter{}, Req: req}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The second query reuses the connection the first one dialed.
+	got := gather(t, prometheus.DefaultGatherer, func(labels map[string]string) (string, bool) {
+		if labels["to"] != to {
+			return "", false
+		}
+		if labels["proxy_name"] == proxyName(g.Name) {
+			return "", true
+		}
+		return labels["rcode"], labels["group"] == g.Name
+	})
+	if got["coredns_proxy_conn_cache_misses_total"] != 1 || got["coredns_proxy_conn_cache_hits_total"] != 1 {
+		t.Errorf("connection cache metrics of the group = %v, want one miss and one hit", got)
+	}
+	if got["coredns_ruledforward_upstream_requests_total NOERROR"] != 2 {
+		t.Errorf("upstream_requests_total = %v, want 2 NOERROR", got)
+	}
+}
+
+func TestRequestDurationMetric(t *testing.T) {
+	m := NewMatcher()
+	m.AddRule(Rule{Type: RuleDomain, Value: "ads.example."})
+	m.Build()
+	g := &Group{Name: "metrics-duration", Action: "empty"}
+	g.SetMatcher(m)
+	r := &Ruledforward{from: ".", groups: []*Group{g}, Next: test.NextHandler(dns.RcodeSuccess, nil)}
+	for _, qname := range []string{"x.ads.example.", "ads.example.", "other.example."} {
+		req := new(dns.Msg)
+		req.SetQuestion(qname, dns.TypeA)
+		if _, err := r.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := gather(t, prometheus.DefaultGatherer, func(labels map[string]string) (string, bool) {
+		return labels["action"], labels["group"] == g.Name
+	})
+	if got["coredns_ruledforward_request_duration_seconds empty"] != 2 {
+		t.Errorf("request_duration_seconds = %v, want 2 requests of the group", got)
+	}
+}
+
+func TestRefreshMetrics(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ads.txt")
+	if err := os.WriteFile(path, []byte("||ads.example^\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	g := &Group{Name: "metrics-refresh", Action: "empty", AdguardPaths: []string{path}}
+	if err := g.refresh(nil, UpdateMatcherAll, "refresh"); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Remove(path)
+	if err := g.refresh(nil, UpdateMatcherAll, "refresh"); err == nil {
+		t.Fatal("expected the refresh to fail without the list")
+	}
+	got := gather(t, prometheus.DefaultGatherer, func(labels map[string]string) (string, bool) {
+		return labels["result"], labels["group"] == g.Name && labels["source"] == "refresh"
+	})
+	if got["coredns_ruledforward_refresh_total success"] != 1 || got["coredns_ruledforward_refresh_total failure"] != 1 ||
+		got["coredns_ruledforward_refresh_duration_seconds"] != 2 {
+		t.Errorf("refresh metrics = %v, want a success and a failure", got)
+	}
+}
+
+// gather returns the values of the gauges and counters, and the sample counts of the histograms, of g that keep
+// accepts, by name followed by the suffix keep returns for their labels, if not empty.
+func gather(t *testing.T, g prometheus.Gatherer, keep func(labels map[string]string) (string, bool)) map[string]float64 {
+	t.Helper()
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]float64)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			suffix, ok := keep(labels)
+			if !ok {
+				continue
+			}
+			name := mf.GetName()
+			if suffix != "" {
+				name += " " + suffix
+			}
+			got[name] = m.GetGauge().GetValue() + m.GetCounter().GetValue() + float64(m.GetHistogram().GetSampleCount())
+		}
+	}
+	return got
+}
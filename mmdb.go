@@ -0,0 +1,307 @@
+package ruledforward
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+	"sync"
+)
+
+// mmdbMetadataMarker precedes the metadata section at the end of a MaxMind DB file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+var errInvalidMMDB = errors.New("invalid MaxMind DB")
+
+// mmdbReader looks up records in a MaxMind DB (.mmdb) file such as GeoLite2-Country or GeoLite2-ASN.
+// Only what answer checks need is implemented: the search tree and the data section decoder.
+// See https://maxmind.github.io/MaxMind-DB/ for the format.
+type mmdbReader struct {
+	buf        []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dataStart  uint // offset of the data section in buf
+	ipv4Start  uint // node reached after the 96 leading zero bits of an IPv4 address in an IPv6 tree
+
+	cache sync.Map // data offset -> decoded record
+}
+
+// openMMDB reads the MaxMind DB at path.
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newMMDBReader(buf)
+}
+
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: no metadata", errInvalidMMDB)
+	}
+	metaStart := uint(i + len(mmdbMetadataMarker))
+	d := mmdbDecoder{buf: buf[metaStart:]}
+	v, _, err := d.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: metadata: %v", errInvalidMMDB, err)
+	}
+	meta, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", errInvalidMMDB)
+	}
+	r := &mmdbReader{
+		buf:        buf,
+		nodeCount:  mmdbUint(meta["node_count"]),
+		recordSize: mmdbUint(meta["record_size"]),
+		ipVersion:  mmdbUint(meta["ip_version"]),
+	}
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%w: record size %d", errInvalidMMDB, r.recordSize)
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	r.dataStart = treeSize + 16
+	if r.dataStart > metaStart || (r.ipVersion != 4 && r.ipVersion != 6) {
+		return nil, fmt.Errorf("%w: bad search tree", errInvalidMMDB)
+	}
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+func mmdbUint(v any) uint {
+	switch v := v.(type) {
+	case uint64:
+		return uint(v)
+	case uint32:
+		return uint(v)
+	case uint16:
+		return uint(v)
+	}
+	return 0
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (r *mmdbReader) record(node uint, bit uint) uint {
+	b := r.buf[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// lookup returns the decoded record for addr, or nil if the database has none.
+func (r *mmdbReader) lookup(addr netip.Addr) (any, error) {
+	addr = addr.Unmap()
+	ip := addr.AsSlice()
+	node := uint(0)
+	if addr.Is4() && r.ipVersion == 6 {
+		node = r.ipv4Start
+	} else if addr.Is6() && r.ipVersion == 4 {
+		return nil, nil
+	}
+	for i := 0; i < len(ip)*8 && node < r.nodeCount; i++ {
+		node = r.record(node, uint(ip[i/8]>>(7-i%8))&1)
+	}
+	if node <= r.nodeCount {
+		return nil, nil
+	}
+	offset := node - r.nodeCount - 16
+	if v, ok := r.cache.Load(offset); ok {
+		return v, nil
+	}
+	d := mmdbDecoder{buf: r.buf[r.dataStart:]}
+	v, _, err := d.decode(offset, 0)
+	if err != nil {
+		return nil, err
+	}
+	r.cache.Store(offset, v)
+	return v, nil
+}
+
+// mmdbPath returns the value at the given map keys in a decoded record, or nil.
+func mmdbPath(v any, keys ...string) any {
+	for _, k := range keys {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+// country returns the ISO country code of addr, preferring the country over the registered country.
+func (r *mmdbReader) country(addr netip.Addr) string {
+	v, err := r.lookup(addr)
+	if err != nil || v == nil {
+		return ""
+	}
+	if cc, ok := mmdbPath(v, "country", "iso_code").(string); ok {
+		return cc
+	}
+	cc, _ := mmdbPath(v, "registered_country", "iso_code").(string)
+	return cc
+}
+
+// mmdbDecoder decodes values of the MaxMind DB data section format. Offsets, including pointers, are relative to buf.
+type mmdbDecoder struct {
+	buf []byte
+}
+
+// maxMMDBDepth bounds nesting so a corrupt file cannot recurse without limit.
+const maxMMDBDepth = 32
+
+// decode decodes the value at offset and returns it with the offset following it.
+func (d *mmdbDecoder) decode(offset uint, depth int) (any, uint, error) {
+	if depth > maxMMDBDepth {
+		return nil, 0, errors.New("data nested too deeply")
+	}
+	if offset >= uint(len(d.buf)) {
+		return nil, 0, errors.New("offset out of range")
+	}
+	ctrl := d.buf[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+	if typ == 1 { // pointer
+		ptr, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(ptr, depth+1)
+		return v, next, err
+	}
+	if typ == 0 { // extended
+		if offset >= uint(len(d.buf)) {
+			return nil, 0, errors.New("offset out of range")
+		}
+		typ = 7 + uint(d.buf[offset])
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(d.buf)) {
+			return nil, 0, errors.New("offset out of range")
+		}
+		v := uint(0)
+		for _, b := range d.buf[offset : offset+n] {
+			v = v<<8 | uint(b)
+		}
+		offset += n
+		size = []uint{29, 285, 65821}[n-1] + v
+	}
+
+	switch typ {
+	case 7: // map
+		m := make(map[string]any, size)
+		for range size {
+			k, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			v, next2, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next2
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]any, 0, min(size, 1024))
+		for range size {
+			v, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case 14: // boolean, the value is the size
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, errors.New("value out of range")
+	}
+	b := d.buf[offset : offset+size]
+	offset += size
+	switch typ {
+	case 2: // UTF-8 string
+		return string(b), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errors.New("bad double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 4: // bytes
+		return bytes.Clone(b), offset, nil
+	case 5, 6, 9: // uint16, uint32, uint64
+		if size > 8 {
+			return nil, 0, errors.New("bad unsigned size")
+		}
+		v := uint64(0)
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, offset, nil
+	case 8: // int32
+		if size > 4 {
+			return nil, 0, errors.New("bad int32 size")
+		}
+		v := uint32(0)
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int64(int32(v)), offset, nil
+	case 10: // uint128, kept as big-endian bytes
+		return bytes.Clone(b), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errors.New("bad float size")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+}
+
+// pointer decodes the pointer whose control byte is ctrl and returns its target and the offset following it.
+func (d *mmdbDecoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	n := uint(ctrl>>3)&3 + 1
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, errors.New("pointer out of range")
+	}
+	v := uint(0)
+	if n < 4 {
+		v = uint(ctrl & 7)
+	}
+	for _, b := range d.buf[offset : offset+n] {
+		v = v<<8 | uint(b)
+	}
+	return v + []uint{0, 2048, 526336, 0}[n-1], offset + n, nil
+}
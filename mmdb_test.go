@@ -0,0 +1,175 @@
+package ruledforward
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mmdbEncode appends v in MaxMind DB data format. Only the types the tests need are supported.
+func mmdbEncode(b []byte, v any) []byte {
+	switch v := v.(type) {
+	case string:
+		b = append(b, 2<<5|byte(len(v)))
+		return append(b, v...)
+	case uint16:
+		return append(b, 5<<5|2, byte(v>>8), byte(v))
+	case uint32:
+		return append(b, 6<<5|4, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	case map[string]any:
+		b = append(b, 7<<5|byte(len(v)))
+		for k, e := range v {
+			b = mmdbEncode(b, k)
+			b = mmdbEncode(b, e)
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+// buildTestMMDB returns an IPv6 MaxMind DB with 24-bit records mapping each prefix to its record.
+func buildTestMMDB(records map[netip.Prefix]map[string]any) []byte {
+	const empty = -1
+	nodes := [][2]int{{empty, empty}}
+	var data []byte
+	for p, rec := range records {
+		leaf := -(2 + len(data))
+		data = mmdbEncode(data, rec)
+		ip := p.Addr().As16()
+		bits := p.Bits()
+		if p.Addr().Is4() {
+			// IPv4 networks live under ::/96 in an IPv6 tree.
+			var v4 [16]byte
+			copy(v4[12:], p.Addr().AsSlice())
+			ip, bits = v4, bits+96
+		}
+		node := 0
+		for i := range bits {
+			bit := ip[i/8] >> (7 - i%8) & 1
+			if i == bits-1 {
+				nodes[node][bit] = leaf
+				break
+			}
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+	n := len(nodes)
+	var tree []byte
+	for _, nd := range nodes {
+		for _, rec := range nd {
+			v := rec
+			switch {
+			case rec == empty:
+				v = n
+			case rec < 0:
+				v = n + 16 + (-rec - 2)
+			}
+			tree = append(tree, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	buf := append(tree, make([]byte, 16)...)
+	buf = append(buf, data...)
+	buf = append(buf, mmdbMetadataMarker...)
+	return mmdbEncode(buf, map[string]any{
+		"node_count":  uint32(n),
+		"record_size": uint16(24),
+		"ip_version":  uint16(6),
+	})
+}
+
+func TestMMDBCountry(t *testing.T) {
+	buf := buildTestMMDB(map[netip.Prefix]map[string]any{
+		netip.MustParsePrefix("1.0.1.0/24"):    {"country": map[string]any{"iso_code": "CN"}},
+		netip.MustParsePrefix("8.8.8.0/24"):    {"registered_country": map[string]any{"iso_code": "US"}},
+		netip.MustParsePrefix("2001:db8::/32"): {"country": map[string]any{"iso_code": "DE"}},
+	})
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := openMMDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"1.0.1.200":      "CN",
+		"::ffff:1.0.1.1": "CN",
+		"8.8.8.8":        "US",
+		"2001:db8::53":   "DE",
+		"9.9.9.9":        "",
+		"2001:db9::1":    "",
+	}
+	for addr, want := range tests {
+		if got := db.country(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("country(%s) = %q, want %q", addr, got, want)
+		}
+	}
+
+	if _, err := newMMDBReader([]byte("not a database")); err == nil {
+		t.Error("expected error for data without metadata")
+	}
+}
+
+func TestMMDBDecodePointer(t *testing.T) {
+	var buf []byte
+	buf = mmdbEncode(buf, "iso_code")
+	ptr := len(buf)
+	buf = append(buf, 1<<5, 0) // pointer to offset 0
+	buf = mmdbEncode(buf, "after")
+	d := mmdbDecoder{buf: buf}
+	v, next, err := d.decode(uint(ptr), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "iso_code" {
+		t.Errorf("pointer decoded to %v", v)
+	}
+	if v, _, _ := d.decode(next, 0); v != "after" {
+		t.Errorf("value after pointer = %v", v)
+	}
+	if _, _, err := d.decode(uint(len(buf)), 0); err == nil {
+		t.Error("expected error past the end")
+	}
+}
+
+func TestExpectedIPsCountryDB(t *testing.T) {
+	db, err := newMMDBReader(buildTestMMDB(map[netip.Prefix]map[string]any{
+		netip.MustParsePrefix("1.0.1.0/24"): {"country": map[string]any{"iso_code": "CN"}},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &Group{Name: "cn", expectedGeo: []string{"CN"}, expectedNets: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	if err := resolveExpectedIPs([]*Group{g}, "", db); err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{"1.0.1.1": true, "10.1.2.3": true, "8.8.8.8": false} {
+		if got := g.ExpectedIPs.Contains(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("Contains(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestClientGeoIPCountryDB(t *testing.T) {
+	db, err := newMMDBReader(buildTestMMDB(map[netip.Prefix]map[string]any{
+		netip.MustParsePrefix("1.0.1.0/24"): {"country": map[string]any{"iso_code": "CN"}},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &Group{Name: "cn", Clients: []clientRule{{geo: []string{"CN"}}}}
+	if err := resolveExpectedIPs([]*Group{g}, "", db); err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{"1.0.1.1": true, "8.8.8.8": false} {
+		if got := g.appliesTo(queryClient{addr: netip.MustParseAddr(addr)}, time.Now()); got != want {
+			t.Errorf("appliesTo(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package ruledforward
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultNegativeCacheSize is the number of entries `negative_cache` adds to the instance's cache by default.
+	defaultNegativeCacheSize = 10000
+	// negativeCacheMaxTTL caps how long a negative answer is cached, like the cache plugin's default for denials.
+	negativeCacheMaxTTL = 30 * time.Minute
+)
+
+// matcherGeneration changes whenever the rules of any group change, so cached routing decisions can tell that the
+// query might now be routed elsewhere.
+var matcherGeneration atomic.Uint64
+
+// negKey identifies a cached negative answer.
+type negKey struct {
+	name  string // lower-case
+	qtype uint16
+	do    bool
+}
+
+// negEntry is a negative answer cached for the group the query was matched (or defaulted) to.
+type negEntry struct {
+	group   *Group
+	msg     *dns.Msg // without OPT record
+	stored  time.Time
+	ttl     time.Duration
+	expires time.Time
+	gen     uint64 // matcherGeneration when stored
+
+	hits        atomic.Uint32 // for prefetch
+	prefetching atomic.Bool
+}
+
+// negativeTTL returns how long m may be cached as a negative answer (RFC 2308): NXDOMAIN or NODATA with an SOA in the
+// authority section, for the lower of the SOA's TTL and minimum, capped by negativeCacheMaxTTL.
+func negativeTTL(m *dns.Msg) (time.Duration, bool) {
+	if m.Truncated || (m.Rcode != dns.RcodeNameError && (m.Rcode != dns.RcodeSuccess || len(m.Answer) > 0)) {
+		return 0, false
+	}
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second
+			return min(ttl, negativeCacheMaxTTL), ttl > 0
+		}
+	}
+	return 0, false
+}
+
+// negCacheWriter caches the negative answers written for queries matched to group.
+type negCacheWriter struct {
+	dns.ResponseWriter
+	cache *lru[negKey, *negEntry]
+	key   negKey
+	group *Group
+	gen   uint64
+}
+
+func (w *negCacheWriter) WriteMsg(m *dns.Msg) error {
+	if ttl, ok := negativeTTL(m); ok {
+		c := m.Copy()
+		c.Extra = withoutOPT(c.Extra)
+		now := time.Now()
+		w.cache.add(w.key, &negEntry{group: w.group, msg: c, stored: now, ttl: ttl, expires: now.Add(ttl), gen: w.gen})
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// withoutOPT removes OPT records from rrs.
+func withoutOPT(rrs []dns.RR) []dns.RR {
+	out := rrs[:0]
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// negativeCacheKey returns the cache key of the query in state.
+func negativeCacheKey(state request.Request) negKey {
+	return negKey{name: state.Name(), qtype: state.QType(), do: state.Do()}
+}
+
+// serveNegativeCache answers req from the negative cache and reports whether it did. Entries expire with their TTL
+// and whenever any group's rules change. start is when ServeDNS got req.
+func (r *Ruledforward) serveNegativeCache(w dns.ResponseWriter, req *dns.Msg, state request.Request, start time.Time) (bool, int, error) {
+	key := negativeCacheKey(state)
+	e, ok := r.negCache.get(key)
+	if !ok {
+		return false, 0, nil
+	}
+	now := time.Now()
+	if !now.Before(e.expires) || e.gen != matcherGeneration.Load() {
+		r.negCache.remove(key)
+		return false, 0, nil
+	}
+	g := e.group
+	r.labelServe(g)
+	if g.RateLimit != nil && !g.RateLimit.Allow(state.IP()) {
+		rcode, err := g.RateLimit.Reject(w, req, g.Name, r.ednsKeep)
+		return true, rcode, err
+	}
+	if g.Prefetch != nil {
+		r.maybePrefetch(e, key, now)
+	}
+
+	m := e.msg.Copy()
+	m.Id = req.Id
+	m.RecursionDesired = req.RecursionDesired
+	m.CheckingDisabled = req.CheckingDisabled
+	m.Question = req.Question
+	age := uint32(now.Sub(e.stored) / time.Second)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			rr.Header().Ttl -= min(age, rr.Header().Ttl)
+		}
+	}
+	state.SizeAndDo(m)
+
+	requestsTotal.WithLabelValues(g.Name, g.Action).Inc()
+	negativeCacheHitsTotal.WithLabelValues(g.Name).Inc()
+	r.recordQuery(state, g)
+	_ = w.WriteMsg(m)
+	requestDuration.WithLabelValues(g.Name, g.Action).Observe(time.Since(start).Seconds())
+	return true, 0, nil
+}
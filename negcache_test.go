@@ -0,0 +1,137 @@
+package ruledforward
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestNegativeTTL(t *testing.T) {
+	soa := func(ttl, minttl uint32) dns.RR {
+		return &dns.SOA{Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl}, Ns: ".", Mbox: ".", Minttl: minttl}
+	}
+	reply := func(rcode int, answer []dns.RR, ns ...dns.RR) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("a.example.", dns.TypeA)
+		m.Rcode = rcode
+		m.Answer = answer
+		m.Ns = ns
+		return m
+	}
+	truncated := reply(dns.RcodeNameError, nil, soa(300, 60))
+	truncated.Truncated = true
+	tests := []struct {
+		name string
+		m    *dns.Msg
+		ttl  time.Duration
+		ok   bool
+	}{
+		{name: "NXDOMAIN", m: reply(dns.RcodeNameError, nil, soa(300, 60)), ttl: time.Minute, ok: true},
+		{name: "NODATA", m: reply(dns.RcodeSuccess, nil, soa(30, 600)), ttl: 30 * time.Second, ok: true},
+		{name: "capped", m: reply(dns.RcodeNameError, nil, soa(86400, 86400)), ttl: negativeCacheMaxTTL, ok: true},
+		{name: "no SOA", m: reply(dns.RcodeNameError, nil)},
+		{name: "zero TTL", m: reply(dns.RcodeNameError, nil, soa(0, 60))},
+		{name: "answer", m: reply(dns.RcodeSuccess, []dns.RR{test.A("a.example. 300 IN A 192.0.2.1")}, soa(300, 60))},
+		{name: "SERVFAIL", m: reply(dns.RcodeServerFailure, nil, soa(300, 60))},
+		{name: "truncated", m: truncated},
+	}
+	for _, tc := range tests {
+		ttl, ok := negativeTTL(tc.m)
+		if ok != tc.ok || (ok && ttl != tc.ttl) {
+			t.Errorf("%s: negativeTTL = %v, %v, want %v, %v", tc.name, ttl, ok, tc.ttl, tc.ok)
+		}
+	}
+}
+
+// newNXDOMAINUpstream returns an upstream that answers every query with NXDOMAIN and a negative TTL of 60s.
+func newNXDOMAINUpstream(t *testing.T, n *atomic.Int32) *proxy.Proxy {
+	t.Helper()
+	s := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		n.Add(1)
+		ret := new(dns.Msg)
+		ret.SetRcode(r, dns.RcodeNameError)
+		ret.Ns = []dns.RR{test.SOA("example. 300 IN SOA ns.example. admin.example. 1 3600 600 86400 60")}
+		_ = w.WriteMsg(ret)
+	})
+	t.Cleanup(s.Close)
+	_, port, _ := net.SplitHostPort(s.Addr)
+	return proxy.NewProxy("ruledforward", net.JoinHostPort("127.0.0.1", port), transport.DNS)
+}
+
+// countingMatcher counts the calls to Match.
+type countingMatcher struct {
+	Matcher
+	n *atomic.Int32
+}
+
+func (m countingMatcher) Match(qname string) bool {
+	m.n.Add(1)
+	return m.Matcher.Match(qname)
+}
+
+func TestNegativeCache(t *testing.T) {
+	var matches atomic.Int32
+	m := NewMatcher()
+	m.AddRule(Rule{Type: RuleDomain, Value: "ads.example."})
+	m.Build()
+	block := &Group{Name: "block", Action: "empty", NegativeCache: 10}
+	block.SetMatcher(countingMatcher{Matcher: m, n: &matches})
+
+	var upstreamN atomic.Int32
+	def := &Group{Name: "default", Action: "forward", Policy: &sequential{}, NegativeCache: 10}
+	def.SetProxies([]*proxy.Proxy{newNXDOMAINUpstream(t, &upstreamN)})
+	def.SetMatcher(NewMatcher())
+	r := &Ruledforward{from: ".", groups: []*Group{block, def}, defaultGroup: def, negCache: newLRU[negKey, *negEntry](20)}
+
+	query := func(name string) *dns.Msg {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := r.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Msg == nil || rec.Msg.Id != req.Id {
+			t.Fatalf("%s: response %v does not answer the query", name, rec.Msg)
+		}
+		return rec.Msg
+	}
+
+	query("x.ads.example.")
+	query("x.ads.example.")
+	if n := matches.Load(); n != 1 {
+		t.Errorf("matcher consulted %d times, want once with the second answer cached", n)
+	}
+
+	// Cached answers count down their TTLs.
+	e, _ := r.negCache.get(negKey{name: "x.ads.example.", qtype: dns.TypeA})
+	e.stored = e.stored.Add(-2 * time.Second)
+	if ret := query("x.ads.example."); len(ret.Ns) != 1 || ret.Ns[0].Header().Ttl != emptyTTL-2 {
+		t.Errorf("cached answer authority = %v, want SOA with TTL %d", ret.Ns, emptyTTL-2)
+	}
+
+	// Upstream negative answers are cached for the group that forwarded them.
+	if ret := query("nx.example."); ret.Rcode != dns.RcodeNameError {
+		t.Fatalf("rcode = %d, want NXDOMAIN", ret.Rcode)
+	}
+	if ret := query("nx.example."); ret.Rcode != dns.RcodeNameError || upstreamN.Load() != 1 {
+		t.Errorf("rcode = %d after %d upstream queries, want NXDOMAIN from the cache", ret.Rcode, upstreamN.Load())
+	}
+
+	// Changing any group's rules invalidates the cache, as the name may now be routed elsewhere.
+	def.SetMatcher(NewMatcher())
+	query("x.ads.example.")
+	query("nx.example.")
+	if n := matches.Load(); n < 2 || upstreamN.Load() != 2 {
+		t.Errorf("after a rule change: %d matches and %d upstream queries, want both answers resolved again", n, upstreamN.Load())
+	}
+}
@@ -0,0 +1,269 @@
+package ruledforward
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// netSet is a kernel address set that a group adds the A/AAAA addresses of its forwarded answers to, configured with
+// `ipset SET4 [SET6]` or `nftset FAMILY TABLE SET4 [SET6]`. Firewall and policy routing rules can then match traffic
+// to the domains the group resolved, like dnsmasq's ipset/nftset options. IPv6 addresses are skipped without SET6.
+type netSet struct {
+	nft    bool   // nftables set instead of ipset
+	family string // nftables table family (ip, ip6, inet, ...)
+	table  string // nftables table
+	v4, v6 string // set names per address family
+
+	mu   sync.Mutex
+	conn *netlinkConn // opened on first use, see netset_linux.go
+	seq  uint32
+
+	start  sync.Once
+	closed sync.Once
+	queue  chan netSetAddrs // drained by a goroutine started on first use
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// netSetQueueSize bounds the additions waiting for a set. Answers arriving while it is full are not added.
+const netSetQueueSize = 1024
+
+// netSetAddrs are the addresses of one answer, waiting to be added to a set.
+type netSetAddrs struct {
+	group  string
+	v4, v6 []netip.Addr
+}
+
+// nftFamilies maps nftables table families to their NFPROTO values.
+var nftFamilies = map[string]uint8{"inet": 1, "ip": 2, "arp": 3, "netdev": 5, "bridge": 7, "ip6": 10}
+
+// parseNetSet parses the arguments of `ipset` (nft false) or `nftset` (nft true).
+func parseNetSet(nft bool, args []string) (*netSet, error) {
+	s := &netSet{nft: nft}
+	if nft {
+		if len(args) != 3 && len(args) != 4 {
+			return nil, fmt.Errorf("nftset needs FAMILY TABLE SET4 [SET6]")
+		}
+		if _, ok := nftFamilies[args[0]]; !ok {
+			return nil, fmt.Errorf("unknown nftables family '%s'", args[0])
+		}
+		s.family, s.table, args = args[0], args[1], args[2:]
+	} else if len(args) != 1 && len(args) != 2 {
+		return nil, fmt.Errorf("ipset needs SET4 [SET6]")
+	}
+	s.v4 = args[0]
+	if len(args) == 2 {
+		s.v6 = args[1]
+	}
+	for _, name := range args {
+		// IPSET_MAXNAMELEN and NFT_SET_MAXNAMELEN include the terminating NUL.
+		if name == "" || len(name) > 31 && !nft || len(name) > 255 {
+			return nil, fmt.Errorf("invalid set name '%s'", name)
+		}
+	}
+	return s, nil
+}
+
+// clone returns a set with the same kernel set names, for a group declared with `extends`. It has its own queue
+// and socket, so the groups can be stopped independently.
+func (s *netSet) clone() *netSet {
+	return &netSet{nft: s.nft, family: s.family, table: s.table, v4: s.v4, v6: s.v6}
+}
+
+func (s *netSet) String() string {
+	names := s.v4
+	if s.v6 != "" {
+		names += " " + s.v6
+	}
+	if s.nft {
+		return "nftset " + s.family + " " + s.table + " " + names
+	}
+	return "ipset " + names
+}
+
+// enqueue queues the A/AAAA addresses of ret to be added to the set, without waiting for the kernel. It reports
+// false if the queue was full and the addresses were dropped.
+func (s *netSet) enqueue(group string, ret *dns.Msg) bool {
+	a := netSetAddrs{group: group}
+	for _, rr := range ret.Answer {
+		addr, ok := rrAddr(rr)
+		switch {
+		case !ok:
+		case addr.Is4():
+			a.v4 = append(a.v4, addr)
+		case s.v6 != "":
+			a.v6 = append(a.v6, addr)
+		}
+	}
+	if len(a.v4) == 0 && len(a.v6) == 0 {
+		return true
+	}
+	s.start.Do(func() {
+		s.queue = make(chan netSetAddrs, netSetQueueSize)
+		s.stop = make(chan struct{})
+		s.done = make(chan struct{})
+		go s.drain()
+	})
+	select {
+	case <-s.stop:
+		return false
+	default:
+	}
+	select {
+	case s.queue <- a:
+		return true
+	default:
+		return false
+	}
+}
+
+// drain adds the queued addresses to the set until close.
+func (s *netSet) drain() {
+	defer close(s.done)
+	for {
+		select {
+		case a := <-s.queue:
+			if err := s.add(a.v4, a.v6); err != nil {
+				netSetErrorsTotal.WithLabelValues(a.group).Inc()
+				log.Debugf("Group '%s': %v", a.group, err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// add adds the addresses to the set.
+func (s *netSet) add(v4, v6 []netip.Addr) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var msgs []byte
+	if s.nft {
+		msgs = s.nftBatch(v4, v6)
+	} else {
+		for _, addr := range v4 {
+			msgs = append(msgs, s.ipsetAdd(s.v4, addr)...)
+		}
+		for _, addr := range v6 {
+			msgs = append(msgs, s.ipsetAdd(s.v6, addr)...)
+		}
+	}
+	return s.send(msgs)
+}
+
+// close stops the queue, dropping what is left in it, and closes the socket. The set takes no more additions.
+// Closing a set again does nothing.
+func (s *netSet) close() {
+	s.closed.Do(func() {
+		started := true
+		s.start.Do(func() { started = false })
+		if started {
+			close(s.stop)
+			<-s.done
+		}
+		s.closeConn()
+	})
+}
+
+// Netlink and nfnetlink constants, from linux/netlink.h, linux/netfilter/nfnetlink.h, linux/netfilter/ipset/ip_set.h
+// and linux/netfilter/nf_tables.h.
+const (
+	nlmFRequest = 0x1
+	nlmFAck     = 0x4
+	nlmFCreate  = 0x400
+	nlaFNested  = 0x8000
+	nlaFNetByte = 0x4000
+
+	nfnlMsgBatchBegin = 0x10
+	nfnlMsgBatchEnd   = 0x11
+	nfnlSubsysIPSet   = 6
+	nfnlSubsysNFT     = 10
+
+	ipsetProtocol      = 6
+	ipsetCmdAdd        = 9
+	ipsetAttrProtocol  = 1
+	ipsetAttrSetname   = 2
+	ipsetAttrData      = 7
+	ipsetAttrIP        = 1
+	ipsetAttrIPAddrV4  = 1
+	ipsetAttrIPAddrV6  = 2
+	nftMsgNewSetElem   = 12
+	nftaSetElemListTbl = 1
+	nftaSetElemListSet = 2
+	nftaSetElemListEls = 3
+	nftaListElem       = 1
+	nftaSetElemKey     = 1
+	nftaDataValue      = 1
+)
+
+// nlMsg builds a netlink message with an nfgenmsg header for family and resID, followed by attrs.
+func (s *netSet) nlMsg(typ, flags uint16, family uint8, resID uint16, attrs []byte) []byte {
+	s.seq++
+	b := make([]byte, 20, 20+len(attrs))
+	binary.NativeEndian.PutUint32(b[0:], uint32(20+len(attrs)))
+	binary.NativeEndian.PutUint16(b[4:], typ)
+	binary.NativeEndian.PutUint16(b[6:], flags)
+	binary.NativeEndian.PutUint32(b[8:], s.seq)
+	b[16] = family
+	binary.BigEndian.PutUint16(b[18:], resID)
+	return append(b, attrs...)
+}
+
+// nlAttr appends a netlink attribute, padded to 4 bytes.
+func nlAttr(b []byte, typ uint16, data []byte) []byte {
+	var hdr [4]byte
+	binary.NativeEndian.PutUint16(hdr[0:], uint16(4+len(data)))
+	binary.NativeEndian.PutUint16(hdr[2:], typ)
+	b = append(append(b, hdr[:]...), data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func cString(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// ipsetAdd returns an IPSET_CMD_ADD message for addr. Without NLM_F_EXCL, adding an existing entry is not an error.
+func (s *netSet) ipsetAdd(set string, addr netip.Addr) []byte {
+	family, typ := uint8(2), uint16(ipsetAttrIPAddrV4) // AF_INET
+	if addr.Is6() {
+		family, typ = 10, ipsetAttrIPAddrV6 // AF_INET6
+	}
+	ip := nlAttr(nil, typ|nlaFNetByte, addr.AsSlice())
+	data := nlAttr(nil, ipsetAttrIP|nlaFNested, ip)
+	attrs := nlAttr(nil, ipsetAttrProtocol, []byte{ipsetProtocol})
+	attrs = nlAttr(attrs, ipsetAttrSetname, cString(set))
+	attrs = nlAttr(attrs, ipsetAttrData|nlaFNested, data)
+	return s.nlMsg(nfnlSubsysIPSet<<8|ipsetCmdAdd, nlmFRequest|nlmFAck, family, 0, attrs)
+}
+
+// nftBatch returns an nftables batch adding v4 to SET4 and v6 to SET6.
+func (s *netSet) nftBatch(v4, v6 []netip.Addr) []byte {
+	family := nftFamilies[s.family]
+	b := s.nlMsg(nfnlMsgBatchBegin, nlmFRequest, 0, nfnlSubsysNFT, nil)
+	for _, set := range []struct {
+		name  string
+		addrs []netip.Addr
+	}{{s.v4, v4}, {s.v6, v6}} {
+		if len(set.addrs) == 0 {
+			continue
+		}
+		var elems []byte
+		for _, addr := range set.addrs {
+			key := nlAttr(nil, nftaDataValue, addr.AsSlice())
+			elem := nlAttr(nil, nftaSetElemKey|nlaFNested, key)
+			elems = nlAttr(elems, nftaListElem|nlaFNested, elem)
+		}
+		attrs := nlAttr(nil, nftaSetElemListTbl, cString(s.table))
+		attrs = nlAttr(attrs, nftaSetElemListSet, cString(set.name))
+		attrs = nlAttr(attrs, nftaSetElemListEls|nlaFNested, elems)
+		b = append(b, s.nlMsg(nfnlSubsysNFT<<8|nftMsgNewSetElem, nlmFRequest|nlmFCreate|nlmFAck, family, 0, attrs)...)
+	}
+	return append(b, s.nlMsg(nfnlMsgBatchEnd, nlmFRequest, 0, nfnlSubsysNFT, nil)...)
+}
@@ -0,0 +1,103 @@
+package ruledforward
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+const (
+	netSetSupported  = true
+	netlinkNetfilter = 12 // NETLINK_NETFILTER
+	netlinkTimeout   = time.Second
+)
+
+// netlinkConn is a NETLINK_NETFILTER socket.
+type netlinkConn struct {
+	fd int
+}
+
+func openNetlink() (*netlinkConn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, netlinkNetfilter)
+	if err != nil {
+		return nil, err
+	}
+	tv := syscall.NsecToTimeval(netlinkTimeout.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &netlinkConn{fd: fd}, nil
+}
+
+// send writes msgs to the kernel and waits for the acknowledgement of each message that requested one. The socket is
+// opened on first use and reopened after an error, so stale replies are never read. Callers hold s.mu.
+func (s *netSet) send(msgs []byte) error {
+	if s.conn == nil {
+		c, err := openNetlink()
+		if err != nil {
+			return fmt.Errorf("%s: %w", s, err)
+		}
+		s.conn = c
+	}
+	err := s.conn.roundTrip(msgs)
+	if err != nil {
+		var errno syscall.Errno
+		if !errors.As(err, &errno) || errno == syscall.EAGAIN {
+			syscall.Close(s.conn.fd)
+			s.conn = nil
+		}
+		return fmt.Errorf("%s: %w", s, err)
+	}
+	return nil
+}
+
+func (c *netlinkConn) roundTrip(msgs []byte) error {
+	acks := 0
+	for b := msgs; len(b) >= 16; b = b[binary.NativeEndian.Uint32(b):] {
+		if binary.NativeEndian.Uint16(b[6:])&nlmFAck != 0 {
+			acks++
+		}
+	}
+	if err := syscall.Sendto(c.fd, msgs, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+	buf := make([]byte, 8192)
+	var firstErr error
+	for acks > 0 {
+		n, _, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		for b := buf[:n]; len(b) >= 16; {
+			l := int(binary.NativeEndian.Uint32(b))
+			if l < 16 || l > len(b) {
+				return errors.New("malformed netlink reply")
+			}
+			if binary.NativeEndian.Uint16(b[4:]) == syscall.NLMSG_ERROR && l >= 20 {
+				acks--
+				if code := int32(binary.NativeEndian.Uint32(b[16:])); code < 0 && firstErr == nil {
+					firstErr = syscall.Errno(-code)
+				}
+			}
+			b = b[min((l+3)&^3, len(b)):]
+		}
+	}
+	return firstErr
+}
+
+// closeConn closes the socket, if open.
+func (s *netSet) closeConn() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		syscall.Close(s.conn.fd)
+		s.conn = nil
+	}
+}
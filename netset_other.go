@@ -0,0 +1,15 @@
+//go:build !linux
+
+package ruledforward
+
+import "errors"
+
+const netSetSupported = false
+
+type netlinkConn struct{}
+
+func (s *netSet) send([]byte) error {
+	return errors.New("ipset and nftset are only supported on Linux")
+}
+
+func (s *netSet) closeConn() {}
@@ -0,0 +1,144 @@
+package ruledforward
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestParseNetSet(t *testing.T) {
+	tests := []struct {
+		nft     bool
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{false, []string{"gfwlist"}, "ipset gfwlist", false},
+		{false, []string{"gfwlist", "gfwlist6"}, "ipset gfwlist gfwlist6", false},
+		{true, []string{"inet", "fw4", "dst4"}, "nftset inet fw4 dst4", false},
+		{true, []string{"inet", "fw4", "dst4", "dst6"}, "nftset inet fw4 dst4 dst6", false},
+		{false, nil, "", true},
+		{false, []string{"a", "b", "c"}, "", true},
+		{false, []string{"a-name-longer-than-thirty-one-bytes"}, "", true},
+		{true, []string{"inet", "fw4"}, "", true},
+		{true, []string{"ipx", "fw4", "dst4"}, "", true},
+	}
+	for _, tc := range tests {
+		s, err := parseNetSet(tc.nft, tc.args)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseNetSet(%v) err = %v, wantErr %v", tc.args, err, tc.wantErr)
+			continue
+		}
+		if err == nil && s.String() != tc.want {
+			t.Errorf("parseNetSet(%v) = %q, want %q", tc.args, s, tc.want)
+		}
+	}
+}
+
+// nlMsgs splits a buffer of netlink messages and returns their types and flags.
+func nlMsgs(t *testing.T, b []byte) (types, flags []uint16) {
+	t.Helper()
+	for len(b) > 0 {
+		l := binary.NativeEndian.Uint32(b)
+		if l < 20 || l%4 != 0 || int(l) > len(b) {
+			t.Fatalf("bad message length %d", l)
+		}
+		types = append(types, binary.NativeEndian.Uint16(b[4:]))
+		flags = append(flags, binary.NativeEndian.Uint16(b[6:]))
+		b = b[l:]
+	}
+	return types, flags
+}
+
+func TestIPSetAddMsg(t *testing.T) {
+	s, _ := parseNetSet(false, []string{"gfwlist", "gfwlist6"})
+	msg := s.ipsetAdd("gfwlist", netip.MustParseAddr("192.0.2.1"))
+	types, flags := nlMsgs(t, msg)
+	if len(types) != 1 || types[0] != 6<<8|9 || flags[0] != nlmFRequest|nlmFAck {
+		t.Fatalf("types %v flags %v", types, flags)
+	}
+	if msg[16] != 2 {
+		t.Errorf("nfgenmsg family = %d, want AF_INET", msg[16])
+	}
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		t.Skip("expected bytes are little-endian")
+	}
+	attrs := msg[20:]
+	// protocol, set name, then data > ip > ipv4 address in network byte order
+	want := []byte{5, 0, 1, 0, ipsetProtocol, 0, 0, 0, 12, 0, 2, 0, 'g', 'f', 'w', 'l', 'i', 's', 't', 0,
+		16, 0, 7, 0x80, 12, 0, 1, 0x80, 8, 0, 1, 0x40, 192, 0, 2, 1}
+	if !bytes.Equal(attrs, want) {
+		t.Errorf("attrs = %v, want %v", attrs, want)
+	}
+
+	msg = s.ipsetAdd("gfwlist6", netip.MustParseAddr("2001:db8::1"))
+	if msg[16] != 10 || !bytes.Contains(msg, netip.MustParseAddr("2001:db8::1").AsSlice()) {
+		t.Errorf("IPv6 message = %v", msg)
+	}
+}
+
+func TestNftSetBatch(t *testing.T) {
+	s, _ := parseNetSet(true, []string{"inet", "fw4", "dst4", "dst6"})
+	v4 := []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")}
+	v6 := []netip.Addr{netip.MustParseAddr("2001:db8::1")}
+	b := s.nftBatch(v4, v6)
+	types, flags := nlMsgs(t, b)
+	newElem := uint16(10<<8 | 12)
+	wantTypes := []uint16{nfnlMsgBatchBegin, newElem, newElem, nfnlMsgBatchEnd}
+	if len(types) != len(wantTypes) {
+		t.Fatalf("types = %v, want %v", types, wantTypes)
+	}
+	for i := range types {
+		if types[i] != wantTypes[i] {
+			t.Errorf("types[%d] = %#x, want %#x", i, types[i], wantTypes[i])
+		}
+	}
+	if flags[1]&nlmFAck == 0 || flags[0]&nlmFAck != 0 {
+		t.Errorf("flags = %v", flags)
+	}
+	for _, want := range [][]byte{[]byte("fw4\x00"), []byte("dst4\x00"), []byte("dst6\x00"), v4[1].AsSlice(), v6[0].AsSlice()} {
+		if !bytes.Contains(b, want) {
+			t.Errorf("batch does not contain %q", want)
+		}
+	}
+
+	types, _ = nlMsgs(t, s.nftBatch(v4, nil))
+	if len(types) != 3 {
+		t.Errorf("IPv4-only batch has %d messages, want 3", len(types))
+	}
+}
+
+func TestNetSetEnqueue(t *testing.T) {
+	s, _ := parseNetSet(false, []string{"gfwlist"})
+	s.start.Do(func() { s.queue = make(chan netSetAddrs, 1) })
+	a := &dns.Msg{Answer: []dns.RR{test.A("example.org. 60 IN A 192.0.2.1"), test.AAAA("example.org. 60 IN AAAA 2001:db8::1")}}
+	if !s.enqueue("g", a) {
+		t.Fatal("first answer dropped")
+	}
+	if s.enqueue("g", a) {
+		t.Error("answer queued beyond the queue size")
+	}
+	if !s.enqueue("g", &dns.Msg{Answer: []dns.RR{test.CNAME("example.org. 60 IN CNAME example.net.")}}) {
+		t.Error("answer without addresses dropped")
+	}
+	got := <-s.queue
+	if len(got.v4) != 1 || len(got.v6) != 0 || got.group != "g" {
+		t.Errorf("queued %+v, want one IPv4 address of group g", got)
+	}
+}
+
+func TestNetSetClose(t *testing.T) {
+	s, _ := parseNetSet(true, []string{"inet", "fw4", "dst4"})
+	s.close()
+	s, _ = parseNetSet(true, []string{"inet", "fw4", "dst4"})
+	s.enqueue("g", &dns.Msg{Answer: []dns.RR{test.A("example.org. 60 IN A 192.0.2.1")}})
+	s.close()
+	s.close()
+	if s.enqueue("g", &dns.Msg{Answer: []dns.RR{test.A("example.org. 60 IN A 192.0.2.1")}}) {
+		t.Error("answer queued after close")
+	}
+}
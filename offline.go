@@ -0,0 +1,97 @@
+package ruledforward
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/caddy/caddyfile"
+)
+
+// The functions in this file work on rules and Corefiles without a running server, for cmd/ruledforwardctl.
+
+// CompileRules returns rules the way a group's matcher keeps them: normalized, without duplicates or rules that a
+// broader domain rule covers, and sorted by type and value. Invalid regular expressions are dropped.
+func CompileRules(rules []Rule) []Rule {
+	m := NewMatcher()
+	for _, r := range rules {
+		m.AddRule(r)
+	}
+	m.Build()
+	return m.(ruleLister).rules()
+}
+
+// ReadRules reads a rule snapshot in any format WriteRules writes: text, adguard or hosts lines, which may be mixed,
+// or json. The file may be gzip-compressed.
+func ReadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = decompress(data, path); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		return parseRuleLines(path, bytes.NewReader(data))
+	}
+	var in []struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	rules := make([]Rule, 0, len(in))
+	for i, jr := range in {
+		r, err := parseRuleLine(jr.Type + ":" + jr.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %w", path, i, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// LoadCorefile parses the ruledforward blocks of the Corefile at path, as CoreDNS would, and loads the updateItems
+// rule sources of every group, with the origin of each rule. Nothing is started: no upstreams are contacted and no
+// admin API listens. Relative paths in the Corefile are resolved against the working directory. The result is keyed
+// by server block, e.g. ".:53".
+func LoadCorefile(path string, updateItems uint16) (map[string]*Ruledforward, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	blocks, err := caddyfile.Parse(path, f, nil)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]*Ruledforward)
+	for i, sb := range blocks {
+		tokens, ok := sb.Tokens["ruledforward"]
+		if !ok {
+			continue
+		}
+		c := caddy.NewTestController("dns", "")
+		c.Dispenser = caddyfile.NewDispenserTokens(path, tokens)
+		c.Key = sb.Keys[0]
+		c.ServerBlockIndex = i
+		r, err := parseRuledforward(c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", c.Key, err)
+		}
+		for _, g := range r.allGroups() {
+			g.trackOrigins = true
+			if err := g.Update(r.dlc, updateItems); err != nil {
+				return nil, fmt.Errorf("%s: updating group %s: %w", c.Key, g.Name, err)
+			}
+		}
+		out[c.Key] = r
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%s: no ruledforward configuration", path)
+	}
+	return out, nil
+}
@@ -0,0 +1,118 @@
+package ruledforward
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCompileRules(t *testing.T) {
+	got := CompileRules([]Rule{
+		{Type: RuleFull, Value: "WWW.Example.com"},
+		{Type: RuleDomain, Value: "example.com"},
+		{Type: RuleDomain, Value: "ads.example.com."},
+		{Type: RuleFull, Value: "tracker.example.org."},
+		{Type: RuleKeyword, Value: "Banner"},
+		{Type: RuleKeyword, Value: "banner"},
+		{Type: RuleRegex, Value: "(["},
+	})
+	want := []Rule{
+		{Type: RuleDomain, Value: "example.com."},
+		{Type: RuleFull, Value: "tracker.example.org."},
+		{Type: RuleKeyword, Value: "banner"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("CompileRules = %v, want %v", got, want)
+	}
+}
+
+func TestReadRules(t *testing.T) {
+	rules := []Rule{
+		{Type: RuleDomain, Value: "example.com."},
+		{Type: RuleFull, Value: "tracker.example.org."},
+		{Type: RuleKeyword, Value: "banner"},
+		{Type: RuleRegex, Value: `^ad\d+\.`},
+	}
+	dir := t.TempDir()
+	for format := range ruleFormats {
+		var b bytes.Buffer
+		if err := WriteRules(&b, format, rules); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, format)
+		if err := os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadRules(path)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		want := rules
+		switch format {
+		case "adguard": // keywords are written as regular expressions
+			want = []Rule{rules[0], rules[1], {Type: RuleRegex, Value: "banner"}, rules[3]}
+		case "hosts":
+			want = []Rule{{Type: RuleFull, Value: "example.com."}, rules[1]}
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: ReadRules = %v, want %v", format, got, want)
+		}
+	}
+
+	path := filepath.Join(dir, "bad")
+	os.WriteFile(path, []byte("domain:example.com\nnot a rule\n"), 0o644)
+	if _, err := ReadRules(path); err == nil {
+		t.Error("expected an error for an invalid line")
+	}
+}
+
+func TestLoadCorefile(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "ads.txt")
+	if err := os.WriteFile(list, []byte("||ads.example^\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	corefile := filepath.Join(dir, "Corefile")
+	conf := `example.:1053 {
+    ruledforward {
+        group block {
+            action empty
+            adguard_rules ` + list + `
+        }
+        group default {
+            to 127.0.0.1:53
+        }
+    }
+}
+other.:1053 {
+    whoami
+}
+`
+	if err := os.WriteFile(corefile, []byte(conf), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	instances, err := LoadCorefile(corefile, UpdateMatcherLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := instances["example.:1053"]
+	if r == nil || len(instances) != 1 {
+		t.Fatalf("LoadCorefile = %v, want only the example.:1053 block", instances)
+	}
+	rule, source, ok := r.RuleFor("x.ads.example.")
+	if !ok || rule != (Rule{Type: RuleDomain, Value: "ads.example."}) || source != "adguard_rules:"+list {
+		t.Errorf("RuleFor = %v, %q, %v", rule, source, ok)
+	}
+	if group, _, _ := r.GroupFor("www.example."); group != "default" {
+		t.Errorf("GroupFor(www.example.) = %q, want default", group)
+	}
+	if _, _, ok := r.RuleFor("www.example."); ok {
+		t.Error("a name routed to the default group should match no rule")
+	}
+
+	if _, err := LoadCorefile(filepath.Join(dir, "missing"), UpdateMatcherLocal); err == nil {
+		t.Error("expected an error for a missing Corefile")
+	}
+}
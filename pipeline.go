@@ -0,0 +1,307 @@
+package ruledforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// pipeline is a `pipeline` block: steps run in order for each query instead of taking the first group that matches,
+// so that a response can be checked and the query resolved again, e.g. by another group when one answers NXDOMAIN.
+type pipeline struct {
+	steps []pipelineStep
+}
+
+// pipelineStep is a line of a pipeline: an action taken if all of its conditions hold, or a label to jump to.
+type pipelineStep struct {
+	label  string // for `label NAME`, which does nothing
+	conds  []pipelineCond
+	action string // exec, accept, reject, jump or next
+	arg    string // group of exec, label of jump
+	rcode  int    // of reject
+	target int    // index of the label a jump goes to
+
+	g *Group // of exec, set by resolve
+}
+
+// pipelineCond is a condition of a pipeline step: `match:GROUP`, `qtype:TYPE`, `rcode:RCODE` or `empty`, negated
+// with a leading `!`. The response conditions hold only once a step has executed a group.
+type pipelineCond struct {
+	not   bool
+	kind  string
+	group string
+	qtype uint16
+	rcode int
+
+	g *Group // of match, set by resolve
+}
+
+// pipelineActions are the actions of pipeline steps.
+var pipelineActions = map[string]bool{"exec": true, "accept": true, "reject": true, "jump": true, "next": true}
+
+// parsePipelineStep parses a line of a pipeline block: `label NAME` or `[if COND...] ACTION [ARG]`.
+func parsePipelineStep(args []string) (pipelineStep, error) {
+	var s pipelineStep
+	if args[0] == "label" {
+		if len(args) != 2 {
+			return s, errors.New("label needs a name")
+		}
+		s.label = args[1]
+		return s, nil
+	}
+	if args[0] == "if" {
+		args = args[1:]
+		for len(args) > 0 && !pipelineActions[args[0]] {
+			c, err := parsePipelineCond(args[0])
+			if err != nil {
+				return s, err
+			}
+			s.conds = append(s.conds, c)
+			args = args[1:]
+		}
+		if len(s.conds) == 0 {
+			return s, errors.New("if needs at least one condition")
+		}
+	}
+	if len(args) == 0 {
+		return s, errors.New("step has no action")
+	}
+	s.action = args[0]
+	args = args[1:]
+	switch s.action {
+	case "exec", "jump":
+		if len(args) != 1 {
+			return s, fmt.Errorf("%s needs exactly one argument", s.action)
+		}
+		s.arg = args[0]
+	case "reject":
+		s.rcode = dns.RcodeRefused
+		if len(args) > 1 {
+			return s, errors.New("reject takes at most one rcode")
+		}
+		if len(args) == 1 {
+			rcode, ok := dns.StringToRcode[strings.ToUpper(args[0])]
+			if !ok {
+				return s, fmt.Errorf("reject: invalid rcode '%s'", args[0])
+			}
+			s.rcode = rcode
+		}
+	case "accept", "next":
+		if len(args) != 0 {
+			return s, fmt.Errorf("%s takes no arguments", s.action)
+		}
+	default:
+		return s, fmt.Errorf("unknown pipeline action '%s'", s.action)
+	}
+	return s, nil
+}
+
+// parsePipelineCond parses a condition of a pipeline step.
+func parsePipelineCond(arg string) (pipelineCond, error) {
+	var c pipelineCond
+	s, not := strings.CutPrefix(arg, "!")
+	c.not = not
+	kind, val, _ := strings.Cut(s, ":")
+	c.kind = kind
+	switch kind {
+	case "match":
+		c.group = val
+	case "qtype":
+		qtype, ok := dns.StringToType[strings.ToUpper(val)]
+		if !ok {
+			return c, fmt.Errorf("invalid qtype in condition '%s'", arg)
+		}
+		c.qtype = qtype
+	case "rcode":
+		rcode, ok := dns.StringToRcode[strings.ToUpper(val)]
+		if !ok {
+			return c, fmt.Errorf("invalid rcode in condition '%s'", arg)
+		}
+		c.rcode = rcode
+	case "empty":
+		if val != "" {
+			return c, fmt.Errorf("invalid condition '%s'", arg)
+		}
+	default:
+		return c, fmt.Errorf("unknown condition '%s'", arg)
+	}
+	if kind != "empty" && val == "" {
+		return c, fmt.Errorf("invalid condition '%s'", arg)
+	}
+	return c, nil
+}
+
+// resolve looks up the groups and labels the steps refer to. Jumps only go forward, so a pipeline always ends.
+func (p *pipeline) resolve(groups []*Group) error {
+	find := func(name string) (*Group, error) {
+		if i := slices.IndexFunc(groups, func(g *Group) bool { return g.Name == name }); i >= 0 {
+			return groups[i], nil
+		}
+		return nil, fmt.Errorf("pipeline: unknown group '%s'", name)
+	}
+	for i := range p.steps {
+		s := &p.steps[i]
+		for j := range s.conds {
+			if s.conds[j].kind != "match" {
+				continue
+			}
+			g, err := find(s.conds[j].group)
+			if err != nil {
+				return err
+			}
+			s.conds[j].g = g
+		}
+		switch s.action {
+		case "exec":
+			g, err := find(s.arg)
+			if err != nil {
+				return err
+			}
+			s.g = g
+		case "jump":
+			t := slices.IndexFunc(p.steps, func(t pipelineStep) bool { return t.label == s.arg })
+			if t < 0 {
+				return fmt.Errorf("pipeline: unknown label '%s'", s.arg)
+			}
+			if t < i {
+				return fmt.Errorf("pipeline: jump to label '%s' must go forward", s.arg)
+			}
+			s.target = t
+		}
+	}
+	return nil
+}
+
+// uses reports whether a step refers to g.
+func (p *pipeline) uses(g *Group) bool {
+	for _, s := range p.steps {
+		if s.g == g || slices.ContainsFunc(s.conds, func(c pipelineCond) bool { return c.g == g }) {
+			return true
+		}
+	}
+	return false
+}
+
+// holds reports whether all conditions of s hold.
+func (s *pipelineStep) holds(q string, qtype uint16, client queryClient, now time.Time, resp *dns.Msg) bool {
+	for _, c := range s.conds {
+		if !c.holds(q, qtype, client, now, resp) {
+			return false
+		}
+	}
+	return true
+}
+
+// holds reports whether c holds for a query of qtype from client for q (normalized), given the response so far.
+func (c pipelineCond) holds(q string, qtype uint16, client queryClient, now time.Time, resp *dns.Msg) bool {
+	var ok bool
+	switch c.kind {
+	case "match":
+		if c.g.appliesTo(client, now) {
+			ok = c.g.matchNormalized(q)
+			if !ok {
+				_, ok = c.g.matchCategory(q)
+			}
+		}
+	case "qtype":
+		ok = qtype == c.qtype
+	case "rcode":
+		ok = resp != nil && resp.Rcode == c.rcode
+	case "empty":
+		ok = resp != nil && emptyAddrAnswer(resp)
+	}
+	return ok != c.not
+}
+
+// servePipeline answers req by running the pipeline. A query that runs off its end is answered with the last
+// response, or as on_no_match says if no group was executed.
+func (r *Ruledforward) servePipeline(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, state request.Request) (int, error) {
+	q := normalizeName(state.Name())
+	qtype := state.QType()
+	client := clientOf(state)
+	now := time.Now()
+	var resp *dns.Msg
+	steps := r.pipeline.steps
+	for i := 0; i < len(steps); i++ {
+		s := &steps[i]
+		if s.action == "" || !s.holds(q, qtype, client, now, resp) {
+			continue
+		}
+		switch s.action {
+		case "exec":
+			resp = r.execGroup(ctx, w, req, state, s.g)
+		case "accept":
+			pipelineTotal.WithLabelValues("accept").Inc()
+			return writePipelineResponse(w, resp)
+		case "reject":
+			pipelineTotal.WithLabelValues("reject").Inc()
+			m := new(dns.Msg)
+			m.SetRcode(req, s.rcode)
+			finishReply(m, req, r.ednsKeep, nil)
+			_ = w.WriteMsg(m)
+			return 0, nil
+		case "jump":
+			i = s.target
+		case "next":
+			pipelineTotal.WithLabelValues("next").Inc()
+			return plugin.NextOrFailure(r.Name(), r.Next, ctx, w, req)
+		}
+	}
+	if resp != nil {
+		pipelineTotal.WithLabelValues("accept").Inc()
+		return writePipelineResponse(w, resp)
+	}
+	pipelineTotal.WithLabelValues("end").Inc()
+	noMatchTotal.Inc()
+	r.recordQuery(state, nil)
+	if r.onNoMatch != dns.RcodeSuccess {
+		return r.onNoMatch, nil
+	}
+	return plugin.NextOrFailure(r.Name(), r.Next, ctx, w, req)
+}
+
+// execGroup resolves req with g, returning its response instead of writing it. A group that fails without writing a
+// response gets one with the rcode it returned.
+func (r *Ruledforward) execGroup(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, state request.Request, g *Group) *dns.Msg {
+	cw := &captureWriter{ResponseWriter: w}
+	rcode, err := r.serveGroup(ctx, cw, req, request.Request{W: cw, Req: req}, g)
+	if err != nil {
+		log.Debugf("Pipeline group '%s' failed for %s: %v", g.Name, state.Name(), err)
+	}
+	if cw.msg == nil {
+		if !plugin.ClientWrite(rcode) {
+			rcode = dns.RcodeServerFailure
+		}
+		cw.msg = new(dns.Msg)
+		cw.msg.SetRcode(req, rcode)
+		finishReply(cw.msg, req, r.ednsKeep, nil)
+	}
+	return cw.msg
+}
+
+// writePipelineResponse writes resp, or SERVFAIL if no group was executed.
+func writePipelineResponse(w dns.ResponseWriter, resp *dns.Msg) (int, error) {
+	if resp == nil {
+		return dns.RcodeServerFailure, errors.New("pipeline accepted no response")
+	}
+	_ = w.WriteMsg(resp)
+	return 0, nil
+}
+
+// captureWriter keeps the response written to it, for a pipeline to check before it answers.
+type captureWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *captureWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
@@ -0,0 +1,143 @@
+package ruledforward
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestParsePipelineStep(t *testing.T) {
+	s, err := parsePipelineStep([]string{"if", "match:cn", "!qtype:AAAA", "rcode:nxdomain", "exec", "overseas"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.conds) != 3 || !s.conds[1].not || s.conds[1].qtype != dns.TypeAAAA || s.conds[2].rcode != dns.RcodeNameError ||
+		s.action != "exec" || s.arg != "overseas" {
+		t.Errorf("step = %+v", s)
+	}
+	if s, err := parsePipelineStep([]string{"reject", "nxdomain"}); err != nil || s.rcode != dns.RcodeNameError {
+		t.Errorf("reject step = %+v, %v", s, err)
+	}
+	for _, args := range [][]string{
+		{"if", "exec", "x"},
+		{"if", "match:x"},
+		{"if", "match:", "accept"},
+		{"if", "qtype:BOGUS", "accept"},
+		{"if", "empty:x", "accept"},
+		{"if", "ip:x", "accept"},
+		{"exec"},
+		{"accept", "x"},
+		{"reject", "NOPE"},
+		{"label"},
+		{"forward", "x"},
+	} {
+		if _, err := parsePipelineStep(args); err == nil {
+			t.Errorf("parsePipelineStep(%q) should fail", args)
+		}
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	// The first query for a name outside example.cn gets NXDOMAIN, as from a censoring domestic resolver, the retry
+	// an answer, as from the overseas one.
+	var n atomic.Int32
+	p := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		switch {
+		case r.Question[0].Qtype != dns.TypeA:
+		case r.Question[0].Name == "www.example.cn.":
+			ret.Answer = append(ret.Answer, test.A("www.example.cn. 300 IN A 1.0.1.1"))
+		case n.Add(1)%2 == 1:
+			ret.Rcode = dns.RcodeNameError
+		default:
+			ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" 300 IN A 192.0.2.1"))
+		}
+		_ = w.WriteMsg(ret)
+	})
+
+	input := `ruledforward . {
+    pipeline {
+        if match:ads reject nxdomain
+        if qtype:AAAA jump local
+        exec domestic
+        if rcode:NXDOMAIN exec overseas
+        accept
+        label local
+        if !match:domestic next
+        exec domestic
+    }
+    group ads {
+        action empty
+        ads.example
+    }
+    group domestic {
+        to 127.0.0.1:1
+        example.cn
+    }
+    group overseas {
+        to 127.0.0.1:1
+    }
+}`
+	r, err := parseRuledforward(caddy.NewTestController("dns", input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range r.groups {
+		g.SetProxies([]*proxy.Proxy{p})
+	}
+	r.Next = test.NextHandler(dns.RcodeRefused, nil)
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		addr  string
+	}{
+		{"www.example.cn.", dns.TypeA, dns.RcodeSuccess, "1.0.1.1"},
+		{"www.example.org.", dns.TypeA, dns.RcodeSuccess, "192.0.2.1"},
+		{"x.ads.example.", dns.TypeA, dns.RcodeNameError, ""},
+		{"www.example.cn.", dns.TypeAAAA, dns.RcodeSuccess, ""},
+		{"www.example.org.", dns.TypeAAAA, dns.RcodeRefused, ""},
+	}
+	for _, tc := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, tc.qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, _ := r.ServeDNS(context.Background(), rec, req)
+		if rec.Msg != nil {
+			rcode = rec.Msg.Rcode
+		}
+		if rcode != tc.rcode {
+			t.Errorf("%s %s: rcode %s, want %s", tc.name, dns.TypeToString[tc.qtype], dns.RcodeToString[rcode], dns.RcodeToString[tc.rcode])
+			continue
+		}
+		if tc.addr != "" && (len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].(*dns.A).A.String() != tc.addr) {
+			t.Errorf("%s: answer = %v, want %s", tc.name, rec.Msg.Answer, tc.addr)
+		}
+	}
+	if n.Load() != 2 {
+		t.Errorf("%d queries for www.example.org, want 2: one per group", n.Load())
+	}
+
+	if err := r.RemoveGroup("overseas"); err == nil {
+		t.Error("a group the pipeline uses should not be removable")
+	}
+	for _, input := range []string{
+		"ruledforward . {\n    pipeline {\n        exec missing\n    }\n}",
+		"ruledforward . {\n    pipeline {\n        label again\n        jump again\n    }\n}",
+		"ruledforward . {\n    pipeline {\n        jump nowhere\n    }\n}",
+		"ruledforward . {\n    pipeline {\n    }\n}",
+	} {
+		if _, err := parseRuledforward(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("parsing %q should fail", input)
+		}
+	}
+}
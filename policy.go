@@ -1,6 +1,8 @@
 package ruledforward
 
 import (
+	"slices"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -10,7 +12,9 @@ import (
 
 // Policy defines a policy for selecting upstreams (same as forward plugin).
 type Policy interface {
-	List([]*proxy.Proxy) []*proxy.Proxy
+	// List returns p in the order to try them. It may return p itself or write the order into dst, which has room
+	// for len(p) proxies, so that selecting upstreams does not allocate.
+	List(dst, p []*proxy.Proxy) []*proxy.Proxy
 	String() string
 }
 
@@ -18,20 +22,20 @@ type random struct{}
 
 func (r *random) String() string { return "random" }
 
-func (r *random) List(p []*proxy.Proxy) []*proxy.Proxy {
+func (r *random) List(dst, p []*proxy.Proxy) []*proxy.Proxy {
 	switch len(p) {
 	case 1:
 		return p
 	case 2:
 		if rn.Int()%2 == 0 {
-			return []*proxy.Proxy{p[1], p[0]}
+			return append(dst[:0], p[1], p[0])
 		}
 		return p
 	}
-	perms := rn.Perm(len(p))
-	rnd := make([]*proxy.Proxy, len(p))
-	for i, p1 := range perms {
-		rnd[i] = p[p1]
+	rnd := append(dst[:0], p...)
+	for i := len(rnd) - 1; i > 0; i-- {
+		j := rn.Int() % (i + 1)
+		rnd[i], rnd[j] = rnd[j], rnd[i]
 	}
 	return rnd
 }
@@ -42,11 +46,10 @@ type roundRobin struct {
 
 func (r *roundRobin) String() string { return "round_robin" }
 
-func (r *roundRobin) List(p []*proxy.Proxy) []*proxy.Proxy {
+func (r *roundRobin) List(dst, p []*proxy.Proxy) []*proxy.Proxy {
 	poolLen := uint32(len(p)) // #nosec G115 -- pool length is small
 	i := atomic.AddUint32(&r.robin, 1) % poolLen
-	robin := make([]*proxy.Proxy, 0, len(p))
-	robin = append(robin, p[i])
+	robin := append(dst[:0], p[i])
 	robin = append(robin, p[:i]...)
 	robin = append(robin, p[i+1:]...)
 	return robin
@@ -56,8 +59,65 @@ type sequential struct{}
 
 func (r *sequential) String() string { return "sequential" }
 
-func (r *sequential) List(p []*proxy.Proxy) []*proxy.Proxy {
+func (r *sequential) List(_, p []*proxy.Proxy) []*proxy.Proxy {
 	return p
 }
 
+// preferPrimary tries the upstreams in the order listed, like sequential, but puts those the health checks mark down
+// last, so that the first healthy one takes every query and the group returns to the primary as soon as it recovers.
+// A change of the upstream in use is logged.
+type preferPrimary struct {
+	group    string
+	maxfails uint32
+	active   atomic.Pointer[proxy.Proxy] // upstream queries went to last
+}
+
+func (r *preferPrimary) String() string { return "prefer_primary" }
+
+func (r *preferPrimary) List(dst, p []*proxy.Proxy) []*proxy.Proxy {
+	i := 0
+	for i < len(p) && p[i].Down(r.maxfails) {
+		i++
+	}
+	if i == 0 || i == len(p) {
+		r.use(p[0], p)
+		return p
+	}
+	r.use(p[i], p)
+	list := append(dst[:0], p[i:]...)
+	return append(list, p[:i]...)
+}
+
+// use records that queries go to pr, logging when that changes.
+func (r *preferPrimary) use(pr *proxy.Proxy, p []*proxy.Proxy) {
+	prev := r.active.Swap(pr)
+	if prev == nil || prev == pr {
+		return
+	}
+	if slices.Index(p, pr) < slices.Index(p, prev) {
+		log.Infof("Group '%s': upstream %s is healthy again, failing back from %s", r.group, pr.Addr(), prev.Addr())
+	} else {
+		log.Warningf("Group '%s': upstream %s is down, failing over to %s", r.group, prev.Addr(), pr.Addr())
+	}
+}
+
+// proxyLists holds the buffers forwardGroup passes to Policy.List.
+var proxyLists = sync.Pool{New: func() any { return new([]*proxy.Proxy) }}
+
+// orderProxies returns p in the order g's policy tries them, in a buffer from proxyLists. Call release with the
+// buffer once the order is no longer used.
+func (g *Group) orderProxies(p []*proxy.Proxy) (list []*proxy.Proxy, buf *[]*proxy.Proxy) {
+	buf = proxyLists.Get().(*[]*proxy.Proxy)
+	if cap(*buf) < len(p) {
+		*buf = make([]*proxy.Proxy, 0, len(p))
+	}
+	return g.Policy.List((*buf)[:len(p)], p), buf
+}
+
+// releaseProxies returns buf to proxyLists, without keeping the proxies it held alive.
+func releaseProxies(buf *[]*proxy.Proxy) {
+	clear((*buf)[:cap(*buf)])
+	proxyLists.Put(buf)
+}
+
 var rn = rand.New(time.Now().UnixNano())
@@ -1,10 +1,14 @@
 package ruledforward
 
 import (
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/coredns/coredns/plugin/pkg/proxy"
 	"github.com/coredns/coredns/plugin/pkg/transport"
+
+	"github.com/miekg/dns"
 )
 
 func mustProxy(addr string) *proxy.Proxy {
@@ -18,22 +22,22 @@ func TestPolicyRandom(t *testing.T) {
 		t.Errorf("String() = %q, want %q", s, "random")
 	}
 	// List with 0 proxies - falls through to default branch, returns empty slice
-	list := r.List(nil)
+	list := r.List(nil, nil)
 	if list != nil && len(list) != 0 {
 		t.Errorf("List(nil) = %v, want empty or nil", list)
 	}
 	one := []*proxy.Proxy{mustProxy("127.0.0.1:0")}
-	list = r.List(one)
+	list = r.List(make([]*proxy.Proxy, len(one)), one)
 	if len(list) != 1 || list[0] != one[0] {
 		t.Errorf("List(one) = %v", list)
 	}
 	two := []*proxy.Proxy{mustProxy("127.0.0.1:0"), mustProxy("127.0.0.2:0")}
-	list = r.List(two)
+	list = r.List(make([]*proxy.Proxy, len(two)), two)
 	if len(list) != 2 {
 		t.Errorf("List(two) len = %d, want 2", len(list))
 	}
 	three := []*proxy.Proxy{mustProxy("127.0.0.1:0"), mustProxy("127.0.0.2:0"), mustProxy("127.0.0.3:0")}
-	list = r.List(three)
+	list = r.List(make([]*proxy.Proxy, len(three)), three)
 	if len(list) != 3 {
 		t.Errorf("List(three) len = %d, want 3", len(list))
 	}
@@ -45,13 +49,13 @@ func TestPolicyRoundRobin(t *testing.T) {
 		t.Errorf("String() = %q, want %q", s, "round_robin")
 	}
 	one := []*proxy.Proxy{mustProxy("127.0.0.1:0")}
-	list := r.List(one)
+	list := r.List(make([]*proxy.Proxy, len(one)), one)
 	if len(list) != 1 {
 		t.Errorf("List(one) len = %d", len(list))
 	}
 	two := []*proxy.Proxy{mustProxy("127.0.0.1:0"), mustProxy("127.0.0.2:0")}
 	for range 4 {
-		list = r.List(two)
+		list = r.List(make([]*proxy.Proxy, len(two)), two)
 		if len(list) != 2 {
 			t.Errorf("List(two) len = %d", len(list))
 		}
@@ -64,8 +68,81 @@ func TestPolicySequential(t *testing.T) {
 		t.Errorf("String() = %q, want %q", s, "sequential")
 	}
 	p := []*proxy.Proxy{mustProxy("127.0.0.1:0"), mustProxy("127.0.0.2:0")}
-	list := r.List(p)
+	list := r.List(make([]*proxy.Proxy, len(p)), p)
 	if len(list) != 2 || list[0] != p[0] || list[1] != p[1] {
 		t.Errorf("List() = %v, want same order as input", list)
 	}
 }
+
+func TestPolicyPreferPrimary(t *testing.T) {
+	// The primary fails its health checks while down is set, and passes them again once it is cleared.
+	var down atomic.Bool
+	down.Store(true)
+	primary := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if down.Load() {
+			return
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		_ = w.WriteMsg(ret)
+	})
+	primary.GetHealthchecker().SetReadTimeout(10 * time.Millisecond)
+	primary.Start(10 * time.Millisecond)
+	defer primary.Stop()
+	p := []*proxy.Proxy{primary, mustProxy("127.0.0.2:0"), mustProxy("127.0.0.3:0")}
+
+	r := &preferPrimary{group: "test", maxfails: 1}
+	if list := r.List(make([]*proxy.Proxy, len(p)), p); list[0] != primary {
+		t.Errorf("List() = %v, want the primary first while it is healthy", list)
+	}
+	waitFor := func(cond func() bool, what string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("primary not %s", what)
+			}
+			primary.Healthcheck()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor(func() bool { return primary.Down(1) }, "marked down")
+	list := r.List(make([]*proxy.Proxy, len(p)), p)
+	if list[0] != p[1] || list[1] != p[2] || list[2] != primary {
+		t.Errorf("List() = %v, want the others in order, then the primary", list)
+	}
+	down.Store(false)
+	waitFor(func() bool { return !primary.Down(1) }, "healthy again")
+	if list := r.List(make([]*proxy.Proxy, len(p)), p); list[0] != primary {
+		t.Errorf("List() = %v, want to fail back to the primary", list)
+	}
+}
+
+func TestPolicyPermutes(t *testing.T) {
+	p := []*proxy.Proxy{mustProxy("127.0.0.1:0"), mustProxy("127.0.0.2:0"), mustProxy("127.0.0.3:0"), mustProxy("127.0.0.4:0")}
+	for _, policy := range []Policy{&random{}, &roundRobin{}, &sequential{}, &preferPrimary{maxfails: 2}} {
+		for range 10 {
+			list := policy.List(make([]*proxy.Proxy, len(p)), p)
+			seen := make(map[*proxy.Proxy]bool)
+			for _, pr := range list {
+				seen[pr] = true
+			}
+			if len(list) != len(p) || len(seen) != len(p) {
+				t.Fatalf("%s: List = %v, want each of %v once", policy, list, p)
+			}
+		}
+	}
+}
+
+func TestOrderProxiesAllocs(t *testing.T) {
+	p := []*proxy.Proxy{mustProxy("127.0.0.1:0"), mustProxy("127.0.0.2:0"), mustProxy("127.0.0.3:0")}
+	for _, policy := range []Policy{&random{}, &roundRobin{}, &sequential{}, &preferPrimary{maxfails: 2}} {
+		g := &Group{Name: "default", Policy: policy}
+		if n := testing.AllocsPerRun(100, func() {
+			_, buf := g.orderProxies(p)
+			releaseProxies(buf)
+		}); n != 0 {
+			t.Errorf("%s: ordering upstreams allocates %v times", policy, n)
+		}
+	}
+}
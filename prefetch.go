@@ -0,0 +1,92 @@
+package ruledforward
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultPrefetchHits is how often a cached answer must be hit before `prefetch` refreshes it by default.
+	defaultPrefetchHits = 2
+	// defaultPrefetchPercent is the share of its TTL a cached answer has left when `prefetch` refreshes it by default.
+	defaultPrefetchPercent = 10
+)
+
+// prefetchConfig is a group's `prefetch` setting.
+type prefetchConfig struct {
+	hits    uint32 // cache hits an entry needs before it is refreshed
+	percent int    // share of the entry's TTL that is left at most when it is refreshed
+}
+
+// maybePrefetch counts a hit of the cached answer e and refreshes it in the background once it has been hit often
+// enough and is about to expire, so popular names do not drop out of the cache.
+func (r *Ruledforward) maybePrefetch(e *negEntry, key negKey, now time.Time) {
+	p := e.group.Prefetch
+	if e.hits.Add(1) < p.hits || e.expires.Sub(now) > e.ttl*time.Duration(p.percent)/100 {
+		return
+	}
+	if !e.prefetching.CompareAndSwap(false, true) {
+		return
+	}
+	prefetchTotal.WithLabelValues(e.group.Name).Inc()
+	go r.resolveForCache(e.group, key)
+}
+
+// warmCache resolves the names of `warm` through the groups they are routed to, so the answers are cached (with
+// negative_cache) and upstream connections are open before the first client asks.
+func (r *Ruledforward) warmCache() {
+	for _, name := range r.warm {
+		g := r.groupFor(name, nil)
+		if g == nil || (g.Action != "forward" && g.NegativeCache == 0) {
+			continue
+		}
+		if len(g.Split) > 0 {
+			g = g.pickSplit().group
+		}
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			r.resolveForCache(g, negKey{name: name, qtype: qtype})
+		}
+	}
+}
+
+// resolveForCache resolves the query of key with g without a client waiting for it, caching a negative answer if g
+// has negative_cache.
+func (r *Ruledforward) resolveForCache(g *Group, key negKey) {
+	req := new(dns.Msg)
+	req.SetQuestion(key.name, key.qtype)
+	if key.do {
+		req.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	var w dns.ResponseWriter = discardWriter{}
+	if r.negCache != nil && g.NegativeCache > 0 {
+		w = &negCacheWriter{ResponseWriter: w, cache: r.negCache, key: key, group: g, gen: matcherGeneration.Load()}
+	}
+	if _, ok := g.BlockQtypes[key.qtype]; ok || g.Action == "empty" {
+		_, _ = writeEmpty(w, req, key.name, r.ednsKeep)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	if _, err := r.forwardGroup(ctx, w, req, request.Request{W: w, Req: req}, g); err != nil {
+		log.Debugf("Resolving %s %s in group %s for the cache: %v", key.name, dns.TypeToString[key.qtype], g.Name, err)
+	}
+}
+
+// discardWriter is the ResponseWriter of queries the plugin makes on its own behalf; responses are dropped.
+type discardWriter struct{}
+
+var localhost = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+func (discardWriter) LocalAddr() net.Addr         { return localhost }
+func (discardWriter) RemoteAddr() net.Addr        { return localhost }
+func (discardWriter) WriteMsg(*dns.Msg) error     { return nil }
+func (discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (discardWriter) Close() error                { return nil }
+func (discardWriter) TsigStatus() error           { return nil }
+func (discardWriter) TsigTimersOnly(bool)         {}
+func (discardWriter) Hijack()                     {}
@@ -0,0 +1,65 @@
+package ruledforward
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestPrefetch(t *testing.T) {
+	var upstreamN atomic.Int32
+	g := &Group{Name: "default", Action: "forward", Policy: &sequential{}, NegativeCache: 10, Prefetch: &prefetchConfig{hits: 2, percent: 10}}
+	g.SetProxies([]*proxy.Proxy{newNXDOMAINUpstream(t, &upstreamN)})
+	g.SetMatcher(NewMatcher())
+	r := &Ruledforward{from: ".", groups: []*Group{g}, defaultGroup: g, negCache: newLRU[negKey, *negEntry](10)}
+	query := func() {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion("nx.example.", dns.TypeA)
+		if _, err := r.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := negKey{name: "nx.example.", qtype: dns.TypeA}
+
+	query()
+	old, _ := r.negCache.get(key)
+	query() // first hit: not popular yet
+	old.expires = time.Now().Add(time.Second)
+	query() // second hit, close to expiry
+	for deadline := time.Now().Add(2 * time.Second); upstreamN.Load() < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := upstreamN.Load(); n != 2 {
+		t.Fatalf("%d upstream queries, want the entry refreshed once", n)
+	}
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if e, _ := r.negCache.get(key); e != old {
+			return
+		}
+	}
+	t.Error("prefetch did not replace the cached entry")
+}
+
+func TestWarmCache(t *testing.T) {
+	var upstreamN atomic.Int32
+	g := &Group{Name: "default", Action: "forward", Policy: &sequential{}, NegativeCache: 10}
+	g.SetProxies([]*proxy.Proxy{newNXDOMAINUpstream(t, &upstreamN)})
+	g.SetMatcher(NewMatcher())
+	r := &Ruledforward{from: ".", groups: []*Group{g}, defaultGroup: g, negCache: newLRU[negKey, *negEntry](10), warm: []string{"nx.example."}}
+
+	r.warmCache()
+	if n := upstreamN.Load(); n != 2 {
+		t.Errorf("%d upstream queries, want A and AAAA", n)
+	}
+	if n := r.negCache.len(); n != 2 {
+		t.Errorf("%d cached answers, want 2", n)
+	}
+}
@@ -0,0 +1,31 @@
+package ruledforward
+
+import (
+	"context"
+	"runtime/pprof"
+)
+
+// groupProfile holds the pprof labels of a group: `group` and `action`, which is `match` while the group's rules are
+// matched. They are kept in contexts built once, so that labeling a query's goroutine does not allocate.
+type groupProfile struct {
+	match, serve context.Context
+}
+
+// profile returns the pprof labels of g.
+func (g *Group) profile() *groupProfile {
+	g.profileOnce.Do(func() {
+		g.prof = &groupProfile{
+			match: pprof.WithLabels(context.Background(), pprof.Labels("group", g.Name, "action", "match")),
+			serve: pprof.WithLabels(context.Background(), pprof.Labels("group", g.Name, "action", g.Action)),
+		}
+	})
+	return g.prof
+}
+
+// labelServe labels the goroutine as answering with the action of g, with `pprof_labels`. Goroutines started to
+// query upstreams inherit the labels.
+func (r *Ruledforward) labelServe(g *Group) {
+	if r.pprofLabels {
+		pprof.SetGoroutineLabels(g.profile().serve)
+	}
+}
@@ -0,0 +1,59 @@
+package ruledforward
+
+import (
+	"bytes"
+	"context"
+	"runtime/pprof"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+// labelWriter records the pprof labels of the goroutine that writes the response.
+type labelWriter struct {
+	test.ResponseWriter
+	labels string
+}
+
+func (w *labelWriter) WriteMsg(m *dns.Msg) error {
+	var buf bytes.Buffer
+	_ = pprof.Lookup("goroutine").WriteTo(&buf, 1)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.Contains(line, "# labels:") && strings.Contains(line, `"group":"block"`) {
+			w.labels = line
+		}
+	}
+	return nil
+}
+
+func TestPprofLabels(t *testing.T) {
+	m := NewMatcher()
+	m.AddRule(Rule{Type: RuleDomain, Value: "ads.example."})
+	m.Build()
+	g := &Group{Name: "block", Action: "empty"}
+	g.SetMatcher(m)
+	r := &Ruledforward{from: ".", groups: []*Group{g}, pprofLabels: true, Next: test.NextHandler(dns.RcodeSuccess, nil)}
+
+	req := new(dns.Msg)
+	req.SetQuestion("x.ads.example.", dns.TypeA)
+	w := &labelWriter{}
+	if _, err := r.ServeDNS(context.Background(), w, req); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(w.labels, `"action":"empty"`) {
+		t.Errorf("labels while answering = %q, want the group and its action", w.labels)
+	}
+	var buf bytes.Buffer
+	_ = pprof.Lookup("goroutine").WriteTo(&buf, 1)
+	if strings.Contains(buf.String(), `"group":"block"`) {
+		t.Error("labels should be put back after ServeDNS")
+	}
+
+	defer pprof.SetGoroutineLabels(context.Background())
+	if n := testing.AllocsPerRun(100, func() { r.labelServe(g) }); n != 0 {
+		t.Errorf("labeling allocates %v times", n)
+	}
+}
@@ -0,0 +1,69 @@
+package ruledforward
+
+import (
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// reverseZones returns the in-addr.arpa or ip6.arpa names whose subtrees are exactly the reverse names of the
+// addresses in p. Reverse names have one label per octet (IPv4) or nibble (IPv6), so a prefix that does not end on
+// a label boundary expands to one name per value of the partial label: at most 128 for IPv4 and 8 for IPv6.
+func reverseZones(p netip.Prefix) []string {
+	p = p.Masked()
+	b := p.Addr().AsSlice()
+	unit, radix, suffix := 8, 10, "in-addr.arpa."
+	label := func(i int) int { return int(b[i]) }
+	if p.Addr().Is6() {
+		unit, radix, suffix = 4, 16, "ip6.arpa."
+		label = func(i int) int {
+			if i%2 == 0 {
+				return int(b[i/2] >> 4)
+			}
+			return int(b[i/2] & 0x0f)
+		}
+	}
+	n := (p.Bits() + unit - 1) / unit
+	if n == 0 {
+		return []string{suffix}
+	}
+
+	// labels[0] is the partial (least significant covered) label, followed by the more significant ones.
+	labels := make([]string, n)
+	for i := range n {
+		labels[n-1-i] = strconv.FormatInt(int64(label(i)), radix)
+	}
+	spread := 1 << (n*unit - p.Bits())
+	first := label(n - 1)
+	names := make([]string, 0, spread)
+	for v := range spread {
+		labels[0] = strconv.FormatInt(int64(first+v), radix)
+		names = append(names, strings.Join(labels, ".")+"."+suffix)
+	}
+	return names
+}
+
+// parseIPRule parses the value of an `ip:` rule, a CIDR or a single address, into domain rules on its reverse names.
+func parseIPRule(val string) ([]Rule, error) {
+	var p netip.Prefix
+	var err error
+	if strings.Contains(val, "/") {
+		p, err = netip.ParsePrefix(val)
+	} else {
+		var addr netip.Addr
+		addr, err = netip.ParseAddr(val)
+		p = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.Addr().Is4In6() {
+		p = netip.PrefixFrom(p.Addr().Unmap(), max(p.Bits()-96, 0))
+	}
+	zones := reverseZones(p)
+	rules := make([]Rule, len(zones))
+	for i, z := range zones {
+		rules[i] = Rule{Type: RuleDomain, Value: z}
+	}
+	return rules, nil
+}
@@ -0,0 +1,62 @@
+package ruledforward
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestReverseZones(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"10.0.0.0/8", []string{"10.in-addr.arpa."}},
+		{"192.168.1.0/24", []string{"1.168.192.in-addr.arpa."}},
+		{"192.0.2.1/32", []string{"1.2.0.192.in-addr.arpa."}},
+		{"0.0.0.0/0", []string{"in-addr.arpa."}},
+		{"192.168.2.0/23", []string{"2.168.192.in-addr.arpa.", "3.168.192.in-addr.arpa."}},
+		{"fd00::/8", []string{"d.f.ip6.arpa."}},
+		{"2001:db8::/32", []string{"8.b.d.0.1.0.0.2.ip6.arpa."}},
+		{"fe80::/10", []string{"8.e.f.ip6.arpa.", "9.e.f.ip6.arpa.", "a.e.f.ip6.arpa.", "b.e.f.ip6.arpa."}},
+	}
+	for _, tc := range tests {
+		got := reverseZones(netip.MustParsePrefix(tc.prefix))
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("reverseZones(%s) = %v, want %v", tc.prefix, got, tc.want)
+		}
+	}
+	if n := len(reverseZones(netip.MustParsePrefix("172.16.0.0/12"))); n != 16 {
+		t.Errorf("172.16.0.0/12: %d names, want 16", n)
+	}
+}
+
+func TestIPRuleMatchesPTR(t *testing.T) {
+	rules, err := parseIPRule("172.16.0.0/12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewBloomedMatcher(1024, bloomFP)
+	for _, r := range rules {
+		m.AddRule(r)
+	}
+	m.Build()
+	for qname, want := range map[string]bool{
+		"1.0.16.172.in-addr.arpa.":    true,
+		"9.9.31.172.in-addr.arpa.":    true,
+		"1.0.32.172.in-addr.arpa.":    false,
+		"1.0.15.172.in-addr.arpa.":    false,
+		"1.0.16.172.in-addr.arpa.com": false,
+	} {
+		if got := m.Match(qname); got != want {
+			t.Errorf("Match(%s) = %v, want %v", qname, got, want)
+		}
+	}
+
+	if _, err := parseIPRule("10.0.0.0/33"); err == nil {
+		t.Error("expected error for invalid prefix")
+	}
+	if rules, err := parseIPRule("2001:db8::1"); err != nil || len(rules) != 1 || len(rules[0].Value) != 73 {
+		t.Errorf("single IPv6 address: %v, %v", rules, err)
+	}
+}
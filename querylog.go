@@ -0,0 +1,90 @@
+package ruledforward
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync/atomic"
+)
+
+// queryLog is the `query_log` setting: routing decisions logged as info lines, filtered and sampled so that a busy
+// resolver can keep the useful ones.
+type queryLog struct {
+	sample  uint64         // log 1 in sample of the queries the filters keep
+	blocked bool           // only queries answered by an `empty` group
+	groups  []string       // only queries routed to these groups; nil for all
+	exclude []netip.Prefix // clients whose queries are not logged
+	n       atomic.Uint64  // queries the filters kept, for sampling
+}
+
+// parseOption parses a line of a `query_log` block into l.
+func (l *queryLog) parseOption(args []string) error {
+	switch args[0] {
+	case "sample":
+		if len(args) != 2 {
+			return errors.New("sample needs exactly one argument")
+		}
+		n, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil || n == 0 {
+			return fmt.Errorf("sample must be a positive integer: %s", args[1])
+		}
+		l.sample = n
+	case "blocked":
+		if len(args) != 1 {
+			return errors.New("blocked takes no arguments")
+		}
+		l.blocked = true
+	case "groups":
+		if len(args) < 2 {
+			return errors.New("groups needs at least one group")
+		}
+		l.groups = append(l.groups, args[1:]...)
+	case "exclude_clients":
+		if len(args) < 2 {
+			return errors.New("exclude_clients needs at least one address or CIDR")
+		}
+		for _, arg := range args[1:] {
+			p, err := parseClientPrefix(arg)
+			if err != nil {
+				return err
+			}
+			l.exclude = append(l.exclude, p)
+		}
+	default:
+		return fmt.Errorf("unknown option '%s'", args[0])
+	}
+	return nil
+}
+
+// keep reports whether e passes the filters and the sampling of l.
+func (l *queryLog) keep(e queryEntry) bool {
+	if l.blocked && e.Action != "empty" {
+		return false
+	}
+	if l.groups != nil && !slices.Contains(l.groups, e.Group) {
+		return false
+	}
+	if len(l.exclude) > 0 {
+		if addr, err := netip.ParseAddr(e.Client); err == nil {
+			addr = addr.Unmap()
+			if slices.ContainsFunc(l.exclude, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+				return false
+			}
+		}
+	}
+	return (l.n.Add(1)-1)%l.sample == 0
+}
+
+// log logs e if l keeps it.
+func (l *queryLog) log(e queryEntry) {
+	if !l.keep(e) {
+		return
+	}
+	group := e.Group
+	if group == "" {
+		group = "-"
+	}
+	log.Infof("query client=%s name=%s type=%s group=%s action=%s", e.Client, e.Name, e.Type, group, e.Action)
+}
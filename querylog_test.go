@@ -0,0 +1,81 @@
+package ruledforward
+
+import (
+	"bytes"
+	golog "log"
+	"strings"
+	"testing"
+)
+
+func TestQueryLogKeep(t *testing.T) {
+	l := &queryLog{sample: 1}
+	for _, args := range [][]string{{"blocked"}, {"groups", "ads", "kids"}, {"exclude_clients", "192.168.1.10", "10.0.0.0/8"}} {
+		if err := l.parseOption(args); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, args := range [][]string{{"sample"}, {"sample", "0"}, {"blocked", "yes"}, {"groups"}, {"exclude_clients", "x"}, {"verbose"}} {
+		if err := (&queryLog{sample: 1}).parseOption(args); err == nil {
+			t.Errorf("parseOption(%q) should fail", args)
+		}
+	}
+
+	tests := []struct {
+		e    queryEntry
+		want bool
+	}{
+		{queryEntry{Client: "192.168.1.20", Group: "ads", Action: "empty"}, true},
+		{queryEntry{Client: "192.168.1.20", Group: "ads", Action: "forward"}, false},
+		{queryEntry{Client: "192.168.1.20", Group: "other", Action: "empty"}, false},
+		{queryEntry{Client: "192.168.1.20", Action: "next"}, false},
+		{queryEntry{Client: "192.168.1.10", Group: "kids", Action: "empty"}, false},
+		{queryEntry{Client: "10.1.2.3", Group: "kids", Action: "empty"}, false},
+	}
+	for _, tc := range tests {
+		if got := l.keep(tc.e); got != tc.want {
+			t.Errorf("keep(%+v) = %v, want %v", tc.e, got, tc.want)
+		}
+	}
+
+	l = &queryLog{}
+	if err := l.parseOption([]string{"sample", "3"}); err != nil {
+		t.Fatal(err)
+	}
+	var kept int
+	for range 9 {
+		if l.keep(queryEntry{Client: "192.168.1.20", Action: "next"}) {
+			kept++
+		}
+	}
+	if kept != 3 {
+		t.Errorf("sample 3 kept %d of 9 queries, want 3", kept)
+	}
+}
+
+func TestQueryLogLine(t *testing.T) {
+	var buf bytes.Buffer
+	out, flags := golog.Writer(), golog.Flags()
+	golog.SetOutput(&buf)
+	golog.SetFlags(0)
+	defer func() {
+		golog.SetOutput(out)
+		golog.SetFlags(flags)
+	}()
+
+	l := &queryLog{sample: 1}
+	l.log(queryEntry{Client: "192.168.1.20", Name: "x.ads.example.", Type: "A", Group: "ads", Action: "empty"})
+	l.log(queryEntry{Client: "192.168.1.20", Name: "example.org.", Type: "AAAA", Action: "next"})
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	want := []string{
+		"query client=192.168.1.20 name=x.ads.example. type=A group=ads action=empty",
+		"query client=192.168.1.20 name=example.org. type=AAAA group=- action=next",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("logged %q, want %q", lines, want)
+	}
+	for i, line := range lines {
+		if !strings.HasSuffix(line, want[i]) {
+			t.Errorf("line %d = %q, want it to end with %q", i, line, want[i])
+		}
+	}
+}
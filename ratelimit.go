@@ -0,0 +1,90 @@
+package ruledforward
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const rateLimitSweepInterval = time.Minute
+
+// RateLimiter is a per-client token bucket limiter. Each client IP gets Burst tokens refilled at Rate per second;
+// a query that finds the bucket empty is rejected with Action ("drop" or "refuse").
+type RateLimiter struct {
+	Rate   float64
+	Burst  float64
+	Action string
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing rate queries per second per client with the given burst.
+func NewRateLimiter(rate, burst float64, action string) *RateLimiter {
+	return &RateLimiter{
+		Rate:    rate,
+		Burst:   burst,
+		Action:  action,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow takes one token from client's bucket and reports whether the query may proceed.
+func (l *RateLimiter) Allow(client string) bool {
+	return l.allowAt(client, time.Now())
+}
+
+func (l *RateLimiter) allowAt(client string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	b := l.buckets[client]
+	if b == nil {
+		b = &tokenBucket{tokens: l.Burst, last: now}
+		l.buckets[client] = b
+	} else {
+		b.tokens = min(l.Burst, b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep forgets clients whose bucket has refilled completely; they are indistinguishable from new clients.
+// Must be called with l.mu held.
+func (l *RateLimiter) sweep(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.Rate >= l.Burst {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Reject answers (or silently drops) a query that exceeded the limit. group is empty for the plugin-wide limiter.
+// keepOpts is as for finishReply.
+func (l *RateLimiter) Reject(w dns.ResponseWriter, req *dns.Msg, group string, keepOpts bool) (int, error) {
+	rateLimitedTotal.WithLabelValues(group, l.Action).Inc()
+	if l.Action == "drop" {
+		return dns.RcodeSuccess, nil
+	}
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeRefused)
+	finishReply(m, req, keepOpts, nil)
+	_ = w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
@@ -0,0 +1,84 @@
+package ruledforward
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := NewRateLimiter(1, 2, "refuse")
+	now := time.Now()
+	if !l.allowAt("10.0.0.1", now) || !l.allowAt("10.0.0.1", now) {
+		t.Fatal("expected burst of 2 to be allowed")
+	}
+	if l.allowAt("10.0.0.1", now) {
+		t.Error("expected third query within the same instant to be limited")
+	}
+	if !l.allowAt("10.0.0.2", now) {
+		t.Error("expected a different client to have its own bucket")
+	}
+	if !l.allowAt("10.0.0.1", now.Add(time.Second)) {
+		t.Error("expected one token to be refilled after 1s")
+	}
+
+	// A full bucket is forgotten on the next sweep.
+	later := now.Add(rateLimitSweepInterval + time.Second)
+	l.allowAt("10.0.0.3", later)
+	if _, ok := l.buckets["10.0.0.2"]; ok {
+		t.Error("expected refilled bucket to be swept")
+	}
+}
+
+func TestRateLimiterReject(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := NewRateLimiter(1, 1, "refuse").Reject(rec, req, "g", false); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Msg == nil || rec.Msg.Rcode != dns.RcodeRefused {
+		t.Errorf("refuse: got %v, want REFUSED", rec.Msg)
+	}
+
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := NewRateLimiter(1, 1, "drop").Reject(rec, req, "g", false); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Msg != nil {
+		t.Errorf("drop: expected no response, got %v", rec.Msg)
+	}
+}
+
+func TestRuledforwardGlobalRateLimit(t *testing.T) {
+	m := NewMatcher()
+	m.AddRule(Rule{Type: RuleDomain, Value: "example.com."})
+	m.Build()
+	g := &Group{Name: "block", Action: "empty"}
+	g.SetMatcher(m)
+	r := &Ruledforward{from: ".", groups: []*Group{g}, rateLimit: NewRateLimiter(1, 1, "refuse")}
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := r.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Msg == nil || rec.Msg.Rcode != dns.RcodeSuccess {
+		t.Fatalf("first query: got %v, want NOERROR", rec.Msg)
+	}
+
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := r.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Msg == nil || rec.Msg.Rcode != dns.RcodeRefused {
+		t.Errorf("second query: got %v, want REFUSED", rec.Msg)
+	}
+}
@@ -0,0 +1,253 @@
+package ruledforward
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const redisTimeout = 10 * time.Second
+
+// redisSource is a `redis_rules` setting: Redis sets whose members are rule lines in the adguard_rules format.
+// Changes are picked up through keyspace notifications, which the server must publish for set and generic
+// commands (`notify-keyspace-events Kgs` or a superset).
+type redisSource struct {
+	addr     string
+	tls      bool
+	username string
+	password string
+	db       int
+	keys     []string
+}
+
+// parseRedisSource parses `redis_rules redis[s]://[[USER]:PASSWORD@]HOST[:PORT][/DB] KEY...`.
+func parseRedisSource(rawURL string, keys []string) (*redisSource, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Hostname() == "" {
+		return nil, fmt.Errorf("redis_rules needs a redis:// or rediss:// URL: %s", rawURL)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("redis_rules needs at least one key")
+	}
+	s := &redisSource{tls: u.Scheme == "rediss", keys: keys}
+	port := u.Port()
+	if port == "" {
+		port = "6379"
+	}
+	s.addr = net.JoinHostPort(u.Hostname(), port)
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if s.db, err = strconv.Atoi(db); err != nil || s.db < 0 {
+			return nil, fmt.Errorf("invalid redis database '%s'", db)
+		}
+	}
+	return s, nil
+}
+
+func (s *redisSource) String() string {
+	return fmt.Sprintf("redis %s/%d %s", s.addr, s.db, strings.Join(s.keys, " "))
+}
+
+// redisConn is a connection speaking RESP2, enough for the few commands rule loading needs.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dial connects to the server, authenticates and selects the database.
+func (s *redisSource) dial(ctx context.Context) (*redisConn, error) {
+	d := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if s.tls {
+		host, _, _ := net.SplitHostPort(s.addr)
+		conn, err = (&tls.Dialer{NetDialer: d, Config: &tls.Config{ServerName: host}}).DialContext(ctx, "tcp", s.addr)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if s.password != "" {
+		args := []string{"AUTH", s.password}
+		if s.username != "" {
+			args = []string{"AUTH", s.username, s.password}
+		}
+		if _, err := c.do(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if s.db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(s.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// do sends a command and returns its reply.
+func (c *redisConn) do(args ...string) (any, error) {
+	_ = c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+func (c *redisConn) send(args ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	_, err := io.WriteString(c.conn, b.String())
+	return err
+}
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// read reads one reply: a string for simple and bulk strings, int64, []any for arrays, nil for null replies, or
+// redisError.
+func (c *redisConn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		out := make([]any, 0, min(n, 1024))
+		for range n {
+			v, err := c.read()
+			if err != nil {
+				var re redisError
+				if !errors.As(err, &re) {
+					return nil, err
+				}
+				v = re
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+func (c *redisConn) Close() error { return c.conn.Close() }
+
+// members returns the members of the set key.
+func (c *redisConn) members(key string) ([]string, error) {
+	v, err := c.do("SMEMBERS", key)
+	if err != nil {
+		return nil, fmt.Errorf("SMEMBERS %s: %w", key, err)
+	}
+	arr, _ := v.([]any)
+	out := make([]string, 0, len(arr))
+	for _, m := range arr {
+		if s, ok := m.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+// load reads the rules of all keys. A missing key is an empty set.
+func (s *redisSource) load(ctx context.Context) ([]Rule, error) {
+	c, err := s.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	var lines []string
+	for _, key := range s.keys {
+		m, err := c.members(key)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, m...)
+	}
+	return ParseAdguardRules(strings.Join(lines, "\n"))
+}
+
+// subscribe subscribes c to the keyspace notifications of the source's keys.
+func (s *redisSource) subscribe(c *redisConn) error {
+	args := []string{"SUBSCRIBE"}
+	for _, key := range s.keys {
+		args = append(args, fmt.Sprintf("__keyspace@%d__:%s", s.db, key))
+	}
+	_ = c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	if err := c.send(args...); err != nil {
+		return err
+	}
+	for range s.keys {
+		if _, err := c.read(); err != nil {
+			return err
+		}
+	}
+	return c.conn.SetDeadline(time.Time{})
+}
+
+// follow subscribes to changes of the keys, requests a reload, and then one per notification until the connection
+// fails or ctx is done. It reports whether the subscription was set up.
+func (s *redisSource) follow(ctx context.Context, notify func()) (bool, error) {
+	c, err := s.dial(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+	if err := s.subscribe(c); err != nil {
+		return false, err
+	}
+	notify()
+	for {
+		v, err := c.read()
+		if err != nil {
+			return true, err
+		}
+		if msg, ok := v.([]any); ok && len(msg) == 3 && msg[0] == "message" {
+			notify()
+		}
+	}
+}
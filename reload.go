@@ -0,0 +1,163 @@
+package ruledforward
+
+import (
+	"maps"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+)
+
+// carryover hands state from the running instance to the one built by a Corefile reload. caddy parses and starts the
+// new instance before shutting down the old one, so a group can pick up its predecessor's downloaded rules and live
+// proxies at parse time instead of refetching everything and serving a partial rule set for a while.
+var carryover = struct {
+	sync.Mutex
+	live map[string]*Group // group key -> group of the running instance
+	dlc  *dlcSnapshot
+}{live: make(map[string]*Group)}
+
+// dlcSnapshot is the last loaded dlcfile, reused while the file is unchanged.
+type dlcSnapshot struct {
+	path  string
+	stamp fileStamp
+	rules map[string][]Rule
+}
+
+// groupKey identifies a group across reloads: the server block key plus the group name.
+func groupKey(server, name string) string {
+	return server + "/" + name
+}
+
+// liveGroup returns the running group registered under key, or nil.
+func liveGroup(key string) *Group {
+	carryover.Lock()
+	defer carryover.Unlock()
+	return carryover.live[key]
+}
+
+// registerLive records r's groups as the running ones, replacing those of a previous instance.
+func (r *Ruledforward) registerLive() {
+	carryover.Lock()
+	defer carryover.Unlock()
+	for _, g := range r.allGroups() {
+		carryover.live[g.key] = g
+	}
+}
+
+// unregisterLive removes r's groups from the registry unless a newer instance already replaced them.
+func (r *Ruledforward) unregisterLive() {
+	carryover.Lock()
+	defer carryover.Unlock()
+	for _, g := range r.allGroups() {
+		if carryover.live[g.key] == g {
+			delete(carryover.live, g.key)
+		}
+	}
+}
+
+// unregisterLiveGroup removes g from the registry, so that no later instance takes over its stopped proxies.
+func unregisterLiveGroup(g *Group) {
+	carryover.Lock()
+	defer carryover.Unlock()
+	if carryover.live[g.key] == g {
+		delete(carryover.live, g.key)
+	}
+}
+
+// handedOver reports whether p is now used by the group that replaced g, in which case g must not stop it.
+func (g *Group) handedOver(p *proxy.Proxy) bool {
+	succ := liveGroup(g.key)
+	return succ != nil && succ != g && slices.Contains(succ.Proxies(), p)
+}
+
+// reusableProxies returns prev's proxies keyed like newProxies does, if prev's upstream settings match cfg.
+// The `to` list itself may differ: upstreams present in both keep their proxy.
+func reusableProxies(prev *Group, cfg *upstreamConfig) map[string]*proxy.Proxy {
+	if prev == nil || prev.upstream == nil || !prev.upstream.sameSettings(cfg) {
+		return nil
+	}
+	reuse := make(map[string]*proxy.Proxy)
+	for _, p := range prev.Proxies() {
+		trans := transport.DNS
+		if p.GetTransport().GetTLSConfig() != nil {
+			trans = transport.TLS
+		}
+		reuse[trans+"://"+p.Addr()] = p
+	}
+	return reuse
+}
+
+// sameSettings reports whether proxies built from a and b are interchangeable, ignoring the `to` list.
+func (a *upstreamConfig) sameSettings(b *upstreamConfig) bool {
+	return slices.Equal(a.tlsArgs, b.tlsArgs) &&
+		slices.Equal(a.tlsCA, b.tlsCA) &&
+		a.tlsMinVersion == b.tlsMinVersion &&
+		slices.Equal(a.tlsCiphers, b.tlsCiphers) &&
+		a.tlsNoTickets == b.tlsNoTickets &&
+		a.tlsServerName == b.tlsServerName &&
+		maps.Equal(a.perUpstream, b.perUpstream) &&
+		a.bootstrapDNS == b.bootstrapDNS &&
+		a.ddr == b.ddr &&
+		a.expire == b.expire &&
+		a.maxIdleConns == b.maxIdleConns &&
+		a.opts == b.opts
+}
+
+// inheritRemoteRules takes over prev's downloaded adguard_rules if the group fetches the same URLs the same way.
+// It reports whether rules were carried over.
+func (g *Group) inheritRemoteRules(prev *Group) bool {
+	if prev == nil || len(g.AdguardURLs) == 0 ||
+		!slices.Equal(prev.AdguardURLs, g.AdguardURLs) || prev.BootstrapDNS != g.BootstrapDNS {
+		return false
+	}
+	rules := prev.remoteRules.Load()
+	if rules == nil {
+		return false
+	}
+	g.remoteRules.Store(rules)
+	// Keep the sources of the carried rules for debug logging.
+	g.origins.Store(prev.origins.Load())
+	return true
+}
+
+// inheritFeeds takes over the rules prev loaded for the threat feeds the group also has.
+func (g *Group) inheritFeeds(prev *Group) {
+	if prev == nil {
+		return
+	}
+	for _, f := range g.Feeds {
+		i := slices.IndexFunc(prev.Feeds, func(p *threatFeed) bool { return p.String() == f.String() })
+		if i >= 0 {
+			f.rules.Store(prev.Feeds[i].rules.Load())
+			f.zone.Store(prev.Feeds[i].zone.Load())
+		}
+	}
+}
+
+// loadDLCCached is LoadDLC, returning the previous result while the file's size and modification time are unchanged.
+// A directory is always read again, as its modification time does not change when a file in it is edited.
+func loadDLCCached(path string) (map[string][]Rule, error) {
+	var stamp fileStamp
+	if fi, err := os.Stat(path); err == nil && !fi.IsDir() {
+		stamp = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+	}
+	carryover.Lock()
+	snap := carryover.dlc
+	carryover.Unlock()
+	if snap != nil && snap.path == path && !stamp.modTime.IsZero() &&
+		snap.stamp.modTime.Equal(stamp.modTime) && snap.stamp.size == stamp.size {
+		return snap.rules, nil
+	}
+
+	rules, err := LoadDLC(path)
+	if err != nil {
+		return nil, err
+	}
+	carryover.Lock()
+	carryover.dlc = &dlcSnapshot{path: path, stamp: stamp, rules: rules}
+	carryover.Unlock()
+	return rules, nil
+}
@@ -0,0 +1,249 @@
+package ruledforward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+
+	"github.com/hr3lxphr6j/coredns-ruledforward/internal/dlcpb"
+)
+
+func parseForReload(t *testing.T, input string) *Ruledforward {
+	t.Helper()
+	c := caddy.NewTestController("dns", input)
+	c.Key = "reload-test:53"
+	dnsserver.NewServer("", []*dnsserver.Config{{Root: t.TempDir()}})
+	r, err := parseRuledforward(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestReloadCarriesOverState(t *testing.T) {
+	input := `ruledforward . {
+    group remote {
+        action forward
+        to 10.0.0.1 tls://10.0.0.2
+        adguard_rules https://lists.invalid/ads.txt
+        local.example
+    }
+}`
+	old := parseForReload(t, input)
+	og := old.groups[0]
+	if og.initialized.Load() {
+		t.Fatal("group with remote lists should not be initialized before the first download")
+	}
+	remote := []Rule{{Type: RuleDomain, Value: "ads.example."}}
+	og.remoteRules.Store(&remote)
+	if err := og.Update(nil, UpdateMatcherLocal); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.OnStartup(); err != nil {
+		t.Fatal(err)
+	}
+
+	cur := parseForReload(t, input)
+	g := cur.groups[0]
+	if !g.initialized.Load() {
+		t.Error("group should be initialized with rules carried over from the previous instance")
+	}
+	if !g.Matcher().Match("x.ads.example.") || !g.Matcher().Match("local.example.") {
+		t.Error("matcher should hold both carried remote rules and local rules right after parse")
+	}
+	if len(g.Proxies()) != 2 || g.Proxies()[0] != og.Proxies()[0] || g.Proxies()[1] != og.Proxies()[1] {
+		t.Error("proxies should be carried over when upstream settings are unchanged")
+	}
+	if len(g.inherited) != 2 {
+		t.Errorf("inherited = %d proxies, want 2", len(g.inherited))
+	}
+
+	if err := cur.OnStartup(); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.OnShutdown(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range og.Proxies() {
+		if !og.handedOver(p) {
+			t.Errorf("proxy %s should be handed over to the new instance", p.Addr())
+		}
+	}
+	if liveGroup(g.key) != g {
+		t.Error("new group should stay registered after the old instance shuts down")
+	}
+	if err := cur.OnShutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if liveGroup(g.key) != nil {
+		t.Error("group should be unregistered after final shutdown")
+	}
+}
+
+func TestReloadChangedConfigNotCarried(t *testing.T) {
+	old := parseForReload(t, `ruledforward . {
+    group remote {
+        to 10.0.0.1
+        adguard_rules https://lists.invalid/ads.txt
+    }
+}`)
+	remote := []Rule{{Type: RuleDomain, Value: "ads.example."}}
+	old.groups[0].remoteRules.Store(&remote)
+	if err := old.OnStartup(); err != nil {
+		t.Fatal(err)
+	}
+	defer old.OnShutdown()
+
+	cur := parseForReload(t, `ruledforward . {
+    group remote {
+        to 10.0.0.1
+        expire 30s
+        adguard_rules https://lists.invalid/other.txt
+    }
+}`)
+	g := cur.groups[0]
+	if g.remoteRules.Load() != nil || g.initialized.Load() {
+		t.Error("remote rules should not be carried over when the URL list changed")
+	}
+	if g.Proxies()[0] == old.groups[0].Proxies()[0] || len(g.inherited) != 0 {
+		t.Error("proxies should not be carried over when upstream settings changed")
+	}
+}
+
+func TestReloadForceTCPNotCarried(t *testing.T) {
+	old := parseForReload(t, `ruledforward . {
+    group g {
+        to 10.0.0.1
+    }
+}`)
+	if err := old.OnStartup(); err != nil {
+		t.Fatal(err)
+	}
+	defer old.OnShutdown()
+
+	for _, opt := range []string{"force_tcp", "prefer_udp"} {
+		cur := parseForReload(t, `ruledforward . {
+    group g {
+        to 10.0.0.1
+        `+opt+`
+    }
+}`)
+		if g := cur.groups[0]; g.Proxies()[0] == old.groups[0].Proxies()[0] || len(g.inherited) != 0 {
+			t.Errorf("%s: proxies should not be carried over when only the transport options changed", opt)
+		}
+	}
+}
+
+func TestLoadDLCCached(t *testing.T) {
+	list := &dlcpb.GeoSiteList{Entry: []*dlcpb.GeoSite{{
+		CountryCode: "test",
+		Domain:      []*dlcpb.Domain{{Type: dlcpb.Domain_RootDomain, Value: "example.com"}},
+	}}}
+	data := mustMarshal(t, list)
+	path := filepath.Join(t.TempDir(), "dlc.dat")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := loadDLCCached(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := loadDLCCached(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) == 0 || len(first) != len(second) {
+		t.Fatalf("unexpected dlc sizes %d, %d", len(first), len(second))
+	}
+	first["__MARK__"] = nil
+	if _, ok := second["__MARK__"]; !ok {
+		t.Error("unchanged dlcfile should return the cached rules")
+	}
+
+	list.Entry = append(list.Entry, &dlcpb.GeoSite{
+		CountryCode: "other",
+		Domain:      []*dlcpb.Domain{{Type: dlcpb.Domain_Full, Value: "example.org"}},
+	})
+	if err := os.WriteFile(path, mustMarshal(t, list), 0644); err != nil {
+		t.Fatal(err)
+	}
+	third, err := loadDLCCached(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := third["__MARK__"]; ok {
+		t.Error("changed dlcfile should be reloaded")
+	}
+}
+
+func TestDLCPerInstance(t *testing.T) {
+	list := &dlcpb.GeoSiteList{Entry: []*dlcpb.GeoSite{{
+		CountryCode: "test",
+		Domain:      []*dlcpb.Domain{{Type: dlcpb.Domain_RootDomain, Value: "example.com"}},
+	}}}
+	path := filepath.Join(t.TempDir(), "dlc.dat")
+	if err := os.WriteFile(path, mustMarshal(t, list), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	with, err := parseRuledforward(caddy.NewTestController("dns", `ruledforward . {
+    dlcfile `+path+`
+    group g {
+        action empty
+        geosite test
+    }
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	without, err := parseRuledforward(caddy.NewTestController("dns", `ruledforward . {
+    group g {
+        action empty
+        geosite test
+    }
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !with.groups[0].Match("www.example.com.") {
+		t.Error("group should match the geosite list of its dlcfile")
+	}
+	if without.dlc != nil || without.groups[0].Match("www.example.com.") {
+		t.Error("a server block without dlcfile should not see the dlcfile of another")
+	}
+}
+
+func TestReadyAfterFirstLoad(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("||ads.example^\n"))
+	}))
+	defer srv.Close()
+	r := parseForReload(t, `ruledforward . {
+    group block {
+        action empty
+        adguard_rules `+srv.URL+`/ads.txt
+    }
+}`)
+	if r.Ready() {
+		t.Fatal("Ready() = true before the first download")
+	}
+	if err := r.OnStartup(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.OnShutdown()
+	for deadline := time.Now().Add(5 * time.Second); !r.Ready(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("not ready after the first download")
+		}
+	}
+	if !r.groups[0].Matcher().Match("x.ads.example.") {
+		t.Error("ready before the downloaded rules were loaded")
+	}
+}
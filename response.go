@@ -0,0 +1,209 @@
+package ruledforward
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// answerMap translates answer addresses in one prefix to the same host part in another prefix of equal length.
+type answerMap struct {
+	from, to netip.Prefix
+}
+
+// mapAddr returns ip translated from m.from to m.to, or false if ip is not in m.from.
+func (m answerMap) mapAddr(ip net.IP) (netip.Addr, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	addr = addr.Unmap()
+	if !m.from.Contains(addr) {
+		return netip.Addr{}, false
+	}
+	src, dst := addr.AsSlice(), m.to.Addr().AsSlice()
+	bits := m.to.Bits()
+	for i := range dst {
+		switch {
+		case bits >= 8:
+			bits -= 8
+		case bits > 0:
+			mask := byte(0xff) << (8 - bits)
+			dst[i] = dst[i]&mask | src[i]&^mask
+			bits = 0
+		default:
+			dst[i] = src[i]
+		}
+	}
+	mapped, _ := netip.AddrFromSlice(dst)
+	return mapped, true
+}
+
+// processResponse applies the group's answer rewrites to an upstream reply before it is written to the client.
+func (g *Group) processResponse(ret *dns.Msg) {
+	if len(g.FilterTypes) > 0 {
+		ret.Answer = filterTypes(ret.Answer, g.FilterTypes)
+		ret.Extra = filterTypes(ret.Extra, g.FilterTypes)
+	}
+	if g.StripECH {
+		stripECH(ret.Answer)
+		stripECH(ret.Extra)
+	}
+	if g.BlockASN != nil {
+		var dropped bool
+		if ret.Answer, dropped = dropAddrs(ret.Answer, g.BlockASN); dropped {
+			asnBlockedTotal.WithLabelValues(g.Name).Inc()
+		}
+	}
+	if len(g.AnswerMaps) > 0 {
+		mapAnswers(ret.Answer, g.AnswerMaps)
+	}
+	if len(g.SortAnswers) > 0 {
+		sortAnswers(ret.Answer, g.SortAnswers)
+	}
+	if g.MinTTL > 0 || g.MaxTTL > 0 {
+		clampTTL(ret, g.MinTTL, g.MaxTTL)
+	}
+}
+
+// filterTypes returns rrs without the records whose type is in types. It filters in place.
+func filterTypes(rrs []dns.RR, types map[uint16]struct{}) []dns.RR {
+	out := rrs[:0]
+	for _, rr := range rrs {
+		if _, drop := types[rr.Header().Rrtype]; drop {
+			continue
+		}
+		out = append(out, rr)
+	}
+	return out
+}
+
+// stripECH removes the ech SvcParam from HTTPS and SVCB records, and from their mandatory key list, so clients fall
+// back to a plaintext SNI that firewalls and split tunnels can see.
+func stripECH(rrs []dns.RR) {
+	for _, rr := range rrs {
+		var svcb *dns.SVCB
+		switch v := rr.(type) {
+		case *dns.HTTPS:
+			svcb = &v.SVCB
+		case *dns.SVCB:
+			svcb = v
+		default:
+			continue
+		}
+		out := svcb.Value[:0]
+		for _, kv := range svcb.Value {
+			switch kv := kv.(type) {
+			case *dns.SVCBECHConfig:
+				continue
+			case *dns.SVCBMandatory:
+				kv.Code = slices.DeleteFunc(kv.Code, func(k dns.SVCBKey) bool { return k == dns.SVCB_ECHCONFIG })
+				if len(kv.Code) == 0 {
+					continue
+				}
+			}
+			out = append(out, kv)
+		}
+		svcb.Value = out
+	}
+}
+
+// mapAnswers rewrites the addresses of A and AAAA records using the first map whose source prefix contains them.
+func mapAnswers(rrs []dns.RR, maps []answerMap) {
+	for _, rr := range rrs {
+		var ip *net.IP
+		switch v := rr.(type) {
+		case *dns.A:
+			ip = &v.A
+		case *dns.AAAA:
+			ip = &v.AAAA
+		default:
+			continue
+		}
+		for _, m := range maps {
+			mapped, ok := m.mapAddr(*ip)
+			if !ok {
+				continue
+			}
+			// An AAAA record keeps a 16-byte address, also when an IPv4-mapped one was translated by an IPv4 map.
+			if rr.Header().Rrtype == dns.TypeAAAA {
+				b := mapped.As16()
+				*ip = b[:]
+			} else {
+				*ip = mapped.AsSlice()
+			}
+			break
+		}
+	}
+}
+
+// parseAnswerPreference parses a `sort_answers` argument: ipv4, ipv6, or a CIDR or address.
+func parseAnswerPreference(s string) (netip.Prefix, error) {
+	switch strings.ToLower(s) {
+	case "ipv4":
+		return netip.PrefixFrom(netip.IPv4Unspecified(), 0), nil
+	case "ipv6":
+		return netip.PrefixFrom(netip.IPv6Unspecified(), 0), nil
+	}
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	return p.Masked(), err
+}
+
+// sortAnswers reorders the A and AAAA records of rrs by the index of the first preference containing their address;
+// records matching none go last. The order is otherwise kept, and other records stay where they are so a CNAME chain
+// still precedes the addresses.
+func sortAnswers(rrs []dns.RR, prefs []netip.Prefix) {
+	var slots []int
+	var addrs []dns.RR
+	for i, rr := range rrs {
+		if _, ok := rrAddr(rr); ok {
+			slots = append(slots, i)
+			addrs = append(addrs, rr)
+		}
+	}
+	if len(addrs) < 2 {
+		return
+	}
+	rank := func(rr dns.RR) int {
+		addr, _ := rrAddr(rr)
+		for i, p := range prefs {
+			if p.Contains(addr) {
+				return i
+			}
+		}
+		return len(prefs)
+	}
+	slices.SortStableFunc(addrs, func(a, b dns.RR) int { return rank(a) - rank(b) })
+	for i, rr := range addrs {
+		rrs[slots[i]] = rr
+	}
+}
+
+// clampTTL raises TTLs below minTTL and lowers TTLs above maxTTL in all sections. A zero bound is not applied.
+// The OPT pseudo-record is skipped since its TTL field carries EDNS flags.
+func clampTTL(m *dns.Msg, minTTL, maxTTL uint32) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if minTTL > 0 && hdr.Ttl < minTTL {
+				hdr.Ttl = minTTL
+			}
+			if maxTTL > 0 && hdr.Ttl > maxTTL {
+				hdr.Ttl = maxTTL
+			}
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package ruledforward
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestClampTTL(t *testing.T) {
+	m := new(dns.Msg)
+	m.Answer = []dns.RR{
+		test.A("low.example.com. 5 IN A 127.0.0.1"),
+		test.A("mid.example.com. 300 IN A 127.0.0.2"),
+		test.A("high.example.com. 86400 IN A 127.0.0.3"),
+	}
+	m.SetEdns0(4096, true)
+	clampTTL(m, 60, 3600)
+
+	want := []uint32{60, 300, 3600}
+	for i, rr := range m.Answer {
+		if rr.Header().Ttl != want[i] {
+			t.Errorf("Answer[%d] TTL = %d, want %d", i, rr.Header().Ttl, want[i])
+		}
+	}
+	if opt := m.IsEdns0(); opt == nil || !opt.Do() {
+		t.Error("OPT record must not be modified")
+	}
+}
+
+func TestGroupProcessResponseMaxOnly(t *testing.T) {
+	g := &Group{MaxTTL: 30}
+	m := new(dns.Msg)
+	m.Answer = []dns.RR{test.A("a.example.com. 5 IN A 127.0.0.1"), test.A("b.example.com. 600 IN A 127.0.0.1")}
+	g.processResponse(m)
+	if m.Answer[0].Header().Ttl != 5 || m.Answer[1].Header().Ttl != 30 {
+		t.Errorf("TTLs = %d, %d, want 5, 30", m.Answer[0].Header().Ttl, m.Answer[1].Header().Ttl)
+	}
+}
+
+func TestGroupProcessResponseFilterTypes(t *testing.T) {
+	g := &Group{FilterTypes: map[uint16]struct{}{dns.TypeHTTPS: {}, dns.TypeTXT: {}}}
+	m := new(dns.Msg)
+	m.Answer = []dns.RR{
+		test.A("example.com. 300 IN A 127.0.0.1"),
+		&dns.HTTPS{SVCB: dns.SVCB{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeHTTPS, Class: dns.ClassINET, Ttl: 300}, Priority: 1, Target: "."}},
+		test.TXT(`example.com. 300 IN TXT "v=spf1 -all"`),
+	}
+	m.Extra = []dns.RR{test.TXT(`extra.example.com. 300 IN TXT "x"`)}
+	g.processResponse(m)
+	if len(m.Answer) != 1 || m.Answer[0].Header().Rrtype != dns.TypeA {
+		t.Errorf("Answer = %v, want only the A record", m.Answer)
+	}
+	if len(m.Extra) != 0 {
+		t.Errorf("Extra = %v, want empty", m.Extra)
+	}
+}
+
+func TestMapAnswers(t *testing.T) {
+	maps := []answerMap{
+		{from: netip.MustParsePrefix("203.0.113.0/24"), to: netip.MustParsePrefix("10.10.0.0/24")},
+		{from: netip.MustParsePrefix("198.51.100.0/23"), to: netip.MustParsePrefix("172.16.4.0/23")},
+		{from: netip.MustParsePrefix("2001:db8:1::/48"), to: netip.MustParsePrefix("fd00:10::/48")},
+	}
+	rrs := []dns.RR{
+		test.A("a.example.com. 300 IN A 203.0.113.7"),
+		test.A("b.example.com. 300 IN A 198.51.101.9"),
+		test.A("c.example.com. 300 IN A 192.0.2.1"),
+		test.AAAA("d.example.com. 300 IN AAAA 2001:db8:1:2::3"),
+		test.CNAME("e.example.com. 300 IN CNAME a.example.com."),
+		test.AAAA("f.example.com. 300 IN AAAA ::ffff:203.0.113.8"),
+	}
+	mapAnswers(rrs, maps)
+
+	want := []string{"10.10.0.7", "172.16.5.9", "192.0.2.1"}
+	for i, w := range want {
+		if got := rrs[i].(*dns.A).A.String(); got != w {
+			t.Errorf("A[%d] = %s, want %s", i, got, w)
+		}
+	}
+	if got := rrs[3].(*dns.AAAA).AAAA.String(); got != "fd00:10:0:2::3" {
+		t.Errorf("AAAA = %s, want fd00:10:0:2::3", got)
+	}
+	if got := rrs[5].(*dns.AAAA).AAAA; len(got) != net.IPv6len || !got.Equal(net.ParseIP("10.10.0.8")) {
+		t.Errorf("IPv4-mapped AAAA = %v, want ::ffff:10.10.0.8 in 16 bytes", []byte(got))
+	}
+	m := new(dns.Msg)
+	m.Answer = rrs[5:]
+	if _, err := m.Pack(); err != nil {
+		t.Errorf("packing the mapped AAAA record: %v", err)
+	}
+}
+
+func TestSortAnswers(t *testing.T) {
+	var prefs []netip.Prefix
+	for _, a := range []string{"10.0.0.0/8", "ipv6", "192.0.2.1"} {
+		p, err := parseAnswerPreference(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prefs = append(prefs, p)
+	}
+	if _, err := parseAnswerPreference("ipv5"); err == nil {
+		t.Error("expected error for ipv5")
+	}
+	rrs := []dns.RR{
+		test.CNAME("www.example.com. 300 IN CNAME cdn.example.net."),
+		test.A("cdn.example.net. 300 IN A 198.51.100.1"),
+		test.A("cdn.example.net. 300 IN A 192.0.2.1"),
+		test.AAAA("cdn.example.net. 300 IN AAAA 2001:db8::1"),
+		test.A("cdn.example.net. 300 IN A 198.51.100.2"),
+		test.A("cdn.example.net. 300 IN A 10.1.2.3"),
+	}
+	sortAnswers(rrs, prefs)
+
+	if _, ok := rrs[0].(*dns.CNAME); !ok {
+		t.Fatalf("CNAME moved: %v", rrs)
+	}
+	want := []string{"10.1.2.3", "2001:db8::1", "192.0.2.1", "198.51.100.1", "198.51.100.2"}
+	for i, w := range want {
+		if addr, _ := rrAddr(rrs[i+1]); addr.String() != w {
+			t.Errorf("answer[%d] = %s, want %s", i+1, addr, w)
+		}
+	}
+}
+
+func TestStripECH(t *testing.T) {
+	rr, err := dns.NewRR(`example.com. 300 IN HTTPS 1 . alpn="h2,h3" ech="AEX+DQBBpQAgACCW2/dfOBZAtQU55/py/BlhdRdaauPAkrERAUwppoeSEgAEAAEAAQASY2xvdWRmbGFyZS1lY2guY29tAAA=" mandatory=alpn,ech`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrs := []dns.RR{rr, test.A("example.com. 300 IN A 192.0.2.1")}
+	stripECH(rrs)
+
+	https := rrs[0].(*dns.HTTPS)
+	if len(https.Value) != 2 {
+		t.Fatalf("Value = %v, want mandatory and alpn only", https.Value)
+	}
+	for _, kv := range https.Value {
+		if kv.Key() == dns.SVCB_ECHCONFIG {
+			t.Error("ech parameter should be removed")
+		}
+		if m, ok := kv.(*dns.SVCBMandatory); ok && (len(m.Code) != 1 || m.Code[0] != dns.SVCB_ALPN) {
+			t.Errorf("mandatory = %v, want alpn", m.Code)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package ruledforward
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// qnameRewrite is one group `rewrite` rule, applied to the qname before forwarding and reverted in the reply.
+// Either suffix rewriting (from/to) or a regex substitution (re/replacement) is set.
+type qnameRewrite struct {
+	from, to    string
+	re          *regexp.Regexp
+	replacement string
+}
+
+// apply returns the rewritten qname, or false if the rule does not apply to qname.
+func (rw *qnameRewrite) apply(qname string) (string, bool) {
+	var out string
+	if rw.re != nil {
+		if !rw.re.MatchString(qname) {
+			return "", false
+		}
+		out = strings.ToLower(dns.Fqdn(rw.re.ReplaceAllString(qname, rw.replacement)))
+	} else {
+		prefix, ok := cutSuffixName(qname, rw.from)
+		if !ok {
+			return "", false
+		}
+		out = prefix + rw.to
+	}
+	if _, ok := dns.IsDomainName(out); !ok || out == qname {
+		return "", false
+	}
+	return out, true
+}
+
+// revert maps names in ret back from the rewritten qname to the client's qname. Regex rules only map the exact
+// rewritten name; suffix rules map every name under the target suffix, including CNAME targets.
+func (rw *qnameRewrite) revert(ret *dns.Msg, orig, rewritten string) {
+	for i := range ret.Question {
+		ret.Question[i].Name = orig
+	}
+	name := func(n string) string {
+		if strings.EqualFold(n, rewritten) {
+			return orig
+		}
+		if rw.re == nil {
+			if prefix, ok := cutSuffixName(strings.ToLower(n), rw.to); ok {
+				return prefix + rw.from
+			}
+		}
+		return n
+	}
+	for _, section := range [][]dns.RR{ret.Answer, ret.Ns, ret.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			rr.Header().Name = name(rr.Header().Name)
+			if cname, ok := rr.(*dns.CNAME); ok {
+				cname.Target = name(cname.Target)
+			}
+		}
+	}
+}
+
+// cutSuffixName returns the labels of name before the zone suffix, including the trailing dot, if name is suffix or
+// a subdomain of it. Both must be lower-case and fully qualified.
+func cutSuffixName(name, suffix string) (string, bool) {
+	if name == suffix {
+		return "", true
+	}
+	if suffix == "." {
+		return name, true
+	}
+	if prefix, ok := strings.CutSuffix(name, "."+suffix); ok {
+		return prefix + ".", true
+	}
+	return "", false
+}
+
+// rewriteRequest applies the group's first matching rewrite rule to the request's qname. It returns a rewritten
+// copy of req and the rule, or req itself and nil if no rule applies.
+func (g *Group) rewriteRequest(req *dns.Msg, qname string) (*dns.Msg, *qnameRewrite) {
+	for _, rw := range g.Rewrites {
+		to, ok := rw.apply(qname)
+		if !ok {
+			continue
+		}
+		out := req.Copy()
+		out.Question[0].Name = to
+		return out, rw
+	}
+	return req, nil
+}
@@ -0,0 +1,83 @@
+package ruledforward
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestQnameRewriteApply(t *testing.T) {
+	suffix := &qnameRewrite{from: "lan.", to: "internal.example.com."}
+	re := &qnameRewrite{re: regexp.MustCompile(`^(.+)\.home\.$`), replacement: "$1.int.example.net"}
+	tests := []struct {
+		rw    *qnameRewrite
+		qname string
+		want  string
+		ok    bool
+	}{
+		{suffix, "nas.lan.", "nas.internal.example.com.", true},
+		{suffix, "lan.", "internal.example.com.", true},
+		{suffix, "plan.", "", false},
+		{suffix, "nas.example.com.", "", false},
+		{re, "nas.home.", "nas.int.example.net.", true},
+		{re, "nas.lan.", "", false},
+	}
+	for _, tc := range tests {
+		got, ok := tc.rw.apply(tc.qname)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("apply(%q) = %q, %v; want %q, %v", tc.qname, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestForwardGroupRewrite(t *testing.T) {
+	p := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Name == "nas.internal.example.com." {
+			ret.Answer = append(ret.Answer,
+				test.CNAME("nas.internal.example.com. 300 IN CNAME box.internal.example.com."),
+				test.A("box.internal.example.com. 300 IN A 10.0.0.5"))
+		}
+		_ = w.WriteMsg(ret)
+	})
+	g := &Group{
+		Name:     "split",
+		Action:   "forward",
+		Policy:   &sequential{},
+		Rewrites: []*qnameRewrite{{from: "lan.", to: "internal.example.com."}},
+	}
+	g.SetProxies([]*proxy.Proxy{p})
+	r := &Ruledforward{from: ".", groups: []*Group{g}}
+
+	req := new(dns.Msg)
+	req.SetQuestion("NAS.lan.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	state := request.Request{W: rec, Req: req}
+	if _, err := r.forwardGroup(context.Background(), rec, req, state, g); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Msg == nil || len(rec.Msg.Answer) != 2 {
+		t.Fatalf("got %v, want CNAME and A", rec.Msg)
+	}
+	if rec.Msg.Question[0].Name != "NAS.lan." {
+		t.Errorf("question = %s, want the client's name", rec.Msg.Question[0].Name)
+	}
+	cname := rec.Msg.Answer[0].(*dns.CNAME)
+	if cname.Hdr.Name != "NAS.lan." || cname.Target != "box.lan." {
+		t.Errorf("CNAME = %s, want NAS.lan. -> box.lan.", cname)
+	}
+	if rec.Msg.Answer[1].Header().Name != "box.lan." {
+		t.Errorf("A owner = %s, want box.lan.", rec.Msg.Answer[1].Header().Name)
+	}
+	if req.Question[0].Name != "NAS.lan." {
+		t.Error("client request must not be modified")
+	}
+}
@@ -0,0 +1,415 @@
+package ruledforward
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	rpzTimeout     = 30 * time.Second // of each read of a zone transfer
+	rpzDialTimeout = 5 * time.Second
+)
+
+// errFeedUnchanged is returned by loadFeed for an RPZ zone whose serial is that of the last transfer, or whose changes
+// were applied to its rules by IXFR, leaving the group's matcher as it is.
+var errFeedUnchanged = errors.New("zone serial unchanged")
+
+// rpzSource is the master and zone of an `axfr://MASTER[:PORT]/ZONE` threat feed, with an optional TSIG key given as
+// `?tsig=NAME&secret=BASE64[&algorithm=ALGORITHM]`.
+type rpzSource struct {
+	master    string // host:port
+	zone      string // fully qualified
+	keyName   string
+	secret    string
+	algorithm string
+}
+
+// parseRPZSource parses an axfr:// threat feed source.
+func parseRPZSource(raw string) (*rpzSource, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "axfr" || u.Host == "" {
+		return nil, fmt.Errorf("invalid RPZ source '%s', want axfr://MASTER[:PORT]/ZONE", redactFeedSource(raw))
+	}
+	zone := dns.Fqdn(strings.ToLower(strings.Trim(u.Path, "/")))
+	if _, ok := dns.IsDomainName(zone); !ok || zone == "." {
+		return nil, fmt.Errorf("invalid RPZ zone in '%s'", redactFeedSource(raw))
+	}
+	s := &rpzSource{master: u.Host, zone: zone}
+	if u.Port() == "" {
+		s.master = net.JoinHostPort(u.Hostname(), "53")
+	}
+	q := u.Query()
+	if name := q.Get("tsig"); name != "" {
+		if q.Get("secret") == "" {
+			return nil, errors.New("RPZ source with tsig needs a secret")
+		}
+		s.keyName = dns.Fqdn(strings.ToLower(name))
+		s.secret = q.Get("secret")
+		s.algorithm = dns.Fqdn(strings.ToLower(q.Get("algorithm")))
+		if s.algorithm == "." {
+			s.algorithm = dns.HmacSHA256
+		}
+	}
+	return s, nil
+}
+
+// redactFeedSource returns raw without the query of an axfr:// URL, which may hold a TSIG secret.
+func redactFeedSource(raw string) string {
+	if before, _, ok := strings.Cut(raw, "?"); ok && strings.HasPrefix(raw, "axfr://") {
+		return before
+	}
+	return raw
+}
+
+// sign adds the source's TSIG key, if any, to m and returns the secrets to verify the response with.
+func (s *rpzSource) sign(m *dns.Msg) map[string]string {
+	if s.keyName == "" {
+		return nil
+	}
+	m.SetTsig(s.keyName, s.algorithm, 300, time.Now().Unix())
+	return map[string]string{s.keyName: s.secret}
+}
+
+// serial queries the master for the zone's SOA serial.
+func (s *rpzSource) serial() (uint32, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(s.zone, dns.TypeSOA)
+	c := &dns.Client{Net: "tcp", Timeout: rpzDialTimeout}
+	c.TsigSecret = s.sign(m)
+	ret, _, err := c.Exchange(m, s.master)
+	if err != nil {
+		return 0, err
+	}
+	for _, rr := range ret.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+	return 0, fmt.Errorf("no SOA for %s from %s (%s)", s.zone, s.master, dns.RcodeToString[ret.Rcode])
+}
+
+// transfer transfers the zone from the master.
+func (s *rpzSource) transfer() ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(s.zone)
+	return s.in(m)
+}
+
+// ixfr asks the master for the changes to the zone since serial. The master answers with its SOA alone if the zone is
+// unchanged, with the whole zone if it cannot send the changes, or with the changes.
+func (s *rpzSource) ixfr(serial uint32) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetIxfr(s.zone, serial, ".", ".")
+	return s.in(m)
+}
+
+// in runs the zone transfer m, returning its records, which start with the zone's SOA.
+func (s *rpzSource) in(m *dns.Msg) ([]dns.RR, error) {
+	t := &dns.Transfer{DialTimeout: rpzDialTimeout, ReadTimeout: rpzTimeout}
+	t.TsigSecret = s.sign(m)
+	ch, err := t.In(m, s.master)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dns.RR
+	for env := range ch {
+		if env.Error != nil {
+			return nil, env.Error
+		}
+		rrs = append(rrs, env.RR...)
+	}
+	if len(rrs) == 0 {
+		return nil, fmt.Errorf("empty transfer of %s from %s", s.zone, s.master)
+	}
+	if _, ok := rrs[0].(*dns.SOA); !ok {
+		return nil, fmt.Errorf("transfer of %s from %s does not start with its SOA", s.zone, s.master)
+	}
+	return rrs, nil
+}
+
+// rpzState is a zone transferred from its master: its serial, the records of each owner name, to apply the changes of
+// an IXFR to, and the rules they make. A feed of the same source takes it over on reload.
+type rpzState struct {
+	mu     sync.Mutex // serializes transfers
+	serial uint32
+	owners map[string]rpzOwner // nil for rules restored from a snapshot, until the zone is transferred again
+	rules  atomic.Pointer[layeredRules]
+}
+
+// rpzOwner counts the records of an owner name of an RPZ zone; it is a trigger if it has records and no passthru.
+type rpzOwner struct {
+	rrs      int
+	passthru int
+}
+
+func (o rpzOwner) trigger() bool { return o.rrs > 0 && o.passthru == 0 }
+
+// add counts rr, or uncounts it if n is -1.
+func (o *rpzOwner) add(rr dns.RR, n int) {
+	o.rrs += n
+	if c, ok := rr.(*dns.CNAME); ok && strings.EqualFold(c.Target, "rpz-passthru.") {
+		o.passthru += n
+	}
+}
+
+// loadRPZ brings the zone of f up to date. The first load transfers the whole zone; later ones ask for the changes
+// since, which are applied to the zone's rules instead of rebuilding them and return errFeedUnchanged, as an unchanged
+// serial does. If the master refuses IXFR, the zone is transferred again when its serial changes.
+func loadRPZ(f *threatFeed, s *rpzSource) ([]Rule, error) {
+	z := f.zone.Load()
+	if z == nil {
+		f.zone.CompareAndSwap(nil, new(rpzState))
+		z = f.zone.Load()
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.owners != nil {
+		rrs, err := s.ixfr(z.serial)
+		if err == nil {
+			return z.applyIXFR(rrs, s.zone)
+		}
+		log.Debugf("IXFR of %s from %s failed, falling back to AXFR: %v", s.zone, s.master, err)
+		serial, err := s.serial()
+		if err != nil {
+			return nil, err
+		}
+		if serial == z.serial {
+			return nil, errFeedUnchanged
+		}
+	}
+	rrs, err := s.transfer()
+	if err != nil {
+		return nil, err
+	}
+	return z.replace(rrs, s.zone), nil
+}
+
+// applyIXFR applies the answer to an IXFR: the SOA alone, the whole zone, or between two copies of the new SOA, for
+// each change the old SOA, the records deleted, the new SOA and the records added.
+func (z *rpzState) applyIXFR(rrs []dns.RR, zone string) ([]Rule, error) {
+	serial := rrs[0].(*dns.SOA).Serial
+	if len(rrs) == 1 || serial == z.serial {
+		return nil, errFeedUnchanged
+	}
+	if _, ok := rrs[1].(*dns.SOA); !ok || len(rrs) == 2 {
+		return z.replace(rrs, zone), nil
+	}
+	before := make(map[string]rpzOwner)
+	n := 1 // -1 for the records deleted, 1 for those added
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		if _, ok := rr.(*dns.SOA); ok {
+			n = -n
+			continue
+		}
+		if rr.Header().Rrtype == dns.TypeNS {
+			continue
+		}
+		owner := strings.ToLower(rr.Header().Name)
+		o := z.owners[owner]
+		if _, ok := before[owner]; !ok {
+			before[owner] = o
+		}
+		o.add(rr, n)
+		if o.rrs <= 0 {
+			delete(z.owners, owner)
+		} else {
+			z.owners[owner] = o
+		}
+	}
+	var add, del []Rule
+	for owner, was := range before {
+		rule, ok := rpzTrigger(owner, zone)
+		if !ok {
+			continue
+		}
+		switch now := z.owners[owner].trigger(); {
+		case now && !was.trigger():
+			add = append(add, rule)
+		case !now && was.trigger():
+			del = append(del, rule)
+		}
+	}
+	z.rules.Store(z.rules.Load().apply(add, del))
+	matcherGeneration.Add(1)
+	log.Infof("IXFR of %s from serial %d to %d: %d rules added, %d removed", zone, z.serial, serial, len(add), len(del))
+	z.serial = serial
+	return nil, errFeedUnchanged
+}
+
+// replace sets the zone to that of a full transfer and returns its rules.
+func (z *rpzState) replace(rrs []dns.RR, zone string) []Rule {
+	z.serial = rrs[0].(*dns.SOA).Serial
+	z.owners = make(map[string]rpzOwner)
+	for _, rr := range rrs {
+		if t := rr.Header().Rrtype; t == dns.TypeSOA || t == dns.TypeNS {
+			continue
+		}
+		owner := strings.ToLower(rr.Header().Name)
+		o := z.owners[owner]
+		o.add(rr, 1)
+		z.owners[owner] = o
+	}
+	rules := rpzRules(rrs, zone)
+	z.rules.Store(newLayeredRules(rules))
+	matcherGeneration.Add(1)
+	return rules
+}
+
+// restoreZone sets the rules of f, an axfr:// feed, to those restored from a snapshot, until its zone is transferred.
+func (f *threatFeed) restoreZone(rules []Rule) {
+	z := new(rpzState)
+	z.rules.Store(newLayeredRules(rules))
+	f.zone.Store(z)
+	matcherGeneration.Add(1)
+}
+
+// matchRule returns the rule of the zone of f, an axfr:// feed, that q (normalized) matches.
+func (f *threatFeed) matchRule(q string) (Rule, bool) {
+	if z := f.zone.Load(); z != nil {
+		if l := z.rules.Load(); l != nil {
+			return l.matchRule(q)
+		}
+	}
+	return Rule{}, false
+}
+
+// parseRPZFeed parses an RPZ zone in master file format; its origin is that of its SOA record.
+func parseRPZFeed(data []byte) ([]Rule, error) {
+	zp := dns.NewZoneParser(bytes.NewReader(data), "", "")
+	var rrs []dns.RR
+	origin := ""
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if soa, isSOA := rr.(*dns.SOA); isSOA && origin == "" {
+			origin = strings.ToLower(soa.Hdr.Name)
+		}
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if origin == "" {
+		return nil, errors.New("RPZ zone has no SOA record")
+	}
+	return rpzRules(rrs, origin), nil
+}
+
+// rpzRules returns the rules of the QNAME triggers of an RPZ zone: `NAME.ZONE` as a `full:` rule and `*.NAME.ZONE`
+// as a `domain:` rule. Exceptions (CNAME rpz-passthru.) and IP, NSDNAME, NSIP and client IP triggers are skipped; the
+// policy of a trigger is the group's action.
+func rpzRules(rrs []dns.RR, zone string) []Rule {
+	seen := make(map[string]bool)
+	passthru := make(map[string]bool)
+	for _, rr := range rrs {
+		if c, ok := rr.(*dns.CNAME); ok && strings.EqualFold(c.Target, "rpz-passthru.") {
+			passthru[strings.ToLower(rr.Header().Name)] = true
+		}
+	}
+	var rules []Rule
+	for _, rr := range rrs {
+		owner := strings.ToLower(rr.Header().Name)
+		if rr.Header().Rrtype == dns.TypeSOA || rr.Header().Rrtype == dns.TypeNS || seen[owner] || passthru[owner] {
+			continue
+		}
+		seen[owner] = true
+		if rule, ok := rpzTrigger(owner, zone); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// rpzTrigger returns the rule of owner (lowercase) if it is a QNAME trigger of zone.
+func rpzTrigger(owner, zone string) (Rule, bool) {
+	trigger, ok := strings.CutSuffix(owner, "."+zone)
+	if !ok {
+		return Rule{}, false
+	}
+	labels := dns.SplitDomainName(trigger)
+	if last := labels[len(labels)-1]; strings.HasPrefix(last, "rpz-") {
+		return Rule{}, false
+	}
+	if wildcard, ok := strings.CutPrefix(trigger, "*."); ok {
+		return Rule{Type: RuleDomain, Value: wildcard + "."}, true
+	}
+	if trigger == "*" {
+		return Rule{}, false
+	}
+	return Rule{Type: RuleFull, Value: trigger + "."}, true
+}
+
+// layeredRules is a set of `full:` and `domain:` rules that is never modified. A change makes a new set that shares
+// the base and copies the small overlay of changes, which is merged into a new base once it grows, so that a few
+// changes to a large list cost little and queries read the set without a lock.
+type layeredRules struct {
+	base    map[Rule]struct{}
+	overlay map[Rule]bool // true for rules added to base, false for rules removed from it
+}
+
+func newLayeredRules(rules []Rule) *layeredRules {
+	l := &layeredRules{base: make(map[Rule]struct{}, len(rules))}
+	for _, r := range rules {
+		l.base[r] = struct{}{}
+	}
+	return l
+}
+
+func (l *layeredRules) has(r Rule) bool {
+	if in, ok := l.overlay[r]; ok {
+		return in
+	}
+	_, ok := l.base[r]
+	return ok
+}
+
+// matchRule returns the rule that q (normalized) matches: q as a `full:` rule, or q or a parent as a `domain:` rule.
+func (l *layeredRules) matchRule(q string) (Rule, bool) {
+	if r := (Rule{Type: RuleFull, Value: q}); l.has(r) {
+		return r, true
+	}
+	for name := q; name != ""; {
+		if r := (Rule{Type: RuleDomain, Value: name}); l.has(r) {
+			return r, true
+		}
+		_, name, _ = strings.Cut(name, ".")
+	}
+	return Rule{}, false
+}
+
+// apply returns l with the rules of add added and those of del removed.
+func (l *layeredRules) apply(add, del []Rule) *layeredRules {
+	if l == nil {
+		l = newLayeredRules(nil)
+	}
+	overlay := maps.Clone(l.overlay)
+	if overlay == nil {
+		overlay = make(map[Rule]bool, len(add)+len(del))
+	}
+	for _, r := range del {
+		overlay[r] = false
+	}
+	for _, r := range add {
+		overlay[r] = true
+	}
+	if len(overlay) <= len(l.base)/8+1024 {
+		return &layeredRules{base: l.base, overlay: overlay}
+	}
+	base := maps.Clone(l.base)
+	for r, in := range overlay {
+		if in {
+			base[r] = struct{}{}
+		} else {
+			delete(base, r)
+		}
+	}
+	return &layeredRules{base: base}
+}
@@ -0,0 +1,218 @@
+package ruledforward
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+const rpzZone = `$TTL 300
+@                           IN SOA  ns.rpz.example. hostmaster.rpz.example. 1 3600 600 86400 300
+@                           IN NS   ns.rpz.example.
+malware.example             IN CNAME .
+*.malware.example           IN CNAME .
+tracker.example             IN CNAME *.
+tracker.example             IN TXT  "listed twice"
+ok.malware.example          IN CNAME rpz-passthru.
+32.1.2.0.192.rpz-ip         IN CNAME .
+ns.evil.example.rpz-nsdname IN CNAME .
+`
+
+func TestParseRPZFeed(t *testing.T) {
+	rules, err := parseRPZFeed([]byte("$ORIGIN rpz.example.\n" + rpzZone))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Rule{
+		{Type: RuleFull, Value: "malware.example."},
+		{Type: RuleDomain, Value: "malware.example."},
+		{Type: RuleFull, Value: "tracker.example."},
+	}
+	if !slices.Equal(rules, want) {
+		t.Errorf("rules = %v, want %v", rules, want)
+	}
+	if _, err := parseRPZFeed([]byte("$ORIGIN rpz.example.\nmalware.example 300 IN CNAME .\n")); err == nil {
+		t.Error("a zone without SOA should fail")
+	}
+}
+
+func TestParseRPZSource(t *testing.T) {
+	s, err := parseRPZSource("axfr://192.0.2.53/RPZ.example?tsig=key.example&secret=c2VjcmV0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.master != "192.0.2.53:53" || s.zone != "rpz.example." || s.keyName != "key.example." || s.algorithm != dns.HmacSHA256 {
+		t.Errorf("source = %+v", s)
+	}
+	f, err := parseThreatFeed([]string{"rpz", "axfr://192.0.2.53/rpz.example?tsig=key.example&secret=c2VjcmV0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.String() != "threat_feed rpz axfr://192.0.2.53/rpz.example" {
+		t.Errorf("String() = %q, want the secret left out", f.String())
+	}
+	for _, args := range [][]string{
+		{"hosts", "axfr://192.0.2.53/rpz.example"},
+		{"rpz", "axfr://192.0.2.53/"},
+		{"rpz", "axfr:///rpz.example"},
+		{"rpz", "axfr://192.0.2.53/rpz.example?tsig=key.example"},
+	} {
+		if _, err := parseThreatFeed(args); err == nil {
+			t.Errorf("parseThreatFeed(%q) should fail", args)
+		}
+	}
+}
+
+func TestRPZTransfer(t *testing.T) {
+	// Serial 2 adds phish.example, 3 removes malware.example and 4 adds evil.example, after which IXFR is refused.
+	var serial atomic.Uint32
+	serial.Store(1)
+	var transfers atomic.Int32
+	soa := func(n uint32) dns.RR {
+		rr := test.SOA("rpz.example. 300 IN SOA ns.rpz.example. hostmaster.rpz.example. 1 3600 600 86400 300")
+		rr.Serial = n
+		return rr
+	}
+	trigger := func(name string) dns.RR { return test.CNAME(name + ".rpz.example. 300 IN CNAME .") }
+	changes := map[uint32][2][]dns.RR{ // deleted and added records by serial
+		2: {nil, {trigger("phish.example")}},
+		3: {{trigger("malware.example")}, nil},
+		4: {nil, {trigger("evil.example")}},
+	}
+	zone := func() []dns.RR {
+		rrs := []dns.RR{soa(serial.Load()), trigger("malware.example")}
+		for n := uint32(2); n <= serial.Load(); n++ {
+			rrs = slices.DeleteFunc(rrs, func(rr dns.RR) bool {
+				return slices.ContainsFunc(changes[n][0], func(d dns.RR) bool { return dns.IsDuplicate(rr, d) })
+			})
+			rrs = append(rrs, changes[n][1]...)
+		}
+		return append(rrs, rrs[0])
+	}
+	out := func(w dns.ResponseWriter, r *dns.Msg, rrs []dns.RR) {
+		ch := make(chan *dns.Envelope, 1)
+		ch <- &dns.Envelope{RR: rrs}
+		close(ch)
+		_ = new(dns.Transfer).Out(w, r, ch)
+		w.Hijack()
+	}
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		switch r.Question[0].Qtype {
+		case dns.TypeSOA:
+			ret.Answer = zone()[:1]
+			_ = w.WriteMsg(ret)
+		case dns.TypeAXFR:
+			transfers.Add(1)
+			out(w, r, zone())
+		case dns.TypeIXFR:
+			if serial.Load() >= 4 {
+				ret.Rcode = dns.RcodeRefused
+				_ = w.WriteMsg(ret)
+				return
+			}
+			rrs := []dns.RR{soa(serial.Load())}
+			for n := r.Ns[0].(*dns.SOA).Serial + 1; n <= serial.Load(); n++ {
+				rrs = append(rrs, soa(n-1))
+				rrs = append(rrs, changes[n][0]...)
+				rrs = append(rrs, soa(n))
+				rrs = append(rrs, changes[n][1]...)
+			}
+			if len(rrs) > 1 {
+				rrs = append(rrs, rrs[0])
+			}
+			out(w, r, rrs)
+		}
+	})
+	defer s.Close()
+	_, port, _ := net.SplitHostPort(s.Addr)
+
+	f, err := parseThreatFeed([]string{"rpz", "axfr://127.0.0.1:" + port + "/rpz.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &Group{Name: "rpz", Feeds: []*threatFeed{f}}
+	load := func() ([]Rule, error) {
+		rules, err := g.loadFeed(f)
+		if err == nil {
+			f.rules.Store(&rules)
+		}
+		return rules, err
+	}
+	matches := func(want ...string) {
+		t.Helper()
+		for _, name := range []string{"malware.example.", "phish.example.", "evil.example."} {
+			if g.Match(name) != slices.Contains(want, name) {
+				t.Errorf("serial %d: Match(%s) = %v", serial.Load(), name, g.Match(name))
+			}
+		}
+	}
+	if rules, err := load(); err != nil || !slices.Equal(rules, []Rule{{Type: RuleFull, Value: "malware.example."}}) {
+		t.Fatalf("first transfer = %v, %v", rules, err)
+	}
+	matches("malware.example.")
+	if _, err := load(); err != errFeedUnchanged {
+		t.Errorf("load with the same serial = %v, want errFeedUnchanged", err)
+	}
+	// Rules changed by IXFR are not those of the matcher; cached routing decisions must still be dropped.
+	r := &Ruledforward{from: ".", groups: []*Group{g}, decisions: newLRU[string, decision](10)}
+	if rg := r.routeFor("phish.example.", queryClient{}, func(*Group) {}); rg != nil {
+		t.Errorf("before IXFR: routed phish.example. to %v, want no group", rg)
+	}
+	serial.Store(2)
+	if _, err := load(); err != errFeedUnchanged {
+		t.Errorf("IXFR to serial 2 = %v, want errFeedUnchanged", err)
+	}
+	matches("malware.example.", "phish.example.")
+	if rg := r.routeFor("phish.example.", queryClient{}, func(*Group) {}); rg != g {
+		t.Errorf("after IXFR: routed phish.example. to %v, want %s", rg, g.Name)
+	}
+	serial.Store(3)
+	if _, err := load(); err != errFeedUnchanged {
+		t.Errorf("IXFR to serial 3 = %v, want errFeedUnchanged", err)
+	}
+	matches("phish.example.")
+	if _, source, ok := g.explainMatch("phish.example."); !ok || source != f.String() {
+		t.Errorf("explainMatch(phish.example.) from %q, want %q", source, f.String())
+	}
+	if n := transfers.Load(); n != 1 {
+		t.Errorf("%d full transfers before IXFR is refused, want 1", n)
+	}
+	serial.Store(4)
+	if rules, err := load(); err != nil || len(rules) != 2 {
+		t.Errorf("transfer after IXFR is refused = %v, %v", rules, err)
+	}
+	matches("phish.example.", "evil.example.")
+	if n := transfers.Load(); n != 2 {
+		t.Errorf("%d full transfers, want 2", n)
+	}
+}
+
+func TestLayeredRules(t *testing.T) {
+	l := newLayeredRules([]Rule{{Type: RuleDomain, Value: "example.com."}, {Type: RuleFull, Value: "example.org."}})
+	next := l.apply([]Rule{{Type: RuleFull, Value: "example.net."}}, []Rule{{Type: RuleDomain, Value: "example.com."}})
+	if _, ok := l.matchRule("www.example.com."); !ok {
+		t.Error("apply should leave the set it was called on as it was")
+	}
+	for name, want := range map[string]bool{"www.example.com.": false, "example.org.": true, "www.example.org.": false, "example.net.": true} {
+		if _, ok := next.matchRule(name); ok != want {
+			t.Errorf("matchRule(%s) = %v, want %v", name, ok, want)
+		}
+	}
+	big := make([]Rule, 2000)
+	for i := range big {
+		big[i] = Rule{Type: RuleFull, Value: fmt.Sprintf("host%d.example.", i)}
+	}
+	merged := next.apply(big, nil)
+	if merged.overlay != nil || len(merged.base) != 2002 {
+		t.Errorf("an overlay of %d changes should be merged into a base of %d rules", len(merged.overlay), len(merged.base))
+	}
+}
@@ -1,10 +1,15 @@
 package ruledforward
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
-	"strings"
+	"net/netip"
+	"net/url"
+	"runtime/pprof"
+	"slices"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -22,38 +27,180 @@ const (
 )
 
 var (
-	errNoHealthy = errors.New("no healthy proxies")
+	errNoHealthy     = errors.New("no healthy proxies")
+	errLimitExceeded = errors.New("concurrent queries exceeded maximum")
+	errWrongReply    = errors.New("reply does not match the query")
+	errNoConsensus   = errors.New("no consensus among upstreams")
 )
 
 // Ruledforward is a plugin that forwards or returns empty based on domain rules.
 type Ruledforward struct {
 	from         string
+	server       string       // server block key, used to register the instance for Instance()
+	rateLimit    *RateLimiter // optional global per-client limit, checked before matching
+	onNoMatch    int          // rcode for queries no group takes, see `on_no_match`; 0 to pass them to the next plugin
 	groups       []*Group
-	defaultGroup *Group // cached reference to default group if exists
+	rulesets     []*Group                // named rule sets shared by groups via `use`; never routed to directly
+	defaultGroup *Group                  // cached reference to default group if exists
+	debug        bool                    // the server block has `debug`
+	logJSON      bool                    // `log_format json`: log JSON lines instead of text
+	pprofLabels  bool                    // `pprof_labels`: label goroutines with the group and action for CPU profiles
+	ednsKeep     bool                    // `edns_options keep`: echo the EDNS0 options of queries in synthesized responses
+	opcodesNext  bool                    // `other_opcodes next`: pass messages with other opcodes than QUERY on
+	geoipfile    string                  // for expected_ips of groups added at runtime
+	countries    *mmdbReader             // optional country database from mmdbfile
+	asn          *mmdbReader             // optional ASN database from asnfile
+	dlc          map[string][]Rule       // lists of the dlcfile by name, shared read-only with reloads; nil without one
+	admin        string                  // optional admin API listen address
+	adminToken   string                  // `admin_token`: bearer token the admin API requires of changes
+	adminUp      bool                    // whether this instance holds a reference to the admin server
+	activity     *activity               // recent queries and blocked names for the admin dashboard; nil without admin
+	queryLog     *queryLog               // nil without query_log
+	negCache     *lru[negKey, *negEntry] // negative answers of groups with negative_cache; nil if no group has it
+	warm         []string                // names resolved at startup to fill the caches
+	decisions    *lru[string, decision]  // routing decisions by qname; nil without decision_cache
+	unmatched    *unmatched              // names of queries no group matched; nil without capture_unmatched
+	categorizer  *categorizer            // categories of names for groups with `category`; nil without categorize
+	clientTags   *clientTags             // tags of clients for groups with `client_tag`; nil without clients_file
+	pipeline     *pipeline               // steps that route queries instead of the group order; nil without pipeline
+	conflictsMu  sync.Mutex
+	conflicts    []ruleConflict // rules shared by groups with different actions, see checkConflicts
+	overridden   map[string]int // number of conflicts each group lost at the last check
+	tableMu      sync.Mutex
+	table        atomic.Pointer[groupTable] // groups as changed at runtime, serialized by tableMu; nil while unchanged
 	Next         plugin.Handler
 }
 
 // Group is one rule group: either forward to upstreams or return empty.
 // Matcher is updated atomically (no lock in Matcher; holder uses atomic pointer swap).
 type Group struct {
-	Name    string
-	Action  string // "forward" or "empty"
-	matcher atomic.Pointer[Matcher]
+	concurrent int64 // atomic counters need to be first in struct for proper alignment
+
+	Name        string
+	Action      string // "forward", "empty", "zonefile" or "script"
+	Shadow      bool   // `mode shadow`: matches are only recorded, the query continues to later groups
+	key         string // identifies the group across Corefile reloads, see groupKey
+	matcher     atomic.Pointer[Matcher]
+	Rulesets    []*Group      // shared rulesets referenced with `use`, matched after the group's own rules
+	Split       []splitTarget // if set, matched queries are served by one of these groups, chosen by weight
+	Zone        *zoneFile     // of action zonefile, the zone matched queries are answered from
+	Script      *luaScript    // of action script, which decides how matched queries are answered
+	uses        []string      // ruleset names from `use`, resolved into Rulesets once all rulesets are parsed
+	initialized atomic.Bool   // set once the initial rule load (including remote lists) has completed
+	initialLoad bool          // the initial rule load is left to startGroup
+	ruleCount   atomic.Int64  // rules added to the current matcher, including duplicates
+	prunedCount atomic.Int64  // rules of ruleCount the matcher dropped as redundant
+	BloomSize   uint          // keys the matcher's bloom filter is sized for; 0 to size it for the rules loaded
+	BloomFP     float64       // target false positive rate of the bloom filter; 0 for the default
+	NoBloom     bool          // `no_bloom`: match without a bloom filter
+	DGA         *dgaScorer    // also matches names that look algorithmically generated; nil to disable
+	Categories  []string      // `category`: also matches names the categorizer puts in one of these, after all rules
+	categorizer *categorizer  // of the instance, set if Categories is
+	Clients     []clientRule  // `clients`: if set, the group only takes queries from these clients, at their times
+	clientTags  *clientTags   // of the instance, set if a rule of Clients has tags
+	DNSSECFlags dnssecFlags   // `dnssec_flags`: if set, the group only takes queries with these DNSSEC bits
 
 	// forward-only
-	Proxies  []*proxy.Proxy
-	Policy   Policy
-	Maxfails uint32
-	Opts     proxy.Options
+	proxies    atomic.Pointer[[]*proxy.Proxy]
+	Policy     Policy
+	Maxfails   uint32
+	Failfast   bool // SERVFAIL at once when every upstream is down, instead of trying them until the deadline
+	Opts       proxy.Options
+	bind       *sourceBinding            // optional source address/interface for upstream connections
+	boundConns *boundConns               // idle upstream connections from the bind address, set if bind is
+	inherited  map[*proxy.Proxy]struct{} // proxies taken over from the previous instance; already started
+	Keepalive  time.Duration             // interval of keepalive queries over cached TCP/DoT connections, 0 for none
+
+	RateLimit      *RateLimiter        // optional per-client limit for queries routed to this group
+	DNS0x20        bool                // randomize qname case towards plain-DNS upstreams and verify it in replies
+	CNAMECheck     bool                // suppress answers whose CNAME targets match a blocking group
+	FilterTypes    map[uint16]struct{} // RR types removed from forwarded answers
+	BlockQtypes    map[uint16]struct{} // query types answered locally (ANY: RFC 8482 HINFO, others: NODATA)
+	StripECH       bool                // remove the ech parameter from HTTPS/SVCB answers
+	Rewrites       []*qnameRewrite     // qname rewrites applied before forwarding, first match wins
+	AnswerMaps     []answerMap         // A/AAAA address translations applied to forwarded answers
+	SortAnswers    []netip.Prefix      // preferred A/AAAA prefixes, most preferred first; matching records are moved up
+	NetSets        []*netSet           // ipset/nftables sets that forwarded A/AAAA addresses are added to
+	BufSize        uint16              // EDNS0 UDP payload size of forwarded queries and responses, 0 to keep the client's
+	MinTTL         uint32              // answer TTL floor, 0 to disable
+	MaxTTL         uint32              // answer TTL ceiling, 0 to disable
+	MaxConcurrent  int64               // 0 means unlimited
+	Hedge          time.Duration       // send the query to the next upstream too if no reply came within this; 0 to disable
+	Concurrent     int                 // number of upstreams queried at once, the first trusted reply wins; 0 or 1 to disable
+	Consensus      int                 // number of upstreams queried at once whose replies must agree; 0 or 1 to disable
+	ConsensusTrust string              // address of the upstream whose reply Consensus accepts on its own; "" for none
+	OverLimitRcode int                 // rcode returned when MaxConcurrent is exceeded (REFUSED or SERVFAIL)
+	NegativeCache  int                 // entries this group adds to the instance's negative cache; 0 to disable
+	Prefetch       *prefetchConfig     // refresh popular negative cache entries before they expire; nil to disable
+	ExpectedIPs    addrMatcher         // a forwarded A/AAAA answer with no address in the set goes to Fallback
+	BlockASN       addrMatcher         // A/AAAA answers in these ASNs go to Fallback, or are removed without one
+	Fallback       *Group              // forward group that answers when this group's response is not trusted
+	FallbackOn     map[int]struct{}    // response rcodes that are answered by Fallback instead
+	FallbackEmpty  bool                // A/AAAA responses without an address of the queried type go to Fallback
+
+	fallbackName string
+	expectedGeo  []string       // geoip codes of expected_ips, resolved into ExpectedIPs after parsing
+	expectedNets []netip.Prefix // literal prefixes of expected_ips
+	blockASNs    []uint64       // block_asn numbers, resolved into BlockASN with asnfile after parsing
+
+	// for upstream reload: resolv.conf-style `to` files are re-read when they change, host names are re-resolved
+	UpstreamFiles  []string
+	upstream       *upstreamConfig
+	upstreamByKey  map[string]*proxy.Proxy
+	upstreamStamps map[string]fileStamp
+	resolvedAt     time.Time
+	StopWatch      chan struct{}
+	watchDone      chan struct{} // closed when watchUpstreams has returned
+	StopKeepalive  chan struct{}
 
 	// for refresh: static rules (inline + geosite) + URL list
-	GeositeNames []string
-	InlineRules  []Rule
-	AdguardPaths []string
-	AdguardURLs  []string
-	BootstrapDNS string // optional; used to resolve adguard_rules URL host to avoid DNS loop
-	RefreshCron  string
-	StopRefresh  chan struct{}
+	GeositeNames     []string
+	InlineRules      []Rule
+	AdguardPaths     []string
+	AdguardURLs      []string
+	BootstrapDNS     string                  // optional; used to resolve adguard_rules URL host to avoid DNS loop
+	DownloadProxy    *url.URL                // optional; HTTP(S) proxy for adguard_rules URLs instead of HTTP_PROXY etc.
+	Verify           map[string]*sourceCheck // optional; checks for adguard_rules URLs, by URL
+	remoteRules      atomic.Pointer[[]Rule]  // last successfully downloaded adguard_rules URLs; nil until the first load
+	Redis            []*redisSource          // optional; redis_rules sources, reloaded when their keys change
+	redisRules       atomic.Pointer[[]Rule]  // last successful load of Redis; nil until the first load
+	Kube             []*kubeSource           // optional; kubernetes_rules ConfigMaps, reloaded when they change
+	kubeRules        atomic.Pointer[[]Rule]  // last successful load of Kube; nil until the first load
+	AdguardHome      []*adguardHomeSource    // optional; adguard_home instances, reloaded when their filtering changes
+	adguardHomeRules atomic.Pointer[[]Rule]  // last successful load of AdguardHome; nil until the first load
+	TXT              []*txtSource            // optional; txt_rules lists, reloaded when their serial changes
+	txtRules         atomic.Pointer[[]Rule]  // last successful load of TXT; nil until the first load
+	Feeds            []*threatFeed           // optional; threat_feed lists, each keeping its last successful load
+	RefreshCron      string
+	StopRefresh      chan struct{}
+	StopSources      chan struct{} // stops the watchers of Redis, Kube, AdguardHome and TXT
+
+	runtime        runtimeRules            // rules added through the admin API
+	runtimeMatcher atomic.Pointer[Matcher] // matcher of runtime; nil without runtime rules
+
+	trackOrigins bool                        // keep origins, for debug logging of the rule that matched
+	onUpdate     func()                      // called after the rules changed; nil during setup
+	origins      atomic.Pointer[ruleOrigins] // sources of the rules of the current matcher; nil unless trackOrigins
+	snapshot     *snapshotFile               // where the matcher is saved and loaded from; nil without snapshot_dir
+
+	bloomFalsePositives atomic.Uint64 // names the bloom filters of the group's matchers let through but no rule matched
+
+	profileOnce sync.Once
+	prof        *groupProfile // pprof labels, built on first use
+}
+
+// Proxies returns the current upstream proxies (atomic load). Returns nil if not yet set.
+func (g *Group) Proxies() []*proxy.Proxy {
+	p := g.proxies.Load()
+	if p == nil {
+		return nil
+	}
+	return *p
+}
+
+// SetProxies atomically stores the upstream proxies. Used by upstream reload and tests.
+func (g *Group) SetProxies(ps []*proxy.Proxy) {
+	g.proxies.Store(&ps)
 }
 
 // Matcher returns the current matcher (atomic load). Returns nil if not yet set.
@@ -68,27 +215,102 @@ func (g *Group) Matcher() Matcher {
 // SetMatcher atomically stores the matcher. Used by Update (refresh) and tests.
 func (g *Group) SetMatcher(m Matcher) {
 	g.matcher.Store(&m)
+	matcherGeneration.Add(1)
+}
+
+// Match reports whether qname matches the group's own rules or any of its rulesets, including rules added at runtime.
+func (g *Group) Match(qname string) bool {
+	return g.matchNormalized(normalizeName(qname))
+}
+
+// matchNormalized is Match for a name already normalized, as on the query path.
+func (g *Group) matchNormalized(q string) bool {
+	if g.matchOwn(q) {
+		return true
+	}
+	for _, rs := range g.Rulesets {
+		if rs.matchOwn(q) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOwn reports whether q (normalized) matches the group's own rules, including rules added at runtime and those of
+// RPZ zones transferred from their masters.
+func (g *Group) matchOwn(q string) bool {
+	if m := g.Matcher(); m != nil && matchNormalized(m, q) {
+		return true
+	}
+	if m := g.runtimeMatcher.Load(); m != nil && matchNormalized(*m, q) {
+		return true
+	}
+	for _, f := range g.Feeds {
+		if _, ok := f.matchRule(q); ok {
+			return true
+		}
+	}
+	return g.DGA != nil && g.DGA.match(q)
+}
+
+// allGroups returns the groups followed by the rulesets, for lifecycle work shared by both.
+func (r *Ruledforward) allGroups() []*Group {
+	groups, _ := r.routes()
+	return append(slices.Clip(groups), r.rulesets...)
 }
 
 const (
-	UpdateMatcherGeosite byte = 1 << iota
+	UpdateMatcherGeosite uint16 = 1 << iota
 	UpdateMatcherInlinee
 	UpdateMatcherAdguardLocal
 	UpdateMatcherAdguardRemote
+	UpdateMatcherRedis
+	UpdateMatcherKube
+	UpdateMatcherFeeds
+	UpdateMatcherAdguardHome
+	UpdateMatcherTXT
 
 	UpdateMatcherLocal = UpdateMatcherGeosite | UpdateMatcherInlinee | UpdateMatcherAdguardLocal
-	UpdateMatcherAll   = UpdateMatcherLocal | UpdateMatcherAdguardRemote
+	UpdateMatcherAll   = UpdateMatcherLocal | UpdateMatcherAdguardRemote | UpdateMatcherRedis | UpdateMatcherKube |
+		UpdateMatcherFeeds | UpdateMatcherAdguardHome | UpdateMatcherTXT
 )
 
-func (g *Group) updateMatcher(dlcMap map[string][]Rule, updateItems byte) error {
-	bm := NewBloomedMatcher(2<<13, bloomFP)
+// newMatcher returns an empty matcher for the group's rules, with the group's bloom filter settings.
+func (g *Group) newMatcher() Matcher {
+	if g.NoBloom {
+		return NewMatcher()
+	}
+	return g.bloomedMatcher(newBloomedMatcher(g.BloomSize, cmp.Or(g.BloomFP, bloomFP)))
+}
+
+// bloomedMatcher returns m, a bloomed matcher for the group's rules, built or restored from a snapshot, counting its
+// false positives for the group.
+func (g *Group) bloomedMatcher(m *bloomedMatcher) *bloomedMatcher {
+	m.falsePositives = &g.bloomFalsePositives
+	return m
+}
+
+func (g *Group) updateMatcher(dlcMap map[string][]Rule, updateItems uint16) error {
+	bm := g.newMatcher()
+	var n int64
+	var origins, loaded *ruleOrigins
+	if g.trackOrigins {
+		origins, loaded = newRuleOrigins(), newRuleOrigins()
+	}
+	add := func(rule Rule, source string) {
+		bm.AddRule(rule)
+		n++
+		if origins != nil {
+			origins.add(rule, source)
+		}
+	}
 
 	if updateItems&UpdateMatcherGeosite != 0 {
 		for _, listName := range g.GeositeNames {
 			if dlcMap != nil {
-				rules := dlcMap[strings.ToUpper(listName)]
+				rules := dlcMap[geositeKey(listName)]
 				for _, rule := range rules {
-					bm.AddRule(rule)
+					add(rule, "geosite:"+listName)
 				}
 			}
 		}
@@ -96,7 +318,7 @@ func (g *Group) updateMatcher(dlcMap map[string][]Rule, updateItems byte) error
 
 	if updateItems&UpdateMatcherInlinee != 0 {
 		for _, rule := range g.InlineRules {
-			bm.AddRule(rule)
+			add(rule, "inline")
 		}
 	}
 
@@ -108,30 +330,144 @@ func (g *Group) updateMatcher(dlcMap map[string][]Rule, updateItems byte) error
 				return fmt.Errorf("group %s adguard_rules %s: %w", g.Name, path, err)
 			}
 			for _, rule := range rules {
-				bm.AddRule(rule)
+				add(rule, "adguard_rules:"+path)
 			}
 		}
 	}
 
 	if updateItems&UpdateMatcherAdguardRemote != 0 {
+		var remote []Rule
 		for _, url := range g.AdguardURLs {
 			log.Infof("Load Adguard Rule URL: %s", url)
-			rules, err := LoadAdguardFromURL(url, adguardTimeout, g.BootstrapDNS)
+			rules, err := g.loadAdguardURL(url)
 			if err != nil {
 				return fmt.Errorf("group %s adguard_rules %s: %w", g.Name, url, err)
 			}
-			for _, rule := range rules {
-				bm.AddRule(rule)
+			remote = append(remote, rules...)
+			loaded.addAll(rules, "adguard_rules:"+url)
+		}
+		g.remoteRules.Store(&remote)
+	}
+	if updateItems&UpdateMatcherRedis != 0 && len(g.Redis) > 0 {
+		var rules []Rule
+		for _, src := range g.Redis {
+			ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+			loadedRules, err := src.load(ctx)
+			cancel()
+			if err != nil {
+				return fmt.Errorf("group %s %s: %w", g.Name, src, err)
+			}
+			rules = append(rules, loadedRules...)
+			loaded.addAll(loadedRules, src.String())
+		}
+		g.redisRules.Store(&rules)
+	}
+	if updateItems&UpdateMatcherKube != 0 && len(g.Kube) > 0 {
+		var rules []Rule
+		for _, src := range g.Kube {
+			loadedRules, err := src.load(context.Background())
+			if err != nil {
+				return fmt.Errorf("group %s %s: %w", g.Name, src, err)
+			}
+			rules = append(rules, loadedRules...)
+			loaded.addAll(loadedRules, src.String())
+		}
+		g.kubeRules.Store(&rules)
+	}
+	if updateItems&UpdateMatcherAdguardHome != 0 && len(g.AdguardHome) > 0 {
+		var rules []Rule
+		for _, src := range g.AdguardHome {
+			loadedRules, err := src.load(context.Background(), g.fetchVerified)
+			if err != nil {
+				return fmt.Errorf("group %s %s: %w", g.Name, src, err)
+			}
+			rules = append(rules, loadedRules...)
+			loaded.addAll(loadedRules, src.String())
+		}
+		g.adguardHomeRules.Store(&rules)
+	}
+	if updateItems&UpdateMatcherTXT != 0 && len(g.TXT) > 0 {
+		var rules []Rule
+		for _, src := range g.TXT {
+			loadedRules, err := src.load(context.Background())
+			if err != nil {
+				return fmt.Errorf("group %s %s: %w", g.Name, src, err)
+			}
+			rules = append(rules, loadedRules...)
+			loaded.addAll(loadedRules, src.String())
+		}
+		g.txtRules.Store(&rules)
+	}
+	if updateItems&UpdateMatcherFeeds != 0 {
+		for _, f := range g.Feeds {
+			log.Infof("Load threat feed: %s", redactFeedSource(f.source))
+			rules, err := g.loadFeed(f)
+			if errors.Is(err, errFeedUnchanged) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("group %s %s: %w", g.Name, f, err)
+			}
+			f.rules.Store(&rules)
+			if f.rpz == nil {
+				loaded.addAll(rules, f.String())
+			}
+		}
+	}
+	// Remote rules are kept from the last download so a local-only update doesn't drop them. Their sources are those
+	// just loaded, or else those recorded when they were.
+	prev := g.origins.Load()
+	cachedSource := func(rule Rule, fallback string) string {
+		if origins == nil {
+			return ""
+		}
+		r := normalizeRule(rule)
+		return cmp.Or(loaded.source(r), prev.source(r), fallback)
+	}
+	if remote := g.remoteRules.Load(); remote != nil {
+		for _, rule := range *remote {
+			add(rule, cachedSource(rule, "adguard_rules"))
+		}
+	}
+	for _, cached := range []*atomic.Pointer[[]Rule]{&g.redisRules, &g.kubeRules, &g.adguardHomeRules, &g.txtRules} {
+		if rules := cached.Load(); rules != nil {
+			for _, rule := range *rules {
+				add(rule, cachedSource(rule, "rule source"))
+			}
+		}
+	}
+	for _, f := range g.Feeds {
+		if rules := f.rules.Load(); rules != nil && f.rpz == nil {
+			for _, rule := range *rules {
+				add(rule, cachedSource(rule, f.String()))
 			}
 		}
 	}
 
 	bm.Build()
 	g.SetMatcher(bm)
+	g.ruleCount.Store(n)
+	if p, ok := bm.(rulePruner); ok {
+		g.prunedCount.Store(int64(p.prunedRules()))
+		if p.prunedRules() > 0 {
+			log.Infof("group %s: dropped %d of %d rules as duplicates or covered by broader domain rules", g.Name, p.prunedRules(), n)
+		}
+	}
+	if origins != nil {
+		g.origins.Store(origins)
+	}
+	if g.snapshot != nil {
+		if err := g.saveSnapshot(bm, n); err != nil {
+			log.Warningf("group %s: saving snapshot %s: %v", g.Name, g.snapshot.path, err)
+		}
+	}
+	if g.onUpdate != nil {
+		g.onUpdate()
+	}
 	return nil
 }
 
-func (g *Group) Update(dlcMap map[string][]Rule, updateItems byte) error {
+func (g *Group) Update(dlcMap map[string][]Rule, updateItems uint16) error {
 	if err := g.updateMatcher(dlcMap, updateItems); err != nil {
 		return err
 	}
@@ -139,11 +475,49 @@ func (g *Group) Update(dlcMap map[string][]Rule, updateItems byte) error {
 	return nil
 }
 
+// refresh is Update for a reload after startup, triggered by source: the refresh schedule or a rule source that
+// changed. Its outcome is counted in the refresh metrics.
+func (g *Group) refresh(dlcMap map[string][]Rule, updateItems uint16, source string) error {
+	start := time.Now()
+	err := g.Update(dlcMap, updateItems)
+	g.observeRefresh(source, start, err)
+	return err
+}
+
+// observeRefresh records the outcome of a reload for source that began at start.
+func (g *Group) observeRefresh(source string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	refreshTotal.WithLabelValues(g.Name, source, result).Inc()
+	refreshDuration.WithLabelValues(g.Name, source).Observe(time.Since(start).Seconds())
+}
+
+// hasRemoteSources reports whether the group has rule sources loaded after the local ones at startup: adguard_rules
+// URLs, Redis, Kubernetes, AdGuard Home, TXT records and threat feeds.
+func (g *Group) hasRemoteSources() bool {
+	return len(g.AdguardURLs) > 0 || len(g.Redis) > 0 || len(g.Kube) > 0 || len(g.AdguardHome) > 0 ||
+		len(g.TXT) > 0 || len(g.Feeds) > 0
+}
+
+// Ready implements ready.Readiness. It reports false until every group has completed its initial rule load,
+// including the first download of remote adguard_rules, so traffic is not routed to an instance with a partial rule set.
+func (r *Ruledforward) Ready() bool {
+	for _, g := range r.allGroups() {
+		if !g.initialized.Load() {
+			return false
+		}
+	}
+	return true
+}
+
 // Name implements plugin.Handler.
 func (r *Ruledforward) Name() string { return "ruledforward" }
 
 // ServeDNS implements plugin.Handler.
 func (r *Ruledforward) ServeDNS(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) (int, error) {
+	start := time.Now()
 	state := request.Request{W: w, Req: req}
 	qname := state.Name()
 
@@ -151,61 +525,333 @@ func (r *Ruledforward) ServeDNS(ctx context.Context, w dns.ResponseWriter, req *
 		return plugin.NextOrFailure(r.Name(), r.Next, ctx, w, req)
 	}
 
-	for _, g := range r.groups {
+	if req.Opcode != dns.OpcodeQuery {
+		return r.serveOtherOpcode(ctx, w, req)
+	}
+
+	if r.rateLimit != nil && !r.rateLimit.Allow(state.IP()) {
+		return r.rateLimit.Reject(w, req, "", r.ednsKeep)
+	}
+
+	if r.pprofLabels {
+		// Put back the labels the goroutine had, as the rest of the plugin chain does not run for a group.
+		defer pprof.SetGoroutineLabels(ctx)
+	}
+
+	if r.pipeline != nil {
+		return r.servePipeline(ctx, w, req, state)
+	}
+
+	var gen uint64
+	if r.negCache != nil {
+		if ok, rcode, err := r.serveNegativeCache(w, req, state, start); ok {
+			return rcode, err
+		}
+		// Read before matching, so an answer is not cached as current if the rules change while it is resolved.
+		gen = matcherGeneration.Load()
+	}
+
+	span, _ := startSpan(ctx, "match")
+	g := r.routeFor(qname, clientOf(state), func(sg *Group) {
+		shadowMatchTotal.WithLabelValues(sg.Name, sg.Action).Inc()
+		log.Debugf("Shadow group '%s' matched %s", sg.Name, qname)
+	})
+	if span != nil {
+		if g != nil {
+			span.SetTag("group", g.Name)
+		}
+		span.Finish()
+	}
+	r.captureUnmatched(qname, g)
+	if g != nil {
+		reportMatch(ctx, qname, g)
+		// The negative cache answers before routing, so it must not hold answers of groups only some queries get.
+		if g.NegativeCache > 0 && r.negCache != nil && !g.perQuery() {
+			w = &negCacheWriter{ResponseWriter: w, cache: r.negCache, key: negativeCacheKey(state), group: g, gen: gen}
+		}
+		rcode, err := r.serveGroup(ctx, w, req, state, g)
+		requestDuration.WithLabelValues(g.Name, g.Action).Observe(time.Since(start).Seconds())
+		return rcode, err
+	}
+
+	noMatchTotal.Inc()
+	r.recordQuery(state, nil)
+	if r.onNoMatch != dns.RcodeSuccess {
+		return r.onNoMatch, nil
+	}
+	return plugin.NextOrFailure(r.Name(), r.Next, ctx, w, req)
+}
+
+// serveOtherOpcode handles a message in FROM whose opcode is not QUERY, such as NOTIFY or UPDATE, which no group can
+// answer or forward as a query: it is answered NOTIMP, or passed to the next plugin with `other_opcodes next`.
+func (r *Ruledforward) serveOtherOpcode(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) (int, error) {
+	if r.opcodesNext {
+		return plugin.NextOrFailure(r.Name(), r.Next, ctx, w, req)
+	}
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeNotImplemented)
+	finishReply(m, req, r.ednsKeep, nil)
+	_ = w.WriteMsg(m)
+	return 0, nil
+}
+
+// groupFor returns the first group whose rules match qname, or else the first with a `category` of qname, the default
+// group if none does, or nil. Groups with `clients` are skipped.
+// qname must be lower-case and fully qualified. Shadow groups never take effect; if shadowed is not nil, it is
+// called for each one that matches before the returned group, i.e. each one that would have changed the decision.
+func (r *Ruledforward) groupFor(qname string, shadowed func(*Group)) *Group {
+	g, _ := r.matchGroup(qname, queryClient{}, shadowed, false)
+	return g
+}
+
+// matchGroup is groupFor for a query from client, also reporting whether the decision depended on more than qname
+// and the rules: on the categories of qname, or on groups with `clients` or `dnssec_flags`. With label, the goroutine is labeled for
+// CPU profiles with each group whose rules it matches; ServeDNS puts its labels back.
+func (r *Ruledforward) matchGroup(qname string, client queryClient, shadowed func(*Group), label bool) (*Group, bool) {
+	groups, defaultGroup := r.routes()
+	now := time.Now()
+	varies := false
+	applies := func(g *Group) bool {
+		varies = varies || g.perQuery()
+		return g.appliesTo(client, now)
+	}
+	for _, g := range groups {
 		// Skip default group in normal iteration, it will be handled if no match found
 		if g.Name == "default" {
 			continue
 		}
-		if m := g.Matcher(); m == nil || !m.Match(qname) {
+		if label {
+			pprof.SetGoroutineLabels(g.profile().match)
+		}
+		if !g.matchNormalized(qname) || !applies(g) {
 			continue
 		}
-
-		switch g.Action {
-		case "empty":
-			requestsTotal.WithLabelValues(g.Name, "empty").Inc()
-			m := new(dns.Msg)
-			m.SetReply(req)
-			m.Ns = soaForEmpty(qname)
-			_ = w.WriteMsg(m)
-			return 0, nil
-		case "forward":
-			requestsTotal.WithLabelValues(g.Name, "forward").Inc()
-			return r.forwardGroup(ctx, w, req, state, g)
-		default:
+		if g.Shadow {
+			if shadowed != nil {
+				shadowed(g)
+			}
 			continue
 		}
+		return g, varies
+	}
+	// Categories are looked up only for names no rule takes.
+	if r.categorizer != nil {
+		varies = true
+		for _, g := range groups {
+			if g.Name == "default" || g.categorizer == nil || !applies(g) {
+				continue
+			}
+			if label {
+				pprof.SetGoroutineLabels(g.profile().match)
+			}
+			if _, ok := g.matchCategory(qname); !ok {
+				continue
+			}
+			if g.Shadow {
+				if shadowed != nil {
+					shadowed(g)
+				}
+				continue
+			}
+			return g, true
+		}
 	}
-
 	// If no group matched, use default group if it exists
-	if r.defaultGroup != nil {
-		switch r.defaultGroup.Action {
-		case "empty":
-			requestsTotal.WithLabelValues(r.defaultGroup.Name, "empty").Inc()
-			m := new(dns.Msg)
-			m.SetReply(req)
-			m.Ns = soaForEmpty(qname)
-			_ = w.WriteMsg(m)
-			return 0, nil
-		case "forward":
-			requestsTotal.WithLabelValues(r.defaultGroup.Name, "forward").Inc()
-			return r.forwardGroup(ctx, w, req, state, r.defaultGroup)
+	g := defaultGroup
+	if g == nil || !applies(g) {
+		return nil, varies
+	}
+	if g.Shadow {
+		if shadowed != nil {
+			shadowed(g)
 		}
+		return nil, varies
 	}
+	return g, varies
+}
 
-	noMatchTotal.Inc()
+// serveGroup answers req with the action of the group it was matched (or defaulted) to.
+func (r *Ruledforward) serveGroup(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, state request.Request, g *Group) (int, error) {
+	r.labelServe(g)
+	if g.RateLimit != nil && !g.RateLimit.Allow(state.IP()) {
+		return g.RateLimit.Reject(w, req, g.Name, r.ednsKeep)
+	}
+
+	if _, ok := g.BlockQtypes[state.QType()]; ok {
+		qtypeBlockedTotal.WithLabelValues(g.Name, state.Type()).Inc()
+		if state.QType() == dns.TypeANY {
+			return writeMinimalANY(w, req, state.QName(), r.ednsKeep)
+		}
+		return writeEmpty(w, req, state.Name(), r.ednsKeep)
+	}
+
+	if g.BufSize > 0 {
+		w = newBufsizeWriter(w, req, g.BufSize)
+	}
+
+	if len(g.Split) > 0 {
+		t := g.pickSplit()
+		splitTotal.WithLabelValues(g.Name, t.group.Name).Inc()
+		return r.serveGroup(ctx, w, req, state, t.group)
+	}
+
+	switch g.Action {
+	case "empty":
+		requestsTotal.WithLabelValues(g.Name, "empty").Inc()
+		r.recordQuery(state, g)
+		return writeEmpty(w, req, state.Name(), r.ednsKeep)
+	case "forward":
+		requestsTotal.WithLabelValues(g.Name, "forward").Inc()
+		r.recordQuery(state, g)
+		return r.forwardGroup(ctx, w, req, state, g)
+	case "zonefile":
+		requestsTotal.WithLabelValues(g.Name, "zonefile").Inc()
+		r.recordQuery(state, g)
+		return writeZoneAnswer(w, req, g.Zone, state.Name(), state.QType(), r.ednsKeep)
+	case "script":
+		requestsTotal.WithLabelValues(g.Name, "script").Inc()
+		r.recordQuery(state, g)
+		return r.serveScript(ctx, w, req, state, g)
+	}
 	return plugin.NextOrFailure(r.Name(), r.Next, ctx, w, req)
 }
 
-func soaForEmpty(origin string) []dns.RR {
+// serveFallback forwards a query that fb, a group's fallback, answers instead. The query was admitted and counted by
+// the group it was routed to, so fb's ratelimit, block_qtypes and request counters do not apply to it again.
+func (r *Ruledforward) serveFallback(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, state request.Request, fb *Group) (int, error) {
+	for {
+		r.labelServe(fb)
+		if fb.BufSize > 0 {
+			w = newBufsizeWriter(w, req, fb.BufSize)
+		}
+		if len(fb.Split) == 0 {
+			return r.forwardGroup(ctx, w, req, state, fb)
+		}
+		t := fb.pickSplit()
+		splitTotal.WithLabelValues(fb.Name, t.group.Name).Inc()
+		fb = t.group
+	}
+}
+
+// emptyReply holds a NODATA answer with its SOA and OPT records, so that writeEmpty allocates them at once. The
+// answers are not pooled: writers further up the chain, such as the recorders of the log and metrics plugins or the
+// cache plugin, may keep the message or its records after WriteMsg returns.
+type emptyReply struct {
+	msg   dns.Msg
+	soa   dns.SOA
+	ns    [1]dns.RR
+	opt   dns.OPT
+	extra [1]dns.RR
+}
+
+// writeEmpty answers req with NODATA (empty answer plus SOA). keepOpts is as for finishReply.
+func writeEmpty(w dns.ResponseWriter, req *dns.Msg, qname string, keepOpts bool) (int, error) {
+	e := new(emptyReply)
+	e.msg.SetReply(req)
+	e.soa = emptySOA(qname)
+	e.ns[0] = &e.soa
+	e.msg.Ns = e.ns[:]
+	e.msg.Extra = e.extra[:0]
+	finishReply(&e.msg, req, keepOpts, &e.opt)
+	_ = w.WriteMsg(&e.msg)
+	return 0, nil
+}
+
+// writeMinimalANY answers an ANY query with the single synthesized HINFO record recommended by RFC 8482.
+func writeMinimalANY(w dns.ResponseWriter, req *dns.Msg, qname string, keepOpts bool) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Answer = []dns.RR{&dns.HINFO{
+		Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: 8482},
+		Cpu: "RFC8482",
+	}}
+	finishReply(m, req, keepOpts, nil)
+	_ = w.WriteMsg(m)
+	return 0, nil
+}
+
+// cnameBlocked returns the first blocking (action empty) group matching a CNAME target in ret, or nil.
+// This catches CNAME cloaking, where an innocuous name is aliased to a blocked one.
+func (r *Ruledforward) cnameBlocked(ret *dns.Msg) *Group {
+	groups, _ := r.routes()
+	for _, rr := range ret.Answer {
+		cname, ok := rr.(*dns.CNAME)
+		if !ok {
+			continue
+		}
+		for _, g := range groups {
+			if g.Action != "empty" || g.Name == "default" || g.Shadow {
+				continue
+			}
+			if g.Match(cname.Target) {
+				return g
+			}
+		}
+	}
+	return nil
+}
+
+func emptySOA(origin string) dns.SOA {
 	hdr := dns.RR_Header{Name: origin, Ttl: emptyTTL, Class: dns.ClassINET, Rrtype: dns.TypeSOA}
-	return []dns.RR{&dns.SOA{Hdr: hdr, Ns: ".", Mbox: ".", Serial: 0, Refresh: 0, Retry: 0, Expire: 0, Minttl: emptyTTL}}
+	return dns.SOA{Hdr: hdr, Ns: ".", Mbox: ".", Serial: 0, Refresh: 0, Retry: 0, Expire: 0, Minttl: emptyTTL}
+}
+
+// exchange sends fwd to pr, retrying when a cached connection turns out to be closed and over TCP when a UDP reply
+// is truncated.
+func (g *Group) exchange(ctx context.Context, pr *proxy.Proxy, fwd request.Request) (*dns.Msg, error) {
+	span, ctx := startSpan(ctx, "upstream")
+	if span != nil {
+		span.SetTag("group", g.Name)
+		span.SetTag("upstream", pr.Addr())
+	}
+	opts := g.Opts
+	for {
+		ret, err := g.connect(ctx, pr, fwd, opts)
+		if errors.Is(err, proxy.ErrCachedClosed) {
+			cachedClosedRetriesTotal.WithLabelValues(g.Name, pr.Addr()).Inc()
+			continue
+		}
+		if ret != nil && ret.Truncated && !opts.ForceTCP && opts.PreferUDP {
+			opts.ForceTCP = true
+			continue
+		}
+		finishUpstreamSpan(span, ret, err)
+		rcode := "error"
+		if err == nil && ret != nil {
+			rcode = dns.RcodeToString[ret.Rcode]
+		}
+		upstreamRequestsTotal.WithLabelValues(g.Name, pr.Addr(), rcode).Inc()
+		return ret, err
+	}
 }
 
 func (r *Ruledforward) forwardGroup(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, state request.Request, g *Group) (int, error) {
-	if len(g.Proxies) == 0 {
+	if g.MaxConcurrent > 0 {
+		count := atomic.AddInt64(&g.concurrent, 1)
+		defer atomic.AddInt64(&g.concurrent, -1)
+		if count > g.MaxConcurrent {
+			maxConcurrentRejectTotal.WithLabelValues(g.Name).Inc()
+			return g.OverLimitRcode, errLimitExceeded
+		}
+	}
+
+	proxies := g.Proxies()
+	if len(proxies) == 0 {
 		return dns.RcodeServerFailure, errNoHealthy
 	}
-	list := g.Policy.List(g.Proxies)
+	list, buf := g.orderProxies(proxies)
+	defer releaseProxies(buf)
+
+	// The rewritten query is what goes upstream; the reply is mapped back to the client's name before it is checked.
+	fwd := state
+	fwdReq, rw := g.rewriteRequest(req, state.Name())
+	if g.BufSize > 0 {
+		fwdReq = withBufsize(fwdReq, g.BufSize)
+	}
+	if fwdReq != req {
+		fwd = request.Request{W: w, Req: fwdReq}
+	}
+
 	deadline := time.Now().Add(defaultTimeout)
 	i := 0
 	fails := 0
@@ -220,25 +866,27 @@ func (r *Ruledforward) forwardGroup(ctx context.Context, w dns.ResponseWriter, r
 		i++
 		if pr.Down(g.Maxfails) {
 			fails++
-			if fails < len(g.Proxies) {
+			if fails < len(proxies) {
 				continue
 			}
+			// All upstreams are down; unless failing fast, assume the health checks are broken and try the first.
+			if g.Failfast {
+				break
+			}
 			pr = list[0]
 		}
 
-		opts := g.Opts
 		var ret *dns.Msg
 		var err error
-		for {
-			ret, err = pr.Connect(ctx, state, opts)
-			if errors.Is(err, proxy.ErrCachedClosed) {
-				continue
-			}
-			if ret != nil && ret.Truncated && !opts.ForceTCP && opts.PreferUDP {
-				opts.ForceTCP = true
-				continue
-			}
-			break
+		agreed, disagreement := true, ""
+		if g.Consensus > 1 {
+			pr, ret, disagreement, agreed, err = g.exchangeConsensus(ctx, pr, g.consensusUpstreams(list, i, pr), fwd)
+		} else if others := g.otherUpstreams(list, i, pr, g.Concurrent-1); len(others) > 0 {
+			pr, ret, err = g.exchangeConcurrent(ctx, pr, others, fwd)
+		} else if next := g.hedgeTarget(list, i, pr); next != nil {
+			pr, ret, err = g.exchangeHedged(ctx, pr, next, fwd)
+		} else {
+			ret, err = g.exchange(ctx, pr, fwd)
 		}
 		upstreamErr = err
 
@@ -246,20 +894,61 @@ func (r *Ruledforward) forwardGroup(ctx context.Context, w dns.ResponseWriter, r
 			if g.Maxfails != 0 {
 				pr.Healthcheck()
 			}
-			if fails < len(g.Proxies) {
+			if fails < len(proxies) {
 				continue
 			}
 			break
 		}
 
-		if !state.Match(ret) {
-			debug.Hexdumpf(ret, "Wrong reply for id: %d, %s %d", ret.Id, state.QName(), state.QType())
+		if !fwd.Match(ret) {
+			debug.Hexdumpf(ret, "Wrong reply for id: %d, %s %d", ret.Id, fwd.QName(), fwd.QType())
 			formerr := new(dns.Msg)
 			formerr.SetRcode(state.Req, dns.RcodeFormatError)
+			finishReply(formerr, state.Req, r.ednsKeep, nil)
 			_ = w.WriteMsg(formerr)
 			return 0, nil
 		}
+		if rw != nil {
+			rw.revert(ret, state.Req.Question[0].Name, fwd.Req.Question[0].Name)
+		}
+
+		if disagreement != "" {
+			consensusDisagreementsTotal.WithLabelValues(g.Name, disagreement).Inc()
+		}
+		if !agreed {
+			if g.Fallback == nil {
+				log.Debugf("Group '%s' has no consensus on %s (%s)", g.Name, state.Name(), disagreement)
+				return dns.RcodeServerFailure, errNoConsensus
+			}
+			fallbackTotal.WithLabelValues(g.Name, g.Fallback.Name, "consensus").Inc()
+			log.Debugf("Group '%s' has no consensus on %s (%s), using '%s'", g.Name, state.Name(), disagreement, g.Fallback.Name)
+			return r.serveFallback(ctx, w, req, state, g.Fallback)
+		}
+
+		if g.CNAMECheck {
+			if bg := r.cnameBlocked(ret); bg != nil {
+				cnameBlockedTotal.WithLabelValues(g.Name, bg.Name).Inc()
+				return writeEmpty(w, req, state.Name(), r.ednsKeep)
+			}
+		}
 
+		if g.Fallback != nil {
+			if reason := g.untrusted(ret); reason != "" {
+				fallbackTotal.WithLabelValues(g.Name, g.Fallback.Name, reason).Inc()
+				log.Debugf("Group '%s' answer for %s not trusted (%s), using '%s'", g.Name, state.Name(), reason, g.Fallback.Name)
+				return r.serveFallback(ctx, w, req, state, g.Fallback)
+			}
+		}
+
+		g.processResponse(ret)
+		if r.countries != nil {
+			r.countAnswerCountry(g, ret)
+		}
+		for _, s := range g.NetSets {
+			if !s.enqueue(g.Name, ret) {
+				netSetDroppedTotal.WithLabelValues(g.Name).Inc()
+			}
+		}
 		_ = w.WriteMsg(ret)
 		return 0, nil
 	}
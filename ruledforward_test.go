@@ -3,7 +3,10 @@ package ruledforward
 import (
 	"context"
 	"errors"
+	"net"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
 	"github.com/coredns/coredns/plugin/pkg/proxy"
@@ -63,6 +66,61 @@ func TestRuledforwardServeDNS(t *testing.T) {
 	}
 }
 
+func TestRuledforwardOnNoMatch(t *testing.T) {
+	r := &Ruledforward{from: "example.org.", onNoMatch: dns.RcodeServerFailure}
+	r.Next = test.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		t.Error("Next should not be called with on_no_match servfail")
+		return dns.RcodeSuccess, nil
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.org.", dns.TypeA)
+	rcode, err := r.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), req)
+	if rcode != dns.RcodeServerFailure || err != nil {
+		t.Errorf("ServeDNS = %d, %v; want SERVFAIL", rcode, err)
+	}
+
+	// Names outside FROM still go to the next plugin.
+	nextCalled := false
+	r.Next = test.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		nextCalled = true
+		return dns.RcodeSuccess, nil
+	})
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	_, _ = r.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), req)
+	if !nextCalled {
+		t.Error("expected Next when qname not in from zone")
+	}
+}
+
+func TestRuledforwardOtherOpcodes(t *testing.T) {
+	g := &Group{Name: "default", Action: "empty"}
+	r := &Ruledforward{from: "example.org.", groups: []*Group{g}, defaultGroup: g}
+	nextCalled := false
+	r.Next = test.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		nextCalled = true
+		return dns.RcodeSuccess, nil
+	})
+
+	req := new(dns.Msg)
+	req.SetNotify("example.org.")
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := r.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Msg == nil || rec.Msg.Rcode != dns.RcodeNotImplemented || rec.Msg.Opcode != dns.OpcodeNotify || nextCalled {
+		t.Errorf("NOTIFY: got %v, want NOTIMP", rec.Msg)
+	}
+
+	r.opcodesNext = true
+	req.SetUpdate("example.org.")
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	_, _ = r.ServeDNS(context.Background(), rec, req)
+	if !nextCalled || rec.Msg != nil {
+		t.Errorf("UPDATE with other_opcodes next: got %v, want it passed to the next plugin", rec.Msg)
+	}
+}
+
 func TestRuledforwardZoneMatch(t *testing.T) {
 	r := &Ruledforward{from: "example.org."}
 	r.groups = []*Group{} // no groups
@@ -81,13 +139,22 @@ func TestRuledforwardZoneMatch(t *testing.T) {
 	}
 }
 
-func TestSoaForEmpty(t *testing.T) {
-	ns := soaForEmpty("example.com.")
-	if len(ns) != 1 {
-		t.Fatalf("expected 1 SOA RR, got %d", len(ns))
+func TestWriteEmpty(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	_, _ = writeEmpty(rec, req, "example.com.", false)
+	if len(rec.Msg.Answer) != 0 || len(rec.Msg.Ns) != 1 || rec.Msg.Id != req.Id {
+		t.Fatalf("expected a NODATA reply with 1 SOA RR, got %v", rec.Msg)
 	}
-	if ns[0].Header().Rrtype != dns.TypeSOA {
-		t.Errorf("expected SOA type, got %d", ns[0].Header().Rrtype)
+	if soa, ok := rec.Msg.Ns[0].(*dns.SOA); !ok || soa.Hdr.Name != "example.com." || soa.Minttl != emptyTTL {
+		t.Errorf("unexpected SOA %v", rec.Msg.Ns[0])
+	}
+
+	// The reply and its SOA record take one allocation, the question copied by SetReply another.
+	w := &test.ResponseWriter{}
+	if n := testing.AllocsPerRun(100, func() { writeEmpty(w, req, "example.com.", false) }); n > 2 {
+		t.Errorf("writeEmpty allocates %v times, want at most 2", n)
 	}
 }
 
@@ -173,7 +240,7 @@ func TestDefaultGroupMatchesAll(t *testing.T) {
 
 func TestForwardGroupNoProxies(t *testing.T) {
 	r := &Ruledforward{from: "."}
-	g := &Group{Name: "empty", Action: "forward", Proxies: nil, Policy: &sequential{}}
+	g := &Group{Name: "empty", Action: "forward", Policy: &sequential{}}
 	req := new(dns.Msg)
 	req.SetQuestion("example.com.", dns.TypeA)
 	rec := dnstest.NewRecorder(&test.ResponseWriter{})
@@ -187,10 +254,137 @@ func TestForwardGroupNoProxies(t *testing.T) {
 	}
 }
 
+func TestForwardGroupFailfast(t *testing.T) {
+	// The upstream answers queries but not the health checks, which time out until it is down.
+	var queries atomic.Int32
+	pr := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "." {
+			return
+		}
+		queries.Add(1)
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		_ = w.WriteMsg(ret)
+	})
+	pr.GetHealthchecker().SetReadTimeout(10 * time.Millisecond)
+	pr.Start(10 * time.Millisecond)
+	defer pr.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for !pr.Down(1) {
+		if time.Now().After(deadline) {
+			t.Fatal("upstream not marked down by health checks")
+		}
+		pr.Healthcheck()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	r := &Ruledforward{from: "."}
+	for _, failfast := range []bool{true, false} {
+		g := &Group{Name: "down", Action: "forward", Policy: &sequential{}, Maxfails: 1, Failfast: failfast}
+		g.SetProxies([]*proxy.Proxy{pr})
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		queries.Store(0)
+		code, err := r.forwardGroup(context.Background(), rec, req, request.Request{W: rec, Req: req}, g)
+		if failfast && (code != dns.RcodeServerFailure || !errors.Is(err, errNoHealthy) || queries.Load() != 0) {
+			t.Errorf("failfast: forwardGroup = %d, %v after %d queries, want SERVFAIL without a query", code, err, queries.Load())
+		}
+		if !failfast && (err != nil || queries.Load() != 1) {
+			t.Errorf("forwardGroup = %d, %v after %d queries, want the upstream tried anyway", code, err, queries.Load())
+		}
+	}
+}
+
+func TestForwardGroupMaxConcurrent(t *testing.T) {
+	r := &Ruledforward{from: "."}
+	g := &Group{Name: "limited", Action: "forward", Policy: &sequential{}, MaxConcurrent: 1, OverLimitRcode: dns.RcodeServerFailure}
+	g.concurrent = 1 // one query already in flight
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	state := request.Request{W: rec, Req: req}
+	code, err := r.forwardGroup(context.Background(), rec, req, state, g)
+	if code != dns.RcodeServerFailure {
+		t.Errorf("forwardGroup code = %d, want RcodeServerFailure", code)
+	}
+	if !errors.Is(err, errLimitExceeded) {
+		t.Errorf("forwardGroup err = %v, want errLimitExceeded", err)
+	}
+	if g.concurrent != 1 {
+		t.Errorf("concurrent = %d after reject, want 1", g.concurrent)
+	}
+}
+
+// newTestUpstream starts a DNS server answering with f and returns a proxy for it (on 127.0.0.1).
+func newTestUpstream(t *testing.T, f dns.HandlerFunc) *proxy.Proxy {
+	t.Helper()
+	s := dnstest.NewServer(f)
+	t.Cleanup(s.Close)
+	_, port, _ := net.SplitHostPort(s.Addr)
+	return proxy.NewProxy("ruledforward", net.JoinHostPort("127.0.0.1", port), transport.DNS)
+}
+
+func TestForwardGroupCNAMECheck(t *testing.T) {
+	p := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer,
+			test.CNAME("cloaked.example.org. 300 IN CNAME tracker.ads.example.com."),
+			test.A("tracker.ads.example.com. 300 IN A 127.0.0.1"))
+		_ = w.WriteMsg(ret)
+	})
+
+	m := NewMatcher()
+	m.AddRule(Rule{Type: RuleDomain, Value: "ads.example.com."})
+	m.Build()
+	block := &Group{Name: "block", Action: "empty"}
+	block.SetMatcher(m)
+	fwd := &Group{Name: "fwd", Action: "forward", Policy: &sequential{}}
+	fwd.SetProxies([]*proxy.Proxy{p})
+	r := &Ruledforward{from: ".", groups: []*Group{block, fwd}}
+
+	req := new(dns.Msg)
+	req.SetQuestion("cloaked.example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	state := request.Request{W: rec, Req: req}
+	if _, err := r.forwardGroup(context.Background(), rec, req, state, fwd); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Msg.Answer) != 2 {
+		t.Fatalf("without cname_check: len(Answer) = %d, want 2", len(rec.Msg.Answer))
+	}
+
+	fwd.CNAMECheck = true
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	state = request.Request{W: rec, Req: req}
+	if _, err := r.forwardGroup(context.Background(), rec, req, state, fwd); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Msg.Answer) != 0 || len(rec.Msg.Ns) == 0 {
+		t.Errorf("with cname_check: got Answer %v, Ns %v, want NODATA", rec.Msg.Answer, rec.Msg.Ns)
+	}
+}
+
+func TestRuledforwardReady(t *testing.T) {
+	local := &Group{Name: "local"}
+	remote := &Group{Name: "remote", AdguardURLs: []string{"https://example.com/list.txt"}}
+	r := &Ruledforward{from: ".", groups: []*Group{local, remote}}
+	local.initialized.Store(true)
+	if r.Ready() {
+		t.Error("Ready() = true before remote group loaded")
+	}
+	remote.initialized.Store(true)
+	if !r.Ready() {
+		t.Error("Ready() = false after all groups loaded")
+	}
+}
+
 func TestOnStartupOnShutdown(t *testing.T) {
 	r := &Ruledforward{from: "."}
 	p := proxy.NewProxy("ruledforward", "127.0.0.1:0", transport.DNS)
-	g := &Group{Name: "g", Proxies: []*proxy.Proxy{p}}
+	g := &Group{Name: "g"}
+	g.SetProxies([]*proxy.Proxy{p})
 	g.SetMatcher(NewMatcher()) // required for Group to be valid
 	r.groups = []*Group{g}
 	if err := r.OnStartup(); err != nil {
@@ -200,3 +394,94 @@ func TestOnStartupOnShutdown(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestStopRefreshRightAfterStart(t *testing.T) {
+	r := &Ruledforward{from: "."}
+	g := &Group{Name: "g", Action: "empty", AdguardURLs: []string{"https://lists.example/ads.txt"}, RefreshCron: "0 * * * *"}
+	g.SetMatcher(NewMatcher())
+	r.startGroup(g)
+	stop := g.StopRefresh
+	if stop == nil {
+		t.Fatal("StopRefresh not set by startGroup")
+	}
+	g.stop()
+	select {
+	case <-stop:
+	default:
+		t.Error("refresh schedule not stopped")
+	}
+}
+
+func TestServeGroupBlockQtypes(t *testing.T) {
+	m := NewMatcher()
+	m.AddRule(Rule{Type: RuleDomain, Value: "example.com."})
+	m.Build()
+	g := &Group{
+		Name:        "fwd",
+		Action:      "forward",
+		Policy:      &sequential{},
+		BlockQtypes: map[uint16]struct{}{dns.TypeANY: {}, dns.TypePTR: {}},
+	}
+	g.SetMatcher(m)
+	r := &Ruledforward{from: ".", groups: []*Group{g}}
+
+	req := new(dns.Msg)
+	req.SetQuestion("Example.com.", dns.TypeANY)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := r.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Msg.Answer) != 1 {
+		t.Fatalf("ANY: got %v, want a single HINFO", rec.Msg.Answer)
+	}
+	if h, ok := rec.Msg.Answer[0].(*dns.HINFO); !ok || h.Cpu != "RFC8482" || h.Hdr.Name != "Example.com." {
+		t.Errorf("ANY: got %v, want RFC 8482 HINFO", rec.Msg.Answer[0])
+	}
+
+	req.SetQuestion("a.example.com.", dns.TypePTR)
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := r.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Msg.Rcode != dns.RcodeSuccess || len(rec.Msg.Answer) != 0 || len(rec.Msg.Ns) == 0 {
+		t.Errorf("PTR: got %v, want NODATA", rec.Msg)
+	}
+}
+
+func TestShadowGroup(t *testing.T) {
+	m := NewMatcher()
+	m.AddRule(Rule{Type: RuleDomain, Value: "ads.example.com."})
+	m.Build()
+	trial := &Group{Name: "trial", Action: "empty", Shadow: true}
+	trial.SetMatcher(m)
+	def := &Group{Name: "default", Action: "empty"}
+	def.SetMatcher(NewMatcher())
+	r := &Ruledforward{from: ".", groups: []*Group{trial, def}, defaultGroup: def}
+
+	var shadowed []string
+	if g := r.groupFor("x.ads.example.com.", func(g *Group) { shadowed = append(shadowed, g.Name) }); g != def {
+		t.Errorf("groupFor = %v, want the default group", g)
+	}
+	if len(shadowed) != 1 || shadowed[0] != "trial" {
+		t.Errorf("shadowed = %v, want [trial]", shadowed)
+	}
+
+	// Without a default group the query goes to the next plugin unchanged.
+	r.defaultGroup = nil
+	r.Next = test.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) (int, error) {
+		ret := new(dns.Msg)
+		ret.SetReply(req)
+		ret.Answer = append(ret.Answer, test.A("x.ads.example.com. 60 IN A 192.0.2.1"))
+		_ = w.WriteMsg(ret)
+		return dns.RcodeSuccess, nil
+	})
+	req := new(dns.Msg)
+	req.SetQuestion("x.ads.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := r.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Msg.Answer) != 1 {
+		t.Errorf("shadow group must not alter the response, got %v", rec.Msg)
+	}
+}
@@ -0,0 +1,250 @@
+package ruledforward
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// runtimeRules are rules added to a group while it runs, through the admin API, on top of its configured sources.
+// They are kept across Corefile reloads and, with `runtime_rules FILE`, persisted to FILE.
+type runtimeRules struct {
+	mu    sync.Mutex
+	path  string // optional persistence file
+	rules []Rule // in the order added, without duplicates
+}
+
+// parseRuleLine parses one rule: `domain:`, `full:`, `keyword:` or `regex:` followed by a value, or a line of an
+// adguard_rules list (e.g. `||ads.example^`, `ads.example`).
+func parseRuleLine(line string) (Rule, error) {
+	line = strings.TrimSpace(line)
+	prefix, val, ok := strings.Cut(line, ":")
+	if ok {
+		val = strings.TrimSpace(val)
+		switch strings.ToLower(prefix) {
+		case "domain", "full":
+			if _, ok := dns.IsDomainName(val); !ok || val == "" || val == "." {
+				return Rule{}, fmt.Errorf("invalid domain in '%s'", line)
+			}
+			typ := RuleDomain
+			if strings.EqualFold(prefix, "full") {
+				typ = RuleFull
+			}
+			return Rule{Type: typ, Value: strings.ToLower(dns.Fqdn(val))}, nil
+		case "keyword":
+			if val == "" {
+				return Rule{}, fmt.Errorf("empty keyword in '%s'", line)
+			}
+			return Rule{Type: RuleKeyword, Value: strings.ToLower(val)}, nil
+		case "regex":
+			return parseRegexRule(val, line)
+		}
+	}
+	rules, err := ParseAdguardRules(line)
+	if err != nil {
+		return Rule{}, err
+	}
+	if len(rules) != 1 {
+		return Rule{}, fmt.Errorf("not a rule: '%s'", line)
+	}
+	if rules[0].Type == RuleRegex {
+		return parseRegexRule(rules[0].Value, line)
+	}
+	return rules[0], nil
+}
+
+func parseRegexRule(expr, line string) (Rule, error) {
+	if expr == "" {
+		return Rule{}, fmt.Errorf("empty regex in '%s'", line)
+	}
+	if _, err := regexp.Compile(expr); err != nil {
+		return Rule{}, fmt.Errorf("invalid regex in '%s': %w", line, err)
+	}
+	return Rule{Type: RuleRegex, Value: expr}, nil
+}
+
+// String formats r in the syntax parseRuleLine reads back.
+func (r Rule) String() string {
+	switch r.Type {
+	case RuleDomain:
+		return "domain:" + strings.TrimSuffix(r.Value, ".")
+	case RuleFull:
+		return "full:" + strings.TrimSuffix(r.Value, ".")
+	case RuleKeyword:
+		return "keyword:" + r.Value
+	case RuleRegex:
+		return "regex:" + r.Value
+	case RuleDGA:
+		return "dga:" + r.Value
+	case RuleCategory:
+		return "category:" + r.Value
+	}
+	return fmt.Sprintf("unknown:%d:%s", r.Type, r.Value)
+}
+
+// loadRuntimeRules reads a runtime_rules file. A missing file has no rules.
+func loadRuntimeRules(path string) ([]Rule, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	all, err := parseRuleLines(path, f)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	for _, r := range all {
+		if !slices.Contains(rules, r) {
+			rules = append(rules, r)
+		}
+	}
+	return rules, nil
+}
+
+// parseRuleLines parses one rule per line with parseRuleLine. Like adguard_rules, it skips blank lines, # and !
+// comments and @@ exceptions. name is used in errors.
+func parseRuleLines(name string, rd io.Reader) ([]Rule, error) {
+	var rules []Rule
+	sc := bufio.NewScanner(rd)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "@@") {
+			continue
+		}
+		r, err := parseRuleLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, n, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, sc.Err()
+}
+
+// save writes the rules to the persistence file, if any, replacing it atomically. Callers hold rr.mu.
+func (rr *runtimeRules) save() error {
+	if rr.path == "" {
+		return nil
+	}
+	var b strings.Builder
+	b.WriteString("# Rules added at runtime through the ruledforward admin API.\n")
+	for _, r := range rr.rules {
+		b.WriteString(r.String())
+		b.WriteByte('\n')
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(rr.path), filepath.Base(rr.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), rr.path)
+}
+
+// RuntimeRules returns the rules added to the group at runtime.
+func (g *Group) RuntimeRules() []Rule {
+	g.runtime.mu.Lock()
+	defer g.runtime.mu.Unlock()
+	return slices.Clone(g.runtime.rules)
+}
+
+// AddRuntimeRules adds rules to the group at runtime and returns how many were not present yet. They take effect
+// immediately and are persisted if the group has a runtime_rules file; if saving fails, nothing is changed.
+func (g *Group) AddRuntimeRules(rules []Rule) (int, error) {
+	return g.editRuntimeRules(func(cur []Rule) []Rule {
+		for _, r := range rules {
+			if !slices.Contains(cur, r) {
+				cur = append(cur, r)
+			}
+		}
+		return cur
+	})
+}
+
+// RemoveRuntimeRules removes rules added at runtime and returns how many were present. Rules from the group's
+// configured sources cannot be removed.
+func (g *Group) RemoveRuntimeRules(rules []Rule) (int, error) {
+	n, err := g.editRuntimeRules(func(cur []Rule) []Rule {
+		return slices.DeleteFunc(cur, func(r Rule) bool { return slices.Contains(rules, r) })
+	})
+	return -n, err
+}
+
+// editRuntimeRules applies edit to a copy of the runtime rules, saves and installs the result, and returns the
+// change in the number of rules.
+func (g *Group) editRuntimeRules(edit func([]Rule) []Rule) (int, error) {
+	rr := &g.runtime
+	rr.mu.Lock()
+	prev := rr.rules
+	rr.rules = edit(slices.Clone(prev))
+	if err := rr.save(); err != nil {
+		rr.rules = prev
+		rr.mu.Unlock()
+		return 0, err
+	}
+	g.setRuntimeMatcher(rr.rules)
+	n := len(rr.rules) - len(prev)
+	rr.mu.Unlock()
+	if g.onUpdate != nil {
+		g.onUpdate()
+	}
+	return n, nil
+}
+
+// initRuntimeRules sets up the group's runtime rules: loaded from the runtime_rules file path if it is set, and
+// otherwise taken over from the group's predecessor prev across a Corefile reload.
+func (g *Group) initRuntimeRules(path string, prev *Group) error {
+	g.runtime.path = path
+	var rules []Rule
+	switch {
+	case path != "":
+		var err error
+		if rules, err = loadRuntimeRules(path); err != nil {
+			return err
+		}
+	case prev != nil:
+		rules = prev.RuntimeRules()
+	}
+	g.setRuntimeRules(rules)
+	return nil
+}
+
+// setRuntimeRules replaces the runtime rules, e.g. with those loaded from the runtime_rules file, without saving.
+func (g *Group) setRuntimeRules(rules []Rule) {
+	g.runtime.mu.Lock()
+	defer g.runtime.mu.Unlock()
+	g.runtime.rules = rules
+	g.setRuntimeMatcher(rules)
+}
+
+func (g *Group) setRuntimeMatcher(rules []Rule) {
+	defer matcherGeneration.Add(1)
+	if len(rules) == 0 {
+		g.runtimeMatcher.Store(nil)
+		return
+	}
+	m := NewMatcher()
+	for _, r := range rules {
+		m.AddRule(r)
+	}
+	m.Build()
+	g.runtimeMatcher.Store(&m)
+}
@@ -0,0 +1,120 @@
+package ruledforward
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseRuleLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    Rule
+		wantErr bool
+	}{
+		{line: "domain:Ads.Example", want: Rule{Type: RuleDomain, Value: "ads.example."}},
+		{line: "full:ads.example.", want: Rule{Type: RuleFull, Value: "ads.example."}},
+		{line: "keyword:Tracker", want: Rule{Type: RuleKeyword, Value: "tracker"}},
+		{line: `regex:^ad\d+\.`, want: Rule{Type: RuleRegex, Value: `^ad\d+\.`}},
+		{line: "||ads.example^", want: Rule{Type: RuleDomain, Value: "ads.example."}},
+		{line: "ads.example", want: Rule{Type: RuleFull, Value: "ads.example."}},
+		{line: "domain:", wantErr: true},
+		{line: "keyword:", wantErr: true},
+		{line: "regex:(", wantErr: true},
+		{line: "! comment", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := parseRuleLine(tc.line)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseRuleLine(%q) err = %v, wantErr %v", tc.line, err, tc.wantErr)
+			continue
+		}
+		if err == nil && got != tc.want {
+			t.Errorf("parseRuleLine(%q) = %+v, want %+v", tc.line, got, tc.want)
+		}
+		if err == nil {
+			if back, err := parseRuleLine(got.String()); err != nil || back != got {
+				t.Errorf("parseRuleLine(%q) = %+v, %v, want round trip of %+v", got.String(), back, err, got)
+			}
+		}
+	}
+}
+
+func TestRuntimeRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "runtime.txt")
+	g := &Group{Name: "ads", Action: "empty"}
+	if err := g.initRuntimeRules(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Update(nil, UpdateMatcherLocal); err != nil {
+		t.Fatal(err)
+	}
+	if g.Match("x.ads.example.") {
+		t.Fatal("match before adding rules")
+	}
+
+	rules := []Rule{{Type: RuleDomain, Value: "ads.example."}, {Type: RuleKeyword, Value: "tracker"}}
+	if n, err := g.AddRuntimeRules(rules); err != nil || n != 2 {
+		t.Fatalf("AddRuntimeRules = %d, %v, want 2", n, err)
+	}
+	if n, _ := g.AddRuntimeRules(rules[:1]); n != 0 {
+		t.Errorf("adding a present rule = %d, want 0", n)
+	}
+	if !g.Match("x.ads.example.") || !g.Match("tracker.example.") {
+		t.Error("runtime rules do not match")
+	}
+	// Reloading the configured sources keeps runtime rules.
+	if err := g.Update(nil, UpdateMatcherLocal); err != nil {
+		t.Fatal(err)
+	}
+	if !g.Match("x.ads.example.") {
+		t.Error("runtime rule lost on update")
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "domain:ads.example\nkeyword:tracker\n") {
+		t.Errorf("file = %q", b)
+	}
+
+	if n, err := g.RemoveRuntimeRules(rules[:1]); err != nil || n != 1 {
+		t.Fatalf("RemoveRuntimeRules = %d, %v, want 1", n, err)
+	}
+	if g.Match("x.ads.example.") || !g.Match("tracker.example.") {
+		t.Error("wrong matches after removing a rule")
+	}
+
+	// A new group reads the file back, e.g. after a restart.
+	g2 := &Group{Name: "ads", Action: "empty"}
+	if err := g2.initRuntimeRules(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := g2.RuntimeRules(); len(got) != 1 || got[0] != rules[1] {
+		t.Errorf("rules from file = %v, want %v", got, rules[1:])
+	}
+
+	// Without a file, rules are carried over from the previous group.
+	g3 := &Group{Name: "ads", Action: "empty"}
+	if err := g3.initRuntimeRules("", g2); err != nil {
+		t.Fatal(err)
+	}
+	if got := g3.RuntimeRules(); len(got) != 1 {
+		t.Errorf("carried over rules = %v, want %v", got, rules[1:])
+	}
+}
+
+func TestRuntimeRulesSaveError(t *testing.T) {
+	g := &Group{Name: "ads", Action: "empty"}
+	if err := g.initRuntimeRules(filepath.Join(t.TempDir(), "missing", "runtime.txt"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.AddRuntimeRules([]Rule{{Type: RuleDomain, Value: "ads.example."}}); err == nil {
+		t.Fatal("expected error saving to a missing directory")
+	}
+	if len(g.RuntimeRules()) != 0 || g.Match("ads.example.") {
+		t.Error("rules changed although saving failed")
+	}
+}
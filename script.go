@@ -0,0 +1,295 @@
+package ruledforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// scriptTimeout bounds each call into a script, so that a loop in it does not hold up the query for good.
+const scriptTimeout = 100 * time.Millisecond
+
+// scriptUnsafeGlobals are the functions of Lua's base library removed from scripts, as they read files or load code
+// from elsewhere. The io, os, package and debug libraries are not opened at all.
+var scriptUnsafeGlobals = []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "_printregs"}
+
+// luaScript is the Lua script of `action script`. It must define `handle(q)`, which decides how a query is answered,
+// and may define `response(q, r)`, which sees and may change the answers of queries it forwarded. Lua states are
+// not safe for concurrent use, so each query takes one from a pool; all run the same compiled chunk.
+type luaScript struct {
+	path  string
+	proto *lua.FunctionProto
+	pool  sync.Pool // of *lua.LState
+}
+
+// scriptDecision is what handle returned for a query.
+type scriptDecision struct {
+	action string // "forward", "empty", "next" or "answer"
+	rcode  int    // of action answer
+	answer []dns.RR
+}
+
+// loadScript reads and compiles the script at path, and checks that running it defines handle.
+func loadScript(path string) (*luaScript, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := parse.Parse(strings.NewReader(string(src)), path)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, err
+	}
+	s := &luaScript{path: path, proto: proto}
+	L, err := s.newState()
+	if err != nil {
+		return nil, err
+	}
+	if L.GetGlobal("handle").Type() != lua.LTFunction {
+		L.Close()
+		return nil, fmt.Errorf("%s: no function handle", path)
+	}
+	s.pool.Put(L)
+	return s, nil
+}
+
+// newState returns a Lua state with only the base, string, table and math libraries, that ran the script.
+func (s *luaScript) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true, MinimizeStackMemory: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range scriptUnsafeGlobals {
+		L.SetGlobal(name, lua.LNil)
+	}
+	path := s.path
+	L.SetGlobal("print", L.NewFunction(func(L *lua.LState) int {
+		args := make([]string, L.GetTop())
+		for i := range args {
+			args[i] = L.ToStringMeta(L.Get(i + 1)).String()
+		}
+		log.Debugf("%s: %s", path, strings.Join(args, "\t"))
+		return 0
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), scriptTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		L.Close()
+		return nil, err
+	}
+	return L, nil
+}
+
+// state takes a Lua state from the pool, or makes one.
+func (s *luaScript) state() (*lua.LState, error) {
+	if L, ok := s.pool.Get().(*lua.LState); ok {
+		return L, nil
+	}
+	return s.newState()
+}
+
+// call calls the global function fn of L with the query table q and any more args, and returns its first result.
+func (s *luaScript) call(ctx context.Context, L *lua.LState, fn string, q *lua.LTable, args ...lua.LValue) (lua.LValue, error) {
+	f := L.GetGlobal(fn)
+	if f.Type() != lua.LTFunction {
+		return nil, fmt.Errorf("%s is not a function", fn)
+	}
+	ctx, cancel := context.WithTimeout(ctx, scriptTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+	if err := L.CallByParam(lua.P{Fn: f, NRet: 1, Protect: true}, append([]lua.LValue{q}, args...)...); err != nil {
+		return nil, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	return ret, nil
+}
+
+// queryTable returns the fields of a query that scripts see: name (lower case, with the trailing dot), type and
+// class as in zone files, client (IP address), proto (udp or tcp) and group.
+func queryTable(L *lua.LState, state request.Request, group string) *lua.LTable {
+	q := L.NewTable()
+	q.RawSetString("name", lua.LString(state.Name()))
+	q.RawSetString("type", lua.LString(state.Type()))
+	q.RawSetString("class", lua.LString(state.Class()))
+	q.RawSetString("client", lua.LString(state.IP()))
+	q.RawSetString("proto", lua.LString(state.Proto()))
+	q.RawSetString("group", lua.LString(group))
+	return q
+}
+
+// decide calls handle for the query. handle returns "forward", "empty" or "next", or a table with an rcode name
+// and answer records in zone file format, such as `{rcode = "NXDOMAIN"}` or `{answer = {"x.example. 60 A 192.0.2.1"}}`.
+func (s *luaScript) decide(ctx context.Context, state request.Request, group string) (scriptDecision, error) {
+	L, err := s.state()
+	if err != nil {
+		return scriptDecision{}, err
+	}
+	ret, err := s.call(ctx, L, "handle", queryTable(L, state, group))
+	if err != nil {
+		// A state whose call was cut short may be left mid-way; it is not reused.
+		L.Close()
+		return scriptDecision{}, err
+	}
+	s.pool.Put(L)
+	switch v := ret.(type) {
+	case lua.LString:
+		switch action := string(v); action {
+		case "forward", "empty", "next":
+			return scriptDecision{action: action}, nil
+		}
+		return scriptDecision{}, fmt.Errorf("handle returned unknown action '%s'", v)
+	case *lua.LTable:
+		d := scriptDecision{action: "answer"}
+		if d.rcode, d.answer, err = parseScriptAnswer(v, dns.RcodeSuccess); err != nil {
+			return scriptDecision{}, err
+		}
+		return d, nil
+	}
+	return scriptDecision{}, fmt.Errorf("handle returned %s, want a string or a table", ret.Type())
+}
+
+// parseScriptAnswer reads the rcode and answer of t, a table returned by a script. rcode is used if t has none.
+func parseScriptAnswer(t *lua.LTable, rcode int) (int, []dns.RR, error) {
+	if v := t.RawGetString("rcode"); v != lua.LNil {
+		rc, ok := dns.StringToRcode[strings.ToUpper(lua.LVAsString(v))]
+		if !ok {
+			return 0, nil, fmt.Errorf("unknown rcode '%s'", v)
+		}
+		rcode = rc
+	}
+	var answer []dns.RR
+	switch v := t.RawGetString("answer").(type) {
+	case *lua.LNilType:
+	case *lua.LTable:
+		for i := 1; i <= v.Len(); i++ {
+			rr, err := dns.NewRR(lua.LVAsString(v.RawGetInt(i)))
+			if err != nil {
+				return 0, nil, err
+			}
+			if rr != nil {
+				answer = append(answer, rr)
+			}
+		}
+	default:
+		return 0, nil, fmt.Errorf("answer is a %s, want a table", v.Type())
+	}
+	return rcode, answer, nil
+}
+
+// respond calls response, if the script defines it, with a forwarded answer m, which it replaces the rcode and
+// answer records of if response returns a table. The table passed to response has them in the same form.
+func (s *luaScript) respond(ctx context.Context, state request.Request, group string, m *dns.Msg) error {
+	L, err := s.state()
+	if err != nil {
+		return err
+	}
+	if L.GetGlobal("response").Type() != lua.LTFunction {
+		s.pool.Put(L)
+		return nil
+	}
+	r := L.NewTable()
+	r.RawSetString("rcode", lua.LString(dns.RcodeToString[m.Rcode]))
+	answer := L.NewTable()
+	for _, rr := range m.Answer {
+		answer.Append(lua.LString(rr.String()))
+	}
+	r.RawSetString("answer", answer)
+	ret, err := s.call(ctx, L, "response", queryTable(L, state, group), r)
+	if err != nil {
+		L.Close()
+		return err
+	}
+	s.pool.Put(L)
+	switch v := ret.(type) {
+	case *lua.LNilType:
+		return nil
+	case *lua.LTable:
+		rcode, answer, err := parseScriptAnswer(v, m.Rcode)
+		if err != nil {
+			return err
+		}
+		m.Rcode, m.Answer = rcode, answer
+		return nil
+	}
+	return fmt.Errorf("response returned %s, want nil or a table", ret.Type())
+}
+
+// errScript is returned for queries whose script failed, answered with SERVFAIL.
+var errScript = errors.New("script failed")
+
+// serveScript answers a query routed to g, a group with `action script`, as its script decides.
+func (r *Ruledforward) serveScript(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, state request.Request, g *Group) (int, error) {
+	d, err := g.Script.decide(ctx, state, g.Name)
+	if err == nil && d.action == "forward" && len(g.Proxies()) == 0 {
+		err = errors.New("handle returned forward, but the group has no 'to'")
+	}
+	if err != nil {
+		scriptErrorsTotal.WithLabelValues(g.Name).Inc()
+		log.Errorf("Group '%s': %s: %v", g.Name, g.Script.path, err)
+		return dns.RcodeServerFailure, errScript
+	}
+	switch d.action {
+	case "forward":
+		return r.forwardGroup(ctx, &scriptWriter{ResponseWriter: w, ctx: ctx, state: state, g: g}, req, state, g)
+	case "empty":
+		return writeEmpty(w, req, state.Name(), r.ednsKeep)
+	case "next":
+		return plugin.NextOrFailure(r.Name(), r.Next, ctx, w, req)
+	}
+	m := new(dns.Msg)
+	m.SetRcode(req, d.rcode)
+	m.Answer = d.answer
+	finishReply(m, req, r.ednsKeep, nil)
+	_ = w.WriteMsg(m)
+	return 0, nil
+}
+
+// scriptWriter passes the answers forwarded for a script group through the script's response function.
+type scriptWriter struct {
+	dns.ResponseWriter
+	ctx   context.Context
+	state request.Request
+	g     *Group
+}
+
+// WriteMsg implements dns.ResponseWriter. If response fails, the answer is replaced by SERVFAIL.
+func (w *scriptWriter) WriteMsg(m *dns.Msg) error {
+	if err := w.g.Script.respond(w.ctx, w.state, w.g.Name, m); err != nil {
+		scriptErrorsTotal.WithLabelValues(w.g.Name).Inc()
+		log.Errorf("Group '%s': %s: %v", w.g.Name, w.g.Script.path, err)
+		ret := new(dns.Msg)
+		ret.SetRcode(w.state.Req, dns.RcodeServerFailure)
+		m = ret
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
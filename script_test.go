@@ -0,0 +1,115 @@
+package ruledforward
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+const testScript = `
+function handle(q)
+    if q.name == "blocked.example." then return {rcode = "NXDOMAIN"} end
+    if q.name == "static.example." then return {answer = {q.name .. " 60 A 192.0.2.1"}} end
+    if q.type == "AAAA" then return "empty" end
+    if q.name == "loop.example." then while true do end end
+    if q.name == "io.example." then return io.open("/etc/passwd") end
+    if q.name == "bad.example." then return "drop" end
+    return "forward"
+end
+
+function response(q, r)
+    if q.name == "rewrite.example." and r.rcode == "NOERROR" then
+        return {answer = {q.name .. " 60 A 192.0.2.2"}}
+    end
+end
+`
+
+func writeTestScript(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.lua")
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadScriptErrors(t *testing.T) {
+	for name, data := range map[string]string{
+		"syntax":    "function handle(q)\n",
+		"no handle": "function other(q) return 'empty' end\n",
+		"error":     "error('boom')\nfunction handle(q) return 'empty' end\n",
+		"os":        "local t = os.time()\nfunction handle(q) return 'empty' end\n",
+		"dofile":    "dofile('/etc/passwd')\nfunction handle(q) return 'empty' end\n",
+	} {
+		if _, err := loadScript(writeTestScript(t, data)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if _, err := loadScript(filepath.Join(t.TempDir(), "missing.lua")); err == nil {
+		t.Error("missing file: expected error")
+	}
+}
+
+func TestRuledforwardScript(t *testing.T) {
+	s, err := loadScript(writeTestScript(t, testScript))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" 300 IN A 127.0.0.1"))
+		_ = w.WriteMsg(ret)
+	})
+	g := &Group{Name: "default", Action: "script", Script: s, Policy: &sequential{}}
+	g.SetProxies([]*proxy.Proxy{p})
+	r := &Ruledforward{from: ".", groups: []*Group{g}, defaultGroup: g}
+
+	for _, tt := range []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer string // the address of the only A record, or "" for none
+	}{
+		{"blocked.example.", dns.TypeA, dns.RcodeNameError, ""},
+		{"static.example.", dns.TypeA, dns.RcodeSuccess, "192.0.2.1"},
+		{"www.example.", dns.TypeAAAA, dns.RcodeSuccess, ""},
+		{"www.example.", dns.TypeA, dns.RcodeSuccess, "127.0.0.1"},
+		{"rewrite.example.", dns.TypeA, dns.RcodeSuccess, "192.0.2.2"},
+		{"loop.example.", dns.TypeA, dns.RcodeServerFailure, ""},
+		{"io.example.", dns.TypeA, dns.RcodeServerFailure, ""},
+		{"bad.example.", dns.TypeA, dns.RcodeServerFailure, ""},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.name, tt.qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		code, _ := r.ServeDNS(context.Background(), rec, req)
+		if code == dns.RcodeServerFailure {
+			if tt.rcode != dns.RcodeServerFailure {
+				t.Errorf("%s %s: SERVFAIL", tt.name, dns.TypeToString[tt.qtype])
+			}
+			continue
+		}
+		m := rec.Msg
+		if m == nil || m.Rcode != tt.rcode {
+			t.Errorf("%s %s: got %v, want rcode %s", tt.name, dns.TypeToString[tt.qtype], m, dns.RcodeToString[tt.rcode])
+			continue
+		}
+		got := ""
+		if len(m.Answer) == 1 {
+			if a, ok := m.Answer[0].(*dns.A); ok {
+				got = a.A.String()
+			}
+		}
+		if got != tt.answer || len(m.Answer) > 1 {
+			t.Errorf("%s %s: answer %v, want %q", tt.name, dns.TypeToString[tt.qtype], m.Answer, tt.answer)
+		}
+	}
+}
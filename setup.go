@@ -2,8 +2,16 @@ package ruledforward
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -11,28 +19,24 @@ import (
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
-	clog "github.com/coredns/coredns/plugin/pkg/log"
 	"github.com/coredns/coredns/plugin/pkg/parse"
 	"github.com/coredns/coredns/plugin/pkg/proxy"
 	pkgtls "github.com/coredns/coredns/plugin/pkg/tls"
-	"github.com/coredns/coredns/plugin/pkg/transport"
 	"github.com/hashicorp/cronexpr"
 
 	"github.com/miekg/dns"
 )
 
-var (
-	log = clog.NewWithPlugin("ruledforward")
-
-	dlcMap map[string][]Rule
-)
-
 const (
 	hcInterval     = 500 * time.Millisecond
 	defaultExpire  = 10 * time.Second
 	maxProxies     = 15
 	bloomFP        = 0.01
 	adguardTimeout = 30 * time.Second
+	// readyTimeout bounds how long a group reports not-ready while its first full rule load is still running.
+	readyTimeout = time.Minute
+
+	upstreamFileInterval = 5 * time.Second
 )
 
 func init() {
@@ -45,6 +49,18 @@ func setup(c *caddy.Controller) error {
 		return plugin.Error("ruledforward", err)
 	}
 
+	if dryRunEnabled() {
+		if err := r.dryRun(); err != nil {
+			return plugin.Error("ruledforward", fmt.Errorf("dry run: %w", err))
+		}
+		c.OnFirstStartup(func() error {
+			log.Info("dry run: configuration is valid, exiting")
+			os.Exit(0)
+			return nil
+		})
+		return nil
+	}
+
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		r.Next = next
 		return r
@@ -52,13 +68,19 @@ func setup(c *caddy.Controller) error {
 
 	c.OnStartup(r.OnStartup)
 	c.OnShutdown(r.OnShutdown)
+	// Like the health plugin, release the admin address before a reload starts the new instances.
+	c.OnStartup(r.startAdmin)
+	c.OnRestart(r.stopAdmin)
+	c.OnRestartFailed(r.startAdmin)
+	c.OnFinalShutdown(r.stopAdmin)
 
 	return nil
 }
 
 func parseRuledforward(c *caddy.Controller) (*Ruledforward, error) {
-	r := &Ruledforward{from: "."}
-	var dlcfile string
+	r := &Ruledforward{from: ".", server: c.Key}
+	var dlcfile, geoipfile, mmdbfile, asnfile, snapshotDir string
+	builds := make(map[string]*groupBuild) // parsed groups by name, for `extends`
 
 	if !c.Next() {
 		return r, c.ArgErr()
@@ -82,17 +104,233 @@ func parseRuledforward(c *caddy.Controller) (*Ruledforward, error) {
 			if dlcfile != "" && filepath.IsAbs(dlcfile) == false && dnsserver.GetConfig(c).Root != "" {
 				dlcfile = filepath.Join(dnsserver.GetConfig(c).Root, dlcfile)
 			}
+		case "geoipfile":
+			if !c.NextArg() {
+				return r, c.ArgErr()
+			}
+			geoipfile = c.Val()
+			if !filepath.IsAbs(geoipfile) && dnsserver.GetConfig(c).Root != "" {
+				geoipfile = filepath.Join(dnsserver.GetConfig(c).Root, geoipfile)
+			}
+		case "mmdbfile":
+			if !c.NextArg() {
+				return r, c.ArgErr()
+			}
+			mmdbfile = c.Val()
+			if !filepath.IsAbs(mmdbfile) && dnsserver.GetConfig(c).Root != "" {
+				mmdbfile = filepath.Join(dnsserver.GetConfig(c).Root, mmdbfile)
+			}
+		case "asnfile":
+			if !c.NextArg() {
+				return r, c.ArgErr()
+			}
+			asnfile = c.Val()
+			if !filepath.IsAbs(asnfile) && dnsserver.GetConfig(c).Root != "" {
+				asnfile = filepath.Join(dnsserver.GetConfig(c).Root, asnfile)
+			}
+		case "admin":
+			if !c.NextArg() {
+				return r, c.ArgErr()
+			}
+			if _, _, err := net.SplitHostPort(c.Val()); err != nil {
+				return r, c.Errf("admin must be HOST:PORT: %s", c.Val())
+			}
+			r.admin = c.Val()
+			r.activity = newActivity()
+		case "admin_token":
+			if !c.NextArg() {
+				return r, c.ArgErr()
+			}
+			r.adminToken = c.Val()
+			if c.NextArg() {
+				return r, c.ArgErr()
+			}
+		case "snapshot_dir":
+			if !c.NextArg() {
+				return r, c.ArgErr()
+			}
+			snapshotDir = c.Val()
+			if !filepath.IsAbs(snapshotDir) && dnsserver.GetConfig(c).Root != "" {
+				snapshotDir = filepath.Join(dnsserver.GetConfig(c).Root, snapshotDir)
+			}
+		case "decision_cache":
+			size := defaultDecisionCacheSize
+			if c.NextArg() {
+				n, err := strconv.Atoi(c.Val())
+				if err != nil || n <= 0 {
+					return r, c.Errf("decision_cache size must be a positive integer: %s", c.Val())
+				}
+				size = n
+			}
+			r.decisions = newLRU[string, decision](size)
+		case "clients_file":
+			if !c.NextArg() {
+				return r, c.ArgErr()
+			}
+			path := c.Val()
+			if !filepath.IsAbs(path) && dnsserver.GetConfig(c).Root != "" {
+				path = filepath.Join(dnsserver.GetConfig(c).Root, path)
+			}
+			t, err := newClientTags(path)
+			if err != nil {
+				return r, c.Errf("clients_file: %v", err)
+			}
+			r.clientTags = t
+		case "categorize":
+			cz, err := parseCategorizer(c.RemainingArgs())
+			if err != nil {
+				return r, c.Err(err.Error())
+			}
+			r.categorizer = cz
+		case "capture_unmatched":
+			size, withDefault := defaultUnmatchedSize, false
+			for _, arg := range c.RemainingArgs() {
+				if arg == "default" {
+					withDefault = true
+					continue
+				}
+				n, err := strconv.Atoi(arg)
+				if err != nil || n <= 0 {
+					return r, c.Errf("capture_unmatched size must be a positive integer: %s", arg)
+				}
+				size = n
+			}
+			r.unmatched = newUnmatched(size, withDefault)
+		case "on_no_match":
+			if !c.NextArg() {
+				return r, c.ArgErr()
+			}
+			switch strings.ToLower(c.Val()) {
+			case "next":
+				r.onNoMatch = dns.RcodeSuccess
+			case "refuse":
+				r.onNoMatch = dns.RcodeRefused
+			case "servfail":
+				r.onNoMatch = dns.RcodeServerFailure
+			default:
+				return r, c.Errf("on_no_match must be refuse, servfail or next: %s", c.Val())
+			}
+			if c.NextArg() {
+				return r, c.ArgErr()
+			}
+		case "other_opcodes":
+			if !c.NextArg() {
+				return r, c.ArgErr()
+			}
+			switch strings.ToLower(c.Val()) {
+			case "notimp":
+				r.opcodesNext = false
+			case "next":
+				r.opcodesNext = true
+			default:
+				return r, c.Errf("other_opcodes must be notimp or next: %s", c.Val())
+			}
+			if c.NextArg() {
+				return r, c.ArgErr()
+			}
+		case "log_format":
+			if !c.NextArg() {
+				return r, c.ArgErr()
+			}
+			switch c.Val() {
+			case "text":
+				r.logJSON = false
+			case "json":
+				r.logJSON = true
+				// Switch now, so that the rules loaded while parsing are logged as JSON too.
+				log.setJSON(true)
+			default:
+				return r, c.Errf("log_format must be text or json: %s", c.Val())
+			}
+			if c.NextArg() {
+				return r, c.ArgErr()
+			}
+		case "pprof_labels":
+			if c.NextArg() {
+				return r, c.ArgErr()
+			}
+			r.pprofLabels = true
+		case "edns_options":
+			if !c.NextArg() {
+				return r, c.ArgErr()
+			}
+			switch c.Val() {
+			case "strip":
+				r.ednsKeep = false
+			case "keep":
+				r.ednsKeep = true
+			default:
+				return r, c.Errf("edns_options must be keep or strip: %s", c.Val())
+			}
+			if c.NextArg() {
+				return r, c.ArgErr()
+			}
+		case "warm":
+			names := c.RemainingArgs()
+			if len(names) == 0 {
+				return r, c.ArgErr()
+			}
+			for _, name := range names {
+				if _, ok := dns.IsDomainName(name); !ok {
+					return r, c.Errf("warm: invalid domain name '%s'", name)
+				}
+				r.warm = append(r.warm, strings.ToLower(dns.Fqdn(name)))
+			}
+		case "query_log":
+			if len(c.RemainingArgs()) > 0 {
+				return r, c.ArgErr()
+			}
+			r.queryLog = &queryLog{sample: 1}
+			if c.NextArg() {
+				for c.Next() && c.Val() != "}" {
+					if err := r.queryLog.parseOption(append([]string{c.Val()}, c.RemainingArgs()...)); err != nil {
+						return r, c.Errf("query_log: %v", err)
+					}
+				}
+			}
+		case "pipeline":
+			if r.pipeline != nil {
+				return r, c.Err("at most one pipeline is allowed")
+			}
+			if len(c.RemainingArgs()) > 0 {
+				return r, c.ArgErr()
+			}
+			r.pipeline = &pipeline{}
+			for c.Next() && c.Val() != "}" {
+				if c.Val() == "{" {
+					continue
+				}
+				step, err := parsePipelineStep(append([]string{c.Val()}, c.RemainingArgs()...))
+				if err != nil {
+					return r, c.Errf("pipeline: %v", err)
+				}
+				r.pipeline.steps = append(r.pipeline.steps, step)
+			}
+			if len(r.pipeline.steps) == 0 {
+				return r, c.Err("pipeline needs at least one step")
+			}
+		case "ratelimit":
+			rl, err := parseRateLimit(c)
+			if err != nil {
+				return r, err
+			}
+			r.rateLimit = rl
 		case "group":
 			// Get group name
 			if !c.NextArg() {
 				return r, c.ArgErr()
 			}
 			groupName := c.Val()
-			gb := &groupBuild{
-				Action:   "forward",
-				maxfails: 2,
-				expire:   defaultExpire,
-				opts:     proxy.Options{HCRecursionDesired: true, HCDomain: "."},
+			gb := newGroupBuild()
+			if args := c.RemainingArgs(); len(args) > 0 {
+				if len(args) != 2 || args[0] != "extends" {
+					return r, c.ArgErr()
+				}
+				base, ok := builds[args[1]]
+				if !ok {
+					return r, c.Errf("group %s extends unknown group '%s'", groupName, args[1])
+				}
+				gb = base.inherit()
 			}
 			gb.Name = groupName
 			// Parse group block contents
@@ -104,33 +342,154 @@ func parseRuledforward(c *caddy.Controller) (*Ruledforward, error) {
 				}
 			}
 			// Build the group
-			g, err := buildGroup(gb)
+			key := groupKey(c.Key, groupName)
+			g, err := buildGroup(gb, liveGroup(key))
 			if err != nil {
 				return r, err
 			}
+			g.key = key
 			r.groups = append(r.groups, g)
+			builds[groupName] = gb
+		case "ruleset":
+			if !c.NextArg() {
+				return r, c.ArgErr()
+			}
+			gb := &groupBuild{Name: c.Val(), Action: "empty"}
+			for c.Next() && c.Val() != "}" {
+				if err := parseRulesetDirective(c, gb); err != nil {
+					return r, err
+				}
+			}
+			for _, rs := range r.rulesets {
+				if rs.Name == gb.Name {
+					return r, fmt.Errorf("duplicate ruleset '%s'", gb.Name)
+				}
+			}
+			key := groupKey(c.Key, "ruleset:"+gb.Name)
+			rs, err := buildGroup(gb, liveGroup(key))
+			if err != nil {
+				return r, err
+			}
+			rs.key = key
+			r.rulesets = append(r.rulesets, rs)
 		default:
 			return r, c.Errf("unknown directive '%s'", c.Val())
 		}
 	}
 
+	// Rulesets, split targets and fallbacks may be defined after the groups that refer to them.
+	for _, g := range r.groups {
+		if err := g.resolveRefs(r.groups, r.rulesets); err != nil {
+			return r, err
+		}
+	}
+	if r.pipeline != nil {
+		if err := r.pipeline.resolve(r.groups); err != nil {
+			return r, err
+		}
+	}
+	if r.adminToken != "" && r.admin == "" {
+		return r, fmt.Errorf("admin_token requires admin")
+	}
+	if r.admin != "" && r.adminToken == "" && !adminLoopback(r.admin) {
+		// Without a token, anyone who can reach the admin API could change the groups through it.
+		return r, fmt.Errorf("admin %s is not a loopback address and requires admin_token", r.admin)
+	}
+	if r.queryLog != nil {
+		for _, name := range r.queryLog.groups {
+			if !slices.ContainsFunc(r.groups, func(g *Group) bool { return g.Name == name }) {
+				return r, fmt.Errorf("query_log: unknown group '%s'", name)
+			}
+		}
+	}
+
+	if mmdbfile != "" {
+		db, err := openMMDB(mmdbfile)
+		if err != nil {
+			return r, fmt.Errorf("loading mmdbfile %s: %w", mmdbfile, err)
+		}
+		r.countries = db
+	}
+	r.geoipfile = geoipfile
+	if err := resolveExpectedIPs(r.groups, geoipfile, r.countries); err != nil {
+		return r, err
+	}
+	if asnfile != "" {
+		db, err := openMMDB(asnfile)
+		if err != nil {
+			return r, fmt.Errorf("loading asnfile %s: %w", asnfile, err)
+		}
+		r.asn = db
+	}
+	if err := resolveBlockASN(r.groups, r.asn); err != nil {
+		return r, err
+	}
+	if err := resolveCategories(r.groups, r.categorizer); err != nil {
+		return r, err
+	}
+	if err := resolveClientTags(r.groups, r.clientTags); err != nil {
+		return r, err
+	}
+
 	if dlcfile != "" {
 		var err error
-		dlcMap, err = LoadDLC(dlcfile)
+		r.dlc, err = loadDLCCached(dlcfile)
 		if err != nil {
 			return r, fmt.Errorf("loading dlcfile %s: %w", dlcfile, err)
 		}
 	}
+	var err error
+	if r.dlc, err = loadExtGeosites(r.dlc, r.allGroups(), dnsserver.GetConfig(c).Root); err != nil {
+		return r, err
+	}
 
-	for _, g := range r.groups {
-		if err := g.Update(dlcMap, UpdateMatcherLocal); err != nil {
-			return r, fmt.Errorf("updating group %s: %w", g.Name, err)
+	if snapshotDir != "" {
+		if err := os.MkdirAll(snapshotDir, 0o755); err != nil {
+			return r, fmt.Errorf("snapshot_dir: %w", err)
 		}
-		time.AfterFunc(time.Minute, func() {
-			if err := g.Update(dlcMap, UpdateMatcherAll); err != nil {
-				log.Errorf("updating group %s: %v", g.Name, err)
+		var dlcDigest []byte
+		if dlcfile != "" {
+			var err error
+			if dlcDigest, err = fileDigest(dlcfile); err != nil {
+				return r, fmt.Errorf("loading dlcfile %s: %w", dlcfile, err)
 			}
-		})
+		}
+		for _, g := range r.allGroups() {
+			g.snapshot = &snapshotFile{path: snapshotPath(snapshotDir, g.key), dlcDigest: dlcDigest}
+		}
+	}
+
+	r.debug = dnsserver.GetConfig(c).Debug
+	for _, g := range r.allGroups() {
+		g.trackOrigins = r.debug
+		// Rules carried over from the previous instance are already complete; the refresh schedule keeps them current.
+		carried := g.remoteRules.Load() != nil
+		restored := false
+		if g.snapshot != nil && !carried {
+			var err error
+			if restored, err = g.loadSnapshot(); err != nil {
+				log.Warningf("group %s: ignoring snapshot %s: %v", g.Name, g.snapshot.path, err)
+			}
+		}
+		if !restored {
+			if err := g.Update(r.dlc, UpdateMatcherLocal); err != nil {
+				return r, fmt.Errorf("updating group %s: %w", g.Name, err)
+			}
+		}
+		g.onUpdate = r.checkConflicts
+		// A snapshot with the last rules of every remote source serves them until they are loaded again.
+		complete := (len(g.AdguardURLs) == 0 || g.remoteRules.Load() != nil) &&
+			(len(g.Redis) == 0 || g.redisRules.Load() != nil) && (len(g.Kube) == 0 || g.kubeRules.Load() != nil) &&
+			(len(g.AdguardHome) == 0 || g.adguardHomeRules.Load() != nil) && (len(g.TXT) == 0 || g.txtRules.Load() != nil) &&
+			!slices.ContainsFunc(g.Feeds, func(f *threatFeed) bool { return f.rules.Load() == nil })
+		if carried || complete {
+			g.initialized.Store(true)
+		}
+		// A restored snapshot of local sources only is as current as rebuilding it.
+		if carried || restored && !g.hasRemoteSources() {
+			continue
+		}
+		g.initialLoad = true
 	}
 
 	// Validate that there is at most one default group and cache reference
@@ -144,6 +503,15 @@ func parseRuledforward(c *caddy.Controller) (*Ruledforward, error) {
 	if defaultCount > 1 {
 		return r, fmt.Errorf("at most one 'default' group is allowed, found %d", defaultCount)
 	}
+	r.checkConflicts()
+
+	negSize := 0
+	for _, g := range r.groups {
+		negSize += g.NegativeCache
+	}
+	if negSize > 0 {
+		r.negCache = newLRU[negKey, *negEntry](negSize)
+	}
 
 	return r, nil
 }
@@ -152,22 +520,179 @@ func parseRuledforward(c *caddy.Controller) (*Ruledforward, error) {
 type groupBuild struct {
 	Name          string
 	Action        string
+	zoneFile      string
+	scriptFile    string
+	shadow        bool
 	geositeNames  []string
 	inlineRules   []Rule
 	adguardRules  []Rule
 	adguardPaths  []string
 	adguardURLs   []string
+	runtimeFile   string
+	redis         []*redisSource
+	kube          []*kubeSource
+	adguardHome   []*adguardHomeSource
+	txt           []*txtSource
+	feeds         []*threatFeed
 	bootstrapDNS  string
+	downloadProxy *url.URL
+	verify        map[string]*sourceCheck
 	refreshCron   string
 	toHosts       []string
 	policy        string
 	maxfails      uint32
+	maxfailsSet   bool
+	failfast      bool
 	expire        time.Duration
+	maxIdleConns  int
+	keepalive     time.Duration
+	bufsize       uint16
+	maxConcurrent int64
+	hedge         time.Duration
+	negativeCache int
+	prefetch      *prefetchConfig
+	bloomSize     uint
+	bloomFP       float64
+	noBloom       bool
+	dga           *dgaScorer
+	categories    []string
+	clients       []clientRule
+	dnssecFlags   dnssecFlags
+	concurrent    int
+	consensus     int
+	trusted       string // upstream address of `consensus N trusted ADDR`
+	overLimit     int
+	rateLimit     *RateLimiter
+	dns0x20       bool
+	ddr           bool
+	cnameCheck    bool
+	stripECH      bool
+	filterTypes   map[uint16]struct{}
+	blockQtypes   map[uint16]struct{}
+	rewrites      []*qnameRewrite
+	uses          []string
+	split         []splitTarget
+	fallback      string
+	fallbackOn    map[int]struct{}
+	fallbackEmpty bool
+	expectedGeo   []string
+	expectedNets  []netip.Prefix
+	blockASNs     []uint64
+	answerMaps    []answerMap
+	sortAnswers   []netip.Prefix
+	netSets       []*netSet
+	minTTL        uint32
+	maxTTL        uint32
 	tlsConfig     *tls.Config
+	caPool        *x509.CertPool
+	tlsCA         []string
+	tlsMinVersion uint16
+	tlsCiphers    []uint16
+	tlsNoTickets  bool
+	tlsArgs       []string
 	tlsServerName string
+	upstreamOpts  map[string]upstreamOptions
+	bind          *sourceBinding
 	opts          proxy.Options
 }
 
+// newGroupBuild returns the settings of a group before its directives are parsed.
+func newGroupBuild() *groupBuild {
+	return &groupBuild{
+		Action:    "forward",
+		maxfails:  2,
+		expire:    defaultExpire,
+		overLimit: dns.RcodeRefused,
+		opts:      proxy.Options{HCRecursionDesired: true, HCDomain: "."},
+	}
+}
+
+// resolveRefs resolves the rulesets of `use`, the split targets and the fallback group of g by name, among groups
+// and rulesets.
+func (g *Group) resolveRefs(groups, rulesets []*Group) error {
+	for _, name := range g.uses {
+		i := slices.IndexFunc(rulesets, func(rs *Group) bool { return rs.Name == name })
+		if i < 0 {
+			return fmt.Errorf("group %s: unknown ruleset '%s'", g.Name, name)
+		}
+		g.Rulesets = append(g.Rulesets, rulesets[i])
+	}
+
+	for i, t := range g.Split {
+		j := slices.IndexFunc(groups, func(tg *Group) bool { return tg.Name == t.name })
+		if j < 0 {
+			return fmt.Errorf("group %s: unknown split target '%s'", g.Name, t.name)
+		}
+		tg := groups[j]
+		if tg == g || tg.Action != "forward" || len(tg.Split) > 0 {
+			return fmt.Errorf("group %s: split target '%s' must be another forward group without split", g.Name, t.name)
+		}
+		g.Split[i].group = tg
+	}
+
+	if g.fallbackName == "" {
+		return nil
+	}
+	j := slices.IndexFunc(groups, func(fg *Group) bool { return fg.Name == g.fallbackName })
+	if j < 0 {
+		return fmt.Errorf("group %s: unknown fallback group '%s'", g.Name, g.fallbackName)
+	}
+	fg := groups[j]
+	if fg == g || fg.Action != "forward" || fg.Fallback != nil || fg.fallbackName != "" {
+		return fmt.Errorf("group %s: fallback '%s' must be another forward group without fallback", g.Name, g.fallbackName)
+	}
+	// A fallback that splits passes the query on to its targets, which must not fall back in turn, or queries could
+	// go round between the groups.
+	for _, t := range fg.Split {
+		if k := slices.IndexFunc(groups, func(tg *Group) bool { return tg.Name == t.name }); k >= 0 && groups[k].fallbackName != "" {
+			return fmt.Errorf("group %s: fallback '%s' splits to '%s', which has a fallback of its own", g.Name, g.fallbackName, t.name)
+		}
+	}
+	g.Fallback = fg
+	return nil
+}
+
+// inherit returns a copy of gb's settings for a group declared with `extends`. Rule sources are not inherited, and
+// nothing mutable is shared: the new group gets its own maps, rate limiter and kernel address sets.
+func (gb *groupBuild) inherit() *groupBuild {
+	out := *gb
+	out.Name = ""
+	out.geositeNames = nil
+	out.inlineRules = nil
+	out.adguardRules = nil
+	out.adguardPaths = nil
+	out.adguardURLs = nil
+	out.runtimeFile = ""
+	out.redis = nil
+	out.kube = nil
+	out.adguardHome = nil
+	out.txt = nil
+	out.feeds = nil
+	out.verify = nil
+	out.uses = nil
+	out.toHosts = slices.Clip(gb.toHosts)
+	out.clients = slices.Clip(gb.clients)
+	out.rewrites = slices.Clip(gb.rewrites)
+	out.answerMaps = slices.Clip(gb.answerMaps)
+	out.sortAnswers = slices.Clip(gb.sortAnswers)
+	out.netSets = nil
+	for _, ns := range gb.netSets {
+		out.netSets = append(out.netSets, ns.clone())
+	}
+	out.split = slices.Clone(gb.split)
+	out.expectedGeo = slices.Clone(gb.expectedGeo)
+	out.expectedNets = slices.Clone(gb.expectedNets)
+	out.blockASNs = slices.Clone(gb.blockASNs)
+	out.filterTypes = maps.Clone(gb.filterTypes)
+	out.blockQtypes = maps.Clone(gb.blockQtypes)
+	out.fallbackOn = maps.Clone(gb.fallbackOn)
+	out.upstreamOpts = maps.Clone(gb.upstreamOpts)
+	if gb.rateLimit != nil {
+		out.rateLimit = NewRateLimiter(gb.rateLimit.Rate, gb.rateLimit.Burst, gb.rateLimit.Action)
+	}
+	return &out
+}
+
 func parseGroupDirective(c *caddy.Controller, gb *groupBuild) error {
 	switch c.Val() {
 	case "action":
@@ -175,14 +700,51 @@ func parseGroupDirective(c *caddy.Controller, gb *groupBuild) error {
 			return c.ArgErr()
 		}
 		gb.Action = strings.ToLower(c.Val())
-		if gb.Action != "forward" && gb.Action != "empty" {
-			return c.Errf("action must be 'forward' or 'empty'")
+		gb.zoneFile = ""
+		gb.scriptFile = ""
+		switch gb.Action {
+		case "forward", "empty":
+		case "zonefile":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			gb.zoneFile = c.Val()
+		case "script":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			gb.scriptFile = c.Val()
+		default:
+			return c.Errf("action must be 'forward', 'empty', 'zonefile' or 'script'")
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "mode":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch strings.ToLower(c.Val()) {
+		case "enforce":
+			gb.shadow = false
+		case "shadow":
+			gb.shadow = true
+		default:
+			return c.Errf("mode must be 'enforce' or 'shadow'")
 		}
 	case "geosite":
-		gb.geositeNames = c.RemainingArgs()
-		if len(gb.geositeNames) == 0 {
+		args := c.RemainingArgs()
+		if len(args) == 0 {
 			return c.ArgErr()
 		}
+		gb.geositeNames = nil
+		for _, arg := range args {
+			name, err := parseGeositeName(arg)
+			if err != nil {
+				return c.Err(err.Error())
+			}
+			gb.geositeNames = append(gb.geositeNames, name)
+		}
 	case "adguard_rules":
 		paths := c.RemainingArgs()
 		if len(paths) == 0 {
@@ -195,11 +757,79 @@ func parseGroupDirective(c *caddy.Controller, gb *groupBuild) error {
 				gb.adguardPaths = append(gb.adguardPaths, p)
 			}
 		}
+	case "redis_rules":
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+		src, err := parseRedisSource(args[0], args[1:])
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		gb.redis = append(gb.redis, src)
+	case "runtime_rules":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		gb.runtimeFile = c.Val()
+		if !filepath.IsAbs(gb.runtimeFile) && dnsserver.GetConfig(c).Root != "" {
+			gb.runtimeFile = filepath.Join(dnsserver.GetConfig(c).Root, gb.runtimeFile)
+		}
+	case "kubernetes_rules":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		src, err := parseKubeSource(args[0], args[1:])
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		gb.kube = append(gb.kube, src)
+	case "adguard_home":
+		src, err := parseAdguardHomeSource(c.RemainingArgs())
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		gb.adguardHome = append(gb.adguardHome, src)
+	case "txt_rules":
+		src, err := parseTXTSource(c.RemainingArgs())
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		gb.txt = append(gb.txt, src)
+	case "threat_feed":
+		f, err := parseThreatFeed(c.RemainingArgs())
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		gb.feeds = append(gb.feeds, f)
 	case "bootstrap_dns":
 		if !c.NextArg() {
 			return c.ArgErr()
 		}
 		gb.bootstrapDNS = c.Val()
+	case "download_proxy":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		u, err := url.Parse(c.Val())
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+			return c.Errf("download_proxy must be an http://, https:// or socks5:// URL: %s", c.Val())
+		}
+		gb.downloadProxy = u
+	case "verify":
+		args := c.RemainingArgs()
+		if len(args) < 3 {
+			return c.ArgErr()
+		}
+		sc, err := parseSourceCheck(args[0], args[1:])
+		if err != nil {
+			return c.Errf("verify %s: %v", args[0], err)
+		}
+		if gb.verify == nil {
+			gb.verify = make(map[string]*sourceCheck)
+		}
+		gb.verify[args[0]] = sc
 	case "refresh":
 		if !c.NextArg() {
 			return c.ArgErr()
@@ -208,8 +838,46 @@ func parseGroupDirective(c *caddy.Controller, gb *groupBuild) error {
 		if _, err := cronexpr.Parse(gb.refreshCron); err != nil {
 			return c.Errf("invalid refresh cron: %v", err)
 		}
+	case "split":
+		args := c.RemainingArgs()
+		for len(args) > 0 {
+			if args[0] == "/" {
+				args = args[1:]
+				continue
+			}
+			if len(args) < 2 {
+				return c.ArgErr()
+			}
+			w, err := strconv.Atoi(strings.TrimSuffix(args[0], "%"))
+			if err != nil || w <= 0 {
+				return c.Errf("split weight must be a positive integer: %s", args[0])
+			}
+			gb.split = append(gb.split, splitTarget{weight: w, name: args[1]})
+			args = args[2:]
+		}
+		if len(gb.split) < 2 {
+			return c.Errf("split needs at least two targets")
+		}
+	case "use":
+		names := c.RemainingArgs()
+		if len(names) == 0 {
+			return c.ArgErr()
+		}
+		gb.uses = append(gb.uses, names...)
 	case "to":
-		gb.toHosts = c.RemainingArgs()
+		gb.toHosts = nil
+		for c.NextArg() {
+			if c.Val() != "{" {
+				gb.toHosts = append(gb.toHosts, c.Val())
+				continue
+			}
+			if len(gb.toHosts) == 0 {
+				return c.Errf("upstream options block without an upstream")
+			}
+			if err := parseUpstreamOptions(c, gb, gb.toHosts[len(gb.toHosts)-1]); err != nil {
+				return err
+			}
+		}
 		if len(gb.toHosts) == 0 {
 			return c.ArgErr()
 		}
@@ -227,6 +895,12 @@ func parseGroupDirective(c *caddy.Controller, gb *groupBuild) error {
 			return err
 		}
 		gb.maxfails = uint32(n)
+		gb.maxfailsSet = true
+	case "failfast_all_unhealthy_upstreams":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		gb.failfast = true
 	case "tls":
 		args := c.RemainingArgs()
 		config := dnsserver.GetConfig(c)
@@ -240,11 +914,60 @@ func parseGroupDirective(c *caddy.Controller, gb *groupBuild) error {
 			return err
 		}
 		gb.tlsConfig = tlsConfig
+		gb.tlsArgs = args
 	case "tls_servername":
 		if !c.NextArg() {
 			return c.ArgErr()
 		}
 		gb.tlsServerName = c.Val()
+	case "tls_ca":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		config := dnsserver.GetConfig(c)
+		for i := range args {
+			if !filepath.IsAbs(args[i]) && config.Root != "" {
+				args[i] = filepath.Join(config.Root, args[i])
+			}
+		}
+		pool, err := loadCAPool(args)
+		if err != nil {
+			return c.Errf("tls_ca: %v", err)
+		}
+		gb.caPool = pool
+		gb.tlsCA = args
+	case "tls_min_version":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		v, err := parseTLSVersion(c.Val())
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		gb.tlsMinVersion = v
+	case "tls_ciphers":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		ids, err := parseCipherSuites(args)
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		gb.tlsCiphers = ids
+	case "tls_session_tickets":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch c.Val() {
+		case "on":
+			gb.tlsNoTickets = false
+		case "off":
+			gb.tlsNoTickets = true
+		default:
+			return c.Errf("tls_session_tickets must be on or off: %s", c.Val())
+		}
 	case "expire":
 		if !c.NextArg() {
 			return c.ArgErr()
@@ -254,7 +977,351 @@ func parseGroupDirective(c *caddy.Controller, gb *groupBuild) error {
 			return err
 		}
 		gb.expire = dur
-	case "force_tcp":
+	case "keepalive":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return c.Errf("keepalive must be positive: %s", c.Val())
+		}
+		gb.keepalive = dur
+	case "bufsize":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil || n < 512 || n > 4096 {
+			return c.Errf("bufsize must be between 512 and 4096: %s", c.Val())
+		}
+		gb.bufsize = uint16(n) // #nosec G115 -- checked above
+	case "hedge":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return c.Errf("hedge must be positive: %s", c.Val())
+		}
+		gb.hedge = dur
+	case "bloom":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		var n uint64
+		if len(args) == 2 {
+			var err error
+			if n, err = strconv.ParseUint(args[0], 10, 32); err != nil || n == 0 {
+				return c.Errf("bloom size must be a positive integer: %s", args[0])
+			}
+		}
+		fp, err := strconv.ParseFloat(args[len(args)-1], 64)
+		if err != nil || fp <= 0 || fp >= 1 {
+			return c.Errf("bloom false positive rate must be between 0 and 1: %s", args[len(args)-1])
+		}
+		gb.bloomSize, gb.bloomFP, gb.noBloom = uint(n), fp, false
+	case "dga":
+		d := &dgaScorer{threshold: defaultDGAThreshold}
+		if c.NextArg() {
+			t, err := strconv.ParseFloat(c.Val(), 64)
+			if err != nil || t <= 0 || t >= 1 {
+				return c.Errf("dga threshold must be between 0 and 1: %s", c.Val())
+			}
+			d.threshold = t
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		gb.dga = d
+	case "category":
+		names := c.RemainingArgs()
+		if len(names) == 0 {
+			return c.ArgErr()
+		}
+		gb.categories = nil
+		for _, name := range names {
+			gb.categories = append(gb.categories, strings.ToLower(name))
+		}
+	case "clients":
+		cr, err := parseClientRule(c.RemainingArgs())
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		gb.clients = append(gb.clients, cr)
+	case "client_tag":
+		cr, err := parseClientTagRule(c.RemainingArgs())
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		gb.clients = append(gb.clients, cr)
+	case "client_mac":
+		cr, err := parseClientMACRule(c.RemainingArgs())
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		gb.clients = append(gb.clients, cr)
+	case "client_id":
+		cr, err := parseClientIDRule(c.RemainingArgs())
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		gb.clients = append(gb.clients, cr)
+	case "client_geoip":
+		cr, err := parseClientGeoIPRule(c.RemainingArgs())
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		gb.clients = append(gb.clients, cr)
+	case "dnssec_flags":
+		f, err := parseDNSSECFlags(c.RemainingArgs())
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		gb.dnssecFlags = f
+	case "no_bloom":
+		gb.bloomSize, gb.bloomFP, gb.noBloom = 0, 0, true
+	case "negative_cache":
+		gb.negativeCache = defaultNegativeCacheSize
+		if c.NextArg() {
+			n, err := strconv.Atoi(c.Val())
+			if err != nil || n <= 0 {
+				return c.Errf("negative_cache size must be a positive integer: %s", c.Val())
+			}
+			gb.negativeCache = n
+		}
+	case "prefetch":
+		p := &prefetchConfig{hits: defaultPrefetchHits, percent: defaultPrefetchPercent}
+		if c.NextArg() {
+			n, err := strconv.ParseUint(c.Val(), 10, 32)
+			if err != nil || n == 0 {
+				return c.Errf("prefetch hits must be a positive integer: %s", c.Val())
+			}
+			p.hits = uint32(n)
+		}
+		if c.NextArg() {
+			pct, err := strconv.Atoi(strings.TrimSuffix(c.Val(), "%"))
+			if err != nil || !strings.HasSuffix(c.Val(), "%") || pct < 1 || pct > 99 {
+				return c.Errf("prefetch percentage must be between 1%% and 99%%: %s", c.Val())
+			}
+			p.percent = pct
+		}
+		gb.prefetch = p
+	case "concurrent", "consensus":
+		dir := c.Val()
+		args := c.RemainingArgs()
+		if len(args) != 1 && (dir != "consensus" || len(args) != 3 || args[1] != "trusted") {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 2 {
+			return c.Errf("%s must be a number of upstreams of at least 2: %s", dir, args[0])
+		}
+		if dir == "concurrent" {
+			gb.concurrent = n
+			break
+		}
+		gb.consensus = n
+		if len(args) == 3 {
+			hosts, err := parse.HostPortOrFile(args[2])
+			if err != nil || len(hosts) != 1 {
+				return c.Errf("invalid trusted upstream '%s'", args[2])
+			}
+			_, gb.trusted = parse.Transport(hosts[0])
+		}
+	case "max_concurrent":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		n, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return c.Errf("max_concurrent can't be negative: %d", n)
+		}
+		gb.maxConcurrent = n
+		if len(args) == 2 {
+			switch strings.ToLower(args[1]) {
+			case "refused":
+				gb.overLimit = dns.RcodeRefused
+			case "servfail":
+				gb.overLimit = dns.RcodeServerFailure
+			default:
+				return c.Errf("max_concurrent action must be 'refused' or 'servfail'")
+			}
+		}
+	case "ratelimit":
+		rl, err := parseRateLimit(c)
+		if err != nil {
+			return err
+		}
+		gb.rateLimit = rl
+	case "dns0x20":
+		gb.dns0x20 = true
+	case "ddr":
+		gb.ddr = true
+	case "expected_ips":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		codes, prefixes, err := parseExpectedIPs(args)
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		gb.expectedGeo = append(gb.expectedGeo, codes...)
+		gb.expectedNets = append(gb.expectedNets, prefixes...)
+	case "block_asn":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		asns, err := parseASNs(args)
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		gb.blockASNs = append(gb.blockASNs, asns...)
+	case "fallback":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		gb.fallback = c.Val()
+	case "fallback_on":
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+		if gb.fallbackOn == nil {
+			gb.fallbackOn = make(map[int]struct{})
+		}
+		for _, a := range args[:len(args)-1] {
+			if strings.EqualFold(a, "NODATA") {
+				gb.fallbackEmpty = true
+				continue
+			}
+			rc, ok := dns.StringToRcode[strings.ToUpper(a)]
+			if !ok || rc == dns.RcodeSuccess {
+				return c.Errf("fallback_on: invalid rcode '%s'", a)
+			}
+			gb.fallbackOn[rc] = struct{}{}
+		}
+		gb.fallback = args[len(args)-1]
+	case "cname_check":
+		gb.cnameCheck = true
+	case "strip_ech":
+		gb.stripECH = true
+	case "filter_response_types", "block_qtypes":
+		dir := c.Val()
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		types := &gb.filterTypes
+		if dir == "block_qtypes" {
+			types = &gb.blockQtypes
+		}
+		if *types == nil {
+			*types = make(map[uint16]struct{})
+		}
+		for _, a := range args {
+			qt, ok := dns.StringToType[strings.ToUpper(a)]
+			if !ok {
+				return c.Errf("unknown RR type '%s'", a)
+			}
+			(*types)[qt] = struct{}{}
+		}
+	case "rewrite":
+		rw, err := parseRewrite(c)
+		if err != nil {
+			return err
+		}
+		gb.rewrites = append(gb.rewrites, rw)
+	case "map_answer":
+		args := c.RemainingArgs()
+		if len(args) == 3 && args[1] == "->" {
+			args = []string{args[0], args[2]}
+		}
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		from, err := netip.ParsePrefix(args[0])
+		if err != nil {
+			return c.Errf("map_answer: %v", err)
+		}
+		to, err := netip.ParsePrefix(args[1])
+		if err != nil {
+			return c.Errf("map_answer: %v", err)
+		}
+		if from.Addr().Is4() != to.Addr().Is4() || from.Bits() != to.Bits() {
+			return c.Errf("map_answer: %s and %s must be the same address family and prefix length", from, to)
+		}
+		gb.answerMaps = append(gb.answerMaps, answerMap{from: from.Masked(), to: to.Masked()})
+	case "ipset", "nftset":
+		dir := c.Val()
+		if !netSetSupported {
+			return c.Errf("%s is only supported on Linux", dir)
+		}
+		ns, err := parseNetSet(dir == "nftset", c.RemainingArgs())
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		gb.netSets = append(gb.netSets, ns)
+	case "sort_answers":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		for _, a := range args {
+			p, err := parseAnswerPreference(a)
+			if err != nil {
+				return c.Errf("sort_answers: %v", err)
+			}
+			gb.sortAnswers = append(gb.sortAnswers, p)
+		}
+	case "min_ttl", "max_ttl":
+		dir := c.Val()
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.ParseUint(c.Val(), 10, 32)
+		if err != nil {
+			return c.Errf("%s must be a number of seconds: %s", dir, c.Val())
+		}
+		if dir == "min_ttl" {
+			gb.minTTL = uint32(n)
+		} else {
+			gb.maxTTL = uint32(n)
+		}
+	case "max_idle_conns":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return c.Errf("max_idle_conns can't be negative: %d", n)
+		}
+		gb.maxIdleConns = n
+	case "bind":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		b, err := parseSourceBinding(c.Val())
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		gb.bind = b
+	case "force_tcp":
 		gb.opts.ForceTCP = true
 	case "prefer_udp":
 		gb.opts.PreferUDP = true
@@ -267,6 +1334,29 @@ func parseGroupDirective(c *caddy.Controller, gb *groupBuild) error {
 		if strings.HasPrefix(directive, "include:") {
 			return c.Errf("include: is not supported in group rules")
 		}
+		if strings.HasPrefix(directive, "||") {
+			rules, err := ParseAdguardRules(directive)
+			if err != nil {
+				return err
+			}
+			gb.inlineRules = append(gb.inlineRules, rules...)
+			return nil
+		}
+		if strings.HasPrefix(strings.ToLower(directive), "ip:") {
+			val := strings.TrimSpace(directive[3:])
+			if val == "" && c.NextArg() {
+				val = c.Val()
+			}
+			if val == "" {
+				return c.ArgErr()
+			}
+			rules, err := parseIPRule(val)
+			if err != nil {
+				return c.Errf("invalid ip: rule '%s': %v", val, err)
+			}
+			gb.inlineRules = append(gb.inlineRules, rules...)
+			return nil
+		}
 		rule, err := parseInlineRule(directive, c)
 		if err != nil {
 			return err
@@ -278,51 +1368,191 @@ func parseGroupDirective(c *caddy.Controller, gb *groupBuild) error {
 	return nil
 }
 
-func buildGroup(gb *groupBuild) (*Group, error) {
-	if gb.Action == "empty" && len(gb.toHosts) > 0 {
-		return nil, fmt.Errorf("group %s: action empty cannot have 'to'", gb.Name)
+// buildGroup builds a group from its parsed config. prev is the running group with the same key, if any; its proxies
+// and downloaded rules are taken over where the config allows.
+func buildGroup(gb *groupBuild, prev *Group) (*Group, error) {
+	if gb.Action != "forward" && gb.Action != "script" && len(gb.toHosts) > 0 {
+		return nil, fmt.Errorf("group %s: action %s cannot have 'to'", gb.Name, gb.Action)
+	}
+	if len(gb.split) > 0 && (gb.Action != "forward" || len(gb.toHosts) > 0) {
+		return nil, fmt.Errorf("group %s: split requires action forward and no 'to'", gb.Name)
 	}
-	if gb.Action == "forward" && len(gb.toHosts) == 0 {
+	if gb.Action == "forward" && len(gb.toHosts) == 0 && len(gb.split) == 0 {
 		return nil, fmt.Errorf("group %s: action forward requires 'to'", gb.Name)
 	}
+	if gb.Action != "forward" && len(gb.answerMaps) > 0 {
+		return nil, fmt.Errorf("group %s: map_answer requires action forward", gb.Name)
+	}
+	if gb.Action != "forward" && len(gb.sortAnswers) > 0 {
+		return nil, fmt.Errorf("group %s: sort_answers requires action forward", gb.Name)
+	}
+	if gb.Action != "forward" && len(gb.rewrites) > 0 {
+		return nil, fmt.Errorf("group %s: rewrite requires action forward", gb.Name)
+	}
+	for u := range gb.verify {
+		if !slices.Contains(gb.adguardURLs, u) {
+			return nil, fmt.Errorf("group %s: verify %s is not an adguard_rules URL of the group", gb.Name, u)
+		}
+	}
+	if (len(gb.expectedGeo) > 0 || len(gb.expectedNets) > 0) && gb.fallback == "" {
+		return nil, fmt.Errorf("group %s: expected_ips requires fallback", gb.Name)
+	}
+	if gb.fallback != "" && (gb.Action != "forward" || len(gb.split) > 0) {
+		return nil, fmt.Errorf("group %s: fallback requires action forward and no split", gb.Name)
+	}
+	if (gb.hedge > 0 || gb.concurrent > 0 || gb.consensus > 0) && (gb.Action != "forward" || len(gb.split) > 0) {
+		return nil, fmt.Errorf("group %s: hedge, concurrent and consensus require action forward and no split", gb.Name)
+	}
+	modes := 0
+	for _, set := range []bool{gb.hedge > 0, gb.concurrent > 0, gb.consensus > 0} {
+		if set {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return nil, fmt.Errorf("group %s: hedge, concurrent and consensus are mutually exclusive", gb.Name)
+	}
+	if gb.negativeCache > 0 && len(gb.split) > 0 {
+		return nil, fmt.Errorf("group %s: negative_cache requires no split", gb.Name)
+	}
+	if gb.negativeCache > 0 && (gb.Action == "zonefile" || gb.Action == "script") {
+		return nil, fmt.Errorf("group %s: negative_cache cannot be used with action %s", gb.Name, gb.Action)
+	}
+	if gb.prefetch != nil && gb.negativeCache == 0 {
+		return nil, fmt.Errorf("group %s: prefetch requires negative_cache", gb.Name)
+	}
+	if len(gb.blockASNs) > 0 && (gb.Action != "forward" || len(gb.split) > 0) {
+		return nil, fmt.Errorf("group %s: block_asn requires action forward and no split", gb.Name)
+	}
+	if len(gb.netSets) > 0 && (gb.Action != "forward" || len(gb.split) > 0) {
+		return nil, fmt.Errorf("group %s: ipset and nftset require action forward and no split", gb.Name)
+	}
+	if gb.ddr && len(gb.toHosts) == 0 {
+		return nil, fmt.Errorf("group %s: ddr requires 'to'", gb.Name)
+	}
+	if gb.bind != nil {
+		// The proxies' health checks cannot be sent from the bound address, so they would judge the wrong path.
+		if gb.maxfailsSet && gb.maxfails != 0 {
+			return nil, fmt.Errorf("group %s: bind requires max_fails 0, as health checks are not sent from the bound address", gb.Name)
+		}
+		gb.maxfails = 0
+	}
+	if gb.keepalive > 0 && (gb.Action != "forward" || len(gb.split) > 0 || gb.bind != nil) {
+		return nil, fmt.Errorf("group %s: keepalive requires action forward, no split and no bind", gb.Name)
+	}
+	if gb.keepalive > 0 && gb.keepalive >= gb.expire {
+		return nil, fmt.Errorf("group %s: keepalive %s must be shorter than expire %s", gb.Name, gb.keepalive, gb.expire)
+	}
+	if gb.minTTL > 0 && gb.maxTTL > 0 && gb.minTTL > gb.maxTTL {
+		return nil, fmt.Errorf("group %s: min_ttl %d is greater than max_ttl %d", gb.Name, gb.minTTL, gb.maxTTL)
+	}
+
+	var zone *zoneFile
+	if gb.Action == "zonefile" {
+		var err error
+		if zone, err = loadZoneFile(gb.zoneFile); err != nil {
+			return nil, fmt.Errorf("group %s: %w", gb.Name, err)
+		}
+	}
+	var script *luaScript
+	if gb.Action == "script" {
+		var err error
+		if script, err = loadScript(gb.scriptFile); err != nil {
+			return nil, fmt.Errorf("group %s: %w", gb.Name, err)
+		}
+	}
 
 	g := &Group{
-		Name:     gb.Name,
-		Action:   gb.Action,
-		Maxfails: gb.maxfails,
-		Opts:     gb.opts,
+		Name:      gb.Name,
+		Action:    gb.Action,
+		Zone:      zone,
+		Script:    script,
+		Shadow:    gb.shadow,
+		Split:     gb.split,
+		uses:      gb.uses,
+		Maxfails:  gb.maxfails,
+		Failfast:  gb.failfast,
+		Opts:      gb.opts,
+		bind:      gb.bind,
+		Keepalive: gb.keepalive,
+
+		RateLimit:      gb.rateLimit,
+		DNS0x20:        gb.dns0x20,
+		CNAMECheck:     gb.cnameCheck,
+		StripECH:       gb.stripECH,
+		FilterTypes:    gb.filterTypes,
+		BlockQtypes:    gb.blockQtypes,
+		Rewrites:       gb.rewrites,
+		AnswerMaps:     gb.answerMaps,
+		SortAnswers:    gb.sortAnswers,
+		NetSets:        gb.netSets,
+		BufSize:        gb.bufsize,
+		MinTTL:         gb.minTTL,
+		MaxTTL:         gb.maxTTL,
+		MaxConcurrent:  gb.maxConcurrent,
+		Hedge:          gb.hedge,
+		Concurrent:     gb.concurrent,
+		Consensus:      gb.consensus,
+		ConsensusTrust: gb.trusted,
+		OverLimitRcode: gb.overLimit,
+		NegativeCache:  gb.negativeCache,
+		Prefetch:       gb.prefetch,
+		BloomSize:      gb.bloomSize,
+		BloomFP:        gb.bloomFP,
+		NoBloom:        gb.noBloom,
+		DGA:            gb.dga,
+		Categories:     gb.categories,
+		Clients:        gb.clients,
+		DNSSECFlags:    gb.dnssecFlags,
 	}
 
-	if gb.Action == "forward" {
-		toHosts, err := parse.HostPortOrFile(gb.toHosts...)
+	if gb.Action == "forward" && len(gb.split) == 0 || gb.Action == "script" && len(gb.toHosts) > 0 {
+		g.upstream = &upstreamConfig{
+			toHosts:       gb.toHosts,
+			tlsConfig:     gb.upstreamTLSConfig(),
+			tlsArgs:       gb.tlsArgs,
+			tlsCA:         gb.tlsCA,
+			tlsMinVersion: gb.tlsMinVersion,
+			tlsCiphers:    gb.tlsCiphers,
+			tlsNoTickets:  gb.tlsNoTickets,
+			tlsServerName: gb.tlsServerName,
+			perUpstream:   gb.upstreamOpts,
+			bootstrapDNS:  gb.bootstrapDNS,
+			expire:        gb.expire,
+			maxIdleConns:  gb.maxIdleConns,
+			opts:          gb.opts,
+			hostnames:     hasHostnames(gb.toHosts),
+			ddr:           gb.ddr,
+		}
+		if gb.bind != nil {
+			g.boundConns = newBoundConns(gb.expire, gb.maxIdleConns)
+		}
+		if g.upstream.hostnames && gb.bootstrapDNS == "" {
+			return nil, fmt.Errorf("group %s: upstream host names require bootstrap_dns", gb.Name)
+		}
+		reuse := reusableProxies(prev, g.upstream)
+		proxies, byKey, err := newProxies(gb.Name, g.upstream, reuse)
 		if err != nil {
 			return nil, err
 		}
-		if len(toHosts) > maxProxies {
-			return nil, fmt.Errorf("group %s: more than %d upstreams: %d", gb.Name, maxProxies, len(toHosts))
-		}
-		allowedTrans := map[string]bool{"dns": true, "tls": true}
-		for _, hostWithZone := range toHosts {
-			trans, h := parse.Transport(hostWithZone)
-			if !allowedTrans[trans] {
-				return nil, fmt.Errorf("group %s: unsupported protocol %s", gb.Name, trans)
-			}
-			p := proxy.NewProxy("ruledforward", h, trans)
-			if trans == transport.TLS {
-				tcfg := gb.tlsConfig
-				if tcfg == nil {
-					tcfg = &tls.Config{}
+		for key, p := range byKey {
+			if reuse[key] == p {
+				if g.inherited == nil {
+					g.inherited = make(map[*proxy.Proxy]struct{})
 				}
-				if gb.tlsServerName != "" {
-					tcfg = tcfg.Clone()
-					tcfg.ServerName = gb.tlsServerName
-				}
-				p.SetTLSConfig(tcfg)
+				g.inherited[p] = struct{}{}
 			}
-			p.SetExpire(gb.expire)
-			p.GetHealthchecker().SetRecursionDesired(gb.opts.HCRecursionDesired)
-			p.GetHealthchecker().SetDomain(gb.opts.HCDomain)
-			g.Proxies = append(g.Proxies, p)
+		}
+		g.SetProxies(proxies)
+		g.upstreamByKey = byKey
+		g.UpstreamFiles = upstreamFiles(gb.toHosts)
+		if g.ConsensusTrust != "" && !g.upstream.hostnames && !g.upstream.ddr && len(g.UpstreamFiles) == 0 &&
+			!slices.ContainsFunc(proxies, func(p *proxy.Proxy) bool { return p.Addr() == g.ConsensusTrust }) {
+			return nil, fmt.Errorf("group %s: trusted upstream %s is not one of its upstreams", gb.Name, g.ConsensusTrust)
+		}
+		g.upstreamStamps = statUpstreamFiles(g.UpstreamFiles)
+		if g.upstream.resolves() {
+			g.resolvedAt = time.Now()
 		}
 		switch gb.policy {
 		case "random":
@@ -331,6 +1561,11 @@ func buildGroup(gb *groupBuild) (*Group, error) {
 			g.Policy = &roundRobin{}
 		case "sequential", "":
 			g.Policy = &sequential{}
+		case "prefer_primary":
+			if gb.maxfails == 0 {
+				return nil, fmt.Errorf("group %s: policy prefer_primary needs health checks, which max_fails 0 turns off", gb.Name)
+			}
+			g.Policy = &preferPrimary{group: gb.Name, maxfails: gb.maxfails}
 		default:
 			return nil, fmt.Errorf("unknown policy '%s'", gb.policy)
 		}
@@ -340,12 +1575,134 @@ func buildGroup(gb *groupBuild) (*Group, error) {
 	g.InlineRules = gb.inlineRules
 	g.AdguardPaths = gb.adguardPaths
 	g.AdguardURLs = gb.adguardURLs
+	g.Redis = gb.redis
+	g.Kube = gb.kube
+	g.AdguardHome = gb.adguardHome
+	g.TXT = gb.txt
+	g.Feeds = gb.feeds
 	g.BootstrapDNS = gb.bootstrapDNS
+	g.DownloadProxy = gb.downloadProxy
+	g.fallbackName = gb.fallback
+	g.FallbackOn = gb.fallbackOn
+	g.FallbackEmpty = gb.fallbackEmpty
+	g.expectedGeo = gb.expectedGeo
+	g.expectedNets = gb.expectedNets
+	g.blockASNs = gb.blockASNs
+	g.Verify = gb.verify
 	g.RefreshCron = gb.refreshCron
+	g.inheritRemoteRules(prev)
+	g.inheritFeeds(prev)
+	if err := g.initRuntimeRules(gb.runtimeFile, prev); err != nil {
+		return nil, fmt.Errorf("group %s: runtime_rules: %w", gb.Name, err)
+	}
 
 	return g, nil
 }
 
+// rulesetDirectives are the group directives that add rule sources, the only ones allowed in a ruleset.
+var rulesetDirectives = map[string]bool{
+	"geosite": true, "adguard_rules": true, "bootstrap_dns": true, "download_proxy": true, "refresh": true,
+	"verify": true, "redis_rules": true, "kubernetes_rules": true, "adguard_home": true, "threat_feed": true,
+	"txt_rules": true, "runtime_rules": true, "bloom": true, "no_bloom": true, "dga": true,
+}
+
+// directiveName matches tokens that look like a directive rather than an inline rule (which have a `:`, `.` or `|`).
+var directiveName = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// parseRulesetDirective parses one line of a `ruleset` block: rule sources and inline rules as in a group.
+func parseRulesetDirective(c *caddy.Controller, gb *groupBuild) error {
+	if d := c.Val(); directiveName.MatchString(d) && !rulesetDirectives[d] {
+		return c.Errf("'%s' is not allowed in ruleset %s, only rule sources are", d, gb.Name)
+	}
+	return parseGroupDirective(c, gb)
+}
+
+// parseUpstreamOptions parses a `{ ... }` block following an upstream in `to`, with settings for that upstream only.
+func parseUpstreamOptions(c *caddy.Controller, gb *groupBuild, host string) error {
+	var opts upstreamOptions
+	for c.Next() && c.Val() != "}" {
+		switch c.Val() {
+		case "tls_servername":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			opts.tlsServerName = c.Val()
+		default:
+			return c.Errf("unknown upstream option '%s'", c.Val())
+		}
+	}
+	if gb.upstreamOpts == nil {
+		gb.upstreamOpts = make(map[string]upstreamOptions)
+	}
+	if _, normalized, ok := upstreamHostname(host); ok {
+		gb.upstreamOpts[normalized] = opts
+		return nil
+	}
+	hosts, err := parse.HostPortOrFile(host)
+	if err != nil {
+		return err
+	}
+	for _, h := range hosts {
+		trans, addr := parse.Transport(h)
+		gb.upstreamOpts[trans+"://"+addr] = opts
+	}
+	return nil
+}
+
+// parseRateLimit parses `ratelimit RATE [BURST] [drop|refuse]`. BURST defaults to RATE (at least 1).
+func parseRateLimit(c *caddy.Controller) (*RateLimiter, error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 3 {
+		return nil, c.ArgErr()
+	}
+	rate, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || rate <= 0 {
+		return nil, c.Errf("ratelimit rate must be a positive number: %s", args[0])
+	}
+	burst := max(rate, 1)
+	action := "refuse"
+	for _, a := range args[1:] {
+		switch strings.ToLower(a) {
+		case "drop", "refuse":
+			action = strings.ToLower(a)
+		default:
+			n, err := strconv.ParseFloat(a, 64)
+			if err != nil || n < 1 {
+				return nil, c.Errf("ratelimit burst must be a number >= 1, or action 'drop' or 'refuse': %s", a)
+			}
+			burst = n
+		}
+	}
+	return NewRateLimiter(rate, burst, action), nil
+}
+
+// parseRewrite parses `rewrite suffix FROM TO` or `rewrite regex PATTERN REPLACEMENT`.
+func parseRewrite(c *caddy.Controller) (*qnameRewrite, error) {
+	args := c.RemainingArgs()
+	if len(args) != 3 {
+		return nil, c.ArgErr()
+	}
+	switch strings.ToLower(args[0]) {
+	case "suffix":
+		from := strings.ToLower(dns.Fqdn(strings.TrimPrefix(args[1], ".")))
+		to := strings.ToLower(dns.Fqdn(strings.TrimPrefix(args[2], ".")))
+		for _, n := range []string{from, to} {
+			if _, ok := dns.IsDomainName(n); !ok {
+				return nil, c.Errf("rewrite suffix: invalid domain '%s'", n)
+			}
+		}
+		return &qnameRewrite{from: from, to: to}, nil
+	case "regex":
+		re, err := regexp.Compile(args[1])
+		if err != nil {
+			return nil, c.Errf("rewrite regex: %v", err)
+		}
+		return &qnameRewrite{re: re, replacement: args[2]}, nil
+	default:
+		return nil, c.Errf("rewrite type must be 'suffix' or 'regex'")
+	}
+}
+
 func parseInlineRule(directive string, c *caddy.Controller) (*Rule, error) {
 	lower := strings.ToLower(directive)
 	if strings.HasPrefix(lower, "domain:") {
@@ -394,47 +1751,145 @@ func parseInlineRule(directive string, c *caddy.Controller) (*Rule, error) {
 	return nil, nil
 }
 
-// OnStartup starts proxies and refresh goroutines.
+// OnStartup starts proxies and refresh goroutines. Proxies inherited from the previous instance are already running.
 func (r *Ruledforward) OnStartup() error {
-	for _, g := range r.groups {
-		for _, p := range g.Proxies {
-			p.Start(hcInterval)
-		}
-		if g.RefreshCron != "" && len(g.AdguardURLs) > 0 {
-			go r.runRefresh(g)
-		}
+	r.registerLive()
+	r.registerInstance()
+	applyLogFormat()
+	for _, g := range r.allGroups() {
+		r.startGroup(g)
+	}
+	if len(r.warm) > 0 {
+		go r.warmCache()
+	}
+	if r.clientTags != nil {
+		r.clientTags.stop = make(chan struct{})
+		go r.clientTags.watch(upstreamFileInterval, r.clientTags.stop)
 	}
 	return nil
 }
 
-// OnShutdown stops proxies and refresh goroutines.
+// OnShutdown stops proxies and refresh goroutines, leaving alone proxies handed over to a reloaded instance.
 func (r *Ruledforward) OnShutdown() error {
-	for _, g := range r.groups {
-		for _, p := range g.Proxies {
-			p.Stop()
+	for _, g := range r.allGroups() {
+		g.stop()
+	}
+	if r.clientTags != nil && r.clientTags.stop != nil {
+		close(r.clientTags.stop)
+	}
+	r.unregisterLive()
+	r.unregisterInstance()
+	applyLogFormat()
+	return nil
+}
+
+// startGroup starts the proxies of g, except those inherited from the previous instance, the first full load of its
+// rules if parsing left it to be done, and the goroutines that keep its upstreams and rules current.
+func (r *Ruledforward) startGroup(g *Group) {
+	for _, p := range g.Proxies() {
+		if _, ok := g.inherited[p]; ok {
+			continue
 		}
-		if g.StopRefresh != nil {
-			close(g.StopRefresh)
+		p.Start(hcInterval)
+	}
+	if g.initialLoad {
+		g.initialLoad = false
+		timer := time.AfterFunc(readyTimeout, func() {
+			if !g.initialized.Swap(true) {
+				log.Warningf("group %s: initial rule load still running after %s, reporting ready", g.Name, readyTimeout)
+			}
+		})
+		go func() {
+			// The first full load counts as done even on failure; the error is logged and a later refresh may fix it.
+			defer g.initialized.Store(true)
+			defer timer.Stop()
+			if err := g.Update(r.dlc, UpdateMatcherAll); err != nil {
+				log.Errorf("updating group %s: %v", g.Name, err)
+			}
+		}()
+	}
+	if len(g.UpstreamFiles) > 0 || g.upstream.resolves() {
+		g.StopWatch, g.watchDone = make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(g.watchDone)
+			g.watchUpstreams(upstreamFileInterval, g.StopWatch)
+		}()
+	}
+	if g.Keepalive > 0 {
+		g.StopKeepalive = make(chan struct{})
+		go g.keepalive(g.Keepalive, g.StopKeepalive)
+	}
+	if g.RefreshCron != "" && (len(g.AdguardURLs) > 0 || len(g.Feeds) > 0) {
+		g.StopRefresh = make(chan struct{})
+		go r.runRefresh(g, g.StopRefresh)
+	}
+	if len(g.Redis) > 0 || len(g.Kube) > 0 || len(g.AdguardHome) > 0 || len(g.TXT) > 0 || len(g.Feeds) > 0 {
+		g.StopSources = make(chan struct{})
+		for _, src := range g.Redis {
+			go g.watchRuleSource(src, r.dlc, UpdateMatcherRedis, ruleSourceDebounce, g.StopSources)
+		}
+		for _, src := range g.Kube {
+			go g.watchRuleSource(src, r.dlc, UpdateMatcherKube, ruleSourceDebounce, g.StopSources)
+		}
+		for _, src := range g.AdguardHome {
+			go g.watchRuleSource(src, r.dlc, UpdateMatcherAdguardHome, ruleSourceDebounce, g.StopSources)
+		}
+		for _, src := range g.TXT {
+			go g.watchRuleSource(src, r.dlc, UpdateMatcherTXT, ruleSourceDebounce, g.StopSources)
+		}
+		for _, f := range g.Feeds {
+			if f.interval > 0 {
+				go g.refreshFeed(f, r.dlc, g.StopSources)
+			}
 		}
 	}
-	return nil
 }
 
-func (r *Ruledforward) runRefresh(g *Group) {
+// stop stops what startGroup started, leaving alone proxies handed over to a reloaded instance. The upstream watch
+// is stopped first and waited for, so that it does not swap in and start proxies after they were stopped.
+func (g *Group) stop() {
+	if g.StopWatch != nil {
+		close(g.StopWatch)
+		<-g.watchDone
+	}
+	for _, p := range g.Proxies() {
+		if g.handedOver(p) {
+			continue
+		}
+		p.Stop()
+	}
+	if g.StopKeepalive != nil {
+		close(g.StopKeepalive)
+	}
+	if g.StopRefresh != nil {
+		close(g.StopRefresh)
+	}
+	if g.StopSources != nil {
+		close(g.StopSources)
+	}
+	for _, s := range g.NetSets {
+		s.close()
+	}
+	if g.boundConns != nil {
+		g.boundConns.close()
+	}
+}
+
+// runRefresh refreshes the remote rules of g on its refresh schedule until stop is closed.
+func (r *Ruledforward) runRefresh(g *Group, stop <-chan struct{}) {
 	expr, err := cronexpr.Parse(g.RefreshCron)
 	if err != nil {
 		return
 	}
-	g.StopRefresh = make(chan struct{})
 	for {
 		next := expr.Next(time.Now())
 		timer := time.NewTimer(time.Until(next))
 		select {
-		case <-g.StopRefresh:
+		case <-stop:
 			timer.Stop()
 			return
 		case <-timer.C:
-			if err := g.Update(dlcMap, UpdateMatcherAll); err != nil {
+			if err := g.refresh(r.dlc, UpdateMatcherAll, "refresh"); err != nil {
 				log.Errorf("refresh failed for group '%s': %v", g.Name, err)
 			}
 		}
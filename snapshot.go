@@ -0,0 +1,451 @@
+package ruledforward
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bits-and-blooms/bloom/v3"
+)
+
+// snapshotMagic starts every snapshot file. Bump its version whenever the format or the way a matcher is built
+// changes, so that snapshots of an older build are rebuilt instead of misread.
+const snapshotMagic = "RFSNAP5\n"
+
+// maxSnapshotString bounds the length of a string in a snapshot, to fail cleanly on a damaged file.
+const maxSnapshotString = 1 << 16
+
+var errBadSnapshot = errors.New("damaged snapshot")
+
+// snapshotFile is where a group keeps the snapshot of its matcher, see `snapshot_dir`.
+type snapshotFile struct {
+	path      string
+	dlcDigest []byte // sha256 of the dlcfile; nil without one
+}
+
+// snapshotPath returns the snapshot file of the group with the given key in dir.
+func snapshotPath(dir, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	_, name, _ := strings.Cut(key, "/")
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+	return filepath.Join(dir, fmt.Sprintf("%s-%x.snap", name, sum[:6]))
+}
+
+// fileDigest returns the sha256 of the file at path. For a directory, it hashes the names and contents of the files
+// in it, as LoadDLCDir reads them.
+func fileDigest(path string) ([]byte, error) {
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		return dirDigest(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// dirDigest returns the sha256 of the names and contents of the regular files in dir.
+func dirDigest(dir string) ([]byte, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		d, err := fileDigest(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(h, "%s %x\n", f.Name(), d)
+	}
+	return h.Sum(nil), nil
+}
+
+// sourceDigest hashes the rule sources of g: the contents of its local files and the names of its geosite lists and
+// remote sources, along with its bloom filter settings. A snapshot is only used while the digest it was saved with is unchanged. Remote sources are hashed
+// by name only; their rules in the snapshot are those last loaded, and a refresh updates them.
+func (g *Group) sourceDigest() ([]byte, error) {
+	h := sha256.New()
+	io.WriteString(h, snapshotMagic)
+	fmt.Fprintf(h, "bloom %d %g %t\n", g.BloomSize, g.BloomFP, g.NoBloom)
+	if len(g.GeositeNames) > 0 {
+		h.Write(g.snapshot.dlcDigest)
+	}
+	for _, name := range g.GeositeNames {
+		if file, _, ok := extGeosite(name); ok {
+			d, err := fileDigest(file)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(h, "geosite %s %x\n", name, d)
+			continue
+		}
+		fmt.Fprintf(h, "geosite %s\n", name)
+	}
+	for _, r := range g.InlineRules {
+		fmt.Fprintf(h, "inline %s\n", r)
+	}
+	for _, path := range g.AdguardPaths {
+		d, err := fileDigest(path)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(h, "adguard_rules %s %x\n", path, d)
+	}
+	for _, u := range g.AdguardURLs {
+		fmt.Fprintf(h, "adguard_rules %s\n", u)
+	}
+	for _, src := range g.Redis {
+		fmt.Fprintf(h, "%s\n", src)
+	}
+	for _, src := range g.Kube {
+		fmt.Fprintf(h, "%s\n", src)
+	}
+	for _, src := range g.AdguardHome {
+		fmt.Fprintf(h, "%s\n", src)
+	}
+	for _, src := range g.TXT {
+		fmt.Fprintf(h, "%s\n", src)
+	}
+	for _, f := range g.Feeds {
+		fmt.Fprintf(h, "%s\n", f)
+	}
+	return h.Sum(nil), nil
+}
+
+// saveSnapshot writes the matcher just built from n rules to the group's snapshot file, together with the rules last
+// loaded from remote sources, replacing the file atomically. Matchers without a snapshot encoding are skipped.
+func (g *Group) saveSnapshot(m Matcher, n int64) error {
+	var mm *matcher
+	var bf *BloomFilter
+	switch m := m.(type) {
+	case *matcher:
+		mm = m
+	case *bloomedMatcher:
+		mm, bf = &m.m, m.bf
+	default:
+		return nil
+	}
+	digest, err := g.sourceDigest()
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	w := &snapshotWriter{w: bufio.NewWriter(&body)}
+	w.w.Write(digest)
+	w.uvarint(uint64(n))
+	w.matcher(mm)
+	if bf == nil {
+		w.uvarint(0)
+	} else {
+		w.uvarint(1)
+		if _, err := bf.bf.WriteTo(w.w); err != nil {
+			return err
+		}
+	}
+	for _, cached := range g.cachedRemoteRules() {
+		w.rules(cached.Load())
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body.Bytes())
+
+	tmp, err := os.CreateTemp(filepath.Dir(g.snapshot.path), filepath.Base(g.snapshot.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	for _, b := range [][]byte{[]byte(snapshotMagic), body.Bytes(), sum[:]} {
+		if _, err := tmp.Write(b); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), g.snapshot.path)
+}
+
+// loadSnapshot installs the matcher of the group's snapshot file and the remote rules saved with it. It reports
+// false, without changing g, if there is no snapshot or it was saved for other sources.
+func (g *Group) loadSnapshot() (bool, error) {
+	start := time.Now()
+	data, err := os.ReadFile(g.snapshot.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	body, ok := bytes.CutPrefix(data, []byte(snapshotMagic))
+	if !ok {
+		return false, nil // written by another version
+	}
+	if len(body) < 2*sha256.Size {
+		return false, errBadSnapshot
+	}
+	body, sum := body[:len(body)-sha256.Size], body[len(body)-sha256.Size:]
+	if s := sha256.Sum256(body); !bytes.Equal(s[:], sum) {
+		return false, errBadSnapshot
+	}
+	digest, err := g.sourceDigest()
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(body[:sha256.Size], digest) {
+		return false, nil
+	}
+
+	r := &snapshotReader{r: bytes.NewReader(body[sha256.Size:])}
+	n := r.uvarint()
+	mm := &matcher{}
+	r.matcher(mm)
+	var m Matcher = mm
+	if r.uvarint() == 1 {
+		bm := g.bloomedMatcher(&bloomedMatcher{
+			m:  *mm,
+			bf: &BloomFilter{bf: &bloom.BloomFilter{}},
+			n:  g.BloomSize,
+			fp: cmp.Or(g.BloomFP, bloomFP),
+		})
+		if r.err == nil {
+			_, r.err = bm.bf.bf.ReadFrom(r.r)
+		}
+		m = bm
+	}
+	remote := make([]*[]Rule, len(g.cachedRemoteRules()))
+	for i := range remote {
+		remote[i] = r.rules()
+	}
+	if r.err != nil {
+		return false, fmt.Errorf("%w: %v", errBadSnapshot, r.err)
+	}
+
+	for i, cached := range g.cachedRemoteRules() {
+		if remote[i] != nil {
+			cached.Store(remote[i])
+		}
+	}
+	for _, f := range g.Feeds {
+		if rules := f.rules.Load(); f.rpz != nil && rules != nil {
+			f.restoreZone(*rules)
+		}
+	}
+	g.SetMatcher(m)
+	g.ruleCount.Store(int64(n))
+	g.prunedCount.Store(int64(mm.pruned))
+	log.Infof("group %s: loaded %d rules from snapshot %s in %v", g.Name, n, g.snapshot.path, time.Since(start).Round(time.Millisecond))
+	return true, nil
+}
+
+// cachedRemoteRules returns the rules kept from the group's remote sources, in the order of the snapshot format:
+// adguard_rules URLs, Redis, Kubernetes, AdGuard Home, TXT records, then each threat feed.
+func (g *Group) cachedRemoteRules() []*atomic.Pointer[[]Rule] {
+	cached := []*atomic.Pointer[[]Rule]{&g.remoteRules, &g.redisRules, &g.kubeRules, &g.adguardHomeRules, &g.txtRules}
+	for _, f := range g.Feeds {
+		cached = append(cached, &f.rules)
+	}
+	return cached
+}
+
+// snapshotWriter encodes a matcher: the number of rules it was built from, its exact names, the domain trie, which
+// also holds the domain rules, keywords and regular expressions, all as uvarint-prefixed strings and counts.
+type snapshotWriter struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+func (w *snapshotWriter) uvarint(v uint64) {
+	w.buf = binary.AppendUvarint(w.buf[:0], v)
+	w.w.Write(w.buf)
+}
+
+func (w *snapshotWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.w.WriteString(s)
+}
+
+func (w *snapshotWriter) matcher(m *matcher) {
+	w.uvarint(uint64(m.pruned))
+	w.uvarint(uint64(len(m.full)))
+	for name := range m.full {
+		w.string(name)
+	}
+	w.trie(m.domainTrie)
+	w.uvarint(uint64(len(m.keyword)))
+	for _, k := range m.keyword {
+		w.string(k)
+	}
+	w.uvarint(uint64(len(m.regex)))
+	for _, re := range m.regex {
+		w.string(re.String())
+	}
+}
+
+// trie writes the nodes in preorder: whether the node ends a rule, its number of children, and each child's label
+// followed by the child.
+func (w *snapshotWriter) trie(n *domainTrieNode) {
+	if n == nil {
+		n = &domainTrieNode{}
+	}
+	if n.match {
+		w.uvarint(1)
+	} else {
+		w.uvarint(0)
+	}
+	w.uvarint(uint64(len(n.children)))
+	for label, c := range n.children {
+		w.string(label)
+		w.trie(c)
+	}
+}
+
+// rules writes whether a rule list was loaded and, if so, the list.
+func (w *snapshotWriter) rules(rules *[]Rule) {
+	if rules == nil {
+		w.uvarint(0)
+		return
+	}
+	w.uvarint(1)
+	w.uvarint(uint64(len(*rules)))
+	for _, r := range *rules {
+		w.uvarint(uint64(r.Type))
+		w.string(r.Value)
+	}
+}
+
+// snapshotReader decodes what snapshotWriter encoded. The first error sticks; later reads return zero values.
+type snapshotReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (r *snapshotReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(r.r)
+	r.err = err
+	return v
+}
+
+// count reads a count of items, each taking at least one byte.
+func (r *snapshotReader) count() int {
+	n := r.uvarint()
+	if n > uint64(r.r.Len()) {
+		r.err = errBadSnapshot
+		return 0
+	}
+	return int(n)
+}
+
+func (r *snapshotReader) string() string {
+	n := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if n > maxSnapshotString || n > uint64(r.r.Len()) {
+		r.err = errBadSnapshot
+		return ""
+	}
+	b := make([]byte, n)
+	_, r.err = io.ReadFull(r.r, b)
+	return string(b)
+}
+
+func (r *snapshotReader) matcher(m *matcher) {
+	m.pruned = int(r.uvarint())
+	n := r.count()
+	m.full = make(map[string]struct{}, n)
+	for range n {
+		m.full[r.string()] = struct{}{}
+	}
+	if m.domainTrie = r.trie("", 0, &m.domain); m.domainTrie != nil && len(m.domainTrie.children) == 0 {
+		m.domainTrie = nil // as Build leaves it without domain rules
+	}
+	// Match and keysForBloom expect the order Build leaves the domains in.
+	slices.SortFunc(m.domain, func(a, b string) int { return len(b) - len(a) })
+	n = r.count()
+	for range n {
+		m.keyword = append(m.keyword, r.string())
+	}
+	n = r.count()
+	for range n {
+		expr := r.string()
+		if r.err != nil {
+			return
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			r.err = err
+			return
+		}
+		m.regex = append(m.regex, re)
+	}
+}
+
+// trie reads a node of the domain trie whose domain is name, appending the domains of rule-ending nodes to domains.
+func (r *snapshotReader) trie(name string, depth int, domains *[]string) *domainTrieNode {
+	if depth > 128 {
+		r.err = errBadSnapshot
+		return nil
+	}
+	n := &domainTrieNode{match: r.uvarint() == 1}
+	if n.match {
+		*domains = append(*domains, name)
+	}
+	children := r.count()
+	if r.err != nil {
+		return n
+	}
+	if children > 0 {
+		n.children = make(map[string]*domainTrieNode, children)
+	}
+	for range children {
+		label := r.string()
+		n.children[label] = r.trie(label+"."+name, depth+1, domains)
+		if r.err != nil {
+			break
+		}
+	}
+	return n
+}
+
+func (r *snapshotReader) rules() *[]Rule {
+	if r.uvarint() == 0 {
+		return nil
+	}
+	n := r.count()
+	rules := make([]Rule, 0, n)
+	for range n {
+		rules = append(rules, Rule{Type: RuleType(r.uvarint()), Value: r.string()})
+	}
+	return &rules
+}
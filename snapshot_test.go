@@ -0,0 +1,161 @@
+package ruledforward
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/coredns/caddy"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "ads.txt")
+	if err := os.WriteFile(list, []byte("||ads.example^\n||x.ads.example^\ntracker.example\n/^ad[0-9]+\\./\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	newGroup := func() *Group {
+		return &Group{
+			Name:         "block",
+			AdguardPaths: []string{list},
+			AdguardURLs:  []string{"https://lists.example/ads.txt"},
+			InlineRules:  []Rule{{Type: RuleKeyword, Value: "banner"}},
+			snapshot:     &snapshotFile{path: filepath.Join(dir, "block.snap")},
+		}
+	}
+	remote := []Rule{{Type: RuleFull, Value: "remote.example."}}
+
+	g := newGroup()
+	g.remoteRules.Store(&remote)
+	if err := g.Update(nil, UpdateMatcherLocal); err != nil {
+		t.Fatal(err)
+	}
+
+	h := newGroup()
+	ok, err := h.loadSnapshot()
+	if err != nil || !ok {
+		t.Fatalf("loadSnapshot = %v, %v; want true", ok, err)
+	}
+	if got, want := h.EffectiveRules(), g.EffectiveRules(); !slices.Equal(got, want) {
+		t.Errorf("restored rules = %v, want %v", got, want)
+	}
+	for _, q := range []string{"a.x.ads.example.", "tracker.example.", "ad12.example.", "www.banner.example.", "remote.example.", "www.example."} {
+		if h.Match(q) != g.Match(q) {
+			t.Errorf("Match(%q) = %v after restore, want %v", q, h.Match(q), g.Match(q))
+		}
+	}
+	if rules := h.remoteRules.Load(); rules == nil || !slices.Equal(*rules, remote) {
+		t.Errorf("remote rules = %v, want %v", rules, remote)
+	}
+	if h.ruleCount.Load() != g.ruleCount.Load() || h.prunedCount.Load() != 1 {
+		t.Errorf("counts = %d, %d; want %d, 1", h.ruleCount.Load(), h.prunedCount.Load(), g.ruleCount.Load())
+	}
+
+	// A changed source makes the snapshot stale.
+	if err := os.WriteFile(list, []byte("||ads.example^\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := newGroup().loadSnapshot(); ok || err != nil {
+		t.Errorf("loadSnapshot after a source changed = %v, %v; want false", ok, err)
+	}
+
+	// So does damage.
+	data, _ := os.ReadFile(g.snapshot.path)
+	data[len(data)/2] ^= 0xff
+	os.WriteFile(g.snapshot.path, data, 0o644)
+	if ok, err := g.loadSnapshot(); ok || err == nil {
+		t.Errorf("loadSnapshot of a damaged file = %v, %v; want an error", ok, err)
+	}
+}
+
+func TestSnapshotBloomFalsePositives(t *testing.T) {
+	dir := t.TempDir()
+	newGroup := func() *Group {
+		g := &Group{Name: "block", BloomSize: 10, BloomFP: 0.5, snapshot: &snapshotFile{path: filepath.Join(dir, "block.snap")}}
+		for i := range 100 {
+			g.InlineRules = append(g.InlineRules, Rule{Type: RuleDomain, Value: fmt.Sprintf("d%d.example.", i)})
+		}
+		return g
+	}
+	if err := newGroup().Update(nil, UpdateMatcherLocal); err != nil {
+		t.Fatal(err)
+	}
+
+	g := newGroup()
+	if ok, err := g.loadSnapshot(); err != nil || !ok {
+		t.Fatalf("loadSnapshot = %v, %v; want true", ok, err)
+	}
+	m, ok := g.Matcher().(*bloomedMatcher)
+	if !ok {
+		t.Fatalf("restored matcher is a %T, want *bloomedMatcher", g.Matcher())
+	}
+	var want uint64
+	for i := range 1000 {
+		q := fmt.Sprintf("n%d.example.net.", i)
+		if m.bf.MaybeMatch(q) {
+			want++
+		}
+		g.Match(q)
+	}
+	if want == 0 || g.bloomFalsePositives.Load() != want {
+		t.Errorf("false positives = %d after restore, want the %d names that passed the overfull filter", g.bloomFalsePositives.Load(), want)
+	}
+}
+
+func TestSnapshotNoBloom(t *testing.T) {
+	g := &Group{
+		Name:        "block",
+		NoBloom:     true,
+		InlineRules: []Rule{{Type: RuleDomain, Value: "ads.example."}},
+		snapshot:    &snapshotFile{path: filepath.Join(t.TempDir(), "block.snap")},
+	}
+	if err := g.Update(nil, UpdateMatcherLocal); err != nil {
+		t.Fatal(err)
+	}
+	h := &Group{Name: "block", NoBloom: true, InlineRules: g.InlineRules, snapshot: g.snapshot}
+	if ok, err := h.loadSnapshot(); !ok || err != nil {
+		t.Fatalf("loadSnapshot = %v, %v; want true", ok, err)
+	}
+	if _, ok := h.Matcher().(*matcher); !ok || !h.Match("www.ads.example.") {
+		t.Errorf("restored matcher %T should match without a bloom filter", h.Matcher())
+	}
+
+	// Other bloom settings need another snapshot.
+	h = &Group{Name: "block", InlineRules: g.InlineRules, snapshot: g.snapshot}
+	if ok, err := h.loadSnapshot(); ok || err != nil {
+		t.Errorf("loadSnapshot with a bloom filter = %v, %v; want false", ok, err)
+	}
+}
+
+func TestSnapshotSetup(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "ads.txt")
+	if err := os.WriteFile(list, []byte("||ads.example^\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	input := `ruledforward . {
+    snapshot_dir ` + filepath.Join(dir, "snapshots") + `
+    group block {
+        action empty
+        adguard_rules ` + list + `
+    }
+}`
+	for i := range 2 {
+		r, err := parseRuledforward(caddy.NewTestController("dns", input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := r.groups[0]
+		if g.snapshot == nil {
+			t.Fatal("group should have a snapshot file")
+		}
+		if _, err := os.Stat(g.snapshot.path); err != nil {
+			t.Errorf("run %d: %v", i, err)
+		}
+		if !g.Match("www.ads.example.") || !g.initialized.Load() {
+			t.Errorf("run %d: group should be ready and match its rules", i)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package ruledforward
+
+// splitTarget is one arm of a group's `split`: a forward group and its relative weight.
+type splitTarget struct {
+	weight int
+	name   string
+	group  *Group // resolved once all groups are parsed
+}
+
+// pickSplit returns a split target chosen at random in proportion to the weights.
+func (g *Group) pickSplit() splitTarget {
+	total := 0
+	for _, t := range g.Split {
+		total += t.weight
+	}
+	n := rn.Int() % total
+	for _, t := range g.Split {
+		if n < t.weight {
+			return t
+		}
+		n -= t.weight
+	}
+	return g.Split[len(g.Split)-1]
+}
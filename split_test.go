@@ -0,0 +1,17 @@
+package ruledforward
+
+import (
+	"testing"
+)
+
+func TestPickSplit(t *testing.T) {
+	a, b := &Group{Name: "a"}, &Group{Name: "b"}
+	g := &Group{Split: []splitTarget{{weight: 90, name: "a", group: a}, {weight: 10, name: "b", group: b}}}
+	counts := map[string]int{}
+	for range 10000 {
+		counts[g.pickSplit().name]++
+	}
+	if counts["a"]+counts["b"] != 10000 || counts["b"] < 700 || counts["b"] > 1300 {
+		t.Errorf("split counts = %v, want roughly 9000/1000", counts)
+	}
+}
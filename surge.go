@@ -0,0 +1,40 @@
+package ruledforward
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// surgeRuleTypes maps the domain rule types of Surge and Clash rulesets, and their Quantumult X names, to rule types.
+var surgeRuleTypes = map[string]RuleType{
+	"DOMAIN":         RuleFull,
+	"DOMAIN-SUFFIX":  RuleDomain,
+	"DOMAIN-KEYWORD": RuleKeyword,
+	"HOST":           RuleFull,
+	"HOST-SUFFIX":    RuleDomain,
+	"HOST-KEYWORD":   RuleKeyword,
+}
+
+// parseSurgeRule parses a line of a Surge-style ruleset, `TYPE,VALUE[,POLICY...]`, as published for Surge, Clash
+// and Quantumult X. Lines of other types, such as IP-CIDR or PROCESS-NAME, have no rule and ok false; so do lines
+// that are not of this form.
+func parseSurgeRule(line string) (r Rule, ok bool) {
+	typ, rest, found := strings.Cut(line, ",")
+	if !found {
+		return r, false
+	}
+	t, known := surgeRuleTypes[strings.ToUpper(strings.TrimSpace(typ))]
+	if !known {
+		return r, false
+	}
+	value, _, _ := strings.Cut(rest, ",")
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return r, false
+	}
+	if t != RuleKeyword {
+		value = dns.Fqdn(strings.TrimPrefix(value, "."))
+	}
+	return Rule{Type: t, Value: value}, true
+}
@@ -0,0 +1,39 @@
+package ruledforward
+
+import (
+	"github.com/miekg/dns"
+)
+
+// synthUDPSize is the EDNS0 UDP payload size advertised in responses the plugin synthesizes, the size of DNS Flag
+// Day 2020. A group's `bufsize` replaces it.
+const synthUDPSize = 1232
+
+// finishReply sets the header flags of m, a response synthesized for req, as those of a recursive resolver: RA set,
+// as some stub resolvers retry endlessly on a recursive answer without it, AD clear, as nothing was validated, and RD
+// as in req. It adds an OPT record if req has one: RFC 6891 responders answer EDNS0 queries with EDNS0, and stub
+// resolvers may take a response without it for a broken middlebox. The OPT record carries synthUDPSize and the DO
+// bit of req, and with keepOpts the options of req, as `edns_options keep` asks; otherwise none. opt is filled in if
+// not nil, so that callers can allocate it along with m.
+func finishReply(m, req *dns.Msg, keepOpts bool, opt *dns.OPT) {
+	m.RecursionAvailable = true
+	m.AuthenticatedData = false
+	m.Authoritative = false
+	m.RecursionDesired = req.RecursionDesired
+	ro := req.IsEdns0()
+	if ro == nil || m.IsEdns0() != nil {
+		return
+	}
+	if opt == nil {
+		opt = new(dns.OPT)
+	}
+	opt.Hdr = dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}
+	opt.SetUDPSize(synthUDPSize)
+	if ro.Do() {
+		opt.SetDo()
+	}
+	opt.Option = nil
+	if keepOpts {
+		opt.Option = ro.Option
+	}
+	m.Extra = append(m.Extra, opt)
+}
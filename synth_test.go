@@ -0,0 +1,81 @@
+package ruledforward
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestSynthesizedOPT(t *testing.T) {
+	cookie := &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"}
+	newReq := func(edns, do bool) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if edns {
+			req.SetEdns0(4096, do)
+			req.IsEdns0().Option = []dns.EDNS0{cookie}
+		}
+		return req
+	}
+
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	_, _ = writeEmpty(rec, newReq(false, false), "example.com.", false)
+	if opt := rec.Msg.IsEdns0(); opt != nil {
+		t.Errorf("response to a query without EDNS0 has %v", opt)
+	}
+
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	_, _ = writeEmpty(rec, newReq(true, true), "example.com.", false)
+	opt := rec.Msg.IsEdns0()
+	if opt == nil || opt.UDPSize() != synthUDPSize || !opt.Do() || len(opt.Option) != 0 {
+		t.Errorf("OPT = %v, want size %d, DO and no options", opt, synthUDPSize)
+	}
+
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	_, _ = writeMinimalANY(rec, newReq(true, false), "example.com.", true)
+	opt = rec.Msg.IsEdns0()
+	if opt == nil || opt.Do() || len(opt.Option) != 1 || opt.Option[0] != cookie {
+		t.Errorf("OPT = %v, want the cookie echoed without DO", opt)
+	}
+
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	_, _ = NewRateLimiter(1, 1, "refuse").Reject(rec, newReq(true, false), "g", false)
+	if rec.Msg.IsEdns0() == nil {
+		t.Error("REFUSED response has no OPT record")
+	}
+
+	// With bufsize, the group's size replaces the default.
+	req := newReq(true, false)
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	_, _ = writeEmpty(newBufsizeWriter(rec, req, 512), req, "example.com.", false)
+	if opt := rec.Msg.IsEdns0(); opt == nil || opt.UDPSize() != 512 {
+		t.Errorf("OPT = %v, want size 512", opt)
+	}
+}
+
+func TestSynthesizedFlags(t *testing.T) {
+	for _, rd := range []bool{true, false} {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		req.RecursionDesired = rd
+		req.AuthenticatedData = true
+
+		for name, write := range map[string]func(w dns.ResponseWriter){
+			"empty": func(w dns.ResponseWriter) { _, _ = writeEmpty(w, req, "example.com.", false) },
+			"ANY":   func(w dns.ResponseWriter) { _, _ = writeMinimalANY(w, req, "example.com.", false) },
+			"refuse": func(w dns.ResponseWriter) {
+				_, _ = NewRateLimiter(1, 1, "refuse").Reject(w, req, "g", false)
+			},
+		} {
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			write(rec)
+			m := rec.Msg
+			if !m.RecursionAvailable || m.AuthenticatedData || m.Authoritative || m.RecursionDesired != rd {
+				t.Errorf("%s with RD %v: RA %v, AD %v, AA %v, RD %v; want RA, no AD or AA, and RD as the query",
+					name, rd, m.RecursionAvailable, m.AuthenticatedData, m.Authoritative, m.RecursionDesired)
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package ruledforward
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// upstreamTLSConfig returns the TLS client config for the group's DoT upstreams: the `tls` config, if any, with the
+// group's trust store, protocol and session settings applied. Sessions are cached so reconnects to an upstream can
+// resume instead of doing a full handshake.
+func (gb *groupBuild) upstreamTLSConfig() *tls.Config {
+	cfg := &tls.Config{}
+	if gb.tlsConfig != nil {
+		cfg = gb.tlsConfig.Clone()
+	}
+	if gb.caPool != nil {
+		cfg.RootCAs = gb.caPool
+	}
+	if gb.tlsMinVersion != 0 {
+		cfg.MinVersion = gb.tlsMinVersion
+	}
+	if len(gb.tlsCiphers) > 0 {
+		cfg.CipherSuites = gb.tlsCiphers
+	}
+	if gb.tlsNoTickets {
+		cfg.SessionTicketsDisabled = true
+	} else {
+		cfg.ClientSessionCache = tls.NewLRUClientSessionCache(len(gb.toHosts))
+	}
+	return cfg
+}
+
+// parseTLSVersion parses a `tls_min_version` argument.
+func parseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version '%s', want 1.2 or 1.3", s)
+}
+
+// parseCipherSuites parses `tls_ciphers` names as printed by crypto/tls (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256).
+// Only suites crypto/tls considers secure are accepted.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	ids := make([]uint16, 0, len(names))
+	for _, n := range names {
+		id, ok := uint16(0), false
+		for _, cs := range tls.CipherSuites() {
+			if strings.EqualFold(cs.Name, n) {
+				id, ok = cs.ID, true
+				break
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite '%s'", n)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// loadCAPool returns a certificate pool holding only the PEM certificates in paths. A directory contributes every
+// regular file in it; files without certificates are an error, so a typo does not silently trust nothing.
+func loadCAPool(paths []string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		files := []string{p}
+		if fi.IsDir() {
+			entries, err := os.ReadDir(p)
+			if err != nil {
+				return nil, err
+			}
+			files = files[:0]
+			for _, e := range entries {
+				if e.Type().IsRegular() {
+					files = append(files, filepath.Join(p, e.Name()))
+				}
+			}
+			if len(files) == 0 {
+				return nil, fmt.Errorf("no certificates in %s", p)
+			}
+		}
+		for _, f := range files {
+			data, err := os.ReadFile(f)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no PEM certificates in %s", f)
+			}
+		}
+	}
+	return pool, nil
+}
@@ -0,0 +1,143 @@
+package ruledforward
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+// writeTestCA writes a self-signed CA certificate in PEM to path.
+func writeTestCA(t *testing.T, path string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadCAPool(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCA(t, filepath.Join(dir, "a.pem"))
+	writeTestCA(t, filepath.Join(dir, "b.pem"))
+
+	if _, err := loadCAPool([]string{filepath.Join(dir, "a.pem")}); err != nil {
+		t.Errorf("file: %v", err)
+	}
+	if _, err := loadCAPool([]string{dir}); err != nil {
+		t.Errorf("directory: %v", err)
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad.pem")
+	if err := os.WriteFile(bad, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCAPool([]string{bad}); err == nil {
+		t.Error("expected error for file without certificates")
+	}
+	if _, err := loadCAPool([]string{t.TempDir()}); err == nil {
+		t.Error("expected error for empty directory")
+	}
+	if _, err := loadCAPool([]string{filepath.Join(dir, "missing.pem")}); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestTLSCA(t *testing.T) {
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	writeTestCA(t, ca)
+	input := `ruledforward . {
+    group internal {
+        to tls://10.0.0.1 8.8.8.8
+        tls_servername dns.corp.example
+        tls_ca ` + ca + `
+        domain: corp.example
+    }
+    group public {
+        to tls://1.1.1.1
+        tls_servername one.one.one.one
+    }
+}`
+	r, err := parseRuledforward(caddy.NewTestController("dns", input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal := r.groups[0].Proxies()[0].GetTransport().GetTLSConfig()
+	if internal == nil || internal.RootCAs == nil {
+		t.Fatal("internal group: RootCAs not set")
+	}
+	if internal.ServerName != "dns.corp.example" {
+		t.Errorf("internal group: ServerName = %q", internal.ServerName)
+	}
+	if public := r.groups[1].Proxies()[0].GetTransport().GetTLSConfig(); public.RootCAs != nil {
+		t.Error("public group: RootCAs set, want system pool")
+	}
+}
+
+func TestTLSSettings(t *testing.T) {
+	input := `ruledforward . {
+    group strict {
+        to tls://1.1.1.1
+        tls_servername one.one.one.one
+        tls_min_version 1.3
+        tls_session_tickets off
+        domain: strict.example
+    }
+    group legacy {
+        to tls://8.8.8.8
+        tls_ciphers TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 tls_ecdhe_ecdsa_with_aes_128_gcm_sha256
+    }
+}`
+	r, err := parseRuledforward(caddy.NewTestController("dns", input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	strict := r.groups[0].Proxies()[0].GetTransport().GetTLSConfig()
+	if strict.MinVersion != tls.VersionTLS13 {
+		t.Errorf("strict: MinVersion = %#x, want TLS 1.3", strict.MinVersion)
+	}
+	if !strict.SessionTicketsDisabled || strict.ClientSessionCache != nil {
+		t.Error("strict: session tickets not disabled")
+	}
+	legacy := r.groups[1].Proxies()[0].GetTransport().GetTLSConfig()
+	want := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	if !slices.Equal(legacy.CipherSuites, want) {
+		t.Errorf("legacy: CipherSuites = %v, want %v", legacy.CipherSuites, want)
+	}
+	if legacy.ClientSessionCache == nil {
+		t.Error("legacy: no session cache")
+	}
+
+	for _, bad := range []string{"tls_min_version 1.1", "tls_ciphers TLS_RSA_WITH_RC4_128_SHA", "tls_session_tickets maybe"} {
+		input := "ruledforward . {\n    group g {\n        to tls://1.1.1.1\n        " + bad + "\n    }\n}"
+		if _, err := parseRuledforward(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
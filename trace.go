@@ -0,0 +1,35 @@
+package ruledforward
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	otext "github.com/opentracing/opentracing-go/ext"
+)
+
+// startSpan starts a child span of the query's span when the trace plugin traces it; otherwise span is nil and ctx
+// is returned unchanged.
+func startSpan(ctx context.Context, name string) (ot.Span, context.Context) {
+	parent := ot.SpanFromContext(ctx)
+	if parent == nil {
+		return nil, ctx
+	}
+	span := parent.Tracer().StartSpan(name, ot.ChildOf(parent.Context()))
+	return span, ot.ContextWithSpan(ctx, span)
+}
+
+// finishUpstreamSpan records the outcome of an upstream attempt on span and finishes it. span may be nil.
+func finishUpstreamSpan(span ot.Span, ret *dns.Msg, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		otext.Error.Set(span, true)
+		span.LogKV("error", err.Error())
+	}
+	if ret != nil {
+		span.SetTag("rcode", dns.RcodeToString[ret.Rcode])
+	}
+	span.Finish()
+}
@@ -0,0 +1,53 @@
+package ruledforward
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestTraceSpans(t *testing.T) {
+	var n atomic.Int32
+	up := newDelayedUpstream(t, "192.0.2.1", 0, &n)
+	g := &Group{Name: "default", Action: "forward", Policy: &sequential{}}
+	g.SetProxies([]*proxy.Proxy{up})
+	g.SetMatcher(NewMatcher())
+	r := &Ruledforward{from: ".", groups: []*Group{g}, defaultGroup: g}
+
+	tracer := mocktracer.New()
+	root := tracer.StartSpan("servedns")
+	ctx := ot.ContextWithSpan(context.Background(), root)
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.org.", dns.TypeA)
+	if _, err := r.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter{}), req); err != nil {
+		t.Fatal(err)
+	}
+	root.Finish()
+
+	spans := make(map[string]*mocktracer.MockSpan)
+	for _, s := range tracer.FinishedSpans() {
+		spans[s.OperationName] = s
+	}
+	rootID := root.Context().(mocktracer.MockSpanContext).SpanID
+	match := spans["match"]
+	if match == nil || match.ParentID != rootID || match.Tag("group") != "default" {
+		t.Errorf("match span = %v, want a child of the query span tagged with the group", match)
+	}
+	upstream := spans["upstream"]
+	if upstream == nil || upstream.ParentID != rootID {
+		t.Fatalf("upstream span = %v, want a child of the query span", upstream)
+	}
+	for tag, want := range map[string]any{"group": "default", "upstream": up.Addr(), "rcode": "NOERROR"} {
+		if got := upstream.Tag(tag); got != want {
+			t.Errorf("upstream span tag %s = %v, want %v", tag, got, want)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package ruledforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	txtRulesInterval = 5 * time.Minute
+	txtRulesTimeout  = 5 * time.Second
+	// txtRulesMaxChunks bounds the chunks of a list, to fail cleanly on a bogus header.
+	txtRulesMaxChunks = 100000
+)
+
+// resolvConf is read for the name server of txt_rules sources that do not name one.
+var resolvConf = "/etc/resolv.conf"
+
+// txtSource is a `txt_rules` setting: rules published in DNS, for networks where DNS is the only way out. The TXT
+// record of ZONE is a header, `v=ruledforward1 serial=SERIAL chunks=N`, and the TXT records of `0.ZONE` to
+// `N-1.ZONE` hold the rules, each string a line in the adguard_rules format. The header is polled, and the chunks
+// are queried again when its serial changes.
+type txtSource struct {
+	zone     string // fully qualified
+	server   string // host:port; "" for the first name server of resolvConf
+	interval time.Duration
+}
+
+// parseTXTSource parses `txt_rules ZONE [SERVER[:PORT]] [INTERVAL]`.
+func parseTXTSource(args []string) (*txtSource, error) {
+	if len(args) < 1 || len(args) > 3 {
+		return nil, errors.New("txt_rules takes a zone, an optional server and an optional interval")
+	}
+	zone := dns.Fqdn(strings.ToLower(args[0]))
+	if _, ok := dns.IsDomainName(zone); !ok || zone == "." {
+		return nil, fmt.Errorf("invalid txt_rules zone '%s'", args[0])
+	}
+	s := &txtSource{zone: zone, interval: txtRulesInterval}
+	for _, arg := range args[1:] {
+		if d, err := time.ParseDuration(arg); err == nil {
+			if d < 10*time.Second {
+				return nil, fmt.Errorf("txt_rules interval must be at least 10s: %s", arg)
+			}
+			s.interval = d
+			continue
+		}
+		if s.server != "" {
+			return nil, fmt.Errorf("txt_rules: unexpected argument '%s'", arg)
+		}
+		host, port, err := net.SplitHostPort(arg)
+		if err != nil {
+			host, port = arg, "53"
+		}
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("txt_rules server must be an IP address: %s", arg)
+		}
+		s.server = net.JoinHostPort(host, port)
+	}
+	return s, nil
+}
+
+func (s *txtSource) String() string {
+	if s.server == "" {
+		return "txt_rules " + s.zone
+	}
+	return "txt_rules " + s.zone + " " + s.server
+}
+
+// query returns the strings of the TXT records of name, queried over TCP since chunks may be large.
+func (s *txtSource) query(ctx context.Context, name string) ([]string, error) {
+	server := s.server
+	if server == "" {
+		cfg, err := dns.ClientConfigFromFile(resolvConf)
+		if err != nil {
+			return nil, err
+		}
+		if len(cfg.Servers) == 0 {
+			return nil, fmt.Errorf("no name server in %s", resolvConf)
+		}
+		server = net.JoinHostPort(cfg.Servers[0], cfg.Port)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeTXT)
+	c := &dns.Client{Net: "tcp", Timeout: txtRulesTimeout}
+	ret, _, err := c.ExchangeContext(ctx, m, server)
+	if err != nil {
+		return nil, err
+	}
+	if ret.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("TXT %s: %s", name, dns.RcodeToString[ret.Rcode])
+	}
+	var txt []string
+	for _, rr := range ret.Answer {
+		if t, ok := rr.(*dns.TXT); ok && strings.EqualFold(t.Hdr.Name, name) {
+			txt = append(txt, t.Txt...)
+		}
+	}
+	return txt, nil
+}
+
+// header returns the serial and the number of chunks of the list.
+func (s *txtSource) header(ctx context.Context) (serial uint64, chunks int, err error) {
+	txt, err := s.query(ctx, s.zone)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, t := range txt {
+		fields := strings.Fields(t)
+		if len(fields) == 0 || fields[0] != "v=ruledforward1" {
+			continue
+		}
+		var hasSerial, hasChunks bool
+		for _, f := range fields[1:] {
+			k, v, _ := strings.Cut(f, "=")
+			switch k {
+			case "serial":
+				serial, err = strconv.ParseUint(v, 10, 64)
+				hasSerial = err == nil
+			case "chunks":
+				chunks, err = strconv.Atoi(v)
+				hasChunks = err == nil && chunks >= 0 && chunks <= txtRulesMaxChunks
+			}
+		}
+		if !hasSerial || !hasChunks {
+			return 0, 0, fmt.Errorf("invalid txt_rules header '%s' at %s", t, s.zone)
+		}
+		return serial, chunks, nil
+	}
+	return 0, 0, fmt.Errorf("no txt_rules header at %s", s.zone)
+}
+
+// load queries the chunks of the list. If its serial changes while they are read, they are read again, so that a
+// list being published is not loaded half old and half new.
+func (s *txtSource) load(ctx context.Context) ([]Rule, error) {
+	serial, chunks, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for range 3 {
+		var lines []string
+		for i := range chunks {
+			txt, err := s.query(ctx, strconv.Itoa(i)+"."+s.zone)
+			if err != nil {
+				return nil, fmt.Errorf("chunk %d: %w", i, err)
+			}
+			lines = append(lines, txt...)
+		}
+		now, n, err := s.header(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if now == serial {
+			return ParseAdguardRules(strings.Join(lines, "\n"))
+		}
+		serial, chunks = now, n
+	}
+	return nil, fmt.Errorf("serial kept changing while loading %s", s.zone)
+}
+
+// follow requests a reload, then one each time the serial of the list changes, polling its header every interval
+// until polling fails or ctx is done. It reports whether the first poll succeeded.
+func (s *txtSource) follow(ctx context.Context, notify func()) (bool, error) {
+	last, _, err := s.header(ctx)
+	if err != nil {
+		return false, err
+	}
+	notify()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return true, ctx.Err()
+		case <-ticker.C:
+		}
+		serial, _, err := s.header(ctx)
+		if err != nil {
+			return true, err
+		}
+		if serial != last {
+			last = serial
+			notify()
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package ruledforward
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+// txtZone serves a list published as txt_rules under rules.example.
+type txtZone struct {
+	mu     sync.Mutex
+	serial int
+	chunks [][]string
+}
+
+func (z *txtZone) set(serial int, chunks ...[]string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.serial, z.chunks = serial, chunks
+}
+
+func (z *txtZone) serve(w dns.ResponseWriter, r *dns.Msg) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	ret := new(dns.Msg)
+	ret.SetReply(r)
+	name := r.Question[0].Name
+	txt := func(strs ...string) {
+		rr := test.TXT(name + " 60 IN TXT \"\"")
+		rr.Txt = strs
+		ret.Answer = append(ret.Answer, rr)
+	}
+	if name == "rules.example." {
+		txt("spf1 unrelated")
+		txt(fmt.Sprintf("v=ruledforward1 serial=%d chunks=%d", z.serial, len(z.chunks)))
+	} else {
+		var i int
+		if _, err := fmt.Sscanf(name, "%d.rules.example.", &i); err != nil || i >= len(z.chunks) {
+			ret.Rcode = dns.RcodeNameError
+		} else {
+			txt(z.chunks[i]...)
+		}
+	}
+	_ = w.WriteMsg(ret)
+}
+
+func TestParseTXTSource(t *testing.T) {
+	s, err := parseTXTSource([]string{"Rules.Example", "192.0.2.53", "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.zone != "rules.example." || s.server != "192.0.2.53:53" || s.interval != time.Minute {
+		t.Errorf("source = %+v", s)
+	}
+	if s, err := parseTXTSource([]string{"rules.example", "[2001:db8::53]:5353"}); err != nil || s.server != "[2001:db8::53]:5353" {
+		t.Errorf("source = %+v, %v", s, err)
+	}
+	for _, args := range [][]string{
+		{},
+		{"."},
+		{"rules.example", "ns.example"},
+		{"rules.example", "1s"},
+		{"rules.example", "192.0.2.53", "192.0.2.54"},
+	} {
+		if _, err := parseTXTSource(args); err == nil {
+			t.Errorf("parseTXTSource(%q) should fail", args)
+		}
+	}
+}
+
+func TestTXTSourceLoad(t *testing.T) {
+	z := &txtZone{}
+	z.set(1, []string{"||ads.example^", "tracker.example"}, []string{"! comment", "||more.example^"})
+	s := dnstest.NewServer(z.serve)
+	defer s.Close()
+
+	src, err := parseTXTSource([]string{"rules.example", s.Addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := src.load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 {
+		t.Errorf("rules = %v, want those of both chunks", rules)
+	}
+
+	z.set(2, []string{"x.example"})
+	if rules, err := src.load(context.Background()); err != nil || len(rules) != 1 || rules[0].Value != "x.example." {
+		t.Errorf("rules after the serial changed = %v, %v", rules, err)
+	}
+
+	src, _ = parseTXTSource([]string{"missing.example", s.Addr})
+	if _, err := src.load(context.Background()); err == nil {
+		t.Error("a list without header should fail")
+	}
+}
+
+func TestWatchTXTRules(t *testing.T) {
+	z := &txtZone{}
+	z.set(1, []string{"||ads.example^"})
+	s := dnstest.NewServer(z.serve)
+	defer s.Close()
+	src, _ := parseTXTSource([]string{"rules.example", s.Addr})
+	src.interval = 10 * time.Millisecond
+	g := &Group{Name: "ads", Action: "empty", TXT: []*txtSource{src}}
+	if err := g.Update(nil, UpdateMatcherLocal); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go g.watchRuleSource(src, nil, UpdateMatcherTXT, 10*time.Millisecond, stop)
+
+	waitMatch := func(qname string, want bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for g.Match(qname) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("Match(%s) != %v", qname, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitMatch("x.ads.example.", true)
+	z.set(2, []string{"||tracker.example^"})
+	waitMatch("tracker.example.", true)
+	waitMatch("x.ads.example.", false)
+}
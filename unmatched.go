@@ -0,0 +1,46 @@
+package ruledforward
+
+import "sync"
+
+// defaultUnmatchedSize is the number of names `capture_unmatched` counts by default.
+const defaultUnmatchedSize = 10000
+
+// unmatched counts the names of queries that no group matched, see `capture_unmatched`, so that operators can build
+// rules from real traffic.
+type unmatched struct {
+	mu          sync.Mutex
+	size        int
+	withDefault bool              // also count names routed to the default group
+	counts      map[string]uint64 // qname -> queries
+}
+
+func newUnmatched(size int, withDefault bool) *unmatched {
+	return &unmatched{size: size, withDefault: withDefault, counts: make(map[string]uint64)}
+}
+
+// captureUnmatched counts qname if it was routed to g and g is nil or, with withDefault, the default group.
+func (r *Ruledforward) captureUnmatched(qname string, g *Group) {
+	u := r.unmatched
+	if u == nil || g != nil && (!u.withDefault || g.Name != "default") {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	countName(u.counts, qname, u.size)
+}
+
+// add adds the counted names to counts.
+func (u *unmatched) add(counts map[string]uint64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for name, n := range u.counts {
+		counts[name] += n
+	}
+}
+
+// reset forgets the counted names.
+func (u *unmatched) reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	clear(u.counts)
+}
@@ -0,0 +1,59 @@
+package ruledforward
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCaptureUnmatched(t *testing.T) {
+	block := &Group{Name: "block", Action: "empty"}
+	def := &Group{Name: "default", Action: "forward"}
+	r := &Ruledforward{from: ".", server: "unmatched:53", unmatched: newUnmatched(10, false)}
+	r.captureUnmatched("a.example.", nil)
+	r.captureUnmatched("a.example.", nil)
+	r.captureUnmatched("b.example.", def)
+	r.captureUnmatched("ads.example.", block)
+	if got := r.unmatched.counts; len(got) != 1 || got["a.example."] != 2 {
+		t.Errorf("counts = %v, want only a.example. twice", got)
+	}
+
+	r.unmatched = newUnmatched(10, true)
+	r.captureUnmatched("b.example.", def)
+	r.captureUnmatched("ads.example.", block)
+	if got := r.unmatched.counts; len(got) != 1 || got["b.example."] != 1 {
+		t.Errorf("counts with default = %v, want only b.example.", got)
+	}
+}
+
+func TestAdminUnmatched(t *testing.T) {
+	r := &Ruledforward{from: ".", server: "admin-unmatched:53", unmatched: newUnmatched(10, false)}
+	for _, name := range []string{"a.example.", "b.example.", "b.example."} {
+		r.captureUnmatched(name, nil)
+	}
+	r.registerInstance()
+	t.Cleanup(r.unregisterInstance)
+	srv := httptest.NewServer(adminHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/unmatched?limit=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []blockedName
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	resp.Body.Close()
+	if len(out) != 1 || out[0] != (blockedName{Name: "b.example.", Count: 2}) {
+		t.Errorf("GET /api/unmatched = %v, want b.example. with 2 queries", out)
+	}
+
+	req, _ := http.NewRequest("DELETE", srv.URL+"/api/unmatched", nil)
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || len(r.unmatched.counts) != 0 {
+		t.Errorf("DELETE = %d, counts = %v; want 204 and none left", resp.StatusCode, r.unmatched.counts)
+	}
+}
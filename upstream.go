@@ -0,0 +1,216 @@
+package ruledforward
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/parse"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+)
+
+// upstreamConfig holds the settings needed to (re)build a forward group's proxies.
+// It is kept on the Group so the proxy set can be rebuilt when a resolv.conf-style
+// `to` file changes (e.g. DHCP rewrote /etc/resolv.conf).
+type upstreamConfig struct {
+	toHosts       []string
+	tlsConfig     *tls.Config
+	tlsArgs       []string // raw `tls` arguments, compared across reloads since tlsConfig is rebuilt each parse
+	tlsCA         []string // `tls_ca` paths, likewise
+	tlsMinVersion uint16
+	tlsCiphers    []uint16
+	tlsNoTickets  bool
+	tlsServerName string
+	perUpstream   map[string]upstreamOptions // per-upstream overrides from `to` sub-blocks, by transport-qualified address
+	bootstrapDNS  string                     // resolves host names in toHosts
+	expire        time.Duration
+	maxIdleConns  int
+	opts          proxy.Options
+
+	hostnames  bool // toHosts names at least one host, to be resolved via bootstrapDNS
+	ddr        bool // upgrade plain upstreams to the DoT endpoints they advertise (RFC 9462)
+	unresolved bool // the last newProxies call failed to resolve a host name or query DDR
+}
+
+// upstreamOptions are the settings that can be given for a single upstream in a `to` sub-block.
+type upstreamOptions struct {
+	tlsServerName string
+}
+
+// fileStamp is the part of a file's stat used to detect changes.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// newProxies resolves cfg.toHosts (addresses, host names and/or resolv.conf-style files) and returns one proxy per
+// upstream, in order, plus the same proxies keyed by transport-qualified address. Proxies found in reuse are returned
+// as-is so their health state and connection cache survive a reload.
+func newProxies(group string, cfg *upstreamConfig, reuse map[string]*proxy.Proxy) ([]*proxy.Proxy, map[string]*proxy.Proxy, error) {
+	cfg.unresolved = false
+	entries, origins := cfg.toHosts, map[string]string(nil)
+	if cfg.hostnames {
+		entries, origins, cfg.unresolved = cfg.expandHostnames()
+	}
+	toHosts, err := parse.HostPortOrFile(entries...)
+	if err != nil {
+		return nil, nil, err
+	}
+	var designated map[string]ddrEndpoint
+	if cfg.ddr {
+		var failed bool
+		toHosts, designated, failed = discoverDesignated(toHosts, cfg.tlsConfig)
+		cfg.unresolved = cfg.unresolved || failed
+	}
+	if len(toHosts) > maxProxies {
+		return nil, nil, fmt.Errorf("group %s: more than %d upstreams: %d", group, maxProxies, len(toHosts))
+	}
+	allowedTrans := map[string]bool{"dns": true, "tls": true}
+	var list []*proxy.Proxy
+	byKey := make(map[string]*proxy.Proxy, len(toHosts))
+	for _, hostWithZone := range toHosts {
+		trans, h := parse.Transport(hostWithZone)
+		if !allowedTrans[trans] {
+			return nil, nil, fmt.Errorf("group %s: unsupported protocol %s", group, trans)
+		}
+		key := trans + "://" + h
+		if _, dup := byKey[key]; dup {
+			continue
+		}
+		p := reuse[key]
+		if p == nil {
+			p = proxy.NewProxy(proxyName(group), h, trans)
+			if trans == transport.TLS {
+				tcfg := cfg.tlsConfig
+				if tcfg == nil {
+					tcfg = &tls.Config{}
+				}
+				ep, isDesignated := designated[key]
+				if isDesignated {
+					tcfg = ep.tlsConfig(tcfg)
+				}
+				serverName := cfg.tlsServerName
+				if origin, ok := origins[key]; ok {
+					if serverName == "" {
+						serverName, _, _ = upstreamHostname(origin)
+					}
+					if o := cfg.perUpstream[origin]; o.tlsServerName != "" {
+						serverName = o.tlsServerName
+					}
+				}
+				if o := cfg.perUpstream[key]; o.tlsServerName != "" {
+					serverName = o.tlsServerName
+				}
+				if serverName != "" {
+					tcfg = tcfg.Clone()
+					tcfg.ServerName = serverName
+				}
+				p.SetTLSConfig(tcfg)
+			}
+			p.SetExpire(cfg.expire)
+			p.SetMaxIdleConns(cfg.maxIdleConns)
+			p.GetHealthchecker().SetRecursionDesired(cfg.opts.HCRecursionDesired)
+			p.GetHealthchecker().SetDomain(cfg.opts.HCDomain)
+		}
+		list = append(list, p)
+		byKey[key] = p
+	}
+	return list, byKey, nil
+}
+
+// proxyName is the name the proxies of group report in the metrics of CoreDNS's proxy package, such as its
+// connection cache hits and misses, so that they can be told apart per group.
+func proxyName(group string) string {
+	return "ruledforward/" + group
+}
+
+// upstreamFiles returns the `to` entries that refer to resolv.conf-style files rather than addresses.
+func upstreamFiles(toHosts []string) []string {
+	var files []string
+	for _, h := range toHosts {
+		_, host := parse.Transport(h)
+		if fi, err := os.Stat(host); err == nil && fi.Mode().IsRegular() {
+			files = append(files, host)
+		}
+	}
+	return files
+}
+
+// statUpstreamFiles returns the current stamp of each file; missing files get a zero stamp.
+func statUpstreamFiles(files []string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp, len(files))
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			stamps[f] = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+		} else {
+			stamps[f] = fileStamp{}
+		}
+	}
+	return stamps
+}
+
+// upstreamFilesChanged re-stats the group's upstream files and reports whether any of them changed since the last
+// call (or since the group was built). Only called from the watch goroutine.
+func (g *Group) upstreamFilesChanged() bool {
+	stamps := statUpstreamFiles(g.UpstreamFiles)
+	changed := false
+	for f, s := range stamps {
+		if old, ok := g.upstreamStamps[f]; !ok || !old.modTime.Equal(s.modTime) || old.size != s.size {
+			changed = true
+		}
+	}
+	g.upstreamStamps = stamps
+	return changed
+}
+
+// reloadUpstreams rebuilds the proxy set from the group's `to` entries and swaps it in atomically.
+// Unchanged upstreams keep their proxy; new ones are started and removed ones are stopped.
+func (g *Group) reloadUpstreams() error {
+	list, byKey, err := newProxies(g.Name, g.upstream, g.upstreamByKey)
+	if err != nil {
+		return err
+	}
+	old := g.Proxies()
+	for _, p := range list {
+		if !slices.Contains(old, p) {
+			p.Start(hcInterval)
+		}
+	}
+	g.SetProxies(list)
+	for _, p := range old {
+		if !slices.Contains(list, p) {
+			p.Stop()
+		}
+	}
+	g.upstreamByKey = byKey
+	return nil
+}
+
+// watchUpstreams polls the group's resolv.conf-style `to` files and reloads the proxy set when one changes or when
+// its upstream host names are due to be resolved again.
+func (g *Group) watchUpstreams(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			changed := g.upstreamFilesChanged()
+			if !changed && !g.upstreamResolveDue(now) {
+				continue
+			}
+			if g.upstream.resolves() {
+				g.resolvedAt = now
+			}
+			if err := g.reloadUpstreams(); err != nil {
+				log.Errorf("reloading upstreams for group '%s': %v", g.Name, err)
+				continue
+			}
+			log.Infof("Reloaded upstreams for group '%s': %d proxies", g.Name, len(g.Proxies()))
+		}
+	}
+}
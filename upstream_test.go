@@ -0,0 +1,141 @@
+package ruledforward
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+)
+
+func TestUpstreamFiles(t *testing.T) {
+	dir := t.TempDir()
+	resolv := filepath.Join(dir, "resolv.conf")
+	if err := os.WriteFile(resolv, []byte("nameserver 10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files := upstreamFiles([]string{"8.8.8.8", "tls://1.1.1.1", resolv})
+	if len(files) != 1 || files[0] != resolv {
+		t.Errorf("upstreamFiles = %v, want [%s]", files, resolv)
+	}
+}
+
+func TestNewProxiesReuse(t *testing.T) {
+	cfg := &upstreamConfig{toHosts: []string{"8.8.8.8", "tls://1.1.1.1", "8.8.8.8"}, expire: defaultExpire}
+	list, byKey, err := newProxies("g", cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || len(byKey) != 2 {
+		t.Fatalf("len(list) = %d, len(byKey) = %d, want 2 (duplicates collapsed)", len(list), len(byKey))
+	}
+	list2, _, err := newProxies("g", cfg, byKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range list {
+		if list[i] != list2[i] {
+			t.Errorf("proxy %d not reused", i)
+		}
+	}
+
+	_, _, err = newProxies("g", &upstreamConfig{toHosts: []string{"grpc://8.8.8.8"}}, nil)
+	if err == nil {
+		t.Error("expected error for unsupported protocol")
+	}
+}
+
+func TestReloadUpstreamsFromResolvConf(t *testing.T) {
+	dir := t.TempDir()
+	resolv := filepath.Join(dir, "resolv.conf")
+	if err := os.WriteFile(resolv, []byte("nameserver 10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	input := `ruledforward . {
+    group dhcp {
+        action forward
+        to ` + resolv + ` 8.8.8.8
+    }
+}`
+	c := caddy.NewTestController("dns", input)
+	dnsserver.NewServer("", []*dnsserver.Config{{Root: dir}})
+	r, err := parseRuledforward(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := r.groups[0]
+	if len(g.UpstreamFiles) != 1 {
+		t.Fatalf("UpstreamFiles = %v, want 1 file", g.UpstreamFiles)
+	}
+	before := g.Proxies()
+	if len(before) != 2 || before[0].Addr() != "10.0.0.1:53" {
+		t.Fatalf("initial proxies = %d, first %q", len(before), before[0].Addr())
+	}
+	if g.upstreamFilesChanged() {
+		t.Error("upstreamFilesChanged = true before any change")
+	}
+
+	if err := os.WriteFile(resolv, []byte("nameserver 10.0.0.2\nnameserver 10.0.0.3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(resolv, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if !g.upstreamFilesChanged() {
+		t.Fatal("upstreamFilesChanged = false after rewrite")
+	}
+	if err := g.reloadUpstreams(); err != nil {
+		t.Fatal(err)
+	}
+	after := g.Proxies()
+	defer func() {
+		for _, p := range after {
+			p.Stop()
+		}
+	}()
+	if len(after) != 3 {
+		t.Fatalf("len(proxies) after reload = %d, want 3", len(after))
+	}
+	if after[0].Addr() != "10.0.0.2:53" || after[1].Addr() != "10.0.0.3:53" {
+		t.Errorf("reloaded proxies = %s, %s", after[0].Addr(), after[1].Addr())
+	}
+	if after[2] != before[1] {
+		t.Error("static upstream 8.8.8.8 should keep its proxy across reload")
+	}
+}
+
+func TestGroupStopWaitsForWatch(t *testing.T) {
+	dir := t.TempDir()
+	resolv := filepath.Join(dir, "resolv.conf")
+	if err := os.WriteFile(resolv, []byte("nameserver 10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := caddy.NewTestController("dns", `ruledforward . {
+    group dhcp {
+        to `+resolv+`
+    }
+}`)
+	dnsserver.NewServer("", []*dnsserver.Config{{Root: dir}})
+	r, err := parseRuledforward(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.OnStartup(); err != nil {
+		t.Fatal(err)
+	}
+	g := r.groups[0]
+	if g.watchDone == nil {
+		t.Fatal("upstream watch not started")
+	}
+	if err := r.OnShutdown(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-g.watchDone:
+	default:
+		t.Error("OnShutdown returned before the upstream watch stopped")
+	}
+}
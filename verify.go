@@ -0,0 +1,125 @@
+package ruledforward
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// sourceCheck is how a downloaded adguard_rules URL is verified before its rules are used: against a SHA-256 digest
+// given inline or published next to the list, or against an Ed25519 signature published next to the list.
+type sourceCheck struct {
+	sha256    []byte // expected digest, or nil
+	sha256URL string // URL of a sha256sum-style file with the expected digest
+	publicKey ed25519.PublicKey
+	sigURL    string // URL of the base64 signature over the list
+}
+
+// parseSourceCheck parses the arguments of `verify URL sha256 HEX|URL` or `verify URL ed25519 KEY [SIG_URL]`.
+func parseSourceCheck(listURL string, args []string) (*sourceCheck, error) {
+	if len(args) < 2 {
+		return nil, errors.New("verify requires a method and a digest or key")
+	}
+	switch args[0] {
+	case "sha256":
+		if len(args) != 2 {
+			return nil, errors.New("verify sha256 takes one digest or URL")
+		}
+		if IsURL(args[1]) {
+			return &sourceCheck{sha256URL: args[1]}, nil
+		}
+		sum, err := hex.DecodeString(args[1])
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid SHA-256 digest '%s'", args[1])
+		}
+		return &sourceCheck{sha256: sum}, nil
+	case "ed25519":
+		if len(args) > 3 {
+			return nil, errors.New("verify ed25519 takes a key and an optional signature URL")
+		}
+		key, err := base64.StdEncoding.DecodeString(args[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 public key '%s'", args[1])
+		}
+		sc := &sourceCheck{publicKey: key, sigURL: listURL + ".sig"}
+		if len(args) == 3 {
+			sc.sigURL = args[2]
+		}
+		return sc, nil
+	}
+	return nil, fmt.Errorf("unknown verify method '%s', want sha256 or ed25519", args[0])
+}
+
+// verify checks data, the list as downloaded. fetch downloads companion files.
+func (sc *sourceCheck) verify(data []byte, fetch func(string) ([]byte, error)) error {
+	switch {
+	case sc.publicKey != nil:
+		raw, err := fetch(sc.sigURL)
+		if err != nil {
+			return err
+		}
+		sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw)))
+		if err != nil {
+			sig = raw
+		}
+		if !ed25519.Verify(sc.publicKey, data, sig) {
+			return errors.New("Ed25519 signature mismatch")
+		}
+		return nil
+	case sc.sha256URL != "":
+		raw, err := fetch(sc.sha256URL)
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(string(raw))
+		if len(fields) == 0 {
+			return fmt.Errorf("no digest in %s", sc.sha256URL)
+		}
+		want, err := hex.DecodeString(fields[0])
+		if err != nil || len(want) != sha256.Size {
+			return fmt.Errorf("invalid SHA-256 digest in %s", sc.sha256URL)
+		}
+		return checkSHA256(data, want)
+	}
+	return checkSHA256(data, sc.sha256)
+}
+
+func checkSHA256(data, want []byte) error {
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(sum[:], want) {
+		return fmt.Errorf("SHA-256 mismatch: got %x", sum)
+	}
+	return nil
+}
+
+// loadAdguardURL downloads one of the group's adguard_rules URLs, verifies it if the group has a check for it, and
+// parses it. A list that fails verification is an error, so the group keeps its previous rules.
+func (g *Group) loadAdguardURL(rawURL string) ([]Rule, error) {
+	data, err := g.fetchVerified(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return parseAdguardData(rawURL, data)
+}
+
+// fetchVerified downloads rawURL with the group's download settings and verifies it if the group has a check for it.
+func (g *Group) fetchVerified(rawURL string) ([]byte, error) {
+	fetch := func(u string) ([]byte, error) {
+		return fetchURL(u, adguardTimeout, g.BootstrapDNS, g.DownloadProxy)
+	}
+	data, err := fetch(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if sc := g.Verify[rawURL]; sc != nil {
+		if err := sc.verify(data, fetch); err != nil {
+			return nil, fmt.Errorf("verification failed: %w", err)
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,115 @@
+package ruledforward
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseSourceCheck(t *testing.T) {
+	sum := sha256.Sum256([]byte("x"))
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	key := base64.StdEncoding.EncodeToString(pub)
+	tests := []struct {
+		args    []string
+		wantErr bool
+	}{
+		{[]string{"sha256", hex.EncodeToString(sum[:])}, false},
+		{[]string{"sha256", "https://lists.example/ads.txt.sha256"}, false},
+		{[]string{"sha256", "abcd"}, true},
+		{[]string{"ed25519", key}, false},
+		{[]string{"ed25519", key, "https://lists.example/ads.sig"}, false},
+		{[]string{"ed25519", "bm90IGEga2V5"}, true},
+		{[]string{"md5", "abcd"}, true},
+		{[]string{"sha256"}, true},
+	}
+	for _, tc := range tests {
+		_, err := parseSourceCheck("https://lists.example/ads.txt", tc.args)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseSourceCheck(%v) err = %v, wantErr %v", tc.args, err, tc.wantErr)
+		}
+	}
+}
+
+func TestLoadAdguardURLVerify(t *testing.T) {
+	list := []byte("||ads.example^\n")
+	sum := sha256.Sum256(list)
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, list))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ads.txt":
+			_, _ = w.Write(list)
+		case "/ads.txt.sha256":
+			_, _ = w.Write([]byte(hex.EncodeToString(sum[:]) + "  ads.txt\n"))
+		case "/ads.txt.sig":
+			_, _ = w.Write([]byte(sig + "\n"))
+		case "/bad.sha256":
+			_, _ = w.Write([]byte(strings.Repeat("00", sha256.Size)))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	listURL := srv.URL + "/ads.txt"
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{"inline digest", []string{"sha256", hex.EncodeToString(sum[:])}, false},
+		{"digest file", []string{"sha256", listURL + ".sha256"}, false},
+		{"signature", []string{"ed25519", base64.StdEncoding.EncodeToString(pub)}, false},
+		{"wrong digest file", []string{"sha256", srv.URL + "/bad.sha256"}, true},
+		{"wrong key", []string{"ed25519", base64.StdEncoding.EncodeToString(otherPub)}, true},
+		{"missing signature", []string{"ed25519", base64.StdEncoding.EncodeToString(pub), srv.URL + "/none.sig"}, true},
+	}
+	for _, tc := range tests {
+		sc, err := parseSourceCheck(listURL, tc.args)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		g := &Group{Name: "ads", Verify: map[string]*sourceCheck{listURL: sc}}
+		rules, err := g.loadAdguardURL(listURL)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tc.name, err, tc.wantErr)
+		}
+		if !tc.wantErr && len(rules) != 1 {
+			t.Errorf("%s: rules = %v", tc.name, rules)
+		}
+	}
+}
+
+func TestVerifyFailureKeepsRules(t *testing.T) {
+	list := []byte("||ads.example^\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(list)
+	}))
+	defer srv.Close()
+	listURL := srv.URL + "/ads.txt"
+	sum := sha256.Sum256(list)
+	g := &Group{Name: "ads", Action: "empty", AdguardURLs: []string{listURL},
+		Verify: map[string]*sourceCheck{listURL: {sha256: sum[:]}}}
+	if err := g.Update(nil, UpdateMatcherAll); err != nil {
+		t.Fatal(err)
+	}
+	if !g.Match("ads.example.") {
+		t.Fatal("rules not loaded")
+	}
+
+	list = []byte("||tampered.example^\n")
+	if err := g.Update(nil, UpdateMatcherAdguardRemote); err == nil {
+		t.Fatal("expected verification error")
+	}
+	if !g.Match("ads.example.") || g.Match("tampered.example.") {
+		t.Error("rules changed after failed verification")
+	}
+}
@@ -0,0 +1,76 @@
+package ruledforward
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// ruleSourceDebounce coalesces bursts of changes, such as a script adding many rules, into one rule reload.
+	ruleSourceDebounce = time.Second
+	// ruleSourceRetryMax caps the delay between attempts to re-establish watching a rule source.
+	ruleSourceRetryMax = time.Minute
+)
+
+// ruleWatcher is a rule source that reports its changes, such as redis_rules.
+type ruleWatcher interface {
+	fmt.Stringer
+	// follow requests a reload once it is watching for changes, and then one per change, until watching fails or ctx
+	// is done. It reports whether watching was set up.
+	follow(ctx context.Context, notify func()) (bool, error)
+}
+
+// watchRuleSource reloads the group's local rules, with geosite lists from dlc, and the source items debounce after
+// src reports a change, until stop is closed. It re-establishes watching with backoff; since follow requests a reload each time, changes made
+// in between are not missed.
+func (g *Group) watchRuleSource(src ruleWatcher, dlc map[string][]Rule, items uint16, debounce time.Duration, stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+	changed := make(chan struct{}, 1)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(debounce):
+			}
+			if err := g.refresh(dlc, UpdateMatcherLocal|items, src.String()); err != nil {
+				log.Errorf("updating group %s from %s: %v", g.Name, src, err)
+			}
+		}
+	}()
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+
+	retry := time.Second
+	for ctx.Err() == nil {
+		following, err := src.follow(ctx, notify)
+		if ctx.Err() != nil {
+			return
+		}
+		if following {
+			retry = time.Second
+		}
+		log.Warningf("Group '%s': watching %s: %v, retrying in %s", g.Name, src, err, retry)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		retry = min(2*retry, ruleSourceRetryMax)
+	}
+}
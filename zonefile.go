@@ -0,0 +1,186 @@
+package ruledforward
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxZoneCNAMEs bounds the CNAME chain followed within a zone file, so that a loop in the file ends.
+const maxZoneCNAMEs = 8
+
+// zoneFile is a zone loaded from an RFC 1035 master file by `action zonefile`. Its origin is that of its SOA record.
+type zoneFile struct {
+	origin  string
+	soa     *dns.SOA
+	records map[string][]dns.RR // by lower-case owner name
+	// nonTerminals holds the names that own no records but have names below them that do, which exist with no data.
+	nonTerminals map[string]struct{}
+}
+
+// loadZoneFile reads the zone file at path. It must have a SOA record, and all its records must be within the zone
+// of the SOA.
+func loadZoneFile(path string) (*zoneFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	z := &zoneFile{records: make(map[string][]dns.RR), nonTerminals: make(map[string]struct{})}
+	zp := dns.NewZoneParser(f, "", path)
+	var rrs []dns.RR
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if soa, isSOA := rr.(*dns.SOA); isSOA {
+			if z.soa != nil {
+				return nil, fmt.Errorf("%s: more than one SOA record", path)
+			}
+			z.soa = soa
+			z.origin = strings.ToLower(soa.Hdr.Name)
+		}
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if z.soa == nil {
+		return nil, fmt.Errorf("%s: zone has no SOA record", path)
+	}
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		hdr.Name = strings.ToLower(hdr.Name)
+		if !dns.IsSubDomain(z.origin, hdr.Name) {
+			return nil, fmt.Errorf("%s: %s is outside the zone %s", path, hdr.Name, z.origin)
+		}
+		if hdr.Class != dns.ClassINET {
+			return nil, fmt.Errorf("%s: %s: class %s is not supported", path, hdr.Name, dns.ClassToString[hdr.Class])
+		}
+		z.records[hdr.Name] = append(z.records[hdr.Name], rr)
+	}
+	for name := range z.records {
+		for off, end := dns.NextLabel(name, 0); !end && dns.IsSubDomain(z.origin, name[off:]); off, end = dns.NextLabel(name, off) {
+			if _, ok := z.records[name[off:]]; !ok {
+				z.nonTerminals[name[off:]] = struct{}{}
+			}
+		}
+	}
+	for name, rrs := range z.records {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeCNAME && len(rrs) > 1 {
+				return nil, fmt.Errorf("%s: %s has a CNAME and other records", path, name)
+			}
+		}
+	}
+	return z, nil
+}
+
+// lookup returns the records of name, those of the wildcard that covers it with their owner set to name, or nil.
+// exists reports whether name is in the zone: it owns records or names below it do.
+func (z *zoneFile) lookup(name string) (rrs []dns.RR, exists bool) {
+	if rrs, ok := z.records[name]; ok {
+		return rrs, true
+	}
+	if _, ok := z.nonTerminals[name]; ok {
+		return nil, true
+	}
+	// The closest encloser is the longest existing ancestor; only its wildcard applies (RFC 4592).
+	for off, end := dns.NextLabel(name, 0); !end && dns.IsSubDomain(z.origin, name[off:]); off, end = dns.NextLabel(name, off) {
+		parent := name[off:]
+		_, isRecord := z.records[parent]
+		_, isNonTerminal := z.nonTerminals[parent]
+		if !isRecord && !isNonTerminal {
+			continue
+		}
+		wild := z.records["*."+parent]
+		if wild == nil {
+			return nil, false
+		}
+		rrs = make([]dns.RR, len(wild))
+		for i, rr := range wild {
+			rrs[i] = dns.Copy(rr)
+			rrs[i].Header().Name = name
+		}
+		return rrs, true
+	}
+	return nil, false
+}
+
+// answer returns the authoritative response of z to req, for the lower-case qname. CNAMEs within the zone are
+// followed, and the addresses in the zone of SRV targets are added. Names outside the zone are refused.
+func (z *zoneFile) answer(req *dns.Msg, qname string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	if !dns.IsSubDomain(z.origin, qname) {
+		m.Rcode = dns.RcodeRefused
+		return m
+	}
+	m.Authoritative = true
+	name := qname
+	for range maxZoneCNAMEs {
+		rrs, exists := z.lookup(name)
+		if !exists {
+			m.Rcode = dns.RcodeNameError
+			m.Ns = []dns.RR{z.negativeSOA()}
+			return m
+		}
+		var cname *dns.CNAME
+		found := false
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == qtype || qtype == dns.TypeANY {
+				m.Answer = append(m.Answer, dns.Copy(rr))
+				found = true
+			} else if c, ok := rr.(*dns.CNAME); ok {
+				cname = c
+			}
+		}
+		if found {
+			z.addSRVTargets(m)
+			return m
+		}
+		if cname == nil {
+			m.Ns = []dns.RR{z.negativeSOA()}
+			return m
+		}
+		m.Answer = append(m.Answer, dns.Copy(cname))
+		name = strings.ToLower(cname.Target)
+		if !dns.IsSubDomain(z.origin, name) {
+			return m
+		}
+	}
+	return m
+}
+
+// addSRVTargets adds the A and AAAA records in the zone of the targets of the SRV records of m to its additional
+// section.
+func (z *zoneFile) addSRVTargets(m *dns.Msg) {
+	for _, rr := range m.Answer {
+		srv, ok := rr.(*dns.SRV)
+		if !ok {
+			continue
+		}
+		for _, t := range z.records[strings.ToLower(srv.Target)] {
+			if t.Header().Rrtype == dns.TypeA || t.Header().Rrtype == dns.TypeAAAA {
+				m.Extra = append(m.Extra, dns.Copy(t))
+			}
+		}
+	}
+}
+
+// negativeSOA returns the SOA record of a negative answer, with the TTL of RFC 2308: the lesser of the SOA's TTL
+// and its MINIMUM.
+func (z *zoneFile) negativeSOA() dns.RR {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+	return soa
+}
+
+// writeZoneAnswer answers req from z. keepOpts is as for finishReply.
+func writeZoneAnswer(w dns.ResponseWriter, req *dns.Msg, z *zoneFile, qname string, qtype uint16, keepOpts bool) (int, error) {
+	m := z.answer(req, qname, qtype)
+	aa := m.Authoritative
+	finishReply(m, req, keepOpts, nil)
+	m.Authoritative = aa
+	_ = w.WriteMsg(m)
+	return 0, nil
+}
@@ -0,0 +1,131 @@
+package ruledforward
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+const testZone = `$ORIGIN internal.example.
+$TTL 300
+@        IN SOA ns.internal.example. admin.internal.example. 1 3600 600 86400 60
+www      IN A     10.0.0.1
+www      IN AAAA  fd00::1
+web      IN CNAME www
+ext      IN CNAME www.example.com.
+loop1    IN CNAME loop2
+loop2    IN CNAME loop1
+info     IN TXT   "hello"
+_ldap._tcp IN SRV 0 0 389 dc
+dc       IN A     10.0.0.2
+*.apps   IN A     10.0.0.3
+a.b      IN A     10.0.0.4
+`
+
+func writeTestZone(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "db.internal")
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestZoneFileAnswer(t *testing.T) {
+	z, err := loadZoneFile(writeTestZone(t, testZone))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		qname   string
+		qtype   uint16
+		rcode   int
+		answers []string // types of the answer records
+		ns      bool     // SOA in the authority section
+		extra   int
+	}{
+		{"www.internal.example.", dns.TypeA, dns.RcodeSuccess, []string{"A"}, false, 0},
+		{"www.internal.example.", dns.TypeAAAA, dns.RcodeSuccess, []string{"AAAA"}, false, 0},
+		{"www.internal.example.", dns.TypeTXT, dns.RcodeSuccess, nil, true, 0},
+		{"www.internal.example.", dns.TypeANY, dns.RcodeSuccess, []string{"A", "AAAA"}, false, 0},
+		{"web.internal.example.", dns.TypeA, dns.RcodeSuccess, []string{"CNAME", "A"}, false, 0},
+		{"web.internal.example.", dns.TypeCNAME, dns.RcodeSuccess, []string{"CNAME"}, false, 0},
+		{"ext.internal.example.", dns.TypeA, dns.RcodeSuccess, []string{"CNAME"}, false, 0},
+		{"loop1.internal.example.", dns.TypeA, dns.RcodeSuccess, []string{"CNAME", "CNAME", "CNAME", "CNAME", "CNAME", "CNAME", "CNAME", "CNAME"}, false, 0},
+		{"info.internal.example.", dns.TypeTXT, dns.RcodeSuccess, []string{"TXT"}, false, 0},
+		{"_ldap._tcp.internal.example.", dns.TypeSRV, dns.RcodeSuccess, []string{"SRV"}, false, 1},
+		{"x.apps.internal.example.", dns.TypeA, dns.RcodeSuccess, []string{"A"}, false, 0},
+		{"b.internal.example.", dns.TypeA, dns.RcodeSuccess, nil, true, 0},
+		{"c.b.internal.example.", dns.TypeA, dns.RcodeNameError, nil, true, 0},
+		{"missing.internal.example.", dns.TypeA, dns.RcodeNameError, nil, true, 0},
+		{"other.example.", dns.TypeA, dns.RcodeRefused, nil, false, 0},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.qname, tt.qtype)
+		m := z.answer(req, tt.qname, tt.qtype)
+		var types []string
+		for _, rr := range m.Answer {
+			types = append(types, dns.TypeToString[rr.Header().Rrtype])
+		}
+		if m.Rcode != tt.rcode || !slices.Equal(types, tt.answers) || (len(m.Ns) == 1) != tt.ns || len(m.Extra) != tt.extra {
+			t.Errorf("%s %s: got %s", tt.qname, dns.TypeToString[tt.qtype], m)
+		}
+		if len(m.Ns) == 1 && m.Ns[0].Header().Ttl != 60 {
+			t.Errorf("%s %s: negative TTL %d, want 60", tt.qname, dns.TypeToString[tt.qtype], m.Ns[0].Header().Ttl)
+		}
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("x.apps.internal.example.", dns.TypeA)
+	if m := z.answer(req, "x.apps.internal.example.", dns.TypeA); m.Answer[0].Header().Name != "x.apps.internal.example." {
+		t.Errorf("wildcard answer owner = %s", m.Answer[0].Header().Name)
+	}
+}
+
+func TestLoadZoneFileErrors(t *testing.T) {
+	for name, data := range map[string]string{
+		"no SOA":        "www.internal.example. 300 IN A 10.0.0.1\n",
+		"outside zone":  testZone + "www.other.example. 300 IN A 10.0.0.1\n",
+		"two SOAs":      testZone + "@ IN SOA ns. admin. 2 3600 600 86400 60\n",
+		"CNAME and A":   testZone + "www IN CNAME web\n",
+		"syntax":        testZone + "www IN A not-an-ip\n",
+		"relative name": "www 300 IN A 10.0.0.1\n",
+	} {
+		if _, err := loadZoneFile(writeTestZone(t, data)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if _, err := loadZoneFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("missing file: expected error")
+	}
+}
+
+func TestRuledforwardZoneFile(t *testing.T) {
+	z, err := loadZoneFile(writeTestZone(t, testZone))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &Group{Name: "default", Action: "zonefile", Zone: z}
+	r := &Ruledforward{from: ".", groups: []*Group{g}, defaultGroup: g}
+	req := new(dns.Msg)
+	req.SetQuestion("WWW.Internal.Example.", dns.TypeA)
+	req.SetEdns0(4096, true)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := r.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatal(err)
+	}
+	m := rec.Msg
+	if m == nil || len(m.Answer) != 1 || !m.Authoritative || !m.RecursionAvailable || m.IsEdns0() == nil {
+		t.Fatalf("got %v, want an authoritative answer with an OPT record", m)
+	}
+	if a, ok := m.Answer[0].(*dns.A); !ok || a.A.String() != "10.0.0.1" {
+		t.Errorf("answer = %v", m.Answer[0])
+	}
+}